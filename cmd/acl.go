@@ -0,0 +1,966 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclLogSize is the number of denials kept by ACL LOG
+const aclLogSize = 128
+
+// ACL errors
+const (
+	errNoAuth      = "-NOAUTH Authentication required.\r\n"
+	errWrongPass   = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+	errNoPermKey   = "-NOPERM No permissions to access a key\r\n"
+	errNoPermChan  = "-NOPERM No permissions to access a channel\r\n"
+	aclDefaultUser = "default"
+)
+
+// aclKeyPattern is a key pattern of a user with the access it grants
+type aclKeyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+// aclUser is a user of the ACL system. Its fields are guarded by the
+// registry's lock.
+type aclUser struct {
+	name         string
+	enabled      bool
+	nopass       bool
+	passwords    map[string]bool // SHA256 hex digests
+	allCommands  bool            // Commands not in commands are allowed
+	commands     map[string]bool // Allowed or denied commands and command|subcommand pairs
+	commandRules []string        // Command rules as given, for ACL GETUSER and LIST
+	keys         []aclKeyPattern
+	channels     []string
+	deleted      bool
+}
+
+// newACLUser creates a user that is off and may do nothing
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, passwords: make(map[string]bool), commands: make(map[string]bool)}
+}
+
+// aclLogEntry is a denied command or failed authentication
+type aclLogEntry struct {
+	count      int
+	reason     string // command, key, channel or auth
+	context    string // toplevel, multi or lua
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// aclRegistry holds the users and the log of denials
+type aclRegistry struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+	log   []*aclLogEntry // Newest first
+	file  string         // ACL file loaded at startup, used by ACL LOAD and SAVE
+}
+
+// newACLRegistry creates a registry with only the default user, which may
+// do everything without a password
+func newACLRegistry() *aclRegistry {
+	r := &aclRegistry{users: make(map[string]*aclUser)}
+	r.users[aclDefaultUser] = defaultACLUser()
+	return r
+}
+
+// defaultACLUser returns the default user as it is before configuration
+func defaultACLUser() *aclUser {
+	u := newACLUser(aclDefaultUser)
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		u.apply(rule)
+	}
+	return u
+}
+
+// aclCategoryNames lists the command categories, see aclCategories
+var aclCategoryNames = []string{
+	"all", "read", "write", "keyspace", "string", "bitmap", "hyperloglog", "geo",
+	"sortedset", "json", "bloom", "cuckoo", "cms", "topk", "timeseries",
+	"pubsub", "scripting", "transaction", "connection", "admin", "dangerous",
+}
+
+// aclCategories returns the categories of a command. Access categories
+// follow the command's flags, type categories its name.
+func aclCategories(cmd *command) []string {
+	cats := []string{"all"}
+	if cmd.flags&flagReadOnly != 0 {
+		cats = append(cats, "read")
+	}
+	if cmd.flags&flagWrite != 0 {
+		cats = append(cats, "write")
+	}
+	if cmd.flags&flagPubSub != 0 {
+		cats = append(cats, "pubsub")
+	}
+	if cmd.flags&flagAdmin != 0 {
+		cats = append(cats, "admin", "dangerous")
+	}
+
+	name := cmd.name
+	switch name {
+	case "DEL", "TYPE", "EXPIRE", "PEXPIRE", "TTL", "PTTL", "PERSIST":
+		cats = append(cats, "keyspace")
+	case "SET", "GET":
+		cats = append(cats, "string")
+	case "EVAL", "EVALSHA", "SCRIPT", "FCALL", "FCALL_RO", "FUNCTION":
+		cats = append(cats, "scripting")
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		cats = append(cats, "transaction")
+	case "AUTH", "PING", "QUIT":
+		cats = append(cats, "connection")
+	}
+
+	prefixes := []struct{ prefix, category string }{
+		{"BIT", "bitmap"}, {"SETBIT", "bitmap"}, {"GETBIT", "bitmap"},
+		{"PF", "hyperloglog"}, {"GEO", "geo"}, {"Z", "sortedset"},
+		{"JSON.", "json"}, {"BF.", "bloom"}, {"CF.", "cuckoo"},
+		{"CMS.", "cms"}, {"TOPK.", "topk"}, {"TS.", "timeseries"},
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			cats = append(cats, p.category)
+			break
+		}
+	}
+	return cats
+}
+
+// allCommandNames returns every command name known to the server
+func allCommandNames() []string {
+	var names []string
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	for name := range inlineCommands {
+		names = append(names, name)
+	}
+	for name := range connectionCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// adminSubcommands lists the subcommands in the @admin and @dangerous
+// categories of commands that are not administrative as a whole
+var adminSubcommands = map[string][]string{
+	"ACL": {"SETUSER", "GETUSER", "DELUSER", "LIST", "USERS", "LOG", "LOAD", "SAVE"},
+}
+
+// categoryCommands returns the commands and command|subcommand pairs of a
+// category
+func categoryCommands(category string) []string {
+	var names []string
+	if category == "admin" || category == "dangerous" {
+		for name, subs := range adminSubcommands {
+			for _, sub := range subs {
+				names = append(names, name+"|"+sub)
+			}
+		}
+	}
+	for _, name := range allCommandNames() {
+		cmd, _ := lookupCommand(name)
+		for _, cat := range aclCategories(cmd) {
+			if cat == category {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// hashPassword returns the digest under which a password is stored
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply changes the user according to one ACL rule, see ACL SETUSER
+func (u *aclUser) apply(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		clear(u.passwords)
+		return nil
+	case "resetpass":
+		u.nopass = false
+		clear(u.passwords)
+		return nil
+	case "allkeys":
+		rule = "~*"
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		rule = "&*"
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		rule = "+@all"
+	case "nocommands":
+		rule = "-@all"
+	case "reset":
+		*u = *newACLUser(u.name)
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(rule, ">"):
+		u.passwords[hashPassword(rule[1:])] = true
+		u.nopass = false
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		digest := strings.ToLower(rule[1:])
+		if len(digest) != 64 || strings.Trim(digest, "0123456789abcdef") != "" {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.passwords[digest] = true
+		u.nopass = false
+	case strings.HasPrefix(rule, "!"):
+		delete(u.passwords, strings.ToLower(rule[1:]))
+
+	case strings.HasPrefix(rule, "~"):
+		u.addKeyPattern(aclKeyPattern{pattern: rule[1:], read: true, write: true})
+	case strings.HasPrefix(rule, "%"):
+		perms, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || perms == "" || strings.Trim(strings.ToUpper(perms), "RW") != "" {
+			return fmt.Errorf("Syntax error")
+		}
+		perms = strings.ToUpper(perms)
+		u.addKeyPattern(aclKeyPattern{pattern: pattern, read: strings.Contains(perms, "R"), write: strings.Contains(perms, "W")})
+	case strings.HasPrefix(rule, "&"):
+		if !containsString(u.channels, rule[1:]) {
+			u.channels = append(u.channels, rule[1:])
+		}
+
+	case strings.HasPrefix(rule, "+@") || strings.HasPrefix(rule, "-@"):
+		allow := rule[0] == '+'
+		category := strings.ToLower(rule[2:])
+		if !containsString(aclCategoryNames, category) {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		if category == "all" {
+			u.allCommands = allow
+			clear(u.commands)
+			u.commandRules = []string{rule}
+			return nil
+		}
+		for _, name := range categoryCommands(category) {
+			u.setCommand(name, allow)
+		}
+		u.commandRules = append(u.commandRules, rule)
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		allow := rule[0] == '+'
+		name, sub, hasSub := strings.Cut(strings.ToUpper(rule[1:]), "|")
+		if _, ok := lookupCommand(name); !ok {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		if hasSub {
+			if sub == "" {
+				return fmt.Errorf("Syntax error")
+			}
+			u.commands[name+"|"+sub] = allow
+		} else {
+			u.setCommand(name, allow)
+		}
+		u.commandRules = append(u.commandRules, strings.ToLower(rule))
+
+	default:
+		return fmt.Errorf("Syntax error")
+	}
+	return nil
+}
+
+// setCommand allows or denies a command including all its subcommands, or
+// a single command|subcommand pair
+func (u *aclUser) setCommand(name string, allow bool) {
+	if strings.Contains(name, "|") {
+		u.commands[name] = allow
+		return
+	}
+	for k := range u.commands {
+		if strings.HasPrefix(k, name+"|") {
+			delete(u.commands, k)
+		}
+	}
+	u.commands[name] = allow
+}
+
+func (u *aclUser) addKeyPattern(p aclKeyPattern) {
+	for i, existing := range u.keys {
+		if existing.pattern == p.pattern {
+			u.keys[i].read = existing.read || p.read
+			u.keys[i].write = existing.write || p.write
+			return
+		}
+	}
+	u.keys = append(u.keys, p)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun reports whether the user may run the command in args
+func (u *aclUser) canRun(args []string) bool {
+	if len(args) > 1 {
+		if allowed, ok := u.commands[args[0]+"|"+strings.ToUpper(args[1])]; ok {
+			return allowed
+		}
+	}
+	if allowed, ok := u.commands[args[0]]; ok {
+		return allowed
+	}
+	return u.allCommands
+}
+
+// canAccessKey reports whether the user may read or write key. An empty
+// key stands for every key, which needs the pattern *.
+func (u *aclUser) canAccessKey(key string, write bool) bool {
+	for _, p := range u.keys {
+		if (write && !p.write) || (!write && !p.read) {
+			continue
+		}
+		if p.pattern == "*" || (key != "" && globMatch(p.pattern, key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel reports whether the user may use a channel. Patterns
+// given to PSUBSCRIBE must equal one of the user's patterns.
+func (u *aclUser) canAccessChannel(channel string, literal bool) bool {
+	for _, p := range u.channels {
+		if p == "*" || (literal && p == channel) || (!literal && globMatch(p, channel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns the rules that recreate the user, as in ACL LIST
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	parts = append(parts, u.sortedPasswords("#")...)
+	parts = append(parts, u.keyRules()...)
+	if len(u.channels) == 0 {
+		parts = append(parts, "resetchannels")
+	}
+	for _, p := range u.channels {
+		parts = append(parts, "&"+p)
+	}
+	parts = append(parts, u.commandRuleString())
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) sortedPasswords(prefix string) []string {
+	var hashes []string
+	for h := range u.passwords {
+		hashes = append(hashes, prefix+h)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func (u *aclUser) keyRules() []string {
+	var rules []string
+	for _, p := range u.keys {
+		switch {
+		case p.read && p.write:
+			rules = append(rules, "~"+p.pattern)
+		case p.read:
+			rules = append(rules, "%R~"+p.pattern)
+		default:
+			rules = append(rules, "%W~"+p.pattern)
+		}
+	}
+	return rules
+}
+
+func (u *aclUser) commandRuleString() string {
+	if len(u.commandRules) == 0 || (u.commandRules[0] != "+@all" && u.commandRules[0] != "-@all") {
+		return strings.Join(append([]string{"-@all"}, u.commandRules...), " ")
+	}
+	return strings.Join(u.commandRules, " ")
+}
+
+// authenticate returns the user if the password is right and the user is
+// enabled
+func (r *aclRegistry) authenticate(username, password string) (*aclUser, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	u, ok := r.users[username]
+	if !ok || !u.enabled {
+		return nil, false
+	}
+	if u.nopass {
+		return u, true
+	}
+	digest := hashPassword(password)
+	for h := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(digest)) == 1 {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// defaultUser returns the default user if connections are authenticated as
+// it without AUTH, that is if it is enabled and needs no password
+func (r *aclRegistry) defaultUser() *aclUser {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if u := r.users[aclDefaultUser]; u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+// authenticateRequest returns the user of a web request. Requests carry
+// their credentials as HTTP basic auth; requests without any are made as
+// the default user if it needs no password. On failure it answers the
+// request itself.
+func (r *aclRegistry) authenticateRequest(w http.ResponseWriter, req *http.Request) (*aclUser, bool) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		if u := r.defaultUser(); u != nil {
+			return u, true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="dustdb"`)
+		http.Error(w, `{"status":"error","message":"NOAUTH Authentication required"}`, http.StatusUnauthorized)
+		return nil, false
+	}
+	if username == "" {
+		username = aclDefaultUser
+	}
+	u, ok := r.authenticate(username, password)
+	if !ok {
+		r.record("auth", "toplevel", "AUTH", username, "addr="+req.RemoteAddr+" web")
+		w.Header().Set("WWW-Authenticate", `Basic realm="dustdb"`)
+		http.Error(w, `{"status":"error","message":"WRONGPASS invalid username-password pair or user is disabled"}`, http.StatusUnauthorized)
+		return nil, false
+	}
+	return u, true
+}
+
+// canReadAllKeys reports whether u may read every key, which the dashboard
+// needs as it shows all of them
+func (r *aclRegistry) canReadAllKeys(u *aclUser) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return u.canAccessKey("", false)
+}
+
+// revoked reports whether u has been deleted, which closes its connections
+func (r *aclRegistry) revoked(u *aclUser) bool {
+	if u == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return u.deleted
+}
+
+// aclKeySpec returns the keys a command reads and writes, or all if it may
+// read any key
+type aclKeySpec func(args []string) (read, write []string, all bool)
+
+// aclKeys holds the key specs of commands whose keys are not just args[1].
+// Commands without an entry that have flagWrite or flagReadOnly write or read
+// args[1].
+var aclKeys = map[string]aclKeySpec{
+	"BITOP":         func(args []string) ([]string, []string, bool) { return args[3:], args[2:3], false },
+	"PFCOUNT":       func(args []string) ([]string, []string, bool) { return args[1:], nil, false },
+	"PFMERGE":       func(args []string) ([]string, []string, bool) { return args[2:], args[1:2], false },
+	"WATCH":         func(args []string) ([]string, []string, bool) { return args[1:], nil, false },
+	"TS.CREATERULE": func(args []string) ([]string, []string, bool) { return args[1:2], args[2:3], false },
+	"TS.DELETERULE": func(args []string) ([]string, []string, bool) { return args[1:2], args[2:3], false },
+	"TS.MRANGE":     func(args []string) ([]string, []string, bool) { return nil, nil, true },
+	"CMS.MERGE": func(args []string) ([]string, []string, bool) {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 || 3+n > len(args) {
+			return nil, args[1:2], false
+		}
+		return args[3 : 3+n], args[1:2], false
+	},
+	"MEMORY": func(args []string) ([]string, []string, bool) {
+		if strings.ToUpper(args[1]) == "USAGE" && len(args) > 2 {
+			return args[2:3], nil, false
+		}
+		return nil, nil, false
+	},
+}
+
+// aclChannels returns the channels a command uses and whether they are
+// patterns
+func aclChannels(args []string) ([]string, bool) {
+	switch args[0] {
+	case "PUBLISH", "SPUBLISH":
+		return args[1:2], false
+	case "SUBSCRIBE", "SSUBSCRIBE":
+		return args[1:], false
+	case "PSUBSCRIBE":
+		return args[1:], true
+	}
+	return nil, false
+}
+
+// check returns a NOPERM error if u may not run the command in args and
+// records the denial in the ACL log. context is toplevel, multi or lua and
+// client describes the connection.
+func (r *aclRegistry) check(u *aclUser, args []string, context, client string) string {
+	if args[0] == "AUTH" || args[0] == "QUIT" {
+		return "" // Every user may switch users or leave
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok || checkArity(cmd, args) != "" {
+		return "" // Unknown commands and wrong arity fail on their own
+	}
+
+	r.mu.RLock()
+	reason, object := "", ""
+	if !u.canRun(args) {
+		reason, object = "command", strings.ToLower(args[0])
+		if len(args) > 1 {
+			if _, ok := u.commands[args[0]+"|"+strings.ToUpper(args[1])]; ok {
+				object += "|" + strings.ToLower(args[1])
+			}
+		}
+	} else {
+		var read, write []string
+		all := false
+		if spec := aclKeys[args[0]]; spec != nil {
+			read, write, all = spec(args)
+		} else if cmd.flags&flagWrite != 0 {
+			write = args[1:2]
+		} else if cmd.flags&flagReadOnly != 0 {
+			read = args[1:2]
+		}
+		if all && !u.canAccessKey("", false) {
+			reason, object = "key", "*"
+		}
+		for _, key := range read {
+			if reason == "" && !u.canAccessKey(key, false) {
+				reason, object = "key", key
+			}
+		}
+		for _, key := range write {
+			if reason == "" && !u.canAccessKey(key, true) {
+				reason, object = "key", key
+			}
+		}
+	}
+	if reason == "" {
+		channels, patterns := aclChannels(args)
+		for _, channel := range channels {
+			if !u.canAccessChannel(channel, patterns) {
+				reason, object = "channel", channel
+				break
+			}
+		}
+	}
+	username := u.name
+	r.mu.RUnlock()
+
+	switch reason {
+	case "":
+		return ""
+	case "key":
+		r.record(reason, context, object, username, client)
+		return errNoPermKey
+	case "channel":
+		r.record(reason, context, object, username, client)
+		return errNoPermChan
+	}
+	r.record(reason, context, object, username, client)
+	return "-NOPERM User " + username + " has no permissions to run the '" + object + "' command\r\n"
+}
+
+// record adds a denial to the ACL log. Repeats of a recent entry only
+// increase its count.
+func (r *aclRegistry) record(reason, context, object, username, client string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range r.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username && now.Sub(e.updated) < time.Minute {
+			e.count++
+			e.updated = now
+			e.clientInfo = client
+			return
+		}
+	}
+	entry := &aclLogEntry{count: 1, reason: reason, context: context, object: object, username: username, clientInfo: client, created: now, updated: now}
+	r.log = append([]*aclLogEntry{entry}, r.log...)
+	if len(r.log) > aclLogSize {
+		r.log = r.log[:aclLogSize]
+	}
+}
+
+// parseACLFile parses the lines of an ACL file. Every line reads
+// "user <name> <rule> ...", blank lines and lines starting with # are
+// skipped.
+func parseACLFile(data string) (map[string]*aclUser, error) {
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" {
+			return nil, fmt.Errorf("line %d should start with user keyword", n)
+		}
+		if _, exists := users[fields[1]]; exists {
+			return nil, fmt.Errorf("line %d: duplicate user '%s'", n, fields[1])
+		}
+		u := newACLUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.apply(rule); err != nil {
+				return nil, fmt.Errorf("line %d: %s: %v", n, rule, err)
+			}
+		}
+		users[u.name] = u
+	}
+	if _, ok := users[aclDefaultUser]; !ok {
+		users[aclDefaultUser] = defaultACLUser()
+	}
+	return users, nil
+}
+
+// load replaces all users with the ones in the ACL file. Users that are
+// gone are marked deleted so that their connections are closed.
+func (r *aclRegistry) load() error {
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	users, err := parseACLFile(string(data))
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, u := range r.users {
+		if fresh, ok := users[name]; ok {
+			// Keep the pointer so authenticated connections see the change
+			*u = *fresh
+			users[name] = u
+		} else {
+			u.deleted = true
+		}
+	}
+	r.users = users
+	return nil
+}
+
+// save writes all users to the ACL file
+func (r *aclRegistry) save() error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.users))
+	for name := range r.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(r.users[name].describe() + "\n")
+	}
+	r.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.file), ".acl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.file)
+}
+
+// LoadACL makes path the ACL file and loads the users defined in it
+func (c *Cache) LoadACL(path string) error {
+	c.acl.file = path
+	return c.acl.load()
+}
+
+// SetRequirePass makes the default user require a password, as the
+// requirepass option of Redis does
+func (c *Cache) SetRequirePass(password string) {
+	c.acl.mu.Lock()
+	defer c.acl.mu.Unlock()
+	u := c.acl.users[aclDefaultUser]
+	u.apply("resetpass")
+	if password != "" {
+		u.apply(">" + password)
+	} else {
+		u.apply("nopass")
+	}
+}
+
+// authCommand implements AUTH password and AUTH username password
+func authCommand(c *Cache, cl *client, args []string) string {
+	var username, password string
+	switch len(args) {
+	case 2:
+		username, password = aclDefaultUser, args[1]
+	case 3:
+		username, password = args[1], args[2]
+	default:
+		return respError("wrong number of arguments for 'auth' command")
+	}
+
+	u, ok := c.acl.authenticate(username, password)
+	if !ok {
+		c.acl.record("auth", "toplevel", "AUTH", username, cl.info())
+		return errWrongPass
+	}
+	cl.user = u
+	return respOK()
+}
+
+// aclCommand implements ACL SETUSER, GETUSER, DELUSER, LIST, USERS,
+// WHOAMI, LOG, CAT, LOAD and SAVE
+func aclCommand(c *Cache, cl *client, args []string) string {
+	if len(args) < 2 {
+		return respError("wrong number of arguments for 'acl' command")
+	}
+	r := c.acl
+	sub := strings.ToUpper(args[1])
+
+	switch sub {
+	case "WHOAMI":
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return respBulk(cl.user.name)
+
+	case "SETUSER":
+		if len(args) < 3 {
+			return respError("wrong number of arguments for 'acl|setuser' command")
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		// Rules are applied to a copy so that an invalid rule changes nothing
+		u, exists := r.users[args[2]]
+		updated := newACLUser(args[2])
+		if exists {
+			*updated = *u
+			updated.passwords = cloneMap(u.passwords)
+			updated.commands = cloneMap(u.commands)
+			updated.commandRules = append([]string(nil), u.commandRules...)
+			updated.keys = append([]aclKeyPattern(nil), u.keys...)
+			updated.channels = append([]string(nil), u.channels...)
+		}
+		for _, rule := range args[3:] {
+			if err := updated.apply(rule); err != nil {
+				return respError("Error in ACL SETUSER modifier '" + rule + "': " + err.Error())
+			}
+		}
+		if exists {
+			*u = *updated
+		} else {
+			r.users[updated.name] = updated
+		}
+		return respOK()
+
+	case "GETUSER":
+		if len(args) != 3 {
+			return respError("wrong number of arguments for 'acl|getuser' command")
+		}
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		u, ok := r.users[args[2]]
+		if !ok {
+			return respNil()
+		}
+		var flags []string
+		if u.enabled {
+			flags = append(flags, respBulk("on"))
+		} else {
+			flags = append(flags, respBulk("off"))
+		}
+		if u.nopass {
+			flags = append(flags, respBulk("nopass"))
+		}
+		var passwords []string
+		for _, h := range u.sortedPasswords("") {
+			passwords = append(passwords, respBulk(h))
+		}
+		channels := make([]string, len(u.channels))
+		for i, p := range u.channels {
+			channels[i] = "&" + p
+		}
+		return respArray([]string{
+			respBulk("flags"), respArray(flags),
+			respBulk("passwords"), respArray(passwords),
+			respBulk("commands"), respBulk(u.commandRuleString()),
+			respBulk("keys"), respBulk(strings.Join(u.keyRules(), " ")),
+			respBulk("channels"), respBulk(strings.Join(channels, " ")),
+		})
+
+	case "DELUSER":
+		if len(args) < 3 {
+			return respError("wrong number of arguments for 'acl|deluser' command")
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		deleted := 0
+		for _, name := range args[2:] {
+			if name == aclDefaultUser {
+				return respError("The 'default' user cannot be removed")
+			}
+		}
+		for _, name := range args[2:] {
+			if u, ok := r.users[name]; ok {
+				u.deleted = true
+				delete(r.users, name)
+				deleted++
+			}
+		}
+		return respInt(int64(deleted))
+
+	case "LIST", "USERS":
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		names := make([]string, 0, len(r.users))
+		for name := range r.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		items := make([]string, len(names))
+		for i, name := range names {
+			if sub == "LIST" {
+				items[i] = respBulk(r.users[name].describe())
+			} else {
+				items[i] = respBulk(name)
+			}
+		}
+		return respArray(items)
+
+	case "LOG":
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		count := 10
+		if len(args) > 2 {
+			if strings.ToUpper(args[2]) == "RESET" {
+				r.log = nil
+				return respOK()
+			}
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 0 {
+				return respError(errNotInteger)
+			}
+			count = n
+		}
+		now := time.Now()
+		var items []string
+		for _, e := range r.log[:min(count, len(r.log))] {
+			items = append(items, respArray([]string{
+				respBulk("count"), respInt(int64(e.count)),
+				respBulk("reason"), respBulk(e.reason),
+				respBulk("context"), respBulk(e.context),
+				respBulk("object"), respBulk(e.object),
+				respBulk("username"), respBulk(e.username),
+				respBulk("age-seconds"), respBulk(strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64)),
+				respBulk("client-info"), respBulk(e.clientInfo),
+			}))
+		}
+		return respArray(items)
+
+	case "CAT":
+		var names []string
+		if len(args) == 2 {
+			names = aclCategoryNames
+		} else {
+			category := strings.ToLower(args[2])
+			if !containsString(aclCategoryNames, category) {
+				return respError("Unknown category '" + args[2] + "'")
+			}
+			for _, name := range categoryCommands(category) {
+				names = append(names, strings.ToLower(name))
+			}
+			sort.Strings(names)
+		}
+		items := make([]string, len(names))
+		for i, name := range names {
+			items[i] = respBulk(name)
+		}
+		return respArray(items)
+
+	case "LOAD", "SAVE":
+		if r.file == "" {
+			return respError("This instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a configuration file set) in order to store users in the configuration.")
+		}
+		var err error
+		if sub == "LOAD" {
+			err = r.load()
+		} else {
+			err = r.save()
+		}
+		if err != nil {
+			return respError(err.Error())
+		}
+		return respOK()
+	}
+	return respError("unknown subcommand '" + args[1] + "' for 'acl' command")
+}
+
+func cloneMap[V any](m map[string]V) map[string]V {
+	out := make(map[string]V, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setUser runs ACL SETUSER and fails the test if it is refused
+func setUser(t *testing.T, c *Cache, rules ...string) {
+	t.Helper()
+	args := append([]string{"ACL", "SETUSER"}, rules...)
+	if got := aclCommand(c, testClient(t, c), args); got != respOK() {
+		t.Fatalf("%v = %q", args, got)
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	c := newTestCache(t)
+	setUser(t, c, "alice", "on", ">pw", "~app:*", "%R~shared:*", "%W~log:*", "&news", "+@read", "+set", "-zscore", "+config|get", "+bitop", "+publish", "+psubscribe")
+	alice, _ := c.acl.authenticate("alice", "pw")
+	noCommand := "-NOPERM User alice has no permissions to run the '%s' command\r\n"
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "app:1"}, ""},
+		{[]string{"SET", "app:1", "v"}, ""},
+		{[]string{"SET", "other", "v"}, errNoPermKey},
+		{[]string{"GET", "shared:1"}, ""},
+		{[]string{"SET", "shared:1", "v"}, errNoPermKey},
+		{[]string{"SET", "log:1", "v"}, ""},
+		{[]string{"GET", "log:1"}, errNoPermKey},
+		{[]string{"ZSCORE", "app:z", "m"}, strings.Replace(noCommand, "%s", "zscore", 1)},
+		{[]string{"ZADD", "app:z", "1", "m"}, strings.Replace(noCommand, "%s", "zadd", 1)},
+		{[]string{"BITOP", "AND", "app:dest", "shared:a", "app:b"}, ""},
+		{[]string{"BITOP", "AND", "shared:dest", "app:a"}, errNoPermKey},
+		{[]string{"BITOP", "AND", "app:dest", "other"}, errNoPermKey},
+		{[]string{"TS.MRANGE", "-", "+", "FILTER", "a=b"}, errNoPermKey},
+		{[]string{"CONFIG", "GET", "maxmemory"}, ""},
+		{[]string{"CONFIG", "SET", "maxmemory", "0"}, strings.Replace(noCommand, "%s", "config", 1)},
+		{[]string{"PUBLISH", "news", "hi"}, ""},
+		{[]string{"PUBLISH", "sport", "hi"}, errNoPermChan},
+		{[]string{"PSUBSCRIBE", "news"}, ""},
+		{[]string{"PSUBSCRIBE", "n*"}, errNoPermChan},
+		{[]string{"AUTH", "bob", "pw"}, ""},
+		{[]string{"GET"}, ""},
+		{[]string{"NOSUCHCOMMAND"}, ""},
+	}
+	for _, tt := range tests {
+		if got := c.acl.check(alice, tt.args, "toplevel", "test"); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestACLSetUser(t *testing.T) {
+	c := newTestCache(t)
+	cl := testClient(t, c)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ACL", "SETUSER", "bob", "on", ">secret", "~*", "+@sortedset", "-zrem"}, "+OK\r\n"},
+		{[]string{"ACL", "GETUSER", "bob"}, respArray([]string{
+			respBulk("flags"), respArray([]string{respBulk("on")}),
+			respBulk("passwords"), respArray([]string{respBulk(hashPassword("secret"))}),
+			respBulk("commands"), respBulk("-@all +@sortedset -zrem"),
+			respBulk("keys"), respBulk("~*"),
+			respBulk("channels"), respBulk(""),
+		})},
+		// A bad rule leaves the user as it was
+		{[]string{"ACL", "SETUSER", "bob", "off", "+nosuchcommand"}, "-ERR Error in ACL SETUSER modifier '+nosuchcommand': Unknown command or category name in ACL\r\n"},
+		{[]string{"ACL", "SETUSER", "bob", "+@nosuchcategory"}, "-ERR Error in ACL SETUSER modifier '+@nosuchcategory': Unknown command or category name in ACL\r\n"},
+		{[]string{"ACL", "SETUSER", "bob", "#abc"}, "-ERR Error in ACL SETUSER modifier '#abc': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters\r\n"},
+		{[]string{"ACL", "SETUSER", "bob", "%X~*"}, "-ERR Error in ACL SETUSER modifier '%X~*': Syntax error\r\n"},
+		{[]string{"ACL", "SETUSER", "bob", "+config|"}, "-ERR Error in ACL SETUSER modifier '+config|': Syntax error\r\n"},
+		{[]string{"ACL", "LIST"}, respArray([]string{
+			respBulk("user bob on #" + hashPassword("secret") + " ~* resetchannels -@all +@sortedset -zrem"),
+			respBulk("user default on nopass ~* &* +@all"),
+		})},
+		{[]string{"ACL", "SETUSER", "bob", "reset", "nopass", "allkeys", "allcommands"}, "+OK\r\n"},
+		{[]string{"ACL", "LIST"}, respArray([]string{
+			respBulk("user bob off nopass ~* resetchannels +@all"),
+			respBulk("user default on nopass ~* &* +@all"),
+		})},
+		{[]string{"ACL", "USERS"}, respArray([]string{respBulk("bob"), respBulk("default")})},
+		{[]string{"ACL", "WHOAMI"}, respBulk("default")},
+		{[]string{"ACL", "GETUSER", "nobody"}, respNil()},
+		{[]string{"ACL", "DELUSER", "bob", "default"}, "-ERR The 'default' user cannot be removed\r\n"},
+		{[]string{"ACL", "DELUSER", "bob", "nobody"}, ":1\r\n"},
+		{[]string{"ACL", "CAT", "transaction"}, respArray([]string{respBulk("discard"), respBulk("exec"), respBulk("multi"), respBulk("unwatch"), respBulk("watch")})},
+		{[]string{"ACL", "CAT", "bogus"}, "-ERR Unknown category 'bogus'\r\n"},
+		{[]string{"ACL", "SAVE"}, "-ERR This instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a configuration file set) in order to store users in the configuration.\r\n"},
+		{[]string{"ACL", "DRYRUN"}, "-ERR unknown subcommand 'DRYRUN' for 'acl' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := aclCommand(c, cl, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	c := newTestCache(t)
+	c.SetRequirePass("secret")
+	setUser(t, c, "alice", "on", ">pw", "~app:*", "+get", "+set")
+	setUser(t, c, "off", "off", ">pw", "+@all")
+
+	send, expect := testConn(t, c)
+	send("SET app:1 v")
+	expect(errNoAuth)
+	send("AUTH wrong")
+	expect(errWrongPass)
+	send("AUTH wrong")
+	expect(errWrongPass)
+	send("AUTH off pw")
+	expect(errWrongPass)
+	send("AUTH alice pw")
+	expect("+OK\r\n")
+	send("SET app:1 v")
+	expect("OK\r\n")
+	send("SET other v")
+	expect(errNoPermKey)
+	send("PING")
+	expect("-NOPERM User alice has no permissions to run the 'ping' command\r\n")
+	send("AUTH secret")
+	expect("+OK\r\n")
+	send("ACL WHOAMI")
+	expect(respBulk("default"))
+
+	// Denials are logged, repeats only count up
+	log := aclCommand(c, testClient(t, c), []string{"ACL", "LOG"})
+	for _, want := range []string{
+		respBulk("count") + respInt(1) + respBulk("reason") + respBulk("command") + respBulk("context") + respBulk("toplevel") + respBulk("object") + respBulk("ping") + respBulk("username") + respBulk("alice"),
+		respBulk("count") + respInt(1) + respBulk("reason") + respBulk("key") + respBulk("context") + respBulk("toplevel") + respBulk("object") + respBulk("other"),
+		respBulk("count") + respInt(2) + respBulk("reason") + respBulk("auth") + respBulk("context") + respBulk("toplevel") + respBulk("object") + respBulk("AUTH") + respBulk("username") + respBulk("default"),
+		respBulk("count") + respInt(1) + respBulk("reason") + respBulk("auth") + respBulk("context") + respBulk("toplevel") + respBulk("object") + respBulk("AUTH") + respBulk("username") + respBulk("off"),
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("ACL LOG = %q, want an entry with %q", log, want)
+		}
+	}
+	if got := aclCommand(c, testClient(t, c), []string{"ACL", "LOG", "RESET"}); got != respOK() {
+		t.Fatalf("ACL LOG RESET = %q", got)
+	}
+	if got := aclCommand(c, testClient(t, c), []string{"ACL", "LOG"}); got != "*0\r\n" {
+		t.Fatalf("ACL LOG after RESET = %q", got)
+	}
+}
+
+func TestDeletedUserDisconnected(t *testing.T) {
+	c := newTestCache(t)
+	setUser(t, c, "alice", "on", ">pw", "~*", "+@all")
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	go handleConnection(conn, c)
+	expect := expectFunc(t, peer)
+
+	peer.Write([]byte("AUTH alice pw\r\n"))
+	expect("+OK\r\n")
+	aclCommand(c, testClient(t, c), []string{"ACL", "DELUSER", "alice"})
+	peer.Write([]byte("PING\r\n"))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := peer.Read(make([]byte, 64)); err != io.EOF {
+		t.Fatalf("connection of a deleted user read %d bytes, %v, want EOF", n, err)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	os.WriteFile(path, []byte("# users\nuser alice on >pw ~app:* +@read\n\nuser default on nopass ~* &* +@all\n"), 0o600)
+
+	c := newTestCache(t)
+	if err := c.LoadACL(path); err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := c.acl.authenticate("alice", "pw")
+	if !ok {
+		t.Fatal("user from the ACL file cannot log in")
+	}
+
+	cl := testClient(t, c)
+	setUser(t, c, "bob", "on", "nopass", "+get")
+	if got := aclCommand(c, cl, []string{"ACL", "SAVE"}); got != respOK() {
+		t.Fatalf("ACL SAVE = %q", got)
+	}
+	data, _ := os.ReadFile(path)
+	want := "user alice on #" + hashPassword("pw") + " ~app:* resetchannels -@all +@read\n" +
+		"user bob on nopass resetchannels -@all +get\n" +
+		"user default on nopass ~* &* +@all\n"
+	if string(data) != want {
+		t.Fatalf("saved ACL file:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Reloading keeps the users of open connections and drops missing ones
+	os.WriteFile(path, []byte("user alice on >pw ~* +@all\n"), 0o600)
+	if got := aclCommand(c, cl, []string{"ACL", "LOAD"}); got != respOK() {
+		t.Fatalf("ACL LOAD = %q", got)
+	}
+	if !alice.canRun([]string{"SET", "k", "v"}) {
+		t.Fatal("reloaded rules did not reach the authenticated user")
+	}
+	if _, ok := c.acl.authenticate("bob", ""); ok {
+		t.Fatal("user missing from the file was kept")
+	}
+	if c.acl.defaultUser() == nil {
+		t.Fatal("default user missing from the file was not recreated")
+	}
+
+	for _, data := range []string{"alice on", "user alice on\nuser alice off", "user alice +nosuchcommand"} {
+		os.WriteFile(path, []byte(data), 0o600)
+		if got := aclCommand(c, cl, []string{"ACL", "LOAD"}); !strings.HasPrefix(got, "-ERR ") {
+			t.Errorf("ACL LOAD of %q = %q", data, got)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// MaxBitOffset is the highest addressable bit of a string value (512MB)
+const MaxBitOffset = 1<<32 - 1
+
+func init() {
+	registerCommand("SETBIT", 4, flagWrite|flagDenyOOM, setbitCommand)
+	registerCommand("GETBIT", 3, flagReadOnly, getbitCommand)
+	registerCommand("BITCOUNT", -2, flagReadOnly, bitcountCommand)
+	registerCommand("BITPOS", -3, flagReadOnly, bitposCommand)
+	registerCommand("BITOP", -4, flagWrite|flagDenyOOM, bitopCommand)
+	registerCommand("BITFIELD", -2, flagWrite|flagDenyOOM, bitfieldCommand)
+	registerCommand("BITFIELD_RO", -2, flagReadOnly, bitfieldCommand)
+}
+
+// parseBitOffset parses a bit offset argument in the range [0, MaxBitOffset]
+func parseBitOffset(s string) (uint64, bool) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > MaxBitOffset {
+		return 0, false
+	}
+	return n, true
+}
+
+// growValue returns value padded with zero bytes so that it holds at least
+// size bytes
+func growValue(value string, size uint64) []byte {
+	if uint64(len(value)) >= size {
+		return []byte(value)
+	}
+	buf := make([]byte, size)
+	copy(buf, value)
+	return buf
+}
+
+// getBit returns the bit at offset, bits past the end of p read as zero.
+// Bit 0 is the most significant bit of the first byte.
+func getBit(p []byte, offset uint64) byte {
+	if offset>>3 >= uint64(len(p)) {
+		return 0
+	}
+	return (p[offset>>3] >> (7 - offset&7)) & 1
+}
+
+// setBit sets the bit at offset, p must be large enough to hold it
+func setBit(p []byte, offset uint64, bit byte) {
+	mask := byte(1) << (7 - offset&7)
+	if bit == 1 {
+		p[offset>>3] |= mask
+	} else {
+		p[offset>>3] &^= mask
+	}
+}
+
+// setbitCommand implements SETBIT key offset value
+func setbitCommand(c *Cache, args []string) string {
+	offset, ok := parseBitOffset(args[2])
+	if !ok {
+		return respError("bit offset is not an integer or out of range")
+	}
+	if args[3] != "0" && args[3] != "1" {
+		return respError("bit is not an integer or out of range")
+	}
+	bit := args[3][0] - '0'
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if entry.Object != nil {
+			reply = errWrongType
+			return updateNone
+		}
+		buf := growValue(entry.Value, offset>>3+1)
+		reply = respInt(int64(getBit(buf, offset)))
+		setBit(buf, offset, bit)
+		entry.Value = string(buf)
+		return updateStore
+	})
+
+	return reply
+}
+
+// getbitCommand implements GETBIT key offset
+func getbitCommand(c *Cache, args []string) string {
+	offset, ok := parseBitOffset(args[2])
+	if !ok {
+		return respError("bit offset is not an integer or out of range")
+	}
+
+	value, _, errReply := getString(c, args[1])
+	if errReply != "" {
+		return errReply
+	}
+	return respInt(int64(getBit([]byte(value), offset)))
+}
+
+// parseBitRange parses the optional "start end [BYTE|BIT]" arguments shared by
+// BITCOUNT and BITPOS and returns the inclusive bit range they select within
+// a value of length bytes. ok is false when the range is empty.
+func parseBitRange(args []string, length int64) (start, end int64, ok bool, errMsg string) {
+	start, end = 0, -1
+	bitMode := false
+
+	if len(args) > 0 {
+		var valid bool
+		if start, valid = parseInt(args[0]); !valid {
+			return 0, 0, false, errNotInteger
+		}
+	}
+	if len(args) > 1 {
+		var valid bool
+		if end, valid = parseInt(args[1]); !valid {
+			return 0, 0, false, errNotInteger
+		}
+	}
+	if len(args) > 2 {
+		switch strings.ToUpper(args[2]) {
+		case "BYTE":
+		case "BIT":
+			bitMode = true
+		default:
+			return 0, 0, false, errSyntax
+		}
+	}
+	if len(args) > 3 {
+		return 0, 0, false, errSyntax
+	}
+
+	if bitMode {
+		start, end, ok = normalizeRange(start, end, length*8)
+		return start, end, ok, ""
+	}
+
+	start, end, ok = normalizeRange(start, end, length)
+	return start * 8, end*8 + 7, ok, ""
+}
+
+// countBits returns the number of set bits in the inclusive bit range
+func countBits(p []byte, start, end int64) int64 {
+	var count int
+	for i := start >> 3; i <= end>>3; i++ {
+		b := p[i]
+		if i == start>>3 {
+			b &= 0xFF >> (start & 7)
+		}
+		if i == end>>3 {
+			b &= 0xFF << (7 - end&7)
+		}
+		count += bits.OnesCount8(b)
+	}
+	return int64(count)
+}
+
+// firstBitPos returns the position of the first bit equal to bit within the
+// inclusive range, or -1 if there is none. Whole bytes that cannot match are
+// skipped and the position inside a byte is found with a leading zero count.
+func firstBitPos(p []byte, bit byte, start, end int64) int64 {
+	for pos := start; pos <= end; pos = (pos | 7) + 1 {
+		b := p[pos>>3]
+		if bit == 0 {
+			b = ^b
+		}
+		b &= 0xFF >> (pos & 7)
+		if pos>>3 == end>>3 {
+			b &= 0xFF << (7 - end&7)
+		}
+		if b != 0 {
+			return pos&^7 + int64(bits.LeadingZeros8(b))
+		}
+	}
+	return -1
+}
+
+// bitcountCommand implements BITCOUNT key [start end [BYTE|BIT]]
+func bitcountCommand(c *Cache, args []string) string {
+	if len(args) == 3 {
+		return respError(errSyntax)
+	}
+
+	value, _, errReply := getString(c, args[1])
+	if errReply != "" {
+		return errReply
+	}
+	start, end, ok, errMsg := parseBitRange(args[2:], int64(len(value)))
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+	if !ok {
+		return respInt(0)
+	}
+
+	return respInt(countBits([]byte(value), start, end))
+}
+
+// bitposCommand implements BITPOS key bit [start [end [BYTE|BIT]]]
+func bitposCommand(c *Cache, args []string) string {
+	if args[2] != "0" && args[2] != "1" {
+		return respError("The bit argument must be 1 or 0.")
+	}
+	bit := args[2][0] - '0'
+
+	value, exists, errReply := getString(c, args[1])
+	if errReply != "" {
+		return errReply
+	}
+	if !exists || len(value) == 0 {
+		if bit == 1 {
+			return respInt(-1)
+		}
+		return respInt(0)
+	}
+
+	start, end, ok, errMsg := parseBitRange(args[3:], int64(len(value)))
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+	if !ok {
+		return respInt(-1)
+	}
+
+	pos := firstBitPos([]byte(value), bit, start, end)
+
+	// Without an explicit end, a string made only of ones is treated as
+	// followed by an infinite run of zeros
+	if pos == -1 && bit == 0 && len(args) < 5 {
+		return respInt(end + 1)
+	}
+	return respInt(pos)
+}
+
+// bitopCommand implements BITOP AND|OR|XOR|NOT destkey key [key ...]
+func bitopCommand(c *Cache, args []string) string {
+	op := strings.ToUpper(args[1])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 4 {
+			return respError("BITOP NOT must be called with a single source key.")
+		}
+	default:
+		return respError(errSyntax)
+	}
+
+	sources := make([]string, 0, len(args)-3)
+	maxLen := 0
+	for _, key := range args[3:] {
+		value, _, errReply := getString(c, key)
+		if errReply != "" {
+			return errReply
+		}
+		sources = append(sources, value)
+		if len(value) > maxLen {
+			maxLen = len(value)
+		}
+	}
+
+	if maxLen == 0 {
+		c.Delete(args[2])
+		return respInt(0)
+	}
+
+	// Shorter sources behave as if padded with zero bytes
+	result := growValue(sources[0], uint64(maxLen))
+	for _, src := range sources[1:] {
+		for i := range result {
+			var b byte
+			if i < len(src) {
+				b = src[i]
+			}
+			switch op {
+			case "AND":
+				result[i] &= b
+			case "OR":
+				result[i] |= b
+			case "XOR":
+				result[i] ^= b
+			}
+		}
+	}
+	if op == "NOT" {
+		for i := range result {
+			result[i] = ^result[i]
+		}
+	}
+
+	if err := c.Set(args[2], string(result), 0); err != nil {
+		return errOOM
+	}
+	return respInt(int64(len(result)))
+}
+
+// Overflow behaviours for BITFIELD SET and INCRBY
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+// bitfieldType is an integer encoding such as i8 or u16
+type bitfieldType struct {
+	signed bool
+	bits   int
+}
+
+// bitfieldOp is a single parsed BITFIELD subcommand
+type bitfieldOp struct {
+	op       string // GET, SET or INCRBY
+	typ      bitfieldType
+	offset   uint64
+	value    int64
+	overflow int
+}
+
+// parseBitfieldType parses i1..i64 and u1..u63
+func parseBitfieldType(s string) (bitfieldType, bool) {
+	if len(s) < 2 {
+		return bitfieldType{}, false
+	}
+
+	var t bitfieldType
+	switch s[0] {
+	case 'i', 'I':
+		t.signed = true
+	case 'u', 'U':
+	default:
+		return bitfieldType{}, false
+	}
+
+	n, err := strconv.Atoi(s[1:])
+	if err != nil || n < 1 || (t.signed && n > 64) || (!t.signed && n > 63) {
+		return bitfieldType{}, false
+	}
+	t.bits = n
+	return t, true
+}
+
+// parseBitfieldOffset parses a plain bit offset or a "#N" offset that is
+// multiplied by the type width
+func parseBitfieldOffset(s string, t bitfieldType) (uint64, bool) {
+	multiply := strings.HasPrefix(s, "#")
+	if multiply {
+		s = s[1:]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if multiply {
+		// Checked before multiplying so that the product cannot wrap around
+		if n > MaxBitOffset/uint64(t.bits) {
+			return 0, false
+		}
+		n *= uint64(t.bits)
+	}
+	if n+uint64(t.bits)-1 > MaxBitOffset {
+		return 0, false
+	}
+	return n, true
+}
+
+// readBitfield returns the raw unsigned bits of a field
+func readBitfield(p []byte, offset uint64, width int) uint64 {
+	var v uint64
+	for i := 0; i < width; i++ {
+		v = v<<1 | uint64(getBit(p, offset+uint64(i)))
+	}
+	return v
+}
+
+// writeBitfield stores the low width bits of v at offset
+func writeBitfield(p []byte, offset uint64, width int, v uint64) {
+	for i := 0; i < width; i++ {
+		setBit(p, offset+uint64(i), byte(v>>(width-1-i))&1)
+	}
+}
+
+// get reads the field and sign-extends it for signed types
+func (t bitfieldType) get(p []byte, offset uint64) int64 {
+	v := readBitfield(p, offset, t.bits)
+	if t.signed && t.bits < 64 && v&(1<<(t.bits-1)) != 0 {
+		v |= math.MaxUint64 << t.bits
+	}
+	return int64(v)
+}
+
+// apply computes value+incr for the type, applying the overflow behaviour.
+// ok is false when the result overflows and the behaviour is FAIL.
+func (t bitfieldType) apply(value, incr int64, overflow int) (int64, bool) {
+	if t.signed {
+		max := int64(math.MaxInt64)
+		if t.bits < 64 {
+			max = 1<<(t.bits-1) - 1
+		}
+		min := -max - 1
+
+		var over, under bool
+		if t.bits == 64 {
+			over = value >= 0 && incr > 0 && incr > max-value
+			under = value < 0 && incr < 0 && incr < min-value
+		} else {
+			over = value > max || incr > max-value
+			under = value < min || incr < min-value
+		}
+		if !over && !under {
+			return value + incr, true
+		}
+
+		switch overflow {
+		case overflowFail:
+			return 0, false
+		case overflowSat:
+			if over {
+				return max, true
+			}
+			return min, true
+		}
+
+		// Wrap: keep the low bits and sign-extend
+		res := uint64(value) + uint64(incr)
+		if t.bits < 64 {
+			mask := uint64(math.MaxUint64) << t.bits
+			if res&(1<<(t.bits-1)) != 0 {
+				res |= mask
+			} else {
+				res &^= mask
+			}
+		}
+		return int64(res), true
+	}
+
+	// A negative value only comes from SET and counts as underflow, so that
+	// SAT stores 0
+	max := int64(1)<<t.bits - 1
+	under := value < 0 || (incr < 0 && incr < -value)
+	over := !under && (value > max || (incr > 0 && incr > max-value))
+	if !over && !under {
+		return value + incr, true
+	}
+
+	switch overflow {
+	case overflowFail:
+		return 0, false
+	case overflowSat:
+		if over {
+			return max, true
+		}
+		return 0, true
+	}
+	return int64((uint64(value) + uint64(incr)) & uint64(max)), true
+}
+
+// parseBitfieldOps parses the subcommands of BITFIELD
+func parseBitfieldOps(args []string, readOnly bool) ([]bitfieldOp, string) {
+	var ops []bitfieldOp
+	overflow := overflowWrap
+
+	for i := 0; i < len(args); {
+		name := strings.ToUpper(args[i])
+
+		if name == "OVERFLOW" {
+			if i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			switch strings.ToUpper(args[i+1]) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return nil, "Invalid OVERFLOW type specified"
+			}
+			i += 2
+			continue
+		}
+
+		argc := 0
+		switch name {
+		case "GET":
+			argc = 2
+		case "SET", "INCRBY":
+			if readOnly {
+				return nil, "BITFIELD_RO only supports the GET subcommand"
+			}
+			argc = 3
+		default:
+			return nil, errSyntax
+		}
+		if i+argc >= len(args) {
+			return nil, errSyntax
+		}
+
+		typ, ok := parseBitfieldType(args[i+1])
+		if !ok {
+			return nil, "Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+		}
+		offset, ok := parseBitfieldOffset(args[i+2], typ)
+		if !ok {
+			return nil, "bit offset is not an integer or out of range"
+		}
+
+		op := bitfieldOp{op: name, typ: typ, offset: offset, overflow: overflow}
+		if argc == 3 {
+			if op.value, ok = parseInt(args[i+3]); !ok {
+				return nil, errNotInteger
+			}
+		}
+		ops = append(ops, op)
+		i += argc + 1
+	}
+
+	return ops, ""
+}
+
+// runBitfieldOps executes ops against p, which must be large enough for every
+// field, and returns one encoded reply per op
+func runBitfieldOps(p []byte, ops []bitfieldOp) []string {
+	replies := make([]string, 0, len(ops))
+
+	for _, op := range ops {
+		old := op.typ.get(p, op.offset)
+
+		switch op.op {
+		case "GET":
+			replies = append(replies, respInt(old))
+
+		case "SET":
+			value, ok := op.typ.apply(op.value, 0, op.overflow)
+			if !ok {
+				replies = append(replies, respNil())
+				continue
+			}
+			writeBitfield(p, op.offset, op.typ.bits, uint64(value))
+			replies = append(replies, respInt(old))
+
+		case "INCRBY":
+			value, ok := op.typ.apply(old, op.value, op.overflow)
+			if !ok {
+				replies = append(replies, respNil())
+				continue
+			}
+			writeBitfield(p, op.offset, op.typ.bits, uint64(value))
+			replies = append(replies, respInt(value))
+		}
+	}
+
+	return replies
+}
+
+// bitfieldCommand implements BITFIELD and BITFIELD_RO
+func bitfieldCommand(c *Cache, args []string) string {
+	ops, errMsg := parseBitfieldOps(args[2:], args[0] == "BITFIELD_RO")
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+
+	var size uint64
+	writes := false
+	for _, op := range ops {
+		if op.op != "GET" {
+			writes = true
+			if end := (op.offset+uint64(op.typ.bits)-1)>>3 + 1; end > size {
+				size = end
+			}
+		}
+	}
+
+	if !writes {
+		value, _, errReply := getString(c, args[1])
+		if errReply != "" {
+			return errReply
+		}
+		return respArray(runBitfieldOps([]byte(value), ops))
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if entry.Object != nil {
+			reply = errWrongType
+			return updateNone
+		}
+		buf := growValue(entry.Value, size)
+		reply = respArray(runBitfieldOps(buf, ops))
+		entry.Value = string(buf)
+		return updateStore
+	})
+
+	return reply
+}
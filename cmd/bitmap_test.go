@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestBitfieldOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"wrap unsigned incr", []string{"SET", "u8", "0", "250", "INCRBY", "u8", "0", "10"}, "*2\r\n:0\r\n:4\r\n"},
+		{"wrap signed incr", []string{"SET", "i8", "0", "120", "INCRBY", "i8", "0", "10"}, "*2\r\n:0\r\n:-126\r\n"},
+		{"wrap unsigned set", []string{"SET", "u8", "0", "-1", "GET", "u8", "0"}, "*2\r\n:0\r\n:255\r\n"},
+		{"sat unsigned over", []string{"OVERFLOW", "SAT", "SET", "u8", "0", "250", "INCRBY", "u8", "0", "10"}, "*2\r\n:0\r\n:255\r\n"},
+		{"sat unsigned under", []string{"OVERFLOW", "SAT", "SET", "u8", "0", "5", "INCRBY", "u8", "0", "-10"}, "*2\r\n:0\r\n:0\r\n"},
+		{"sat unsigned negative set", []string{"OVERFLOW", "SAT", "SET", "u8", "0", "-1", "GET", "u8", "0"}, "*2\r\n:0\r\n:0\r\n"},
+		{"sat unsigned large set", []string{"OVERFLOW", "SAT", "SET", "u8", "0", "300", "GET", "u8", "0"}, "*2\r\n:0\r\n:255\r\n"},
+		{"sat signed over", []string{"OVERFLOW", "SAT", "SET", "i8", "0", "120", "INCRBY", "i8", "0", "10"}, "*2\r\n:0\r\n:127\r\n"},
+		{"sat signed under", []string{"OVERFLOW", "SAT", "SET", "i8", "0", "-120", "INCRBY", "i8", "0", "-10"}, "*2\r\n:0\r\n:-128\r\n"},
+		{"sat i64", []string{"OVERFLOW", "SAT", "SET", "i64", "0", "9223372036854775800", "INCRBY", "i64", "0", "100"}, "*2\r\n:0\r\n:9223372036854775807\r\n"},
+		{"fail unsigned", []string{"OVERFLOW", "FAIL", "SET", "u8", "0", "250", "INCRBY", "u8", "0", "10", "GET", "u8", "0"}, "*3\r\n:0\r\n$-1\r\n:250\r\n"},
+		{"fail unsigned negative set", []string{"OVERFLOW", "FAIL", "SET", "u8", "0", "-1"}, "*1\r\n$-1\r\n"},
+		{"fail signed", []string{"OVERFLOW", "FAIL", "SET", "i8", "0", "-128", "INCRBY", "i8", "0", "-1"}, "*2\r\n:0\r\n$-1\r\n"},
+		{"multiplied offset", []string{"SET", "u8", "#1", "7", "GET", "u8", "8"}, "*2\r\n:0\r\n:7\r\n"},
+		{"last offset", []string{"GET", "u8", "#536870911"}, "*1\r\n:0\r\n"},
+		{"offset past the limit", []string{"GET", "u8", "#536870912"}, "-ERR bit offset is not an integer or out of range\r\n"},
+		{"multiplied offset wraps", []string{"GET", "u8", "#2305843009213693952"}, "-ERR bit offset is not an integer or out of range\r\n"},
+		{"unsigned too wide", []string{"GET", "u64", "0"}, "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			got := executeCommand(c, append([]string{"BITFIELD", "k"}, tt.args...))
+			if got != tt.want {
+				t.Fatalf("BITFIELD k %v = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBitopOutOfMemory(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "a", "abc"})
+	c.SetMaxMemory(1, PolicyNoEviction)
+	if got := bitopCommand(c, []string{"BITOP", "NOT", "dest", "a"}); got != errOOM {
+		t.Fatalf("BITOP over maxmemory = %q, want an OOM error", got)
+	}
+	if _, exists := c.Get("dest"); exists {
+		t.Fatal("BITOP stored its result over maxmemory")
+	}
+}
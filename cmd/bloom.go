@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Defaults for filters created implicitly by BF.ADD and BF.MADD
+const (
+	BloomDefaultErrorRate = 0.01
+	BloomDefaultCapacity  = 100
+	BloomDefaultExpansion = 2
+
+	// Every layer added by auto-scaling gets a tighter error rate so that
+	// the compound error rate stays close to the requested one
+	bloomTighteningRatio = 0.5
+)
+
+func init() {
+	registerCommand("BF.RESERVE", -4, flagWrite|flagDenyOOM, bfReserveCommand)
+	registerCommand("BF.ADD", 3, flagWrite|flagDenyOOM, bfAddCommand)
+	registerCommand("BF.MADD", -3, flagWrite|flagDenyOOM, bfAddCommand)
+	registerCommand("BF.EXISTS", 3, flagReadOnly, bfExistsCommand)
+	registerCommand("BF.MEXISTS", -3, flagReadOnly, bfExistsCommand)
+	registerCommand("BF.INFO", 2, flagReadOnly, bfInfoCommand)
+}
+
+// bloomLayer is a fixed size bloom filter
+type bloomLayer struct {
+	bits     []uint64
+	size     uint64 // Number of bits
+	hashes   uint64
+	capacity uint64
+	count    uint64
+}
+
+// newBloomLayer sizes a layer for capacity items at the given error rate
+func newBloomLayer(capacity uint64, errorRate float64) *bloomLayer {
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2)))
+	size = max(size, 64)
+	return &bloomLayer{
+		bits:     make([]uint64, (size+63)/64),
+		size:     size,
+		hashes:   uint64(math.Ceil(-math.Log2(errorRate))),
+		capacity: capacity,
+	}
+}
+
+// bloomHashes returns the two base hashes combined by double hashing
+func bloomHashes(item string) (uint64, uint64) {
+	return murmurHash64A([]byte(item), 0xc6a4a7935bd1e995), murmurHash64A([]byte(item), 0x9747b28c)
+}
+
+// has reports whether every bit of the item is set
+func (l *bloomLayer) has(h1, h2 uint64) bool {
+	for i := uint64(0); i < l.hashes; i++ {
+		bit := (h1 + i*h2) % l.size
+		if l.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add sets every bit of the item
+func (l *bloomLayer) add(h1, h2 uint64) {
+	for i := uint64(0); i < l.hashes; i++ {
+		bit := (h1 + i*h2) % l.size
+		l.bits[bit/64] |= 1 << (bit % 64)
+	}
+	l.count++
+}
+
+// bloomFilter is a scalable bloom filter: when the newest layer is full a
+// larger one with a tighter error rate is stacked on top of it
+type bloomFilter struct {
+	layers    []*bloomLayer
+	errorRate float64
+	expansion uint64 // Zero for non-scaling filters
+}
+
+// newBloomFilter creates a filter with a single layer
+func newBloomFilter(errorRate float64, capacity, expansion uint64) *bloomFilter {
+	return &bloomFilter{
+		layers:    []*bloomLayer{newBloomLayer(capacity, errorRate)},
+		errorRate: errorRate,
+		expansion: expansion,
+	}
+}
+
+// Type implements Object
+func (f *bloomFilter) Type() string {
+	return "bloom"
+}
+
+// String implements Object
+func (f *bloomFilter) String() string {
+	return fmt.Sprintf("bloom filter: %d items, capacity %d, %d layers, error rate %s",
+		f.Count(), f.Capacity(), len(f.layers), formatFloat(f.errorRate))
+}
+
+// MemoryUsage implements memoryUser
+func (f *bloomFilter) MemoryUsage() int64 {
+	var size int64
+	for _, l := range f.layers {
+		size += int64(len(l.bits))*8 + 64
+	}
+	return size
+}
+
+// Count returns the number of items added
+func (f *bloomFilter) Count() uint64 {
+	var n uint64
+	for _, l := range f.layers {
+		n += l.count
+	}
+	return n
+}
+
+// Capacity returns the combined capacity of all layers
+func (f *bloomFilter) Capacity() uint64 {
+	var n uint64
+	for _, l := range f.layers {
+		n += l.capacity
+	}
+	return n
+}
+
+// Exists reports whether item may have been added
+func (f *bloomFilter) Exists(item string) bool {
+	h1, h2 := bloomHashes(item)
+	for _, l := range f.layers {
+		if l.has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add inserts item. It returns false if the item may already be present and
+// an error if a non-scaling filter is full.
+func (f *bloomFilter) Add(item string) (bool, error) {
+	h1, h2 := bloomHashes(item)
+	for _, l := range f.layers {
+		if l.has(h1, h2) {
+			return false, nil
+		}
+	}
+
+	last := f.layers[len(f.layers)-1]
+	if last.count >= last.capacity {
+		if f.expansion == 0 {
+			return false, fmt.Errorf("non scaling filter is full")
+		}
+		rate := f.errorRate * math.Pow(bloomTighteningRatio, float64(len(f.layers)))
+		last = newBloomLayer(last.capacity*f.expansion, rate)
+		f.layers = append(f.layers, last)
+	}
+
+	last.add(h1, h2)
+	return true, nil
+}
+
+// bfReserveCommand implements BF.RESERVE key error_rate capacity
+// [EXPANSION expansion] [NONSCALING]
+func bfReserveCommand(c *Cache, args []string) string {
+	errorRate, ok := parseFloat(args[2])
+	if !ok || errorRate <= 0 || errorRate >= 1 {
+		return respError("(0 < error rate range < 1)")
+	}
+	capacity, ok := parseInt(args[3])
+	if !ok || capacity <= 0 {
+		return respError("(capacity should be larger than 0)")
+	}
+
+	expansion := int64(BloomDefaultExpansion)
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NONSCALING":
+			expansion = 0
+		case "EXPANSION":
+			if i+1 >= len(args) {
+				return respError(errSyntax)
+			}
+			if expansion, ok = parseInt(args[i+1]); !ok || expansion < 1 {
+				return respError("expansion should be greater or equal to 1")
+			}
+			i++
+		default:
+			return respError(errSyntax)
+		}
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists {
+			reply = respError("item exists")
+			return updateNone
+		}
+		entry.Object = newBloomFilter(errorRate, uint64(capacity), uint64(expansion))
+		reply = respOK()
+		return updateStore
+	})
+	return reply
+}
+
+// bfAddCommand implements BF.ADD key item and BF.MADD key item [item ...]
+func bfAddCommand(c *Cache, args []string) string {
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		var f *bloomFilter
+		if exists {
+			var ok bool
+			if f, ok = entry.Object.(*bloomFilter); !ok {
+				reply = errWrongType
+				return updateNone
+			}
+		} else {
+			f = newBloomFilter(BloomDefaultErrorRate, BloomDefaultCapacity, BloomDefaultExpansion)
+			entry.Object = f
+		}
+
+		items := make([]string, 0, len(args)-2)
+		for _, item := range args[2:] {
+			added, err := f.Add(item)
+			switch {
+			case err != nil:
+				items = append(items, respError(err.Error()))
+			case added:
+				items = append(items, respInt(1))
+			default:
+				items = append(items, respInt(0))
+			}
+		}
+
+		if args[0] == "BF.ADD" {
+			reply = items[0]
+		} else {
+			reply = respArray(items)
+		}
+		return updateStore
+	})
+	return reply
+}
+
+// bfExistsCommand implements BF.EXISTS key item and BF.MEXISTS key item
+// [item ...]
+func bfExistsCommand(c *Cache, args []string) string {
+	var reply string
+	c.View(args[1], func(entry CacheEntry, exists bool) {
+		f, ok := entry.Object.(*bloomFilter)
+		if exists && !ok {
+			reply = errWrongType
+			return
+		}
+
+		items := make([]string, 0, len(args)-2)
+		for _, item := range args[2:] {
+			if exists && f.Exists(item) {
+				items = append(items, respInt(1))
+			} else {
+				items = append(items, respInt(0))
+			}
+		}
+
+		if args[0] == "BF.EXISTS" {
+			reply = items[0]
+		} else {
+			reply = respArray(items)
+		}
+	})
+	return reply
+}
+
+// bfInfoCommand implements BF.INFO key
+func bfInfoCommand(c *Cache, args []string) string {
+	var reply string
+	c.View(args[1], func(entry CacheEntry, exists bool) {
+		if !exists {
+			reply = respError("not found")
+			return
+		}
+		f, ok := entry.Object.(*bloomFilter)
+		if !ok {
+			reply = errWrongType
+			return
+		}
+
+		var size uint64
+		for _, l := range f.layers {
+			size += uint64(len(l.bits)) * 8
+		}
+		reply = respArray([]string{
+			respSimple("Capacity"), respInt(int64(f.Capacity())),
+			respSimple("Size"), respInt(int64(size)),
+			respSimple("Number of filters"), respInt(int64(len(f.layers))),
+			respSimple("Number of items inserted"), respInt(int64(f.Count())),
+			respSimple("Expansion rate"), respInt(int64(f.expansion)),
+		})
+	})
+	return reply
+}
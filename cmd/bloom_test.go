@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBloomCommands(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "str", "hello"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"BF.RESERVE", "bf", "0.01", "2", "NONSCALING"}, "+OK\r\n"},
+		{[]string{"BF.RESERVE", "bf", "0.01", "2"}, "-ERR item exists\r\n"},
+		{[]string{"BF.RESERVE", "x", "1", "2"}, "-ERR (0 < error rate range < 1)\r\n"},
+		{[]string{"BF.RESERVE", "x", "0.01", "0"}, "-ERR (capacity should be larger than 0)\r\n"},
+		{[]string{"BF.RESERVE", "x", "0.01", "10", "EXPANSION", "0"}, "-ERR expansion should be greater or equal to 1\r\n"},
+		{[]string{"BF.RESERVE", "x", "0.01", "10", "EXPANSION"}, "-ERR syntax error\r\n"},
+		{[]string{"BF.ADD", "bf", "a"}, ":1\r\n"},
+		{[]string{"BF.ADD", "bf", "a"}, ":0\r\n"},
+		{[]string{"BF.MADD", "bf", "b", "c"}, "*2\r\n:1\r\n-ERR non scaling filter is full\r\n"},
+		{[]string{"BF.EXISTS", "bf", "b"}, ":1\r\n"},
+		{[]string{"BF.MEXISTS", "bf", "a", "c"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"BF.EXISTS", "missing", "a"}, ":0\r\n"},
+		{[]string{"BF.INFO", "bf"}, "*10\r\n+Capacity\r\n:2\r\n+Size\r\n:8\r\n+Number of filters\r\n:1\r\n+Number of items inserted\r\n:2\r\n+Expansion rate\r\n:0\r\n"},
+		{[]string{"BF.INFO", "missing"}, "-ERR not found\r\n"},
+		{[]string{"BF.ADD", "new", "a"}, ":1\r\n"},
+		{[]string{"TYPE", "new"}, "+bloom\r\n"},
+		{[]string{"BF.ADD", "str", "a"}, errWrongType},
+		{[]string{"BF.EXISTS", "str", "a"}, errWrongType},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestBloomScaling(t *testing.T) {
+	f := newBloomFilter(0.01, 100, 2)
+	for i := 0; i < 10000; i++ {
+		f.Add("item:" + strconv.Itoa(i))
+	}
+	if len(f.layers) < 6 || f.Capacity() < 10000 {
+		t.Fatalf("10000 items in %d layers with capacity %d", len(f.layers), f.Capacity())
+	}
+	for i := 0; i < 10000; i++ {
+		if !f.Exists("item:" + strconv.Itoa(i)) {
+			t.Fatalf("item:%d is missing", i)
+		}
+	}
+
+	// The tightened layers keep the compound error rate near the requested one
+	falsePositives := 0
+	for i := 0; i < 100000; i++ {
+		if f.Exists("other:" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 100000; rate > 0.02 {
+		t.Fatalf("false positive rate = %v, want about 0.01", rate)
+	}
+}
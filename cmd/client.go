@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// pubsubOutputLimit is the number of bytes that may be queued for a
+// subscriber. Subscribers that fall further behind are disconnected so that
+// publishers never block.
+var pubsubOutputLimit int64 = 32 << 20
+
+// SetPubSubOutputLimit changes the output buffer limit of subscribers
+func SetPubSubOutputLimit(limit int64) {
+	atomic.StoreInt64(&pubsubOutputLimit, limit)
+}
+
+// Kinds of subscriptions
+const (
+	subChannel = iota // SUBSCRIBE
+	subPattern        // PSUBSCRIBE
+	subShard          // SSUBSCRIBE
+)
+
+// client is the state kept for a TCP connection
+type client struct {
+	conn      net.Conn
+	mu        sync.Mutex // Serializes replies and pushed messages
+	closed    chan struct{}
+	closeOnce sync.Once
+	pushMode  atomic.Bool // Replies go through the queue once subscribed
+	user      *aclUser    // Authenticated user, nil until AUTH succeeds
+
+	// Output buffer of pushed messages
+	queueMu sync.Mutex
+	queue   []string
+	queued  int64 // Bytes in queue
+	wake    chan struct{}
+
+	// Transaction state, only used by the connection's goroutine
+	monitor  bool       // MONITOR was run, only QUIT is accepted
+	multi    bool       // Commands are queued until EXEC
+	dirty    bool       // A command could not be queued
+	commands [][]string // Commands of the open transaction
+	watched  []watchedKey
+
+	// Subscriptions by kind, guarded by the pub/sub hub's lock. numSubs
+	// counts them so that commands can check for subscriptions without it.
+	subs    [3]map[string]bool
+	numSubs atomic.Int32
+}
+
+// newClient wraps a connection and starts delivering pushed messages
+func newClient(conn net.Conn) *client {
+	cl := &client{
+		conn:   conn,
+		closed: make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+	}
+	for i := range cl.subs {
+		cl.subs[i] = make(map[string]bool)
+	}
+	go cl.pushLoop()
+	return cl
+}
+
+// info describes the client for the ACL log
+func (cl *client) info() string {
+	name := ""
+	if cl.user != nil {
+		name = cl.user.name
+	}
+	return "addr=" + cl.conn.RemoteAddr().String() + " laddr=" + cl.conn.LocalAddr().String() + " user=" + name
+}
+
+// write sends a reply to the client
+func (cl *client) write(reply string) {
+	cl.mu.Lock()
+	cl.conn.Write([]byte(reply))
+	cl.mu.Unlock()
+}
+
+// reply sends a command reply. Once the client has subscribed, replies are
+// queued behind pushed messages so that they arrive in order.
+func (cl *client) reply(reply string) {
+	if cl.pushMode.Load() {
+		cl.push(reply)
+		return
+	}
+	cl.write(reply)
+}
+
+// push queues a message without blocking. A client whose output buffer
+// would exceed the limit is disconnected.
+func (cl *client) push(msg string) {
+	cl.queueMu.Lock()
+	if cl.queued+int64(len(msg)) > atomic.LoadInt64(&pubsubOutputLimit) {
+		cl.queueMu.Unlock()
+		cl.close()
+		return
+	}
+	cl.queue = append(cl.queue, msg)
+	cl.queued += int64(len(msg))
+	cl.queueMu.Unlock()
+
+	select {
+	case cl.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pushLoop writes queued messages until the client is closed. Everything
+// queued since the last write goes out in a single write.
+func (cl *client) pushLoop() {
+	for {
+		select {
+		case <-cl.wake:
+		case <-cl.closed:
+			return
+		}
+		cl.flush()
+	}
+}
+
+// flush writes the queued messages. The queue is taken while holding mu so
+// that messages flushed from different goroutines stay in order.
+func (cl *client) flush() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.queueMu.Lock()
+	batch := cl.queue
+	cl.queue, cl.queued = nil, 0
+	cl.queueMu.Unlock()
+
+	if len(batch) > 0 {
+		cl.conn.Write([]byte(strings.Join(batch, "")))
+	}
+}
+
+// subscriptions returns the number of subscriptions counted in the
+// confirmations of a kind. Shard channels are counted on their own.
+func (cl *client) subscriptions(kind int) int {
+	if kind == subShard {
+		return len(cl.subs[subShard])
+	}
+	return len(cl.subs[subChannel]) + len(cl.subs[subPattern])
+}
+
+// close shuts the connection down, which also ends its read loop
+func (cl *client) close() {
+	cl.closeOnce.Do(func() {
+		close(cl.closed)
+		cl.conn.Close()
+	})
+}
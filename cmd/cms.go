@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+func init() {
+	registerCommand("CMS.INITBYDIM", 4, flagWrite|flagDenyOOM, cmsInitCommand)
+	registerCommand("CMS.INITBYPROB", 4, flagWrite|flagDenyOOM, cmsInitCommand)
+	registerCommand("CMS.INCRBY", -4, flagWrite|flagDenyOOM, cmsIncrByCommand)
+	registerCommand("CMS.QUERY", -3, flagReadOnly, cmsQueryCommand)
+	registerCommand("CMS.MERGE", -4, flagWrite|flagDenyOOM, cmsMergeCommand)
+	registerCommand("CMS.INFO", 2, flagReadOnly, cmsInfoCommand)
+}
+
+// countMinSketch estimates item frequencies with depth rows of width
+// counters. Estimates never undercount.
+type countMinSketch struct {
+	counters []uint64 // depth rows of width counters
+	width    uint64
+	depth    uint64
+	count    uint64 // Total of all increments
+}
+
+// newCountMinSketch allocates an empty sketch
+func newCountMinSketch(width, depth uint64) *countMinSketch {
+	return &countMinSketch{
+		counters: make([]uint64, width*depth),
+		width:    width,
+		depth:    depth,
+	}
+}
+
+// Type implements Object
+func (s *countMinSketch) Type() string {
+	return "cms"
+}
+
+// String implements Object
+func (s *countMinSketch) String() string {
+	return fmt.Sprintf("count-min sketch: width %d, depth %d, count %d", s.width, s.depth, s.count)
+}
+
+// MemoryUsage implements memoryUser
+func (s *countMinSketch) MemoryUsage() int64 {
+	return int64(len(s.counters)) * 8
+}
+
+// index returns the position of item's counter in row
+func (s *countMinSketch) index(item string, row uint64) uint64 {
+	return row*s.width + murmurHash64A([]byte(item), row)%s.width
+}
+
+// IncrBy adds n to item's counters and returns its new estimate
+func (s *countMinSketch) IncrBy(item string, n uint64) uint64 {
+	estimate := uint64(math.MaxUint64)
+	for row := uint64(0); row < s.depth; row++ {
+		i := s.index(item, row)
+		s.counters[i] = satAdd(s.counters[i], n)
+		estimate = min(estimate, s.counters[i])
+	}
+	s.count = satAdd(s.count, n)
+	return estimate
+}
+
+// Query returns the estimated count of item
+func (s *countMinSketch) Query(item string) uint64 {
+	estimate := uint64(math.MaxUint64)
+	for row := uint64(0); row < s.depth; row++ {
+		estimate = min(estimate, s.counters[s.index(item, row)])
+	}
+	return estimate
+}
+
+// satAdd adds without wrapping around
+func satAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// cmsInitCommand implements CMS.INITBYDIM key width depth and
+// CMS.INITBYPROB key error probability
+func cmsInitCommand(c *Cache, args []string) string {
+	var width, depth uint64
+	if args[0] == "CMS.INITBYDIM" {
+		w, ok1 := parseInt(args[2])
+		d, ok2 := parseInt(args[3])
+		if !ok1 || !ok2 || w <= 0 || d <= 0 {
+			return respError("CMS: invalid width/depth")
+		}
+		width, depth = uint64(w), uint64(d)
+	} else {
+		// The estimate is within error*count of the real count with the
+		// given probability of exceeding it
+		errRate, ok1 := parseFloat(args[2])
+		prob, ok2 := parseFloat(args[3])
+		if !ok1 || errRate <= 0 || errRate >= 1 {
+			return respError("CMS: invalid overestimation value")
+		}
+		if !ok2 || prob <= 0 || prob >= 1 {
+			return respError("CMS: invalid prob value")
+		}
+		w := math.Ceil(2 / errRate)
+		d := math.Ceil(math.Log10(prob) / math.Log10(0.5))
+		if w > 1<<28 || d > 1<<28 {
+			return respError("CMS: dimensions too large")
+		}
+		width, depth = uint64(w), max(uint64(d), 1)
+	}
+	// Dividing instead of multiplying keeps the check from overflowing
+	if width > 1<<28/depth {
+		return respError("CMS: dimensions too large")
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists {
+			reply = respError("CMS: key already exists")
+			return updateNone
+		}
+		entry.Object = newCountMinSketch(width, depth)
+		reply = respOK()
+		return updateStore
+	})
+	return reply
+}
+
+// cmsIncrByCommand implements CMS.INCRBY key item increment
+// [item increment ...]
+func cmsIncrByCommand(c *Cache, args []string) string {
+	if len(args)%2 != 0 {
+		return respError(errSyntax)
+	}
+	increments := make([]uint64, 0, len(args)/2-1)
+	for i := 3; i < len(args); i += 2 {
+		n, ok := parseInt(args[i])
+		if !ok || n < 0 {
+			return respError("CMS: Cannot parse number")
+		}
+		increments = append(increments, uint64(n))
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			reply = respError("CMS: key does not exist")
+			return updateNone
+		}
+		s, ok := entry.Object.(*countMinSketch)
+		if !ok {
+			reply = errWrongType
+			return updateNone
+		}
+
+		items := make([]string, 0, len(increments))
+		for i, n := range increments {
+			items = append(items, respInt(int64(min(s.IncrBy(args[2+2*i], n), math.MaxInt64))))
+		}
+		reply = respArray(items)
+		return updateStore
+	})
+	return reply
+}
+
+// viewCountMinSketch runs fn against the sketch stored at key under the
+// shard's read lock
+func viewCountMinSketch(c *Cache, key string, fn func(s *countMinSketch) string) string {
+	var reply string
+	c.View(key, func(entry CacheEntry, exists bool) {
+		if !exists {
+			reply = respError("CMS: key does not exist")
+			return
+		}
+		s, ok := entry.Object.(*countMinSketch)
+		if !ok {
+			reply = errWrongType
+			return
+		}
+		reply = fn(s)
+	})
+	return reply
+}
+
+// cmsQueryCommand implements CMS.QUERY key item [item ...]
+func cmsQueryCommand(c *Cache, args []string) string {
+	return viewCountMinSketch(c, args[1], func(s *countMinSketch) string {
+		items := make([]string, 0, len(args)-2)
+		for _, item := range args[2:] {
+			items = append(items, respInt(int64(min(s.Query(item), math.MaxInt64))))
+		}
+		return respArray(items)
+	})
+}
+
+// cmsMergeCommand implements CMS.MERGE dest numkeys src [src ...]
+// [WEIGHTS weight [weight ...]]
+func cmsMergeCommand(c *Cache, args []string) string {
+	numKeys, ok := parseInt(args[2])
+	if !ok || numKeys <= 0 || int(numKeys) > len(args)-3 {
+		return respError("CMS: invalid numkeys")
+	}
+	sources := args[3 : 3+numKeys]
+	rest := args[3+numKeys:]
+
+	weights := make([]int64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	if len(rest) > 0 {
+		if !strings.EqualFold(rest[0], "WEIGHTS") || int64(len(rest)-1) != numKeys {
+			return respError(errSyntax)
+		}
+		for i, w := range rest[1:] {
+			if weights[i], ok = parseInt(w); !ok {
+				return respError("CMS: invalid weight value")
+			}
+		}
+	}
+
+	// Copy the sources first, each under its own shard's lock
+	copies := make([]*countMinSketch, 0, numKeys)
+	for _, key := range sources {
+		reply := viewCountMinSketch(c, key, func(s *countMinSketch) string {
+			copies = append(copies, &countMinSketch{
+				counters: append([]uint64(nil), s.counters...),
+				width:    s.width,
+				depth:    s.depth,
+				count:    s.count,
+			})
+			return ""
+		})
+		if reply != "" {
+			return reply
+		}
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			reply = respError("CMS: key does not exist")
+			return updateNone
+		}
+		dest, ok := entry.Object.(*countMinSketch)
+		if !ok {
+			reply = errWrongType
+			return updateNone
+		}
+		for _, s := range copies {
+			if s.width != dest.width || s.depth != dest.depth {
+				reply = respError("CMS: width/depth is not equal")
+				return updateNone
+			}
+		}
+
+		// Weighted sums may be negative along the way, clamp only the result
+		for i := range dest.counters {
+			var sum int64
+			for j, s := range copies {
+				sum += weights[j] * int64(min(s.counters[i], math.MaxInt64))
+			}
+			dest.counters[i] = uint64(max(sum, 0))
+		}
+		var total int64
+		for j, s := range copies {
+			total += weights[j] * int64(min(s.count, math.MaxInt64))
+		}
+		dest.count = uint64(max(total, 0))
+
+		reply = respOK()
+		return updateStore
+	})
+	return reply
+}
+
+// cmsInfoCommand implements CMS.INFO key
+func cmsInfoCommand(c *Cache, args []string) string {
+	return viewCountMinSketch(c, args[1], func(s *countMinSketch) string {
+		return respArray([]string{
+			respSimple("width"), respInt(int64(s.width)),
+			respSimple("depth"), respInt(int64(s.depth)),
+			respSimple("count"), respInt(int64(min(s.count, math.MaxInt64))),
+		})
+	})
+}
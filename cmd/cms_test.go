@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCMSDimensions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CMS.INITBYDIM", "k", "2000", "5"}, "+OK\r\n"},
+		{[]string{"CMS.INITBYDIM", "k", "0", "5"}, "-ERR CMS: invalid width/depth\r\n"},
+		{[]string{"CMS.INITBYDIM", "k", "5", "-1"}, "-ERR CMS: invalid width/depth\r\n"},
+		{[]string{"CMS.INITBYDIM", "k", "268435457", "1"}, "-ERR CMS: dimensions too large\r\n"},
+		{[]string{"CMS.INITBYDIM", "k", "65536", "65536"}, "-ERR CMS: dimensions too large\r\n"},
+		// The product wraps around to 0 in 64 bits
+		{[]string{"CMS.INITBYDIM", "k", "4294967296", "4294967296"}, "-ERR CMS: dimensions too large\r\n"},
+		{[]string{"CMS.INITBYDIM", "k", "9223372036854775807", "2"}, "-ERR CMS: dimensions too large\r\n"},
+		{[]string{"CMS.INITBYPROB", "k", "0.001", "0.01"}, "+OK\r\n"},
+		{[]string{"CMS.INITBYPROB", "k", "1e-300", "0.01"}, "-ERR CMS: dimensions too large\r\n"},
+		{[]string{"CMS.INITBYPROB", "k", "0.001", "1e-300"}, "+OK\r\n"},
+		{[]string{"CMS.INITBYPROB", "k", "1e-6", "1e-300"}, "-ERR CMS: dimensions too large\r\n"},
+		{[]string{"CMS.INITBYPROB", "k", "0", "0.5"}, "-ERR CMS: invalid overestimation value\r\n"},
+		{[]string{"CMS.INITBYPROB", "k", "0.01", "1"}, "-ERR CMS: invalid prob value\r\n"},
+	}
+	for _, tt := range tests {
+		c := newTestCache(t)
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
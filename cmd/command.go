@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// commandFunc executes a command against the cache and returns the encoded
+// reply. args[0] holds the upper-cased command name.
+type commandFunc func(c *Cache, args []string) string
+
+// Command flags
+const (
+	flagWrite     = 1 << iota // May modify the keyspace
+	flagReadOnly              // Only reads keys
+	flagDenyOOM               // May use more memory, refused when over maxmemory
+	flagPubSub                // Pub/sub command that does not touch keys
+	flagNoScript              // Not allowed from scripts
+	flagExclusive             // Runs while no other command runs, like EXEC
+	flagNoGate                // Runs without the shard gates so it gets through while a script runs
+	flagAdmin                 // Administrative command, in the @admin ACL category
+	flagNoMulti               // Not allowed inside MULTI
+)
+
+// command describes a single entry of the command table
+type command struct {
+	name    string
+	arity   int // Exact argument count including the name, or -N for at least N
+	flags   int
+	handler commandFunc
+}
+
+// commandTable holds every command that is not handled inline by
+// handleConnection. Entries are added from init functions.
+var commandTable = make(map[string]*command)
+
+// connectionCommands describes the commands handled by handleConnection
+// because they change the state of the connection
+var connectionCommands = map[string]*command{
+	"QUIT":         {name: "QUIT", arity: -1},
+	"AUTH":         {name: "AUTH", arity: -2},
+	"ACL":          {name: "ACL", arity: -2},
+	"SUBSCRIBE":    {name: "SUBSCRIBE", arity: -2, flags: flagPubSub},
+	"PSUBSCRIBE":   {name: "PSUBSCRIBE", arity: -2, flags: flagPubSub},
+	"SSUBSCRIBE":   {name: "SSUBSCRIBE", arity: -2, flags: flagPubSub},
+	"UNSUBSCRIBE":  {name: "UNSUBSCRIBE", arity: -1, flags: flagPubSub},
+	"PUNSUBSCRIBE": {name: "PUNSUBSCRIBE", arity: -1, flags: flagPubSub},
+	"SUNSUBSCRIBE": {name: "SUNSUBSCRIBE", arity: -1, flags: flagPubSub},
+	"MULTI":        {name: "MULTI", arity: 1},
+	"EXEC":         {name: "EXEC", arity: 1},
+	"DISCARD":      {name: "DISCARD", arity: 1},
+	"WATCH":        {name: "WATCH", arity: -2},
+	"UNWATCH":      {name: "UNWATCH", arity: 1},
+	"MONITOR":      {name: "MONITOR", arity: 1, flags: flagAdmin},
+}
+
+// lookupCommand finds a command in the command table, the inline commands
+// or the connection commands
+func lookupCommand(name string) (*command, bool) {
+	if cmd, ok := commandTable[name]; ok {
+		return cmd, true
+	}
+	if cmd, ok := inlineCommands[name]; ok {
+		return cmd, true
+	}
+	cmd, ok := connectionCommands[name]
+	return cmd, ok
+}
+
+// registerCommand adds a command to the command table
+func registerCommand(name string, arity, flags int, handler commandFunc) {
+	commandTable[name] = &command{
+		name:    name,
+		arity:   arity,
+		flags:   flags,
+		handler: handler,
+	}
+}
+
+// dispatchCommand looks up args[0] in the command table, checks its arity and
+// runs it
+func dispatchCommand(cache *Cache, args []string) string {
+	cmd, ok := commandTable[args[0]]
+	if !ok {
+		return respError("unknown command '" + args[0] + "'")
+	}
+
+	if reply := checkArity(cmd, args); reply != "" {
+		return reply
+	}
+
+	if cmd.flags&flagDenyOOM != 0 && !cache.ReserveMemory() {
+		return errOOM
+	}
+
+	return cmd.handler(cache, args)
+}
+
+// checkArity returns an error reply if args has the wrong number of
+// arguments for cmd
+func checkArity(cmd *command, args []string) string {
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return respError(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd.name)))
+	}
+	return ""
+}
+
+// splitArgs splits a request line into arguments on whitespace. An argument
+// starting with a double or single quote extends to the matching closing
+// quote and may contain spaces; double quoted arguments also understand the
+// usual backslash escapes. Quotes in the middle of an argument are kept as
+// is, so JSON such as {"a":1} can be sent unquoted.
+func splitArgs(line string) ([]string, bool) {
+	var args []string
+
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+			continue
+		}
+
+		quote := line[i]
+		if quote != '"' && quote != '\'' {
+			start := i
+			for i < len(line) && !strings.ContainsRune(" \t\r\n", rune(line[i])) {
+				i++
+			}
+			args = append(args, line[start:i])
+			continue
+		}
+
+		var b strings.Builder
+		closed := false
+		for i++; i < len(line); i++ {
+			ch := line[i]
+			if ch == quote {
+				closed = true
+				i++
+				break
+			}
+			if ch == '\\' && i+1 < len(line) && (quote == '"' || line[i+1] == '\'') {
+				i++
+				switch line[i] {
+				case 'n':
+					ch = '\n'
+				case 'r':
+					ch = '\r'
+				case 't':
+					ch = '\t'
+				default:
+					ch = line[i]
+				}
+			}
+			b.WriteByte(ch)
+		}
+
+		// The closing quote must be followed by a space or the end of line
+		if !closed || (i < len(line) && !strings.ContainsRune(" \t\r\n", rune(line[i]))) {
+			return nil, false
+		}
+		args = append(args, b.String())
+	}
+
+	return args, true
+}
+
+// Common error messages shared by command handlers
+const (
+	errSyntax     = "syntax error"
+	errNotInteger = "value is not an integer or out of range"
+	errNotFloat   = "value is not a valid float"
+)
+
+// errWrongType is the complete reply for commands run against a key holding
+// another type of value
+const errWrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+// respOK returns the simple string OK reply
+func respOK() string {
+	return "+OK\r\n"
+}
+
+// respSimple encodes a simple string reply
+func respSimple(s string) string {
+	return "+" + s + "\r\n"
+}
+
+// respError encodes an error reply with the generic ERR prefix
+func respError(msg string) string {
+	return "-ERR " + msg + "\r\n"
+}
+
+// respInt encodes an integer reply
+func respInt(n int64) string {
+	return ":" + strconv.FormatInt(n, 10) + "\r\n"
+}
+
+// respBulk encodes a binary-safe bulk string reply
+func respBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// respNil encodes the null bulk string reply
+func respNil() string {
+	return "$-1\r\n"
+}
+
+// respNilArray encodes the null array reply
+func respNilArray() string {
+	return "*-1\r\n"
+}
+
+// respArray encodes an array whose elements are already encoded replies
+func respArray(items []string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		b.WriteString(item)
+	}
+	return b.String()
+}
+
+// getString returns the string value stored at key. errReply is set to a
+// WRONGTYPE error when the key holds a non-string value.
+func getString(c *Cache, key string) (value string, exists bool, errReply string) {
+	entry, exists := c.Lookup(key)
+	if exists && entry.Object != nil {
+		return "", false, errWrongType
+	}
+	return entry.Value, exists, ""
+}
+
+// parseInt parses a signed 64-bit integer argument
+func parseInt(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// parseFloat parses a floating point argument, accepting "inf" and "-inf"
+// but rejecting NaN
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// formatFloat renders a float the way replies expect it: integral values
+// without an exponent, others in their shortest form
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case f == math.Trunc(f) && math.Abs(f) < 1e17:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// normalizeRange converts an inclusive start/end pair, where negative values
+// count back from length, into a range inside [0, length). ok is false when
+// the range is empty.
+func normalizeRange(start, end, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if length == 0 || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the settings of the server. Each one comes from, in order of
+// increasing priority, its default, the config file, a DUSTDB_* environment
+// variable and a command-line flag.
+type Config struct {
+	File                 string // Config file the settings were read from, if any
+	Bind                 string
+	Port                 int
+	WebBind              string
+	WebPort              int
+	ShardCount           int
+	EvictionCheckPeriod  time.Duration
+	ShutdownTimeout      time.Duration
+	MaxClients           int
+	ReadBufferSize       int
+	WriteBufferSize      int
+	MaxMemory            int64
+	MaxMemoryPolicy      EvictionPolicy
+	MaxMemoryAdmission   bool // W-TinyLFU admission filter in front of the policy
+	PubSubOutputLimit    int64
+	NotifyKeyspaceEvents int
+	FunctionsFile        string
+	ACLFile              string
+	RequirePass          string
+	TLS                  TLSOptions
+	LogLevel             int
+	LogFile              string
+	SlowlogSlowerThan    int // Microseconds, -1 disables the slowlog
+	SlowlogMaxLen        int
+	LatencyThreshold     int // Milliseconds, 0 disables the latency monitor
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                8989,
+		WebPort:             9090,
+		ShardCount:          1024,
+		EvictionCheckPeriod: 5 * time.Second,
+		ShutdownTimeout:     10 * time.Second,
+		MaxClients:          500000,
+		ReadBufferSize:      4 * 1024,
+		WriteBufferSize:     4 * 1024,
+		MaxMemoryPolicy:     PolicyNoEviction,
+		PubSubOutputLimit:   32 << 20,
+		TLS:                 TLSOptions{AuthClients: "no"},
+		LogLevel:            logNotice,
+		SlowlogSlowerThan:   10000,
+		SlowlogMaxLen:       128,
+	}
+}
+
+// configOption is a setting that can be given in the config file, the
+// environment and on the command line. Options with an apply function can
+// also be changed with CONFIG SET while the server runs.
+type configOption struct {
+	name  string
+	usage string
+	set   func(cfg *Config, value string) error
+	get   func(cfg *Config) string
+	apply func(c *Cache, cfg *Config)
+}
+
+// onSet makes the option changeable at runtime, apply puts its value into
+// effect
+func (o *configOption) onSet(apply func(c *Cache, cfg *Config)) *configOption {
+	o.apply = apply
+	return o
+}
+
+// envName returns the environment variable that overrides the option
+func (o *configOption) envName() string {
+	return "DUSTDB_" + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+func stringOption(name, usage string, field func(cfg *Config) *string) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set:   func(cfg *Config, value string) error { *field(cfg) = value; return nil },
+		get:   func(cfg *Config) string { return *field(cfg) },
+	}
+}
+
+func intOption(name, usage string, lo, hi int, field func(cfg *Config) *int) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < lo || n > hi {
+				return fmt.Errorf("must be an integer from %d to %d", lo, hi)
+			}
+			*field(cfg) = n
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.Itoa(*field(cfg)) },
+	}
+}
+
+func sizeOption(name, usage string, lo int64, field func(cfg *Config) *int64) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			n, ok := parseMemorySize(value)
+			if !ok || n < lo {
+				return fmt.Errorf("must be a size of at least %d bytes such as 4kb, 512mb or 2gb", lo)
+			}
+			*field(cfg) = n
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.FormatInt(*field(cfg), 10) },
+	}
+}
+
+// bufferOption is an option for the size of a connection buffer
+func bufferOption(name, usage string, field func(cfg *Config) *int) *configOption {
+	return &configOption{
+		name:  name,
+		usage: usage,
+		set: func(cfg *Config, value string) error {
+			n, ok := parseMemorySize(value)
+			if !ok || n < 512 || n > 64<<20 {
+				return errors.New("must be a size from 512 bytes to 64mb such as 16kb")
+			}
+			*field(cfg) = int(n)
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.Itoa(*field(cfg)) },
+	}
+}
+
+// configOptions lists every option in the order CONFIG GET and the usage
+// message show them
+var configOptions = []*configOption{
+	stringOption("bind", "address the TCP server listens on, empty for all interfaces",
+		func(cfg *Config) *string { return &cfg.Bind }),
+	intOption("port", "port of the TCP server", 1, 65535,
+		func(cfg *Config) *int { return &cfg.Port }),
+	stringOption("web-bind", "address the web server listens on, empty for all interfaces",
+		func(cfg *Config) *string { return &cfg.WebBind }),
+	intOption("web-port", "port of the web server", 1, 65535,
+		func(cfg *Config) *int { return &cfg.WebPort }),
+	{
+		name:  "shard-count",
+		usage: "number of shards the keyspace is split into, a power of two",
+		set: func(cfg *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 1<<16 || n&(n-1) != 0 {
+				return errors.New("must be a power of two from 1 to 65536")
+			}
+			cfg.ShardCount = n
+			return nil
+		},
+		get: func(cfg *Config) string { return strconv.Itoa(cfg.ShardCount) },
+	},
+	{
+		name:  "eviction-check-period",
+		usage: "longest the expiry worker sleeps, such as 5s or 500ms",
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < time.Millisecond {
+				return errors.New("must be a duration of at least 1ms such as 5s or 500ms")
+			}
+			cfg.EvictionCheckPeriod = d
+			return nil
+		},
+		get: func(cfg *Config) string { return cfg.EvictionCheckPeriod.String() },
+	},
+	{
+		name:  "shutdown-timeout",
+		usage: "longest a shutdown waits for clients to finish their commands, such as 10s",
+		set: func(cfg *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return errors.New("must be a duration such as 10s or 500ms")
+			}
+			cfg.ShutdownTimeout = d
+			return nil
+		},
+		get: func(cfg *Config) string { return cfg.ShutdownTimeout.String() },
+	},
+	intOption("maxclients", "maximum number of concurrent TCP connections", 1, 10000000,
+		func(cfg *Config) *int { return &cfg.MaxClients }).onSet(func(c *Cache, cfg *Config) {
+		atomic.StoreInt64(&MaxConcurrentConns, int64(cfg.MaxClients))
+	}),
+	bufferOption("tcp-read-buffer", "read buffer of a TCP connection",
+		func(cfg *Config) *int { return &cfg.ReadBufferSize }),
+	bufferOption("tcp-write-buffer", "socket send buffer of a TCP connection",
+		func(cfg *Config) *int { return &cfg.WriteBufferSize }),
+	sizeOption("maxmemory", "memory limit such as 512mb, 0 disables it", 0,
+		func(cfg *Config) *int64 { return &cfg.MaxMemory }).onSet(applyMaxMemory),
+	{
+		name:  "maxmemory-policy",
+		usage: "keys evicted when maxmemory is reached",
+		set: func(cfg *Config, value string) error {
+			policy, ok := ParseEvictionPolicy(value)
+			if !ok {
+				return fmt.Errorf("must be one of %s", strings.Join(evictionPolicyNames, ", "))
+			}
+			cfg.MaxMemoryPolicy = policy
+			return nil
+		},
+		get:   func(cfg *Config) string { return cfg.MaxMemoryPolicy.String() },
+		apply: applyMaxMemory,
+	},
+	{
+		name:  "maxmemory-admission",
+		usage: "admission filter in front of the eviction policy, none or tinylfu",
+		set: func(cfg *Config, value string) error {
+			switch strings.ToLower(value) {
+			case "none":
+				cfg.MaxMemoryAdmission = false
+			case "tinylfu":
+				cfg.MaxMemoryAdmission = true
+			default:
+				return errors.New("must be none or tinylfu")
+			}
+			return nil
+		},
+		get:   func(cfg *Config) string { return admissionName(cfg.MaxMemoryAdmission) },
+		apply: func(c *Cache, cfg *Config) { c.SetAdmission(cfg.MaxMemoryAdmission) },
+	},
+	sizeOption("pubsub-output-limit", "output buffer of a subscriber before it is disconnected", 1,
+		func(cfg *Config) *int64 { return &cfg.PubSubOutputLimit }).onSet(func(c *Cache, cfg *Config) {
+		SetPubSubOutputLimit(cfg.PubSubOutputLimit)
+	}),
+	{
+		name:  "notify-keyspace-events",
+		usage: "keyspace events to publish such as KEA, empty disables them",
+		set: func(cfg *Config, value string) error {
+			flags, ok := parseNotifyFlags(value)
+			if !ok {
+				return errors.New("must be keyspace event classes such as KEA or Ex")
+			}
+			cfg.NotifyKeyspaceEvents = flags
+			return nil
+		},
+		get:   func(cfg *Config) string { return formatNotifyFlags(cfg.NotifyKeyspaceEvents) },
+		apply: func(c *Cache, cfg *Config) { c.SetNotifyFlags(cfg.NotifyKeyspaceEvents) },
+	},
+	stringOption("functions-file", "file that FUNCTION LOAD libraries are kept in, empty disables it",
+		func(cfg *Config) *string { return &cfg.FunctionsFile }),
+	stringOption("aclfile", "file with the ACL users, one \"user <name> <rules...>\" line each",
+		func(cfg *Config) *string { return &cfg.ACLFile }),
+	stringOption("requirepass", "password of the default user, empty lets clients in without AUTH",
+		func(cfg *Config) *string { return &cfg.RequirePass }).onSet(func(c *Cache, cfg *Config) {
+		c.SetRequirePass(cfg.RequirePass)
+	}),
+	stringOption("tls-cert-file", "certificate in PEM, enables TLS on both servers together with tls-key-file",
+		func(cfg *Config) *string { return &cfg.TLS.CertFile }),
+	stringOption("tls-key-file", "private key of tls-cert-file in PEM",
+		func(cfg *Config) *string { return &cfg.TLS.KeyFile }),
+	stringOption("tls-ca-cert-file", "CA certificates in PEM that client certificates are verified against",
+		func(cfg *Config) *string { return &cfg.TLS.CACertFile }),
+	{
+		name:  "tls-auth-clients",
+		usage: "whether clients must present a certificate: no, optional or yes",
+		set: func(cfg *Config, value string) error {
+			value = strings.ToLower(value)
+			if value != "no" && value != "optional" && value != "yes" {
+				return errors.New("must be no, optional or yes")
+			}
+			cfg.TLS.AuthClients = value
+			return nil
+		},
+		get: func(cfg *Config) string { return cfg.TLS.AuthClients },
+	},
+	{
+		name:  "loglevel",
+		usage: "least severe messages that are logged: debug, verbose, notice or warning",
+		set: func(cfg *Config, value string) error {
+			level, ok := parseLogLevel(value)
+			if !ok {
+				return errors.New("must be debug, verbose, notice or warning")
+			}
+			cfg.LogLevel = level
+			return nil
+		},
+		get:   func(cfg *Config) string { return logLevelNames[cfg.LogLevel] },
+		apply: func(c *Cache, cfg *Config) { logLevel.Store(int32(cfg.LogLevel)) },
+	},
+	stringOption("logfile", "file the log is appended to, empty for stderr",
+		func(cfg *Config) *string { return &cfg.LogFile }),
+	intOption("slowlog-log-slower-than", "microseconds a command must take to enter the slowlog, -1 disables it", -1, 1<<30,
+		func(cfg *Config) *int { return &cfg.SlowlogSlowerThan }).onSet(applySlowlog),
+	intOption("slowlog-max-len", "number of entries the slowlog keeps", 0, 1<<20,
+		func(cfg *Config) *int { return &cfg.SlowlogMaxLen }).onSet(applySlowlog),
+	intOption("latency-monitor-threshold", "milliseconds an event must take to be recorded by LATENCY, 0 disables it", 0, 1<<30,
+		func(cfg *Config) *int { return &cfg.LatencyThreshold }).onSet(func(c *Cache, cfg *Config) {
+		c.latency.threshold.Store(int64(cfg.LatencyThreshold))
+	}),
+}
+
+func applyMaxMemory(c *Cache, cfg *Config) {
+	c.SetMaxMemory(cfg.MaxMemory, cfg.MaxMemoryPolicy)
+}
+
+func applySlowlog(c *Cache, cfg *Config) {
+	c.slowlog.configure(int64(cfg.SlowlogSlowerThan), cfg.SlowlogMaxLen)
+}
+
+// lookupConfigOption finds an option by name, ignoring case
+func lookupConfigOption(name string) *configOption {
+	for _, opt := range configOptions {
+		if strings.EqualFold(opt.name, name) {
+			return opt
+		}
+	}
+	return nil
+}
+
+// configFlag is the command-line flag of an option. Values are checked as
+// they are parsed and applied after the config file and the environment.
+type configFlag struct {
+	opt   *configOption
+	value string
+	set   bool
+}
+
+func (f *configFlag) String() string {
+	if f.opt == nil {
+		return ""
+	}
+	return f.opt.get(DefaultConfig())
+}
+
+func (f *configFlag) Set(value string) error {
+	if err := f.opt.set(DefaultConfig(), value); err != nil {
+		return err
+	}
+	f.value, f.set = value, true
+	return nil
+}
+
+// LoadConfig builds the configuration from the config file given by
+// -config or DUSTDB_CONFIG, the environment and the command-line flags in
+// args, and checks that the settings fit together
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("dustdb", flag.ExitOnError)
+	file := fs.String("config", os.Getenv("DUSTDB_CONFIG"), "config file with one \"option value\" line per setting (env DUSTDB_CONFIG)")
+	flags := make([]*configFlag, len(configOptions))
+	for i, opt := range configOptions {
+		flags[i] = &configFlag{opt: opt}
+		fs.Var(flags[i], opt.name, opt.usage+" (env "+opt.envName()+")")
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg := DefaultConfig()
+	if *file != "" {
+		if err := cfg.loadFile(*file); err != nil {
+			return nil, err
+		}
+		cfg.File = *file
+	}
+	for _, opt := range configOptions {
+		if value, ok := os.LookupEnv(opt.envName()); ok {
+			if err := opt.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("environment %s=%q: %v", opt.envName(), value, err)
+			}
+		}
+	}
+	for _, f := range flags {
+		if f.set {
+			f.opt.set(cfg, f.value)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads a config file. Every line holds an option name and its
+// value, which may be quoted like command arguments. Blank lines and lines
+// starting with # are skipped.
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		args, ok := splitArgs(line)
+		if !ok || len(args) > 2 {
+			return fmt.Errorf("%s:%d: expected an option and one value, quote values with spaces", path, n)
+		}
+		opt := lookupConfigOption(args[0])
+		if opt == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", path, n, args[0])
+		}
+		value := ""
+		if len(args) == 2 {
+			value = args[1]
+		}
+		if err := opt.set(cfg, value); err != nil {
+			return fmt.Errorf("%s:%d: %s %q: %v", path, n, opt.name, value, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// validate checks the settings that depend on each other
+func (cfg *Config) validate() error {
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errors.New("TLS needs both tls-cert-file and tls-key-file")
+	}
+	if cfg.TLS.AuthClients != "no" && cfg.TLS.CACertFile == "" {
+		return fmt.Errorf("tls-auth-clients %s needs tls-ca-cert-file", cfg.TLS.AuthClients)
+	}
+	if cfg.ACLFile != "" && cfg.RequirePass != "" {
+		return errors.New("requirepass cannot be used with aclfile, set a password for the default user in the ACL file instead")
+	}
+	if cfg.Bind == cfg.WebBind && cfg.Port == cfg.WebPort {
+		return fmt.Errorf("port and web-port are both %d", cfg.Port)
+	}
+	return nil
+}
+
+// ApplyConfig puts the runtime settings of cfg into effect and keeps cfg
+// for CONFIG GET, SET and REWRITE
+func (c *Cache) ApplyConfig(cfg *Config) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+	c.config = cfg
+	for _, opt := range configOptions {
+		if opt.apply != nil {
+			opt.apply(c, cfg)
+		}
+	}
+}
+
+// configGet implements CONFIG GET pattern [pattern ...]
+func (c *Cache) configGet(patterns []string) string {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	var items []string
+	for _, opt := range configOptions {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern), opt.name) {
+				items = append(items, respBulk(opt.name), respBulk(opt.get(c.config)))
+				break
+			}
+		}
+	}
+	return respArray(items)
+}
+
+// configSet implements CONFIG SET option value [option value ...]. All
+// values are checked before any of them is applied, so either every option
+// changes or none does.
+func (c *Cache) configSet(args []string) string {
+	if len(args)%2 != 0 {
+		return respError("wrong number of arguments for 'config|set' command")
+	}
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	updated := *c.config
+	var changed []*configOption
+	for i := 0; i < len(args); i += 2 {
+		opt := lookupConfigOption(args[i])
+		switch {
+		case opt == nil:
+			return respError("Unknown option or number of arguments for CONFIG SET - '" + args[i] + "'")
+		case opt.apply == nil:
+			return respError("CONFIG SET failed (possibly related to argument '" + opt.name + "') - can't set immutable config")
+		case containsOption(changed, opt):
+			return respError("CONFIG SET failed (possibly related to argument '" + opt.name + "') - duplicate parameter")
+		}
+		if err := opt.set(&updated, args[i+1]); err != nil {
+			return respError("CONFIG SET failed (possibly related to argument '" + opt.name + "') - " + err.Error())
+		}
+		changed = append(changed, opt)
+	}
+	if err := updated.validate(); err != nil {
+		return respError("CONFIG SET failed - " + err.Error())
+	}
+
+	*c.config = updated
+	for _, opt := range changed {
+		opt.apply(c, c.config)
+	}
+	return respOK()
+}
+
+func containsOption(options []*configOption, opt *configOption) bool {
+	for _, o := range options {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteConfigValue quotes a value for the config file if splitArgs would not
+// read it back as a single argument
+func quoteConfigValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\r\n\"'\\") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// configRewrite implements CONFIG REWRITE. Lines of the config file that
+// set an option get its current value, options that differ from their
+// default and are missing from the file are appended, and comments, blank
+// lines and lines that cannot be parsed are kept.
+func (c *Cache) configRewrite() string {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	path := c.config.File
+	if path == "" {
+		return respError("The server is running without a config file")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return respError("Rewriting config file: " + err.Error())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return respError("Rewriting config file: " + err.Error())
+	}
+
+	written := make(map[*configOption]bool)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			lines = append(lines, line)
+			continue
+		}
+		args, ok := splitArgs(trimmed)
+		if !ok || len(args) == 0 {
+			lines = append(lines, line)
+			continue
+		}
+		opt := lookupConfigOption(args[0])
+		if opt == nil || written[opt] {
+			continue
+		}
+		written[opt] = true
+		lines = append(lines, opt.name+" "+quoteConfigValue(opt.get(c.config)))
+	}
+	defaults := DefaultConfig()
+	for _, opt := range configOptions {
+		if !written[opt] && opt.get(c.config) != opt.get(defaults) {
+			lines = append(lines, opt.name+" "+quoteConfigValue(opt.get(c.config)))
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*")
+	if err != nil {
+		return respError("Rewriting config file: " + err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	// The new file replaces the old one, so it takes over its permissions
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return respError("Rewriting config file: " + err.Error())
+	}
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return respError("Rewriting config file: " + err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return respError("Rewriting config file: " + err.Error())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return respError("Rewriting config file: " + err.Error())
+	}
+	logf(logNotice, "CONFIG REWRITE executed with success")
+	return respOK()
+}
+
+// configCommand implements CONFIG GET, CONFIG SET and CONFIG REWRITE
+func configCommand(c *Cache, args []string) string {
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "GET" && len(args) > 2:
+		return c.configGet(args[2:])
+	case sub == "SET" && len(args) > 3:
+		return c.configSet(args[2:])
+	case sub == "REWRITE" && len(args) == 2:
+		return c.configRewrite()
+	case sub == "GET" || sub == "SET" || sub == "REWRITE":
+		return respError("wrong number of arguments for 'config|" + strings.ToLower(sub) + "' command")
+	}
+	return respError("unknown subcommand '" + args[1] + "' for 'config' command")
+}
+
+func init() {
+	registerCommand("CONFIG", -2, flagAdmin|flagNoScript, configCommand)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigGetSet(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CONFIG", "GET", "maxmemory"}, "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n"},
+		{[]string{"CONFIG", "SET", "maxmemory", "1mb", "maxmemory-policy", "allkeys-lru"}, "+OK\r\n"},
+		{[]string{"CONFIG", "GET", "maxmemory*"}, "*6\r\n$9\r\nmaxmemory\r\n$7\r\n1048576\r\n$16\r\nmaxmemory-policy\r\n$11\r\nallkeys-lru\r\n$19\r\nmaxmemory-admission\r\n$4\r\nnone\r\n"},
+		{[]string{"CONFIG", "SET", "maxmemory", "2mb", "maxmemory-policy", "nope"}, "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-policy') - "},
+		{[]string{"CONFIG", "GET", "maxmemory"}, "*2\r\n$9\r\nmaxmemory\r\n$7\r\n1048576\r\n"},
+		{[]string{"CONFIG", "SET", "port", "1"}, "-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config\r\n"},
+		{[]string{"CONFIG", "SET", "nope", "1"}, "-ERR Unknown option or number of arguments for CONFIG SET - 'nope'\r\n"},
+		{[]string{"CONFIG", "SET", "maxmemory", "1", "maxmemory", "2"}, "-ERR CONFIG SET failed (possibly related to argument 'maxmemory') - duplicate parameter\r\n"},
+		{[]string{"CONFIG", "SET", "maxmemory"}, "-ERR wrong number of arguments for 'config|set' command\r\n"},
+		{[]string{"CONFIG", "REWRITE"}, "-ERR The server is running without a config file\r\n"},
+	}
+	for _, tt := range tests {
+		got := executeCommand(c, tt.args)
+		if len(got) < len(tt.want) || got[:len(tt.want)] != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if limit, policy := c.MaxMemory(); limit != 1<<20 || policy != PolicyAllKeysLRU {
+		t.Fatalf("maxmemory is %d %v, want 1048576 allkeys-lru", limit, policy)
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dustdb.conf")
+	original := "# settings\n" +
+		"maxmemory 100\n" +
+		"\n" +
+		"slowlog-max-len \"unterminated\n" +
+		"maxmemory 200\n" +
+		"port 7000\n"
+	if err := os.WriteFile(path, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.File = path
+	cfg.Port = 7000
+	c := newTestCache(t)
+	c.ApplyConfig(cfg)
+
+	executeCommand(c, []string{"CONFIG", "SET", "maxmemory", "1000", "slowlog-log-slower-than", "5"})
+	if got := executeCommand(c, []string{"CONFIG", "REWRITE"}); got != respOK() {
+		t.Fatalf("CONFIG REWRITE = %q", got)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# settings\n" +
+		"maxmemory 1000\n" +
+		"\n" +
+		"slowlog-max-len \"unterminated\n" +
+		"port 7000\n" +
+		"slowlog-log-slower-than 5\n"
+	if string(data) != want {
+		t.Fatalf("rewritten file:\n%s\nwant:\n%s", data, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Fatalf("rewritten file has mode %v, want 0644", info.Mode().Perm())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dustdb.conf")
+	data := "# settings\n" +
+		"port 7000\n" +
+		"maxmemory 1mb\n" +
+		"loglevel warning\n" +
+		"requirepass \"two words\"\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DUSTDB_CONFIG", path)
+	t.Setenv("DUSTDB_PORT", "7001")
+	t.Setenv("DUSTDB_MAXMEMORY", "2mb")
+
+	cfg, err := LoadConfig([]string{"-port", "7002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != path {
+		t.Errorf("File = %q, want %q", cfg.File, path)
+	}
+	if cfg.Port != 7002 {
+		t.Errorf("port = %d, want the flag's 7002", cfg.Port)
+	}
+	if cfg.MaxMemory != 2<<20 {
+		t.Errorf("maxmemory = %d, want the environment's %d", cfg.MaxMemory, 2<<20)
+	}
+	if cfg.LogLevel != logWarning || cfg.RequirePass != "two words" {
+		t.Errorf("loglevel = %d and requirepass = %q, want the file's", cfg.LogLevel, cfg.RequirePass)
+	}
+	if cfg.WebPort != DefaultConfig().WebPort {
+		t.Errorf("web-port = %d, want the default %d", cfg.WebPort, DefaultConfig().WebPort)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"nope 1\n", nil, nil, `:1: unknown option "nope"`},
+		{"# comment\nport 0\n", nil, nil, `:2: port "0": must be an integer from 1 to 65535`},
+		{"port 1 2\n", nil, nil, ":1: expected an option and one value, quote values with spaces"},
+		{"", map[string]string{"DUSTDB_SHARD_COUNT": "3"}, nil, `environment DUSTDB_SHARD_COUNT="3": must be a power of two from 1 to 65536`},
+		{"", nil, []string{"extra"}, `unexpected argument "extra"`},
+		{"tls-cert-file a.crt\n", nil, nil, "TLS needs both tls-cert-file and tls-key-file"},
+		{"tls-auth-clients optional\n", nil, nil, "tls-auth-clients optional needs tls-ca-cert-file"},
+		{"aclfile users.acl\nrequirepass secret\n", nil, nil, "requirepass cannot be used with aclfile"},
+		{"web-port 8989\n", nil, nil, "port and web-port are both 8989"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "dustdb.conf")
+		if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Run(tt.want, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := LoadConfig(append([]string{"-config", path}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("LoadConfig = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadConfig([]string{"-config", filepath.Join(dir, "missing.conf")}); err == nil || !strings.HasPrefix(err.Error(), "reading config file: ") {
+		t.Fatalf("LoadConfig with a missing file = %v", err)
+	}
+}
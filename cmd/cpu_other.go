@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuTimes returns the system and user CPU time used by the process, which
+// is not available on this platform
+func cpuTimes() (sys, user time.Duration) {
+	return 0, 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTimes returns the system and user CPU time used by the process
+func cpuTimes() (sys, user time.Duration) {
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Stime.Nano()), time.Duration(usage.Utime.Nano())
+}
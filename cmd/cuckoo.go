@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"strings"
+)
+
+// Defaults for cuckoo filters created implicitly by CF.ADD and CF.ADDNX
+const (
+	CuckooDefaultCapacity      = 1024
+	CuckooDefaultBucketSize    = 2
+	CuckooDefaultMaxIterations = 20
+	CuckooDefaultExpansion     = 1
+)
+
+func init() {
+	registerCommand("CF.RESERVE", -3, flagWrite|flagDenyOOM, cfReserveCommand)
+	registerCommand("CF.ADD", 3, flagWrite|flagDenyOOM, cfAddCommand)
+	registerCommand("CF.ADDNX", 3, flagWrite|flagDenyOOM, cfAddCommand)
+	registerCommand("CF.EXISTS", 3, flagReadOnly, cfExistsCommand)
+	registerCommand("CF.MEXISTS", -3, flagReadOnly, cfExistsCommand)
+	registerCommand("CF.DEL", 3, flagWrite, cfDelCommand)
+	registerCommand("CF.COUNT", 3, flagReadOnly, cfCountCommand)
+}
+
+// cuckooTable stores 8-bit fingerprints in buckets of a fixed number of
+// slots. A fingerprint of zero marks an empty slot.
+type cuckooTable struct {
+	slots      []byte
+	numBuckets uint64 // Power of two
+	bucketSize uint64
+}
+
+// newCuckooTable allocates a table large enough for capacity fingerprints
+func newCuckooTable(capacity, bucketSize uint64) *cuckooTable {
+	numBuckets := max((capacity+bucketSize-1)/bucketSize, 1)
+	numBuckets = 1 << bits.Len64(numBuckets-1)
+	return &cuckooTable{
+		slots:      make([]byte, numBuckets*bucketSize),
+		numBuckets: numBuckets,
+		bucketSize: bucketSize,
+	}
+}
+
+// bucket returns the slots of bucket i
+func (t *cuckooTable) bucket(i uint64) []byte {
+	return t.slots[i*t.bucketSize : (i+1)*t.bucketSize]
+}
+
+// altIndex returns the other bucket a fingerprint may live in. Applying it
+// twice gives back the original index.
+func (t *cuckooTable) altIndex(i uint64, fp byte) uint64 {
+	return (i ^ murmurHash64A([]byte{fp}, 0)) & (t.numBuckets - 1)
+}
+
+// place stores fp in a free slot of bucket i
+func (t *cuckooTable) place(i uint64, fp byte) bool {
+	b := t.bucket(i)
+	for j := range b {
+		if b[j] == 0 {
+			b[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// insert adds fp, evicting and relocating other fingerprints for up to
+// maxIterations moves. If no free slot turns up the moves are undone so that
+// no fingerprint is lost.
+func (t *cuckooTable) insert(hash uint64, fp byte, maxIterations int) bool {
+	i1 := hash & (t.numBuckets - 1)
+	i2 := t.altIndex(i1, fp)
+	if t.place(i1, fp) || t.place(i2, fp) {
+		return true
+	}
+
+	type move struct {
+		bucket uint64
+		slot   int
+	}
+	path := make([]move, 0, maxIterations)
+
+	i := i1
+	if rand.IntN(2) == 1 {
+		i = i2
+	}
+	for n := 0; n < maxIterations; n++ {
+		b := t.bucket(i)
+		j := rand.IntN(len(b))
+		fp, b[j] = b[j], fp
+		path = append(path, move{bucket: i, slot: j})
+		i = t.altIndex(i, fp)
+		if t.place(i, fp) {
+			return true
+		}
+	}
+
+	for k := len(path) - 1; k >= 0; k-- {
+		b := t.bucket(path[k].bucket)
+		fp, b[path[k].slot] = b[path[k].slot], fp
+	}
+	return false
+}
+
+// count returns the number of copies of fp in its two buckets
+func (t *cuckooTable) count(hash uint64, fp byte) int {
+	i1 := hash & (t.numBuckets - 1)
+	i2 := t.altIndex(i1, fp)
+	n := 0
+	for _, slot := range t.bucket(i1) {
+		if slot == fp {
+			n++
+		}
+	}
+	if i2 != i1 {
+		for _, slot := range t.bucket(i2) {
+			if slot == fp {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// remove deletes one copy of fp
+func (t *cuckooTable) remove(hash uint64, fp byte) bool {
+	i1 := hash & (t.numBuckets - 1)
+	for _, i := range []uint64{i1, t.altIndex(i1, fp)} {
+		b := t.bucket(i)
+		for j := range b {
+			if b[j] == fp {
+				b[j] = 0
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cuckooFilter is a set of cuckoo tables. Unlike a bloom filter it supports
+// deletion. When the newest table cannot take another fingerprint a larger
+// one is added.
+type cuckooFilter struct {
+	tables        []*cuckooTable
+	capacity      uint64
+	bucketSize    uint64
+	maxIterations int
+	expansion     uint64
+	items         uint64
+	deletes       uint64
+}
+
+// newCuckooFilter creates a filter with a single table
+func newCuckooFilter(capacity, bucketSize uint64, maxIterations int, expansion uint64) *cuckooFilter {
+	return &cuckooFilter{
+		tables:        []*cuckooTable{newCuckooTable(capacity, bucketSize)},
+		capacity:      capacity,
+		bucketSize:    bucketSize,
+		maxIterations: maxIterations,
+		expansion:     expansion,
+	}
+}
+
+// Type implements Object
+func (f *cuckooFilter) Type() string {
+	return "cuckoo"
+}
+
+// String implements Object
+func (f *cuckooFilter) String() string {
+	return fmt.Sprintf("cuckoo filter: %d items, %d tables, %d deleted", f.items, len(f.tables), f.deletes)
+}
+
+// MemoryUsage implements memoryUser
+func (f *cuckooFilter) MemoryUsage() int64 {
+	var size int64
+	for _, t := range f.tables {
+		size += int64(len(t.slots)) + 48
+	}
+	return size
+}
+
+// cuckooHash returns the bucket hash and the non-zero fingerprint of item
+func cuckooHash(item string) (uint64, byte) {
+	hash := murmurHash64A([]byte(item), 0x5bd1e995)
+	return hash, byte(hash>>56)%255 + 1
+}
+
+// Count returns how many times item may have been added
+func (f *cuckooFilter) Count(item string) int {
+	hash, fp := cuckooHash(item)
+	n := 0
+	for _, t := range f.tables {
+		n += t.count(hash, fp)
+	}
+	return n
+}
+
+// Add inserts item, growing the filter when the newest table is full. It
+// returns an error when the filter is full and cannot grow.
+func (f *cuckooFilter) Add(item string) error {
+	hash, fp := cuckooHash(item)
+
+	// Deletions may have freed slots in older tables
+	placed := false
+	for _, t := range f.tables[:len(f.tables)-1] {
+		i1 := hash & (t.numBuckets - 1)
+		if t.place(i1, fp) || t.place(t.altIndex(i1, fp), fp) {
+			placed = true
+			break
+		}
+	}
+
+	last := f.tables[len(f.tables)-1]
+	if !placed && !last.insert(hash, fp, f.maxIterations) {
+		if f.expansion == 0 {
+			return fmt.Errorf("filter is full")
+		}
+		last = newCuckooTable(last.numBuckets*last.bucketSize*f.expansion, f.bucketSize)
+		f.tables = append(f.tables, last)
+		last.insert(hash, fp, f.maxIterations)
+	}
+
+	f.items++
+	return nil
+}
+
+// Delete removes one copy of item, newest tables first
+func (f *cuckooFilter) Delete(item string) bool {
+	hash, fp := cuckooHash(item)
+	for i := len(f.tables) - 1; i >= 0; i-- {
+		if f.tables[i].remove(hash, fp) {
+			f.items--
+			f.deletes++
+			return true
+		}
+	}
+	return false
+}
+
+// cfReserveCommand implements CF.RESERVE key capacity [BUCKETSIZE n]
+// [MAXITERATIONS n] [EXPANSION n]
+func cfReserveCommand(c *Cache, args []string) string {
+	capacity, ok := parseInt(args[2])
+	if !ok || capacity <= 0 {
+		return respError("Bad capacity")
+	}
+
+	bucketSize := int64(CuckooDefaultBucketSize)
+	maxIterations := int64(CuckooDefaultMaxIterations)
+	expansion := int64(CuckooDefaultExpansion)
+	for i := 3; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return respError(errSyntax)
+		}
+		n, ok := parseInt(args[i+1])
+		if !ok {
+			return respError(errNotInteger)
+		}
+		switch strings.ToUpper(args[i]) {
+		case "BUCKETSIZE":
+			if n < 1 || n > 255 {
+				return respError("Bad bucket size")
+			}
+			bucketSize = n
+		case "MAXITERATIONS":
+			if n < 1 || n > 65535 {
+				return respError("Bad max iterations")
+			}
+			maxIterations = n
+		case "EXPANSION":
+			if n < 0 || n > 32768 {
+				return respError("Bad expansion")
+			}
+			expansion = n
+		default:
+			return respError(errSyntax)
+		}
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists {
+			reply = respError("item exists")
+			return updateNone
+		}
+		entry.Object = newCuckooFilter(uint64(capacity), uint64(bucketSize), int(maxIterations), uint64(expansion))
+		reply = respOK()
+		return updateStore
+	})
+	return reply
+}
+
+// cfAddCommand implements CF.ADD key item and CF.ADDNX key item
+func cfAddCommand(c *Cache, args []string) string {
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		var f *cuckooFilter
+		if exists {
+			var ok bool
+			if f, ok = entry.Object.(*cuckooFilter); !ok {
+				reply = errWrongType
+				return updateNone
+			}
+		} else {
+			f = newCuckooFilter(CuckooDefaultCapacity, CuckooDefaultBucketSize, CuckooDefaultMaxIterations, CuckooDefaultExpansion)
+			entry.Object = f
+		}
+
+		if args[0] == "CF.ADDNX" && f.Count(args[2]) > 0 {
+			reply = respInt(0)
+			return updateNone
+		}
+		if err := f.Add(args[2]); err != nil {
+			reply = respError(err.Error())
+		} else {
+			reply = respInt(1)
+		}
+		return updateStore
+	})
+	return reply
+}
+
+// viewCuckooFilter runs fn against the filter stored at key under the
+// shard's read lock. f is nil when the key does not exist.
+func viewCuckooFilter(c *Cache, key string, fn func(f *cuckooFilter) string) string {
+	var reply string
+	c.View(key, func(entry CacheEntry, exists bool) {
+		f, ok := entry.Object.(*cuckooFilter)
+		if exists && !ok {
+			reply = errWrongType
+			return
+		}
+		reply = fn(f)
+	})
+	return reply
+}
+
+// cfExistsCommand implements CF.EXISTS key item and CF.MEXISTS key item
+// [item ...]
+func cfExistsCommand(c *Cache, args []string) string {
+	return viewCuckooFilter(c, args[1], func(f *cuckooFilter) string {
+		items := make([]string, 0, len(args)-2)
+		for _, item := range args[2:] {
+			if f != nil && f.Count(item) > 0 {
+				items = append(items, respInt(1))
+			} else {
+				items = append(items, respInt(0))
+			}
+		}
+		if args[0] == "CF.EXISTS" {
+			return items[0]
+		}
+		return respArray(items)
+	})
+}
+
+// cfCountCommand implements CF.COUNT key item
+func cfCountCommand(c *Cache, args []string) string {
+	return viewCuckooFilter(c, args[1], func(f *cuckooFilter) string {
+		if f == nil {
+			return respInt(0)
+		}
+		return respInt(int64(f.Count(args[2])))
+	})
+}
+
+// cfDelCommand implements CF.DEL key item
+func cfDelCommand(c *Cache, args []string) string {
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			reply = respError("Not found")
+			return updateNone
+		}
+		f, ok := entry.Object.(*cuckooFilter)
+		if !ok {
+			reply = errWrongType
+			return updateNone
+		}
+		if !f.Delete(args[2]) {
+			reply = respInt(0)
+			return updateNone
+		}
+		reply = respInt(1)
+		return updateStore
+	})
+	return reply
+}
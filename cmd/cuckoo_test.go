@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCuckooCommands(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "str", "hello"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CF.RESERVE", "cf", "100", "BUCKETSIZE", "4"}, "+OK\r\n"},
+		{[]string{"CF.RESERVE", "cf", "100"}, "-ERR item exists\r\n"},
+		{[]string{"CF.RESERVE", "x", "0"}, "-ERR Bad capacity\r\n"},
+		{[]string{"CF.RESERVE", "x", "100", "BUCKETSIZE", "256"}, "-ERR Bad bucket size\r\n"},
+		{[]string{"CF.RESERVE", "x", "100", "MAXITERATIONS", "0"}, "-ERR Bad max iterations\r\n"},
+		{[]string{"CF.RESERVE", "x", "100", "EXPANSION", "-1"}, "-ERR Bad expansion\r\n"},
+		{[]string{"CF.RESERVE", "x", "100", "EXPANSION"}, "-ERR syntax error\r\n"},
+		{[]string{"CF.ADD", "cf", "a"}, ":1\r\n"},
+		{[]string{"CF.ADD", "cf", "a"}, ":1\r\n"},
+		{[]string{"CF.ADDNX", "cf", "a"}, ":0\r\n"},
+		{[]string{"CF.ADDNX", "cf", "b"}, ":1\r\n"},
+		{[]string{"CF.COUNT", "cf", "a"}, ":2\r\n"},
+		{[]string{"CF.MEXISTS", "cf", "a", "b", "c"}, "*3\r\n:1\r\n:1\r\n:0\r\n"},
+		{[]string{"CF.DEL", "cf", "a"}, ":1\r\n"},
+		{[]string{"CF.COUNT", "cf", "a"}, ":1\r\n"},
+		{[]string{"CF.DEL", "cf", "a"}, ":1\r\n"},
+		{[]string{"CF.DEL", "cf", "a"}, ":0\r\n"},
+		{[]string{"CF.EXISTS", "cf", "a"}, ":0\r\n"},
+		{[]string{"CF.DEL", "missing", "a"}, "-ERR Not found\r\n"},
+		{[]string{"CF.COUNT", "missing", "a"}, ":0\r\n"},
+		{[]string{"CF.ADD", "new", "a"}, ":1\r\n"},
+		{[]string{"TYPE", "new"}, "+cuckoo\r\n"},
+		{[]string{"CF.ADD", "str", "a"}, errWrongType},
+		{[]string{"CF.EXISTS", "str", "a"}, errWrongType},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCuckooGrowth(t *testing.T) {
+	f := newCuckooFilter(64, 2, 20, 2)
+	for i := 0; i < 5000; i++ {
+		if err := f.Add("item:" + strconv.Itoa(i)); err != nil {
+			t.Fatalf("Add item:%d: %v", i, err)
+		}
+	}
+	if len(f.tables) < 2 {
+		t.Fatalf("5000 items fit in %d tables", len(f.tables))
+	}
+	for i := 0; i < 5000; i++ {
+		if f.Count("item:"+strconv.Itoa(i)) == 0 {
+			t.Fatalf("item:%d is missing", i)
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		if !f.Delete("item:" + strconv.Itoa(i)) {
+			t.Fatalf("Delete item:%d failed", i)
+		}
+	}
+	if f.items != 0 {
+		t.Fatalf("%d items left after deleting all", f.items)
+	}
+}
+
+// TestCuckooFullKeepsItems fills a filter that cannot grow and checks that a
+// failed insert does not push out fingerprints that were already stored
+func TestCuckooFullKeepsItems(t *testing.T) {
+	f := newCuckooFilter(256, 2, 20, 0)
+	var added []string
+	for i := 0; ; i++ {
+		item := "item:" + strconv.Itoa(i)
+		if err := f.Add(item); err != nil {
+			break
+		}
+		added = append(added, item)
+	}
+	if len(added) < 128 {
+		t.Fatalf("filter of 256 slots was full after %d items", len(added))
+	}
+	for i := 0; i < 100; i++ {
+		f.Add("extra:" + strconv.Itoa(i))
+	}
+	for _, item := range added {
+		if f.Count(item) == 0 {
+			t.Fatalf("%s was lost after the filter filled up", item)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// expiryRetryDelay is how soon the expiry worker comes back to a shard that
+// was in use by a transaction
+const expiryRetryDelay = time.Millisecond
+
+// expiryItem is a scheduled expiration. Items are not removed when their key
+// is deleted or gets another deadline; they are skipped when they come due.
+type expiryItem struct {
+	key string
+	at  int64 // Unix nanoseconds
+}
+
+// expiryHeap is a min-heap of expirations ordered by deadline
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryItem)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// scheduleExpiry records the deadline of key in the shard's heap and wakes
+// the expiry worker if it is the earliest one. The shard's write lock must
+// be held.
+func (c *Cache) scheduleExpiry(shard *CacheShard, key string, at int64) {
+	// Rebuild the heap once stale items dominate it
+	if len(shard.expires) > 2*len(shard.data)+64 {
+		shard.expires = shard.expires[:0]
+		for k, entry := range shard.data {
+			if entry.ExpireAt > 0 && k != key {
+				shard.expires = append(shard.expires, expiryItem{key: k, at: entry.ExpireAt})
+			}
+		}
+		heap.Init(&shard.expires)
+	}
+
+	heap.Push(&shard.expires, expiryItem{key: key, at: at})
+	if at < atomic.LoadInt64(&shard.nextExpiry) {
+		atomic.StoreInt64(&shard.nextExpiry, at)
+		if c.lowerNextExpiry(at) {
+			select {
+			case c.expiryWake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// lowerNextExpiry moves the worker's next wake up to at if that is earlier
+func (c *Cache) lowerNextExpiry(at int64) bool {
+	for {
+		next := atomic.LoadInt64(&c.nextExpiry)
+		if at >= next {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.nextExpiry, next, at) {
+			return true
+		}
+	}
+}
+
+// expiryWorker sleeps until the earliest deadline of all shards and then
+// removes the keys that came due. It wakes up at least every
+// EvictionCheckPeriod.
+func (c *Cache) expiryWorker() {
+	timer := time.NewTimer(EvictionCheckPeriod)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-c.expiryWake:
+		case <-c.shutdownChan:
+			return
+		}
+
+		next := c.expireDue()
+		wait := min(time.Duration(next-time.Now().UnixNano()), EvictionCheckPeriod)
+		timer.Reset(max(wait, 0))
+	}
+}
+
+// expireDue removes every key whose deadline has passed and returns the
+// next deadline. Only shards with due items are locked, so the work is
+// proportional to the number of expiring keys.
+func (c *Cache) expireDue() int64 {
+	start := time.Now()
+	defer func() { c.latency.add(latencyExpireCycle, time.Since(start)) }()
+
+	atomic.StoreInt64(&c.nextExpiry, math.MaxInt64)
+	now := time.Now().UnixNano()
+	next := int64(math.MaxInt64)
+	var expired uint64
+
+	for _, shard := range c.shards {
+		if atomic.LoadInt64(&shard.nextExpiry) > now {
+			next = min(next, atomic.LoadInt64(&shard.nextExpiry))
+			continue
+		}
+
+		// Keys do not expire while a transaction uses their shard. Rather
+		// than wait for it, which would hold up every other shard, the
+		// shard is tried again shortly.
+		if !shard.gate.TryRLock() {
+			next = min(next, now+int64(expiryRetryDelay))
+			continue
+		}
+		shard.mu.Lock()
+		for len(shard.expires) > 0 && shard.expires[0].at <= now {
+			item := heap.Pop(&shard.expires).(expiryItem)
+			if entry, exists := shard.data[item.key]; exists && entry.ExpireAt == item.at {
+				c.removeEntry(shard, item.key)
+				c.notify(notifyExpired, "expired", item.key)
+				expired++
+			}
+		}
+		shardNext := int64(math.MaxInt64)
+		if len(shard.expires) > 0 {
+			shardNext = shard.expires[0].at
+		}
+		atomic.StoreInt64(&shard.nextExpiry, shardNext)
+		shard.mu.Unlock()
+		shard.gate.RUnlock()
+
+		next = min(next, shardNext)
+	}
+
+	if expired > 0 {
+		atomic.AddUint64(&c.stats.Evictions, expired)
+	}
+	c.lowerNextExpiry(next)
+	return atomic.LoadInt64(&c.nextExpiry)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitExpired waits up to a second for the expiry worker to remove key.
+// The shard is checked directly, since reading the key would remove it.
+func waitExpired(c *Cache, key string) bool {
+	shard := c.getShard(key)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		shard.mu.RLock()
+		_, exists := shard.data[key]
+		shard.mu.RUnlock()
+		if !exists {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExpiryAroundHeldGate(t *testing.T) {
+	c := newTestCache(t)
+	// The worker visits the shard whose gate is held first
+	held, other := "held", "other"
+	for i := 0; c.shardIndex(other) <= c.shardIndex(held); i++ {
+		held = "held" + strconv.Itoa(i)
+	}
+
+	gate := &c.getShard(held).gate
+	gate.Lock()
+	c.Set(held, "1", 5*time.Millisecond)
+	c.Set(other, "1", 5*time.Millisecond)
+	if !waitExpired(c, other) {
+		gate.Unlock()
+		t.Fatal("a key on another shard did not expire while a gate was held")
+	}
+	gate.Unlock()
+	if !waitExpired(c, held) {
+		t.Fatal("a key did not expire once its shard's gate was released")
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommand("FCALL", -3, flagExclusive|flagNoScript, fcallCommand)
+	registerCommand("FCALL_RO", -3, flagExclusive|flagNoScript, fcallCommand)
+	registerCommand("FUNCTION", -2, flagNoGate|flagNoScript, functionCommand)
+}
+
+// functionLoadTimeout bounds the time the body of a library may run while
+// it is loaded
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionNamePattern is what library and function names may look like
+var functionNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// functionFlags are the flags a function may be registered with. Only
+// no-writes changes behavior, the others are accepted for compatibility.
+var functionFlags = map[string]bool{
+	"no-writes": true, "allow-oom": true, "allow-stale": true, "no-cluster": true, "allow-cross-slot-keys": true,
+}
+
+// scriptFunction is a function registered by a library
+type scriptFunction struct {
+	name        string
+	description string
+	flags       []string
+	noWrites    bool
+	callback    any
+	library     *functionLibrary
+}
+
+// functionLibrary is a loaded library. Its functions run in the state that
+// executed the library's code, whose globals are read-only after loading.
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*scriptFunction
+	L         *luaState
+}
+
+// functionRegistry holds the loaded libraries and, if a file is set, keeps
+// a copy of their code there so that they survive restarts
+type functionRegistry struct {
+	mu        sync.Mutex
+	libraries map[string]*functionLibrary
+	functions map[string]*scriptFunction
+	file      string
+	saveErr   error     // Result of the last save
+	lastSave  time.Time // Last successful save
+}
+
+// newFunctionRegistry creates an empty registry
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{
+		libraries: make(map[string]*functionLibrary),
+		functions: make(map[string]*scriptFunction),
+	}
+}
+
+// compileLibrary runs the code of a library and collects the functions it
+// registers. The code must start with a "#!lua name=<library>" line.
+func compileLibrary(code string) (*functionLibrary, error) {
+	header, body, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(header, "#!") {
+		return nil, errors.New("Missing library metadata")
+	}
+	fields := strings.Fields(header[2:])
+	if len(fields) == 0 || fields[0] != "lua" {
+		return nil, errors.New("Engine '" + strings.Join(fields[:min(len(fields), 1)], "") + "' not found")
+	}
+	lib := &functionLibrary{code: code, functions: make(map[string]*scriptFunction)}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return nil, errors.New("Invalid metadata value given: " + field)
+		}
+		lib.name = value
+	}
+	if lib.name == "" {
+		return nil, errors.New("Library name was not given")
+	}
+	if !functionNamePattern.MatchString(lib.name) {
+		return nil, errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+
+	// The header line is replaced by an empty one so that line numbers in
+	// errors match the code
+	proto, err := luaCompile("\n" + body)
+	if err != nil {
+		return nil, errors.New("Error compiling function: " + err.Error())
+	}
+
+	L := newLuaState()
+	deadline := time.Now().Add(functionLoadTimeout)
+	L.interrupt = func() error {
+		if time.Now().After(deadline) {
+			return errors.New("FUNCTION LOAD timeout")
+		}
+		return nil
+	}
+	redis := newLuaTable()
+	redis.Register("register_function", func(L *luaState, args []any) ([]any, error) {
+		return nil, lib.register(L, args)
+	})
+	L.globals.Set("redis", redis)
+
+	if _, err := L.Call(&luaClosure{proto: proto}, nil); err != nil {
+		return nil, errors.New("Error registering functions: " + err.Error())
+	}
+	if len(lib.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+	L.interrupt = nil
+	L.readOnly = true
+	lib.L = L
+	return lib, nil
+}
+
+// register implements redis.register_function(name, callback) and
+// redis.register_function{function_name=..., callback=..., flags={...},
+// description=...}
+func (lib *functionLibrary) register(L *luaState, args []any) error {
+	fn := &scriptFunction{library: lib}
+	if t, ok := luaArg(args, 0).(*luaTable); ok && len(args) == 1 {
+		for key, value, _ := t.Next(nil); key != nil; key, value, _ = t.Next(key) {
+			switch key {
+			case "function_name":
+				fn.name, _ = value.(string)
+			case "callback":
+				fn.callback = value
+			case "description":
+				fn.description, _ = value.(string)
+			case "flags":
+				flags, ok := value.(*luaTable)
+				if !ok {
+					return L.runtimeError("flags argument to redis.register_function must be a table representing function flags")
+				}
+				for i := 1; i <= flags.Len(); i++ {
+					flag, _ := flags.Get(float64(i)).(string)
+					if !functionFlags[flag] {
+						return L.runtimeError("unknown flag given")
+					}
+					fn.flags = append(fn.flags, flag)
+					fn.noWrites = fn.noWrites || flag == "no-writes"
+				}
+			default:
+				return L.runtimeError("unknown argument given to redis.register_function")
+			}
+		}
+	} else {
+		if len(args) != 2 {
+			return L.runtimeError("wrong number of arguments to redis.register_function")
+		}
+		fn.name, _ = args[0].(string)
+		fn.callback = args[1]
+	}
+
+	switch fn.callback.(type) {
+	case *luaClosure, *luaGoFunc:
+	default:
+		return L.runtimeError("callback argument given to redis.register_function must be a function")
+	}
+	if !functionNamePattern.MatchString(fn.name) {
+		return L.runtimeError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, exists := lib.functions[fn.name]; exists {
+		return L.runtimeError("Function already exists in the library")
+	}
+	lib.functions[fn.name] = fn
+	return nil
+}
+
+// add installs a compiled library. Without replace an existing library of
+// the same name is an error, and function names may never clash with the
+// functions of other libraries. r.mu must be held.
+func (r *functionRegistry) add(lib *functionLibrary, replace bool) error {
+	old, exists := r.libraries[lib.name]
+	if exists && !replace {
+		return errors.New("Library '" + lib.name + "' already exists")
+	}
+	for name := range lib.functions {
+		if fn, ok := r.functions[name]; ok && fn.library != old {
+			return errors.New("Function " + name + " already exists")
+		}
+	}
+	if exists {
+		r.remove(old)
+	}
+	r.libraries[lib.name] = lib
+	for name, fn := range lib.functions {
+		r.functions[name] = fn
+	}
+	return nil
+}
+
+// remove drops a library and its functions. r.mu must be held.
+func (r *functionRegistry) remove(lib *functionLibrary) {
+	delete(r.libraries, lib.name)
+	for name := range lib.functions {
+		delete(r.functions, name)
+	}
+}
+
+// lookup returns a registered function
+func (r *functionRegistry) lookup(name string) *scriptFunction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.functions[name]
+}
+
+// codes returns the code of every library ordered by name. r.mu must be
+// held.
+func (r *functionRegistry) codes() []string {
+	names := make([]string, 0, len(r.libraries))
+	for name := range r.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	codes := make([]string, len(names))
+	for i, name := range names {
+		codes[i] = r.libraries[name].code
+	}
+	return codes
+}
+
+// restore compiles libraries from their code. In replace mode libraries
+// with taken names are replaced, otherwise they are an error and nothing is
+// installed. r.mu must be held.
+func (r *functionRegistry) restore(codes []string, replace bool) error {
+	libs := make([]*functionLibrary, len(codes))
+	for i, code := range codes {
+		lib, err := compileLibrary(code)
+		if err != nil {
+			return err
+		}
+		if _, exists := r.libraries[lib.name]; exists && !replace {
+			return errors.New("Library " + lib.name + " already exists")
+		}
+		libs[i] = lib
+	}
+
+	prev := r.snapshot()
+	for _, lib := range libs {
+		if err := r.add(lib, replace); err != nil {
+			r.rollback(prev)
+			return err
+		}
+	}
+	return nil
+}
+
+// functionSnapshot is the set of installed libraries at one point.
+// Compiled libraries are never modified, so copying the maps is enough.
+type functionSnapshot struct {
+	libraries map[string]*functionLibrary
+	functions map[string]*scriptFunction
+}
+
+// snapshot records the installed libraries so that a change can be undone.
+// r.mu must be held.
+func (r *functionRegistry) snapshot() functionSnapshot {
+	return functionSnapshot{maps.Clone(r.libraries), maps.Clone(r.functions)}
+}
+
+// rollback reinstalls the libraries of a snapshot. r.mu must be held.
+func (r *functionRegistry) rollback(s functionSnapshot) {
+	r.libraries, r.functions = s.libraries, s.functions
+}
+
+// save writes the code of all libraries to the registry's file. r.mu must
+// be held.
+func (r *functionRegistry) save() error {
+	if r.file == "" {
+		return nil
+	}
+	r.saveErr = r.write()
+	if r.saveErr == nil {
+		r.lastSave = time.Now()
+	}
+	return r.saveErr
+}
+
+// write replaces the registry's file with the code of all libraries
+func (r *functionRegistry) write() error {
+	data, err := json.Marshal(r.codes())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.file), ".functions-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.file)
+}
+
+// LoadFunctions makes path the file that function libraries are kept in
+// and loads the libraries stored there, if it exists
+func (c *Cache) LoadFunctions(path string) error {
+	r := c.functions
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.file = path
+	r.lastSave = time.Now()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var codes []string
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return err
+	}
+	return r.restore(codes, true)
+}
+
+// fcallCommand implements FCALL function numkeys [key ...] [arg ...] and
+// FCALL_RO, which only runs functions flagged no-writes. The callback gets
+// the keys and arguments as two tables.
+func fcallCommand(c *Cache, args []string) string {
+	fn := c.functions.lookup(args[1])
+	if fn == nil {
+		return respError("Function not found")
+	}
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil {
+		return respError(errNotInteger)
+	}
+	if numKeys < 0 {
+		return respError("Number of keys can't be negative")
+	}
+	if numKeys > len(args)-3 {
+		return respError("Number of keys can't be greater than number of args")
+	}
+	readOnly := args[0] == "FCALL_RO"
+	if readOnly && !fn.noWrites {
+		return respError("Can not execute a script with write flag using *_ro command.")
+	}
+
+	keys := luaStringArray(args[3 : 3+numKeys])
+	argv := luaStringArray(args[3+numKeys:])
+	return c.runLua(fn.library.L, fn.callback, []any{keys, argv}, readOnly || fn.noWrites)
+}
+
+// functionCommand implements FUNCTION LOAD [REPLACE] code, FUNCTION LIST
+// [LIBRARYNAME pattern] [WITHCODE], FUNCTION DELETE library, FUNCTION
+// FLUSH [ASYNC|SYNC], FUNCTION DUMP, FUNCTION RESTORE payload
+// [FLUSH|APPEND|REPLACE] and FUNCTION KILL. Like SCRIPT it runs without
+// the shard gates.
+func functionCommand(c *Cache, args []string) string {
+	r := c.functions
+	sub := strings.ToUpper(args[1])
+
+	switch sub {
+	case "KILL":
+		return scriptCommand(c, []string{"SCRIPT", "KILL"})
+
+	case "LIST":
+		pattern, withCode := "", false
+		for i := 2; i < len(args); i++ {
+			switch {
+			case strings.ToUpper(args[i]) == "WITHCODE":
+				withCode = true
+			case strings.ToUpper(args[i]) == "LIBRARYNAME" && i+1 < len(args):
+				pattern = args[i+1]
+				i++
+			default:
+				return respError(errSyntax)
+			}
+		}
+		return r.list(pattern, withCode)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Changes are undone if they cannot be saved, so that a failed command
+	// has no effect, now or after a restart
+	prev := r.snapshot()
+
+	switch sub {
+	case "LOAD":
+		if len(args) < 3 || len(args) > 4 || (len(args) == 4 && strings.ToUpper(args[2]) != "REPLACE") {
+			return respError("wrong number of arguments for 'function|load' command")
+		}
+		lib, err := compileLibrary(args[len(args)-1])
+		if err != nil {
+			return respError(err.Error())
+		}
+		if err := r.add(lib, len(args) == 4); err != nil {
+			return respError(err.Error())
+		}
+		if reply := r.saveReply(prev); reply != "" {
+			return reply
+		}
+		return respBulk(lib.name)
+
+	case "DELETE":
+		if len(args) != 3 {
+			return respError("wrong number of arguments for 'function|delete' command")
+		}
+		lib, ok := r.libraries[args[2]]
+		if !ok {
+			return respError("Library not found")
+		}
+		r.remove(lib)
+		if reply := r.saveReply(prev); reply != "" {
+			return reply
+		}
+		return respOK()
+
+	case "FLUSH":
+		if len(args) > 3 || (len(args) == 3 && strings.ToUpper(args[2]) != "ASYNC" && strings.ToUpper(args[2]) != "SYNC") {
+			return respError(errSyntax)
+		}
+		clear(r.libraries)
+		clear(r.functions)
+		if reply := r.saveReply(prev); reply != "" {
+			return reply
+		}
+		return respOK()
+
+	case "DUMP":
+		if len(args) != 2 {
+			return respError("wrong number of arguments for 'function|dump' command")
+		}
+		data, _ := json.Marshal(r.codes())
+		return respBulk(hex.EncodeToString(data))
+
+	case "RESTORE":
+		if len(args) < 3 || len(args) > 4 {
+			return respError("wrong number of arguments for 'function|restore' command")
+		}
+		policy := "APPEND"
+		if len(args) == 4 {
+			policy = strings.ToUpper(args[3])
+		}
+		var codes []string
+		data, err := hex.DecodeString(args[2])
+		if err == nil {
+			err = json.Unmarshal(data, &codes)
+		}
+		if err != nil {
+			return respError("payload version or checksum are wrong")
+		}
+
+		switch policy {
+		case "FLUSH":
+			clear(r.libraries)
+			clear(r.functions)
+			if err := r.restore(codes, false); err != nil {
+				r.rollback(prev)
+				return respError(err.Error())
+			}
+		case "APPEND", "REPLACE":
+			if err := r.restore(codes, policy == "REPLACE"); err != nil {
+				return respError(err.Error())
+			}
+		default:
+			return respError("Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+		if reply := r.saveReply(prev); reply != "" {
+			return reply
+		}
+		return respOK()
+	}
+	return respError("unknown subcommand '" + args[1] + "' for 'function' command")
+}
+
+// saveReply saves the libraries after a change. If that fails the
+// libraries of prev are put back and an error reply is returned. r.mu must
+// be held.
+func (r *functionRegistry) saveReply(prev functionSnapshot) string {
+	if err := r.save(); err != nil {
+		r.rollback(prev)
+		return respError("Failed saving function libraries: " + err.Error())
+	}
+	return ""
+}
+
+// list builds the reply of FUNCTION LIST
+func (r *functionRegistry) list(pattern string, withCode bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.libraries))
+	for name := range r.libraries {
+		if pattern == "" || globMatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	libs := make([]string, 0, len(names))
+	for _, name := range names {
+		lib := r.libraries[name]
+		fnNames := make([]string, 0, len(lib.functions))
+		for fnName := range lib.functions {
+			fnNames = append(fnNames, fnName)
+		}
+		sort.Strings(fnNames)
+
+		functions := make([]string, 0, len(fnNames))
+		for _, fnName := range fnNames {
+			fn := lib.functions[fnName]
+			description := respNil()
+			if fn.description != "" {
+				description = respBulk(fn.description)
+			}
+			flags := make([]string, len(fn.flags))
+			for i, flag := range fn.flags {
+				flags[i] = respBulk(flag)
+			}
+			functions = append(functions, respArray([]string{
+				respBulk("name"), respBulk(fn.name),
+				respBulk("description"), description,
+				respBulk("flags"), respArray(flags),
+			}))
+		}
+
+		fields := []string{
+			respBulk("library_name"), respBulk(lib.name),
+			respBulk("engine"), respBulk("LUA"),
+			respBulk("functions"), respArray(functions),
+		}
+		if withCode {
+			fields = append(fields, respBulk("library_code"), respBulk(lib.code))
+		}
+		libs = append(libs, respArray(fields))
+	}
+	return respArray(libs)
+}
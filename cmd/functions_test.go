@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testLibrary = "#!lua name=mylib\n" +
+		"redis.register_function('get', function(keys) return redis.call('GET', keys[1]) end)\n" +
+		"redis.register_function{function_name = 'echo', callback = function(keys, args) return {#keys, #args, keys[1], args[1]} end,\n" +
+		"  flags = {'no-writes'}, description = 'returns its input'}\n"
+	otherLibrary = "#!lua name=other\nredis.register_function('set', function(keys, args) return redis.call('SET', keys[1], args[1]) end)"
+)
+
+func TestFunctionLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"no metadata", "redis.register_function('f', function() end)", "Missing library metadata"},
+		{"other engine", "#!js name=lib\n", "Engine 'js' not found"},
+		{"no name", "#!lua\nredis.register_function('f', function() end)", "Library name was not given"},
+		{"unknown metadata", "#!lua name=lib version=2\n", "Invalid metadata value given: version=2"},
+		{"bad library name", "#!lua name=my-lib\n", "Library names can only contain letters"},
+		{"syntax error", "#!lua name=lib\nfunction(", "Error compiling function"},
+		{"no functions", "#!lua name=lib\nlocal x = 1", "No functions registered"},
+		{"bad function name", "#!lua name=lib\nredis.register_function('a b', function() end)", "Function names can only contain letters"},
+		{"duplicate function", "#!lua name=lib\nredis.register_function('f', function() end)\nredis.register_function('f', function() end)", "Function already exists in the library"},
+		{"not a function", "#!lua name=lib\nredis.register_function('f', 1)", "callback argument given to redis.register_function must be a function"},
+		{"unknown flag", "#!lua name=lib\nredis.register_function{function_name = 'f', callback = function() end, flags = {'fast'}}", "unknown flag given"},
+		{"unknown argument", "#!lua name=lib\nredis.register_function{function_name = 'f', callback = function() end, speed = 1}", "unknown argument given to redis.register_function"},
+		{"endless body", "#!lua name=lib\nwhile true do end", "FUNCTION LOAD timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			got := executeCommand(c, []string{"FUNCTION", "LOAD", tt.code})
+			if !strings.HasPrefix(got, "-ERR ") || !strings.Contains(got, tt.want) {
+				t.Fatalf("FUNCTION LOAD = %q, want an error with %q", got, tt.want)
+			}
+			if got := executeCommand(c, []string{"FUNCTION", "LIST"}); got != "*0\r\n" {
+				t.Fatalf("FUNCTION LIST after a failed load = %q", got)
+			}
+		})
+	}
+}
+
+func TestFunctionCommands(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "k", "v"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"FUNCTION", "LOAD", testLibrary}, "$5\r\nmylib\r\n"},
+		{[]string{"FUNCTION", "LOAD", testLibrary}, "-ERR Library 'mylib' already exists\r\n"},
+		{[]string{"FUNCTION", "LOAD", "REPLACE", testLibrary}, "$5\r\nmylib\r\n"},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=clash\nredis.register_function('get', function() end)"}, "-ERR Function get already exists\r\n"},
+		{[]string{"FUNCTION", "LOAD", otherLibrary}, "$5\r\nother\r\n"},
+		{[]string{"FCALL", "get", "1", "k"}, "$1\r\nv\r\n"},
+		{[]string{"FCALL", "echo", "1", "k", "a", "b"}, "*4\r\n:1\r\n:2\r\n$1\r\nk\r\n$1\r\na\r\n"},
+		{[]string{"FCALL_RO", "echo", "0", "a"}, "*2\r\n:0\r\n:1\r\n"},
+		{[]string{"FCALL_RO", "set", "1", "k", "w"}, "-ERR Can not execute a script with write flag using *_ro command.\r\n"},
+		{[]string{"FCALL", "set", "1", "k", "w"}, "+OK\r\n"},
+		{[]string{"FCALL", "missing", "0"}, "-ERR Function not found\r\n"},
+		{[]string{"FCALL", "get", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"FCALL", "get", "-1"}, "-ERR Number of keys can't be negative\r\n"},
+		{[]string{"FCALL", "get", "2", "k"}, "-ERR Number of keys can't be greater than number of args\r\n"},
+		{[]string{"FUNCTION", "LIST", "LIBRARYNAME", "my*"}, respArray([]string{respArray([]string{
+			respBulk("library_name"), respBulk("mylib"),
+			respBulk("engine"), respBulk("LUA"),
+			respBulk("functions"), respArray([]string{
+				respArray([]string{respBulk("name"), respBulk("echo"), respBulk("description"), respBulk("returns its input"), respBulk("flags"), respArray([]string{respBulk("no-writes")})}),
+				respArray([]string{respBulk("name"), respBulk("get"), respBulk("description"), respNil(), respBulk("flags"), respArray(nil)}),
+			}),
+		})})},
+		{[]string{"FUNCTION", "LIST", "LIBRARYNAME", "oth*", "WITHCODE"}, respArray([]string{respArray([]string{
+			respBulk("library_name"), respBulk("other"),
+			respBulk("engine"), respBulk("LUA"),
+			respBulk("functions"), respArray([]string{
+				respArray([]string{respBulk("name"), respBulk("set"), respBulk("description"), respNil(), respBulk("flags"), respArray(nil)}),
+			}),
+			respBulk("library_code"), respBulk(otherLibrary),
+		})})},
+		{[]string{"FUNCTION", "LIST", "BOGUS"}, "-ERR syntax error\r\n"},
+		{[]string{"FUNCTION", "DELETE", "other"}, "+OK\r\n"},
+		{[]string{"FUNCTION", "DELETE", "other"}, "-ERR Library not found\r\n"},
+		{[]string{"FCALL", "set", "1", "k", "w"}, "-ERR Function not found\r\n"},
+		{[]string{"FUNCTION", "FLUSH", "LATER"}, "-ERR syntax error\r\n"},
+		{[]string{"FUNCTION", "FLUSH", "SYNC"}, "+OK\r\n"},
+		{[]string{"FUNCTION", "LIST"}, "*0\r\n"},
+		{[]string{"FUNCTION", "STATS"}, "-ERR unknown subcommand 'STATS' for 'function' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestFunctionGlobalsReadOnly(t *testing.T) {
+	c := newTestCache(t)
+	lib := "#!lua name=lib\ncounter = 0\nredis.register_function('bump', function() counter = counter + 1 return counter end)"
+	executeCommand(c, []string{"FUNCTION", "LOAD", lib})
+	if got := executeCommand(c, []string{"FCALL", "bump", "0"}); !strings.Contains(got, "Attempt to modify a readonly table") {
+		t.Fatalf("FCALL assigning a global = %q", got)
+	}
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"FUNCTION", "LOAD", testLibrary})
+	dump := executeCommand(c, []string{"FUNCTION", "DUMP"})
+	payload := strings.Split(dump, "\r\n")[1]
+	executeCommand(c, []string{"FUNCTION", "LOAD", otherLibrary})
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"FUNCTION", "RESTORE", payload}, "-ERR Library mylib already exists\r\n"},
+		{[]string{"FUNCTION", "RESTORE", payload, "REPLACE"}, "+OK\r\n"},
+		{[]string{"FCALL", "set", "1", "k", "v"}, "+OK\r\n"},
+		{[]string{"FUNCTION", "RESTORE", payload, "FLUSH"}, "+OK\r\n"},
+		{[]string{"FCALL", "set", "1", "k", "v"}, "-ERR Function not found\r\n"},
+		{[]string{"FCALL", "get", "1", "k"}, "$1\r\nv\r\n"},
+		{[]string{"FUNCTION", "RESTORE", "zz"}, "-ERR payload version or checksum are wrong\r\n"},
+		{[]string{"FUNCTION", "RESTORE", payload, "MERGE"}, "-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.\r\n"},
+		{[]string{"FUNCTION", "FLUSH"}, "+OK\r\n"},
+		{[]string{"FUNCTION", "RESTORE", payload}, "+OK\r\n"},
+		{[]string{"FUNCTION", "DUMP"}, dump},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestFunctionsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "functions.json")
+	c := newTestCache(t)
+	if err := c.LoadFunctions(path); err != nil {
+		t.Fatal(err)
+	}
+	executeCommand(c, []string{"FUNCTION", "LOAD", testLibrary})
+	executeCommand(c, []string{"FUNCTION", "LOAD", otherLibrary})
+	executeCommand(c, []string{"FUNCTION", "DELETE", "other"})
+
+	restarted := newTestCache(t)
+	if err := restarted.LoadFunctions(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := executeCommand(restarted, []string{"FUNCTION", "DUMP"}), executeCommand(c, []string{"FUNCTION", "DUMP"}); got != want {
+		t.Fatalf("libraries after a restart = %q, want %q", got, want)
+	}
+
+	// A change that cannot be saved is undone
+	os.Remove(path)
+	os.Mkdir(path, 0o755)
+	got := executeCommand(c, []string{"FUNCTION", "LOAD", otherLibrary})
+	if !strings.HasPrefix(got, "-ERR Failed saving function libraries: ") {
+		t.Fatalf("FUNCTION LOAD with an unwritable file = %q", got)
+	}
+	if got := executeCommand(c, []string{"FCALL", "set", "1", "k", "v"}); got != "-ERR Function not found\r\n" {
+		t.Fatalf("library that was not saved was kept, FCALL = %q", got)
+	}
+
+	broken := filepath.Join(t.TempDir(), "broken.json")
+	os.WriteFile(broken, []byte("not json"), 0o644)
+	if err := newTestCache(t).LoadFunctions(broken); err == nil {
+		t.Fatal("loading a corrupt functions file succeeded")
+	}
+}
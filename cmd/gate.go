@@ -0,0 +1,177 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// The transaction gate keeps EXEC and scripts apart from other commands.
+// Each shard has its own gate: commands hold the gates of the shards of
+// their keys shared, EXEC holds the gates of its keys exclusively and
+// scripts, which may touch any key, hold every gate exclusively. Commands
+// on other shards and commands without keys are not held up, so one EXEC
+// only stalls the clients that use its shards.
+
+// gatePollPeriod is how often a command waiting for a gate checks whether
+// a script has exceeded its time limit
+const gatePollPeriod = 20 * time.Millisecond
+
+// gateKeySpec returns the keys of commands whose keys depend on the data,
+// such as TS.ADD which also writes the destinations of compaction rules.
+// The keys are checked again once the gates are held.
+type gateKeySpec func(c *Cache, args []string) []string
+
+var gateKeys = map[string]gateKeySpec{
+	"TS.ADD": tsAddKeys,
+}
+
+// commandKeys returns the keys a command uses, or all if it may use any
+// key. dynamic reports whether the keys were looked up in the keyspace.
+func (c *Cache) commandKeys(args []string) (keys []string, all, dynamic bool) {
+	cmd, ok := lookupCommand(args[0])
+	if !ok || checkArity(cmd, args) != "" {
+		return nil, false, false
+	}
+	if cmd.flags&flagExclusive != 0 {
+		return nil, true, false
+	}
+	if spec := gateKeys[args[0]]; spec != nil {
+		return spec(c, args), false, true
+	}
+	if spec := aclKeys[args[0]]; spec != nil {
+		read, write, all := spec(args)
+		return append(append(keys, read...), write...), all, false
+	}
+	if cmd.flags&(flagWrite|flagReadOnly) != 0 {
+		return args[1:2], false, false
+	}
+	return nil, false, false
+}
+
+// gateSet returns the sorted shard indexes of the gates that commands
+// need. extra are further keys, such as the keys watched by a transaction.
+func (c *Cache) gateSet(commands [][]string, extra []string) (set []int, dynamic bool) {
+	for _, args := range commands {
+		keys, all, dyn := c.commandKeys(args)
+		if all {
+			return c.allGates(), false
+		}
+		dynamic = dynamic || dyn
+		for _, key := range keys {
+			set = append(set, c.shardIndex(key))
+		}
+	}
+	for _, key := range extra {
+		set = append(set, c.shardIndex(key))
+	}
+	slices.Sort(set)
+	return slices.Compact(set), dynamic
+}
+
+// allGates returns the indexes of every shard
+func (c *Cache) allGates() []int {
+	set := make([]int, len(c.shards))
+	for i := range set {
+		set[i] = i
+	}
+	return set
+}
+
+// lockGates takes the gates in set, in order so that commands cannot
+// deadlock. If a script exceeds its time limit while a gate is awaited, the
+// gates taken so far are released again and the BUSY error is returned.
+func (c *Cache) lockGates(set []int, exclusive bool) string {
+	for i, idx := range set {
+		if !c.lockGate(&c.shards[idx].gate, exclusive) {
+			c.unlockGates(set[:i], exclusive)
+			return errBusy
+		}
+	}
+	return ""
+}
+
+// unlockGates releases the gates in set
+func (c *Cache) unlockGates(set []int, exclusive bool) {
+	for _, idx := range set {
+		if exclusive {
+			c.shards[idx].gate.Unlock()
+		} else {
+			c.shards[idx].gate.RUnlock()
+		}
+	}
+}
+
+// holdAll records that cl holds every gate exclusively, for a script or
+// EXEC
+func (c *Cache) holdAll(cl *client) {
+	c.gateClient = cl
+	c.allGatesHeld.Store(true)
+}
+
+// releaseAll undoes holdAll before the gates are released
+func (c *Cache) releaseAll() {
+	c.allGatesHeld.Store(false)
+	c.gateClient = nil
+}
+
+// lockGate takes one gate. It returns false without the gate once a script
+// runs past its time limit. Blocking happens in a goroutine, so that the
+// wait can be given up while keeping the fairness of the RWMutex.
+func (c *Cache) lockGate(gate *sync.RWMutex, exclusive bool) bool {
+	if exclusive && gate.TryLock() || !exclusive && gate.TryRLock() {
+		return true
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if exclusive {
+			gate.Lock()
+		} else {
+			gate.RLock()
+		}
+		close(acquired)
+	}()
+	ticker := time.NewTicker(gatePollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-acquired:
+			return true
+		case <-ticker.C:
+			if c.scripts.busy() == "" {
+				continue
+			}
+			// Release the gate as soon as the abandoned wait gets it
+			go func() {
+				<-acquired
+				if exclusive {
+					gate.Unlock()
+				} else {
+					gate.RUnlock()
+				}
+			}()
+			return false
+		}
+	}
+}
+
+// holdGates takes the gates that commands and extra keys need. Keys that
+// were looked up in the keyspace are looked up again with the gates held,
+// and the gates are taken anew if they changed in the meantime. It returns
+// the gates to release or the BUSY error.
+func (c *Cache) holdGates(commands [][]string, extra []string, exclusive bool) ([]int, string) {
+	for {
+		set, dynamic := c.gateSet(commands, extra)
+		if reply := c.lockGates(set, exclusive); reply != "" {
+			return nil, reply
+		}
+		if !dynamic {
+			return set, ""
+		}
+		if again, _ := c.gateSet(commands, extra); slices.Equal(set, again) {
+			return set, ""
+		}
+		c.unlockGates(set, exclusive)
+	}
+}
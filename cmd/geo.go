@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geo members live in a sorted set whose score is a 52-bit interleaved
+// geohash, so that nearby points have nearby scores and an area can be
+// searched with a few score range queries.
+const (
+	geoStep      = 26 // Bits per coordinate, 52 bits in total
+	geoLatMin    = -85.05112878
+	geoLatMax    = 85.05112878
+	geoLonMin    = -180.0
+	geoLonMax    = 180.0
+	earthRadiusM = 6372797.560856
+
+	geoAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+func init() {
+	registerCommand("GEOADD", -5, flagWrite|flagDenyOOM, geoaddCommand)
+	registerCommand("GEODIST", -4, flagReadOnly, geodistCommand)
+	registerCommand("GEOPOS", -2, flagReadOnly, geoposCommand)
+	registerCommand("GEOHASH", -2, flagReadOnly, geohashCommand)
+	registerCommand("GEOSEARCH", -7, flagReadOnly, geosearchCommand)
+}
+
+// spreadBits moves the low 32 bits of v to the even bit positions
+func spreadBits(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000FFFF0000FFFF
+	x = (x | x<<8) & 0x00FF00FF00FF00FF
+	x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// squashBits is the inverse of spreadBits
+func squashBits(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0F0F0F0F0F0F0F0F
+	x = (x | x>>4) & 0x00FF00FF00FF00FF
+	x = (x | x>>8) & 0x0000FFFF0000FFFF
+	x = (x | x>>16) & 0x00000000FFFFFFFF
+	return uint32(x)
+}
+
+// geohashEncode interleaves the cell indexes of lon and lat at the given
+// step. Longitude bits take the odd positions, so the top bit is longitude
+// as in the standard geohash.
+func geohashEncode(lon, lat float64, step uint, latMin, latMax float64) uint64 {
+	cells := float64(uint64(1) << step)
+	latIdx := uint64((lat - latMin) / (latMax - latMin) * cells)
+	lonIdx := uint64((lon - geoLonMin) / (geoLonMax - geoLonMin) * cells)
+	latIdx = min(latIdx, uint64(cells)-1)
+	lonIdx = min(lonIdx, uint64(cells)-1)
+	return spreadBits(uint32(latIdx)) | spreadBits(uint32(lonIdx))<<1
+}
+
+// geohashDecode returns the center of the cell identified by hash
+func geohashDecode(hash uint64, step uint) (lon, lat float64) {
+	cells := float64(uint64(1) << step)
+	latIdx := float64(squashBits(hash))
+	lonIdx := float64(squashBits(hash >> 1))
+
+	lat = geoLatMin + (latIdx+0.5)/cells*(geoLatMax-geoLatMin)
+	lon = geoLonMin + (lonIdx+0.5)/cells*(geoLonMax-geoLonMin)
+	return math.Max(geoLonMin, math.Min(geoLonMax, lon)), math.Max(geoLatMin, math.Min(geoLatMax, lat))
+}
+
+// geohashString renders the standard 11 character base32 geohash
+func geohashString(lon, lat float64) string {
+	hash := geohashEncode(lon, lat, geoStep, -90, 90)
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := 0
+		if i < 10 {
+			idx = int(hash>>(52-(i+1)*5)) & 0x1F
+		}
+		buf[i] = geoAlphabet[idx]
+	}
+	return string(buf)
+}
+
+// geoDistance returns the haversine distance in meters between two points
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lat2r := lat1*math.Pi/180, lat2*math.Pi/180
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((lon2 - lon1) * math.Pi / 180 / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// geoUnit returns the number of meters in a distance unit
+func geoUnit(s string) (float64, bool) {
+	switch strings.ToLower(s) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// parseLonLat parses and validates a longitude/latitude pair
+func parseLonLat(lonArg, latArg string) (lon, lat float64, errMsg string) {
+	lon, ok1 := parseFloat(lonArg)
+	lat, ok2 := parseFloat(latArg)
+	if !ok1 || !ok2 {
+		return 0, 0, errNotFloat
+	}
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, fmt.Sprintf("invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return lon, lat, ""
+}
+
+// geoaddCommand implements GEOADD key [NX|XX] [CH] lon lat member [...]
+func geoaddCommand(c *Cache, args []string) string {
+	zargs := []string{"ZADD", args[1]}
+	i := 2
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt != "NX" && opt != "XX" && opt != "CH" {
+			break
+		}
+		zargs = append(zargs, opt)
+	}
+
+	triples := args[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return respError(errSyntax)
+	}
+
+	for j := 0; j < len(triples); j += 3 {
+		lon, lat, errMsg := parseLonLat(triples[j], triples[j+1])
+		if errMsg != "" {
+			return respError(errMsg)
+		}
+		score := geohashEncode(lon, lat, geoStep, geoLatMin, geoLatMax)
+		zargs = append(zargs, strconv.FormatUint(score, 10), triples[j+2])
+	}
+
+	return zaddCommand(c, zargs)
+}
+
+// geoMemberPos returns the decoded position of a member of z
+func geoMemberPos(z *sortedSet, member string) (lon, lat float64, ok bool) {
+	if z == nil {
+		return 0, 0, false
+	}
+	score, ok := z.Score(member)
+	if !ok {
+		return 0, 0, false
+	}
+	lon, lat = geohashDecode(uint64(score), geoStep)
+	return lon, lat, true
+}
+
+// geodistCommand implements GEODIST key member1 member2 [m|km|ft|mi]
+func geodistCommand(c *Cache, args []string) string {
+	unit := 1.0
+	if len(args) == 5 {
+		var ok bool
+		if unit, ok = geoUnit(args[4]); !ok {
+			return respError("unsupported unit provided. please use M, KM, FT, MI")
+		}
+	} else if len(args) > 5 {
+		return respError(errSyntax)
+	}
+
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		lon1, lat1, ok1 := geoMemberPos(z, args[2])
+		lon2, lat2, ok2 := geoMemberPos(z, args[3])
+		if !ok1 || !ok2 {
+			return respNil()
+		}
+		return respBulk(strconv.FormatFloat(geoDistance(lon1, lat1, lon2, lat2)/unit, 'f', 4, 64))
+	})
+}
+
+// geoposCommand implements GEOPOS key [member ...]
+func geoposCommand(c *Cache, args []string) string {
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		items := make([]string, 0, len(args)-2)
+		for _, member := range args[2:] {
+			lon, lat, ok := geoMemberPos(z, member)
+			if !ok {
+				items = append(items, respNilArray())
+				continue
+			}
+			items = append(items, respArray([]string{
+				respBulk(strconv.FormatFloat(lon, 'f', -1, 64)),
+				respBulk(strconv.FormatFloat(lat, 'f', -1, 64)),
+			}))
+		}
+		return respArray(items)
+	})
+}
+
+// geohashCommand implements GEOHASH key [member ...]
+func geohashCommand(c *Cache, args []string) string {
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		items := make([]string, 0, len(args)-2)
+		for _, member := range args[2:] {
+			lon, lat, ok := geoMemberPos(z, member)
+			if !ok {
+				items = append(items, respNil())
+				continue
+			}
+			items = append(items, respBulk(geohashString(lon, lat)))
+		}
+		return respArray(items)
+	})
+}
+
+// geoSearch describes the area and options of a GEOSEARCH query
+type geoSearch struct {
+	fromMember    string
+	lon, lat      float64
+	radius        float64 // Meters, zero for box searches
+	width, height float64 // Meters
+	unit          float64
+	sort          int // -1 descending, 0 unsorted, 1 ascending
+	count         int
+	any           bool
+	withCoord     bool
+	withDist      bool
+	withHash      bool
+}
+
+// geoResult is a member matched by a search
+type geoResult struct {
+	member   string
+	score    float64
+	dist     float64
+	lon, lat float64
+}
+
+// parseGeoSearch parses the arguments of GEOSEARCH after the key
+func parseGeoSearch(args []string) (*geoSearch, string) {
+	q := &geoSearch{}
+	var hasFrom, hasBy bool
+
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch strings.ToUpper(args[i]) {
+		case "FROMMEMBER":
+			if left < 1 || hasFrom {
+				return nil, errSyntax
+			}
+			q.fromMember = args[i+1]
+			hasFrom = true
+			i++
+
+		case "FROMLONLAT":
+			if left < 2 || hasFrom {
+				return nil, errSyntax
+			}
+			lon, lat, errMsg := parseLonLat(args[i+1], args[i+2])
+			if errMsg != "" {
+				return nil, errMsg
+			}
+			q.lon, q.lat = lon, lat
+			hasFrom = true
+			i += 2
+
+		case "BYRADIUS":
+			if left < 2 || hasBy {
+				return nil, errSyntax
+			}
+			radius, ok := parseFloat(args[i+1])
+			if !ok || radius < 0 {
+				return nil, "need numeric radius"
+			}
+			if q.unit, ok = geoUnit(args[i+2]); !ok {
+				return nil, "unsupported unit provided. please use M, KM, FT, MI"
+			}
+			q.radius = radius * q.unit
+			q.width, q.height = q.radius*2, q.radius*2
+			hasBy = true
+			i += 2
+
+		case "BYBOX":
+			if left < 3 || hasBy {
+				return nil, errSyntax
+			}
+			width, ok1 := parseFloat(args[i+1])
+			height, ok2 := parseFloat(args[i+2])
+			if !ok1 || !ok2 || width < 0 || height < 0 {
+				return nil, "need numeric width and height"
+			}
+			var ok bool
+			if q.unit, ok = geoUnit(args[i+3]); !ok {
+				return nil, "unsupported unit provided. please use M, KM, FT, MI"
+			}
+			q.width, q.height = width*q.unit, height*q.unit
+			hasBy = true
+			i += 3
+
+		case "ASC":
+			q.sort = 1
+		case "DESC":
+			q.sort = -1
+
+		case "COUNT":
+			if left < 1 {
+				return nil, errSyntax
+			}
+			n, ok := parseInt(args[i+1])
+			if !ok || n <= 0 {
+				return nil, "COUNT must be > 0"
+			}
+			q.count = int(n)
+			i++
+			if i+1 < len(args) && strings.EqualFold(args[i+1], "ANY") {
+				q.any = true
+				i++
+			}
+
+		case "WITHCOORD":
+			q.withCoord = true
+		case "WITHDIST":
+			q.withDist = true
+		case "WITHHASH":
+			q.withHash = true
+
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	if !hasFrom {
+		return nil, "exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH"
+	}
+	if !hasBy {
+		return nil, "exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH"
+	}
+
+	// Like Redis, a COUNT without an explicit order returns the closest
+	// matches unless ANY is given
+	if q.count > 0 && q.sort == 0 && !q.any {
+		q.sort = 1
+	}
+	return q, ""
+}
+
+// match returns the distance from the search center to a point and whether
+// the point lies inside the searched area
+func (q *geoSearch) match(lon, lat float64) (float64, bool) {
+	if q.radius > 0 || q.width == 0 {
+		dist := geoDistance(q.lon, q.lat, lon, lat)
+		return dist, dist <= q.radius
+	}
+
+	if earthRadiusM*math.Abs(lat-q.lat)*math.Pi/180 > q.height/2 {
+		return 0, false
+	}
+	if geoDistance(q.lon, lat, lon, lat) > q.width/2 {
+		return 0, false
+	}
+	return geoDistance(q.lon, q.lat, lon, lat), true
+}
+
+// cells returns the geohash score ranges that together cover the search
+// area. The step is chosen so that a cell is at least as large as the area,
+// which makes the center cell and its eight neighbours sufficient.
+func (q *geoSearch) cells() [][2]float64 {
+	dLat := q.height / 2 / earthRadiusM * 180 / math.Pi
+	edgeLat := math.Min(math.Abs(q.lat)+dLat, 90)
+	dLon := 360.0
+	if cos := math.Cos(edgeLat * math.Pi / 180); cos > 1e-9 {
+		dLon = math.Min(q.width/2/(earthRadiusM*cos)*180/math.Pi, 360)
+	}
+
+	step := uint(geoStep)
+	for step > 1 {
+		cellLon := (geoLonMax - geoLonMin) / float64(uint64(1)<<step)
+		cellLat := (geoLatMax - geoLatMin) / float64(uint64(1)<<step)
+		if cellLon >= dLon && cellLat >= dLat {
+			break
+		}
+		step--
+	}
+
+	cellLon := (geoLonMax - geoLonMin) / float64(uint64(1)<<step)
+	cellLat := (geoLatMax - geoLatMin) / float64(uint64(1)<<step)
+	shift := 2 * (geoStep - step)
+
+	seen := make(map[uint64]bool)
+	var ranges [][2]float64
+	for _, dy := range []float64{-1, 0, 1} {
+		lat := q.lat + dy*cellLat
+		if lat < geoLatMin || lat > geoLatMax {
+			continue
+		}
+		for _, dx := range []float64{-1, 0, 1} {
+			lon := q.lon + dx*cellLon
+			if lon < geoLonMin {
+				lon += 360
+			} else if lon > geoLonMax {
+				lon -= 360
+			}
+
+			hash := geohashEncode(lon, lat, step, geoLatMin, geoLatMax)
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			ranges = append(ranges, [2]float64{float64(hash << shift), float64((hash + 1) << shift)})
+		}
+	}
+	return ranges
+}
+
+// run collects the members of z that lie inside the searched area
+func (q *geoSearch) run(z *sortedSet) []geoResult {
+	var results []geoResult
+	for _, r := range q.cells() {
+		for _, e := range z.RangeByScore(r[0], r[1]) {
+			lon, lat := geohashDecode(uint64(e.score), geoStep)
+			dist, ok := q.match(lon, lat)
+			if !ok {
+				continue
+			}
+			results = append(results, geoResult{member: e.member, score: e.score, dist: dist, lon: lon, lat: lat})
+			if q.any && len(results) == q.count {
+				return results
+			}
+		}
+	}
+	return results
+}
+
+// geosearchCommand implements GEOSEARCH key FROMMEMBER member|FROMLONLAT lon
+// lat BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT n [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH]
+func geosearchCommand(c *Cache, args []string) string {
+	q, errMsg := parseGeoSearch(args[2:])
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		if z == nil {
+			return respArray(nil)
+		}
+		if q.fromMember != "" {
+			var ok bool
+			if q.lon, q.lat, ok = geoMemberPos(z, q.fromMember); !ok {
+				return respError("could not decode requested zset member")
+			}
+		}
+
+		results := q.run(z)
+		switch q.sort {
+		case 1:
+			sort.Slice(results, func(i, j int) bool { return results[i].dist < results[j].dist })
+		case -1:
+			sort.Slice(results, func(i, j int) bool { return results[i].dist > results[j].dist })
+		}
+		if q.count > 0 && len(results) > q.count {
+			results = results[:q.count]
+		}
+
+		items := make([]string, 0, len(results))
+		for _, r := range results {
+			if !q.withCoord && !q.withDist && !q.withHash {
+				items = append(items, respBulk(r.member))
+				continue
+			}
+
+			fields := []string{respBulk(r.member)}
+			if q.withDist {
+				fields = append(fields, respBulk(strconv.FormatFloat(r.dist/q.unit, 'f', 4, 64)))
+			}
+			if q.withHash {
+				fields = append(fields, respInt(int64(r.score)))
+			}
+			if q.withCoord {
+				fields = append(fields, respArray([]string{
+					respBulk(strconv.FormatFloat(r.lon, 'f', -1, 64)),
+					respBulk(strconv.FormatFloat(r.lat, 'f', -1, 64)),
+				}))
+			}
+			items = append(items, respArray(fields))
+		}
+		return respArray(items)
+	})
+}
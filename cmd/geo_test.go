@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGeoCommands(t *testing.T) {
+	c := newTestCache(t)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GEOADD", "sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, ":2\r\n"},
+		{[]string{"GEOADD", "sicily", "200", "38", "x"}, "-ERR invalid longitude,latitude pair 200.000000,38.000000\r\n"},
+		{[]string{"GEOADD", "sicily", "13", "38", "a", "14"}, "-ERR syntax error\r\n"},
+		{[]string{"GEODIST", "sicily", "Palermo", "Catania"}, "$11\r\n166274.1516\r\n"},
+		{[]string{"GEODIST", "sicily", "Palermo", "Catania", "km"}, "$8\r\n166.2742\r\n"},
+		{[]string{"GEODIST", "sicily", "Palermo", "Catania", "yd"}, "-ERR unsupported unit provided. please use M, KM, FT, MI\r\n"},
+		{[]string{"GEODIST", "sicily", "Palermo", "Rome"}, "$-1\r\n"},
+		{[]string{"GEOHASH", "sicily", "Palermo", "Catania", "Rome"}, "*3\r\n$11\r\nsqc8b49rny0\r\n$11\r\nsqdtr74hyu0\r\n$-1\r\n"},
+		{[]string{"GEOPOS", "sicily", "Rome"}, "*1\r\n*-1\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "100", "km"}, "*1\r\n$7\r\nCatania\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, "*2\r\n$7\r\nCatania\r\n$7\r\nPalermo\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "DESC", "COUNT", "1"}, "*1\r\n$7\r\nPalermo\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "COUNT", "1", "WITHDIST"}, "*1\r\n*2\r\n$7\r\nCatania\r\n$7\r\n56.4413\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMMEMBER", "Palermo", "BYBOX", "400", "400", "km", "ASC"}, "*2\r\n$7\r\nPalermo\r\n$7\r\nCatania\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMMEMBER", "Rome", "BYRADIUS", "1", "km"}, "-ERR could not decode requested zset member\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "BYRADIUS", "1", "km", "FROMLONLAT", "15", "37", "COUNT", "0"}, "-ERR COUNT must be > 0\r\n"},
+		{[]string{"GEOSEARCH", "sicily", "FROMLONLAT", "15", "37", "COUNT", "1", "ASC"}, "-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n"},
+		{[]string{"GEOSEARCH", "missing", "FROMLONLAT", "15", "37", "BYRADIUS", "1", "km"}, "*0\r\n"},
+		{[]string{"ZCARD", "sicily"}, ":2\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestGeoPosRoundTrip(t *testing.T) {
+	c := newTestCache(t)
+	points := [][2]float64{{13.361389, 38.115556}, {-179.9999, -85}, {179.9999, 85}, {0, 0}, {-0.1276, 51.5072}}
+	for i, p := range points {
+		member := strconv.Itoa(i)
+		executeCommand(c, []string{"GEOADD", "geo", formatFloat(p[0]), formatFloat(p[1]), member})
+		lon, lat, _ := geoMemberPos(getSortedSet(t, c, "geo"), member)
+		// A 26-bit cell is under a meter across
+		if geoDistance(lon, lat, p[0], p[1]) > 1 {
+			t.Errorf("GEOPOS of %v = %v, %v", p, lon, lat)
+		}
+	}
+}
+
+// getSortedSet returns the sorted set stored at key
+func getSortedSet(t *testing.T, c *Cache, key string) *sortedSet {
+	t.Helper()
+	var z *sortedSet
+	c.View(key, func(entry CacheEntry, exists bool) {
+		z, _ = entry.Object.(*sortedSet)
+	})
+	if z == nil {
+		t.Fatalf("%s is not a sorted set", key)
+	}
+	return z
+}
+
+// TestGeoSearchMatchesScan compares searches against checking every point
+func TestGeoSearchMatchesScan(t *testing.T) {
+	c := newTestCache(t)
+	rng := rand.New(rand.NewSource(1))
+	type point struct{ lon, lat float64 }
+	points := make(map[string]point)
+	for i := 0; i < 5000; i++ {
+		p := point{rng.Float64()*360 - 180, rng.Float64()*170 - 85}
+		member := "p" + strconv.Itoa(i)
+		executeCommand(c, []string{"GEOADD", "geo", formatFloat(p.lon), formatFloat(p.lat), member})
+		lon, lat, _ := geoMemberPos(getSortedSet(t, c, "geo"), member)
+		points[member] = point{lon, lat}
+	}
+
+	for i := 0; i < 200; i++ {
+		lon, lat := rng.Float64()*360-180, rng.Float64()*170-85
+		radius := math.Pow(10, rng.Float64()*4) // 1 to 10000 km
+		var want []string
+		for member, p := range points {
+			if geoDistance(lon, lat, p.lon, p.lat) <= radius*1000 {
+				want = append(want, member)
+			}
+		}
+		sort.Strings(want)
+
+		reply := executeCommand(c, []string{"GEOSEARCH", "geo", "FROMLONLAT", formatFloat(lon), formatFloat(lat),
+			"BYRADIUS", formatFloat(radius), "km"})
+		var got []string
+		for _, line := range strings.Split(reply, "\r\n") {
+			if strings.HasPrefix(line, "p") {
+				got = append(got, line)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("radius %v km around %v, %v found %d members, want %d", radius, lon, lat, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog values are stored as plain strings: a 16 byte header followed
+// by either the dense or the sparse register encoding. The layout follows the
+// Redis one so that 16384 six-bit registers give a standard error of 0.81%.
+//
+// Header: "HYLL" magic, 1 encoding byte, 3 unused bytes and the cached
+// cardinality as a little endian uint64. The most significant bit of the last
+// byte marks the cached cardinality as stale.
+const (
+	hllP           = 14
+	hllQ           = 64 - hllP
+	hllRegisters   = 1 << hllP
+	hllPMask       = hllRegisters - 1
+	hllBits        = 6
+	hllRegisterMax = 1<<hllBits - 1
+	hllHeaderSize  = 16
+	hllDenseSize   = hllHeaderSize + hllRegisters*hllBits/8
+	hllAlphaInf    = 0.721347520444481703680
+
+	hllDense  = 0
+	hllSparse = 1
+
+	// Sparse opcodes: ZERO 00xxxxxx, XZERO 01xxxxxx xxxxxxxx, VAL 1vvvvvxx
+	hllSparseValMax    = 32
+	hllSparseValMaxLen = 4
+	hllSparseZeroMax   = 64
+	hllSparseXZeroMax  = 16384
+
+	HLLSparseMaxBytes = 3000 // Sparse values growing past this are converted to dense
+)
+
+const errNotHLL = "-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n"
+
+func init() {
+	registerCommand("PFADD", -2, flagWrite|flagDenyOOM, pfaddCommand)
+	registerCommand("PFCOUNT", -2, flagReadOnly, pfcountCommand)
+	registerCommand("PFMERGE", -2, flagWrite|flagDenyOOM, pfmergeCommand)
+}
+
+// murmurHash64A is the 64-bit MurmurHash2 variant used to hash elements
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(data))*m
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	switch len(data) {
+	case 7:
+		h ^= uint64(data[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(data[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(data[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(data[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(data[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register an element maps to and the length of the
+// run of zeros (plus one) in the remaining hash bits
+func hllPatLen(element string) (int, uint8) {
+	hash := murmurHash64A([]byte(element), 0xadc83b19)
+	index := int(hash & hllPMask)
+	hash >>= hllP
+	hash |= 1 << hllQ // Guarantees the count terminates
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+// hllDenseGet reads a six-bit register from the dense encoding
+func hllDenseGet(regs []byte, index int) uint8 {
+	b := index * hllBits / 8
+	fb := uint(index*hllBits) & 7
+	v := uint(regs[b]) >> fb
+	if b+1 < len(regs) {
+		v |= uint(regs[b+1]) << (8 - fb)
+	}
+	return uint8(v & hllRegisterMax)
+}
+
+// hllDenseSet writes a six-bit register into the dense encoding
+func hllDenseSet(regs []byte, index int, value uint8) {
+	b := index * hllBits / 8
+	fb := uint(index*hllBits) & 7
+	regs[b] &^= byte(hllRegisterMax << fb)
+	regs[b] |= byte(uint(value) << fb)
+	if b+1 < len(regs) {
+		regs[b+1] &^= byte(hllRegisterMax >> (8 - fb))
+		regs[b+1] |= byte(uint(value) >> (8 - fb))
+	}
+}
+
+// hllHeader returns a fresh header with a stale cardinality cache
+func hllHeader(encoding byte) []byte {
+	hdr := make([]byte, hllHeaderSize)
+	copy(hdr, "HYLL")
+	hdr[4] = encoding
+	hdr[15] = 0x80
+	return hdr
+}
+
+// hllValid reports whether value holds a well formed HyperLogLog
+func hllValid(value string) bool {
+	if len(value) < hllHeaderSize || value[:4] != "HYLL" {
+		return false
+	}
+	switch value[4] {
+	case hllDense:
+		return len(value) == hllDenseSize
+	case hllSparse:
+		_, ok := hllDecodeSparse([]byte(value[hllHeaderSize:]))
+		return ok
+	}
+	return false
+}
+
+// hllDecodeSparse expands sparse opcodes into one byte per register
+func hllDecodeSparse(p []byte) ([]uint8, bool) {
+	regs := make([]uint8, hllRegisters)
+	index := 0
+
+	for i := 0; i < len(p); i++ {
+		b := p[i]
+		var run int
+		var value uint8
+
+		switch {
+		case b&0xC0 == 0x00:
+			run = int(b&0x3F) + 1
+		case b&0xC0 == 0x40:
+			if i+1 >= len(p) {
+				return nil, false
+			}
+			run = (int(b&0x3F)<<8 | int(p[i+1])) + 1
+			i++
+		default:
+			value = (b>>2)&0x1F + 1
+			run = int(b&0x03) + 1
+		}
+
+		if index+run > hllRegisters {
+			return nil, false
+		}
+		for j := 0; j < run; j++ {
+			regs[index+j] = value
+		}
+		index += run
+	}
+
+	return regs, index == hllRegisters
+}
+
+// hllRegistersOf returns the registers of an encoded HyperLogLog, one byte
+// per register
+func hllRegistersOf(value string) ([]uint8, bool) {
+	if !hllValid(value) {
+		return nil, false
+	}
+	if value[4] == hllSparse {
+		return hllDecodeSparse([]byte(value[hllHeaderSize:]))
+	}
+
+	regs := make([]uint8, hllRegisters)
+	dense := []byte(value[hllHeaderSize:])
+	for i := range regs {
+		regs[i] = hllDenseGet(dense, i)
+	}
+	return regs, true
+}
+
+// hllEncodeSparse encodes registers with the sparse opcodes. ok is false
+// when a register is too large for the sparse encoding or the result would
+// exceed HLLSparseMaxBytes.
+func hllEncodeSparse(regs []uint8) ([]byte, bool) {
+	var out []byte
+
+	for i := 0; i < len(regs); {
+		value := regs[i]
+		run := 1
+		for i+run < len(regs) && regs[i+run] == value {
+			run++
+		}
+		i += run
+
+		if value > hllSparseValMax {
+			return nil, false
+		}
+
+		for run > 0 {
+			switch {
+			case value != 0:
+				n := min(run, hllSparseValMaxLen)
+				out = append(out, 0x80|(value-1)<<2|byte(n-1))
+				run -= n
+			case run > hllSparseZeroMax:
+				n := min(run, hllSparseXZeroMax)
+				out = append(out, 0x40|byte((n-1)>>8), byte(n-1))
+				run -= n
+			default:
+				out = append(out, byte(run-1))
+				run = 0
+			}
+		}
+
+		if len(out) > HLLSparseMaxBytes {
+			return nil, false
+		}
+	}
+
+	return out, true
+}
+
+// hllEncode serializes registers, preferring the sparse encoding when it fits
+func hllEncode(regs []uint8) string {
+	if sparse, ok := hllEncodeSparse(regs); ok {
+		return string(append(hllHeader(hllSparse), sparse...))
+	}
+
+	out := append(hllHeader(hllDense), make([]byte, hllDenseSize-hllHeaderSize)...)
+	dense := out[hllHeaderSize:]
+	for i, v := range regs {
+		hllDenseSet(dense, i, v)
+	}
+	return string(out)
+}
+
+// hllTau and hllSigma are the correction functions of Ertl's improved
+// raw estimator
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+// hllCount estimates the cardinality of a register set
+func hllCount(regs []uint8) uint64 {
+	var histogram [hllQ + 2]int
+	for _, v := range regs {
+		histogram[v]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// pfaddCommand implements PFADD key [element ...]
+func pfaddCommand(c *Cache, args []string) string {
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists && !hllValid(entry.Value) {
+			reply = errNotHLL
+			return updateNone
+		}
+
+		// Dense values are updated in place, everything else is expanded
+		// and re-encoded so it can be promoted to dense when needed
+		if exists && entry.Value[4] == hllDense {
+			buf := []byte(entry.Value)
+			dense := buf[hllHeaderSize:]
+			changed := false
+			for _, element := range args[2:] {
+				index, count := hllPatLen(element)
+				if count > hllDenseGet(dense, index) {
+					hllDenseSet(dense, index, count)
+					changed = true
+				}
+			}
+			if !changed {
+				reply = respInt(0)
+				return updateNone
+			}
+			buf[15] |= 0x80
+			entry.Value = string(buf)
+			reply = respInt(1)
+			return updateStore
+		}
+
+		regs := make([]uint8, hllRegisters)
+		if exists {
+			regs, _ = hllRegistersOf(entry.Value)
+		}
+		changed := !exists
+		for _, element := range args[2:] {
+			index, count := hllPatLen(element)
+			if count > regs[index] {
+				regs[index] = count
+				changed = true
+			}
+		}
+		if !changed {
+			reply = respInt(0)
+			return updateNone
+		}
+		entry.Value = hllEncode(regs)
+		reply = respInt(1)
+		return updateStore
+	})
+
+	return reply
+}
+
+// pfcountCommand implements PFCOUNT key [key ...]. A single key uses the
+// cached cardinality while it is valid and otherwise counts the registers
+// without storing the result, so that PFCOUNT stays a read. Several keys are
+// counted as a union.
+func pfcountCommand(c *Cache, args []string) string {
+	if len(args) == 2 {
+		var reply string
+		c.View(args[1], func(entry CacheEntry, exists bool) {
+			switch {
+			case !exists:
+				reply = respInt(0)
+			case !hllValid(entry.Value):
+				reply = errNotHLL
+			case entry.Value[15]&0x80 == 0:
+				reply = respInt(int64(binary.LittleEndian.Uint64([]byte(entry.Value[8:16]))))
+			default:
+				regs, _ := hllRegistersOf(entry.Value)
+				reply = respInt(int64(hllCount(regs)))
+			}
+		})
+		return reply
+	}
+
+	union := make([]uint8, hllRegisters)
+	for _, key := range args[1:] {
+		value, exists := c.Get(key)
+		if !exists {
+			continue
+		}
+		regs, ok := hllRegistersOf(value)
+		if !ok {
+			return errNotHLL
+		}
+		for i, v := range regs {
+			union[i] = max(union[i], v)
+		}
+	}
+
+	return respInt(int64(hllCount(union)))
+}
+
+// pfmergeCommand implements PFMERGE destkey [sourcekey ...]
+func pfmergeCommand(c *Cache, args []string) string {
+	union := make([]uint8, hllRegisters)
+	for _, key := range args[2:] {
+		value, exists := c.Get(key)
+		if !exists {
+			continue
+		}
+		regs, ok := hllRegistersOf(value)
+		if !ok {
+			return errNotHLL
+		}
+		for i, v := range regs {
+			union[i] = max(union[i], v)
+		}
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists {
+			regs, ok := hllRegistersOf(entry.Value)
+			if !ok {
+				reply = errNotHLL
+				return updateNone
+			}
+			for i, v := range regs {
+				union[i] = max(union[i], v)
+			}
+		}
+		entry.Value = hllEncode(union)
+		reply = respOK()
+		return updateStore
+	})
+
+	return reply
+}
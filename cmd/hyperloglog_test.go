@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// pfadd adds the elements prefix+from up to prefix+to to key, 1000 per PFADD
+func pfadd(c *Cache, key, prefix string, from, to int) {
+	for start := from; start < to; start += 1000 {
+		args := []string{"PFADD", key}
+		for i := start; i < min(start+1000, to); i++ {
+			args = append(args, prefix+strconv.Itoa(i))
+		}
+		executeCommand(c, args)
+	}
+}
+
+// pfcount returns the reply of PFCOUNT as a number
+func pfcount(t *testing.T, c *Cache, keys ...string) float64 {
+	t.Helper()
+	reply := executeCommand(c, append([]string{"PFCOUNT"}, keys...))
+	n, err := strconv.Atoi(reply[1 : len(reply)-2])
+	if reply[0] != ':' || err != nil {
+		t.Fatalf("PFCOUNT %v = %q", keys, reply)
+	}
+	return float64(n)
+}
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	for _, n := range []int{10, 1000, 20000, 200000} {
+		c := newTestCache(t)
+		pfadd(c, "hll", "element:", 0, n)
+		// Four standard errors of 0.81%, and small sets are close to exact
+		if got := pfcount(t, c, "hll"); math.Abs(got-float64(n)) > max(0.0324*float64(n), 1) {
+			t.Errorf("PFCOUNT of %d elements = %v", n, got)
+		}
+	}
+}
+
+func TestHyperLogLogEncodings(t *testing.T) {
+	c := newTestCache(t)
+	pfadd(c, "hll", "x", 0, 100)
+	value, _ := c.Get("hll")
+	if !hllValid(value) || value[4] != hllSparse {
+		t.Fatalf("100 elements are not stored sparse")
+	}
+	pfadd(c, "hll", "x", 100, 50000)
+	value, _ = c.Get("hll")
+	if !hllValid(value) || value[4] != hllDense || len(value) != hllDenseSize {
+		t.Fatalf("50000 elements are not stored dense")
+	}
+	before := pfcount(t, c, "hll")
+	pfadd(c, "hll", "x", 0, 50000)
+	if got := pfcount(t, c, "hll"); got != before {
+		t.Fatalf("adding the same elements again changed the count from %v to %v", before, got)
+	}
+}
+
+func TestPFAddAndCount(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "str", "hello"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PFCOUNT", "hll"}, ":0\r\n"},
+		{[]string{"PFADD", "hll"}, ":1\r\n"},
+		{[]string{"PFADD", "hll"}, ":0\r\n"},
+		{[]string{"PFADD", "hll", "a", "b", "c"}, ":1\r\n"},
+		{[]string{"PFADD", "hll", "a", "b"}, ":0\r\n"},
+		{[]string{"PFCOUNT", "hll"}, ":3\r\n"},
+		{[]string{"PFCOUNT", "hll", "missing"}, ":3\r\n"},
+		{[]string{"PFADD", "str", "a"}, errNotHLL},
+		{[]string{"PFCOUNT", "str"}, errNotHLL},
+		{[]string{"PFCOUNT", "hll", "str"}, errNotHLL},
+		{[]string{"PFMERGE", "dest", "str"}, errNotHLL},
+		{[]string{"PFMERGE", "str", "hll"}, errNotHLL},
+		{[]string{"PFADD"}, "-ERR wrong number of arguments for 'pfadd' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPFCountDoesNotStore(t *testing.T) {
+	c := newTestCache(t)
+	pfadd(c, "hll", "x", 0, 10)
+	value, _ := c.Get("hll")
+	pfcount(t, c, "hll")
+	if after, _ := c.Get("hll"); after != value {
+		t.Fatal("PFCOUNT of one key modified it")
+	}
+}
+
+func TestPFMergeAndUnion(t *testing.T) {
+	c := newTestCache(t)
+	pfadd(c, "a", "x", 0, 10000)
+	pfadd(c, "b", "x", 5000, 15000)
+	pfadd(c, "dest", "y", 0, 5000)
+
+	if got := pfcount(t, c, "a", "b"); math.Abs(got-15000) > 0.0324*15000 {
+		t.Fatalf("PFCOUNT a b = %v, want about 15000", got)
+	}
+	if got := executeCommand(c, []string{"PFMERGE", "dest", "a", "b", "missing"}); got != respOK() {
+		t.Fatalf("PFMERGE = %q", got)
+	}
+	if got := pfcount(t, c, "dest"); math.Abs(got-20000) > 0.0324*20000 {
+		t.Fatalf("merged count = %v, want about 20000", got)
+	}
+	if got := executeCommand(c, []string{"PFMERGE", "empty"}); got != respOK() {
+		t.Fatalf("PFMERGE without sources = %q", got)
+	}
+	if got := pfcount(t, c, "empty"); got != 0 {
+		t.Fatalf("PFMERGE without sources counts %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// infoHeaders returns the section headers of an INFO reply
+func infoHeaders(reply string) []string {
+	var headers []string
+	for _, line := range strings.Split(reply, "\r\n") {
+		if strings.HasPrefix(line, "# ") {
+			headers = append(headers, line[2:])
+		}
+	}
+	return headers
+}
+
+func TestInfoSections(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	quiet := "Server Clients Memory Persistence Stats Replication Cpu Errorstats Keyspace"
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"INFO"}, quiet},
+		{[]string{"INFO", "default"}, quiet},
+		{[]string{"INFO", "all"}, "Server Clients Memory Persistence Stats Replication Cpu Commandstats Errorstats Keyspace"},
+		{[]string{"INFO", "everything"}, "Server Clients Memory Persistence Stats Replication Cpu Commandstats Errorstats Keyspace"},
+		{[]string{"INFO", "KEYSPACE", "server"}, "Server Keyspace"},
+		{[]string{"INFO", "commandstats"}, "Commandstats"},
+		{[]string{"INFO", "nope"}, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(infoHeaders(infoCommand(c, tt.args)), " "); got != tt.want {
+			t.Fatalf("%v sections = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := infoCommand(c, []string{"INFO", "nope"}); got != respBulk("") {
+		t.Fatalf("INFO nope = %q, want an empty bulk string", got)
+	}
+	if got := infoCommand(c, []string{"INFO", "server"}); !strings.Contains(got, "\r\ntcp_port:8989\r\n") {
+		t.Fatalf("INFO server = %q, want tcp_port:8989", got)
+	}
+}
+
+func TestInfoStats(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	send, expect := testConn(t, c)
+	send("SET a 1")
+	expect("OK\r\n")
+	send("GET a")
+	expect("1\r\n")
+	send("GET")
+	expect(respError("wrong number of arguments for 'get' command"))
+	send("NOPE")
+	expect("-ERR ")
+
+	got := infoCommand(c, []string{"INFO", "commandstats", "errorstats", "stats"})
+	for _, want := range []string{
+		"\r\ncmdstat_get:calls=2,",
+		",rejected_calls=0,failed_calls=1\r\n",
+		"\r\ncmdstat_set:calls=1,",
+		"\r\nerrorstat_ERR:count=2\r\n",
+		"\r\ntotal_commands_processed:3\r\n",
+		"\r\ntotal_error_replies:2\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("INFO = %q, want it to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "cmdstat_del") {
+		t.Fatalf("INFO commandstats shows a command that was never called: %q", got)
+	}
+}
+
+func TestInfoErrorCodesCapped(t *testing.T) {
+	c := newTestCache(t)
+	for i := 0; i < 200; i++ {
+		c.commandStats.recordError(fmt.Sprintf("-CODE%03d made up\r\n", i))
+	}
+	codes, counts := c.commandStats.errorCounts()
+	if len(codes) != maxErrorCodes {
+		t.Fatalf("%d error codes are counted, want %d", len(codes), maxErrorCodes)
+	}
+	if counts["CODE126"] != 1 || counts["CODE127"] != 0 || counts[errorCodeOther] != 73 {
+		t.Fatalf("CODE126 = %d, CODE127 = %d, OTHER = %d, want 1, 0 and 73",
+			counts["CODE126"], counts["CODE127"], counts[errorCodeOther])
+	}
+
+	// Codes that are already counted keep their own count
+	c.commandStats.recordError("-CODE000 again\r\n")
+	if _, counts := c.commandStats.errorCounts(); counts["CODE000"] != 2 {
+		t.Fatalf("CODE000 = %d after a second error, want 2", counts["CODE000"])
+	}
+}
+
+func TestInfoKeyspace(t *testing.T) {
+	c := newTestCache(t)
+	if got := infoCommand(c, []string{"INFO", "keyspace"}); got != respBulk("# Keyspace\r\n") {
+		t.Fatalf("INFO keyspace of an empty cache = %q", got)
+	}
+	executeCommand(c, []string{"SET", "a", "1"})
+	executeCommand(c, []string{"SET", "b", "1", "EX", "100"})
+	executeCommand(c, []string{"SET", "c", "1", "EX", "100"})
+	executeCommand(c, []string{"DEL", "c"})
+	got := infoCommand(c, []string{"INFO", "keyspace"})
+	if !strings.Contains(got, "\r\ndb0:keys=2,expires=1,avg_ttl=") {
+		t.Fatalf("INFO keyspace = %q, want 2 keys and 1 with a TTL", got)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.00K"},
+		{3 << 19, "1.50M"},
+		{5 << 30, "5.00G"},
+	}
+	for _, tt := range tests {
+		if got := humanBytes(tt.n); got != tt.want {
+			t.Fatalf("humanBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
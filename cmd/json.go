@@ -0,0 +1,937 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+)
+
+func init() {
+	registerCommand("JSON.SET", -4, flagWrite|flagDenyOOM, jsonSetCommand)
+	registerCommand("JSON.GET", -2, flagReadOnly, jsonGetCommand)
+	registerCommand("JSON.DEL", -2, flagWrite, jsonDelCommand)
+	registerCommand("JSON.NUMINCRBY", 4, flagWrite|flagDenyOOM, jsonNumIncrByCommand)
+	registerCommand("JSON.ARRAPPEND", -4, flagWrite|flagDenyOOM, jsonArrAppendCommand)
+	registerCommand("JSON.OBJKEYS", -2, flagReadOnly, jsonObjKeysCommand)
+}
+
+// Kinds of JSON values
+const (
+	jsonNull = iota
+	jsonBool
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// jsonValue is a node of a parsed JSON document. Objects keep their keys in
+// insertion order so documents are returned the way they were written.
+type jsonValue struct {
+	kind   int
+	b      bool
+	str    string // String contents or the literal of a number
+	items  []*jsonValue
+	keys   []string
+	fields map[string]*jsonValue
+}
+
+// jsonDoc is the Object stored in the cache for JSON values
+type jsonDoc struct {
+	root  *jsonValue
+	bytes int64 // Size of root, adjusted as the commands change it
+}
+
+// newJSONDoc wraps a parsed value as a document
+func newJSONDoc(root *jsonValue) *jsonDoc {
+	return &jsonDoc{root: root, bytes: root.size()}
+}
+
+// Type implements Object
+func (d *jsonDoc) Type() string {
+	return "json"
+}
+
+// MemoryUsage implements memoryUser. The size is kept up to date by the
+// commands, so that storing a large document does not walk it every time.
+func (d *jsonDoc) MemoryUsage() int64 {
+	return d.bytes
+}
+
+// String implements Object, documents are pretty printed for the dashboard
+func (d *jsonDoc) String() string {
+	return d.root.encode("  ", "\n", " ")
+}
+
+// parseJSON parses a complete JSON text
+func parseJSON(s string) (*jsonValue, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing characters after JSON value")
+	}
+	return v, nil
+}
+
+// decodeJSONValue reads one value from the token stream
+func decodeJSONValue(dec *json.Decoder) (*jsonValue, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case nil:
+		return &jsonValue{kind: jsonNull}, nil
+	case bool:
+		return &jsonValue{kind: jsonBool, b: t}, nil
+	case json.Number:
+		return &jsonValue{kind: jsonNumber, str: t.String()}, nil
+	case string:
+		return &jsonValue{kind: jsonString, str: t}, nil
+	case json.Delim:
+		if t == '[' {
+			v := &jsonValue{kind: jsonArray}
+			for dec.More() {
+				item, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				v.items = append(v.items, item)
+			}
+			_, err := dec.Token()
+			return v, err
+		}
+
+		v := &jsonValue{kind: jsonObject, fields: make(map[string]*jsonValue)}
+		for dec.More() {
+			keyTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			field, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			v.set(keyTok.(string), field)
+		}
+		_, err := dec.Token()
+		return v, err
+	}
+
+	return nil, errors.New("unexpected JSON token")
+}
+
+// set adds or replaces an object field
+func (v *jsonValue) set(key string, field *jsonValue) {
+	if _, exists := v.fields[key]; !exists {
+		v.keys = append(v.keys, key)
+	}
+	v.fields[key] = field
+}
+
+// remove deletes an object field
+func (v *jsonValue) remove(key string) {
+	delete(v.fields, key)
+	for i, k := range v.keys {
+		if k == key {
+			v.keys = append(v.keys[:i], v.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// clone returns a deep copy of v
+func (v *jsonValue) clone() *jsonValue {
+	c := &jsonValue{kind: v.kind, b: v.b, str: v.str}
+	for _, item := range v.items {
+		c.items = append(c.items, item.clone())
+	}
+	if v.kind == jsonObject {
+		c.fields = make(map[string]*jsonValue, len(v.fields))
+		for _, k := range v.keys {
+			c.set(k, v.fields[k].clone())
+		}
+	}
+	return c
+}
+
+// Estimated bytes an array item and an object field take in their parent,
+// besides the value itself
+const jsonItemOverhead = 8
+
+func jsonFieldOverhead(key string) int64 {
+	return 2*int64(len(key)) + 48
+}
+
+// size estimates the bytes used by v and its children
+func (v *jsonValue) size() int64 {
+	n := int64(unsafe.Sizeof(*v)) + int64(len(v.str))
+	for _, item := range v.items {
+		n += jsonItemOverhead + item.size()
+	}
+	for _, k := range v.keys {
+		n += jsonFieldOverhead(k) + v.fields[k].size()
+	}
+	return n
+}
+
+// walk calls fn for every descendant of v
+func (v *jsonValue) walk(fn func(*jsonValue)) {
+	for _, item := range v.items {
+		fn(item)
+		item.walk(fn)
+	}
+	for _, k := range v.keys {
+		fn(v.fields[k])
+		v.fields[k].walk(fn)
+	}
+}
+
+// encode serializes v. Empty indent, newline and space give compact output.
+func (v *jsonValue) encode(indent, newline, space string) string {
+	var b strings.Builder
+	v.write(&b, indent, newline, space, 0)
+	return b.String()
+}
+
+func (v *jsonValue) write(b *strings.Builder, indent, newline, space string, level int) {
+	switch v.kind {
+	case jsonNull:
+		b.WriteString("null")
+	case jsonBool:
+		b.WriteString(strconv.FormatBool(v.b))
+	case jsonNumber:
+		b.WriteString(v.str)
+	case jsonString:
+		writeJSONString(b, v.str)
+
+	case jsonArray:
+		if len(v.items) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteByte('[')
+		for i, item := range v.items {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(newline + strings.Repeat(indent, level+1))
+			item.write(b, indent, newline, space, level+1)
+		}
+		b.WriteString(newline + strings.Repeat(indent, level) + "]")
+
+	case jsonObject:
+		if len(v.keys) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteByte('{')
+		for i, k := range v.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(newline + strings.Repeat(indent, level+1))
+			writeJSONString(b, k)
+			b.WriteString(":" + space)
+			v.fields[k].write(b, indent, newline, space, level+1)
+		}
+		b.WriteString(newline + strings.Repeat(indent, level) + "}")
+	}
+}
+
+// writeJSONString writes s as a quoted JSON string
+func writeJSONString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || (r == utf8.RuneError && size == 1):
+			b.WriteString(`\u00`)
+			b.WriteString(strconv.FormatUint(uint64(s[i])>>4, 16))
+			b.WriteString(strconv.FormatUint(uint64(s[i])&0xF, 16))
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('"')
+}
+
+// Kinds of JSONPath segments
+const (
+	segKey = iota
+	segIndex
+	segWildcard
+)
+
+// jsonPathSeg is one step of a JSONPath
+type jsonPathSeg struct {
+	kind      int
+	key       string
+	index     int
+	recursive bool // Applies to the node and all of its descendants (..)
+}
+
+// jsonPath is a compiled path. Paths starting with $ are JSONPath and
+// return every match; anything else is a legacy path that addresses a
+// single value.
+type jsonPath struct {
+	segs   []jsonPathSeg
+	legacy bool
+}
+
+// parseJSONPath compiles the supported JSONPath subset: $, .key, ..key,
+// ['key'], [index], [*] and .*
+func parseJSONPath(s string) (*jsonPath, bool) {
+	p := &jsonPath{}
+	switch {
+	case strings.HasPrefix(s, "$"):
+		s = s[1:]
+	case s == ".":
+		s = ""
+		p.legacy = true
+	case strings.HasPrefix(s, ".") || strings.HasPrefix(s, "["):
+		p.legacy = true
+	default:
+		s = "." + s
+		p.legacy = true
+	}
+
+	recursive := false
+	for len(s) > 0 {
+		seg := jsonPathSeg{recursive: recursive}
+		recursive = false
+
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			if strings.HasPrefix(s, ".") {
+				seg.recursive = true
+				s = s[1:]
+			}
+			// A recursive descent written as ..[x] applies to the bracket
+			if seg.recursive && strings.HasPrefix(s, "[") {
+				recursive = true
+				continue
+			}
+			end := strings.IndexAny(s, ".[")
+			if end == -1 {
+				end = len(s)
+			}
+			name := s[:end]
+			s = s[end:]
+			switch name {
+			case "":
+				return nil, false
+			case "*":
+				seg.kind = segWildcard
+			default:
+				seg.kind, seg.key = segKey, name
+			}
+
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end == -1 {
+				return nil, false
+			}
+			inner := s[1:end]
+			s = s[end+1:]
+			switch {
+			case inner == "*":
+				seg.kind = segWildcard
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				seg.kind, seg.key = segKey, inner[1:len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, false
+				}
+				seg.kind, seg.index = segIndex, n
+			}
+
+		default:
+			return nil, false
+		}
+
+		p.segs = append(p.segs, seg)
+	}
+	if recursive {
+		return nil, false
+	}
+
+	return p, true
+}
+
+// jsonMatch is a location selected by a path. node is nil for a missing
+// object field that may be created by JSON.SET.
+type jsonMatch struct {
+	parent *jsonValue
+	key    string
+	index  int
+	node   *jsonValue
+}
+
+// step applies a single non-recursive segment to a node
+func (seg jsonPathSeg) step(v *jsonValue, create bool, out []jsonMatch) []jsonMatch {
+	switch seg.kind {
+	case segKey:
+		if v.kind != jsonObject {
+			return out
+		}
+		if child, ok := v.fields[seg.key]; ok {
+			return append(out, jsonMatch{parent: v, key: seg.key, node: child})
+		}
+		if create {
+			return append(out, jsonMatch{parent: v, key: seg.key})
+		}
+
+	case segIndex:
+		if v.kind != jsonArray {
+			return out
+		}
+		i := seg.index
+		if i < 0 {
+			i += len(v.items)
+		}
+		if i >= 0 && i < len(v.items) {
+			return append(out, jsonMatch{parent: v, index: i, node: v.items[i]})
+		}
+
+	case segWildcard:
+		switch v.kind {
+		case jsonObject:
+			for _, k := range v.keys {
+				out = append(out, jsonMatch{parent: v, key: k, node: v.fields[k]})
+			}
+		case jsonArray:
+			for i, item := range v.items {
+				out = append(out, jsonMatch{parent: v, index: i, node: item})
+			}
+		}
+	}
+	return out
+}
+
+// descend applies a recursive segment to v and all of its descendants
+func (seg jsonPathSeg) descend(v *jsonValue, out []jsonMatch) []jsonMatch {
+	out = seg.step(v, false, out)
+	for _, item := range v.items {
+		out = seg.descend(item, out)
+	}
+	for _, k := range v.keys {
+		out = seg.descend(v.fields[k], out)
+	}
+	return out
+}
+
+// eval returns the locations selected by the path. With create set, a
+// missing object field named by the final segment is returned as a match
+// with a nil node.
+func (p *jsonPath) eval(root *jsonValue, create bool) []jsonMatch {
+	matches := []jsonMatch{{node: root}}
+	for i, seg := range p.segs {
+		last := i == len(p.segs)-1
+		var next []jsonMatch
+		for _, m := range matches {
+			if m.node == nil {
+				continue
+			}
+			if seg.recursive {
+				next = seg.descend(m.node, next)
+			} else {
+				next = seg.step(m.node, create && last, next)
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// replace stores v at the matched location, returning the new root
+func (m jsonMatch) replace(root, v *jsonValue) *jsonValue {
+	switch {
+	case m.parent == nil:
+		return v
+	case m.parent.kind == jsonObject:
+		m.parent.set(m.key, v)
+	default:
+		m.parent.items[m.index] = v
+	}
+	return root
+}
+
+// outermost returns the matches that do not lie within another match, each
+// once. Replacing or removing those accounts for the size of the rest.
+func outermost(matches []jsonMatch) []jsonMatch {
+	matched := make(map[*jsonValue]bool, len(matches))
+	inner := make(map[*jsonValue]bool)
+	for _, m := range matches {
+		if m.node != nil {
+			matched[m.node] = true
+			m.node.walk(func(n *jsonValue) { inner[n] = true })
+		}
+	}
+
+	var top []jsonMatch
+	seen := make(map[*jsonValue]bool, len(matches))
+	for _, m := range matches {
+		switch {
+		case m.node == nil:
+			// A new field, inside a match if its object is
+			if inner[m.parent] || matched[m.parent] {
+				continue
+			}
+		case inner[m.node] || seen[m.node]:
+			continue
+		}
+		seen[m.node] = true
+		top = append(top, m)
+	}
+	return top
+}
+
+// Complete error replies shared by the JSON commands
+const (
+	errJSONPath    = "-ERR invalid JSON path\r\n"
+	errJSONNoKey   = "-ERR could not perform this operation on a key that doesn't exist\r\n"
+	errJSONNewRoot = "-ERR new objects must be created at the root\r\n"
+)
+
+// updateJSON runs fn against the document stored at key. fn is called with
+// a nil document when the key does not exist.
+func updateJSON(c *Cache, key string, fn func(doc *jsonDoc) (string, int)) string {
+	var reply string
+	c.Update(key, func(entry *CacheEntry, exists bool) int {
+		var doc *jsonDoc
+		if exists {
+			var ok bool
+			if doc, ok = entry.Object.(*jsonDoc); !ok {
+				reply = errWrongType
+				return updateNone
+			}
+		}
+
+		var result int
+		reply, result = fn(doc)
+		if result == updateStore && doc == nil {
+			return updateNone
+		}
+		return result
+	})
+	return reply
+}
+
+// viewJSON runs fn against the document stored at key under the shard's
+// read lock. doc is nil when the key does not exist.
+func viewJSON(c *Cache, key string, fn func(doc *jsonDoc) string) string {
+	var reply string
+	c.View(key, func(entry CacheEntry, exists bool) {
+		var doc *jsonDoc
+		if exists {
+			var ok bool
+			if doc, ok = entry.Object.(*jsonDoc); !ok {
+				reply = errWrongType
+				return
+			}
+		}
+		reply = fn(doc)
+	})
+	return reply
+}
+
+// jsonSetCommand implements JSON.SET key path value [NX|XX]
+func jsonSetCommand(c *Cache, args []string) string {
+	path, ok := parseJSONPath(args[2])
+	if !ok {
+		return errJSONPath
+	}
+	value, err := parseJSON(args[3])
+	if err != nil {
+		return respError("invalid JSON: " + err.Error())
+	}
+
+	var nx, xx bool
+	switch {
+	case len(args) == 4:
+	case len(args) == 5 && strings.EqualFold(args[4], "NX"):
+		nx = true
+	case len(args) == 5 && strings.EqualFold(args[4], "XX"):
+		xx = true
+	default:
+		return respError(errSyntax)
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			if len(path.segs) > 0 {
+				reply = errJSONNewRoot
+				return updateNone
+			}
+			if xx {
+				reply = respNil()
+				return updateNone
+			}
+			entry.Object = newJSONDoc(value)
+			reply = respOK()
+			return updateStore
+		}
+
+		doc, ok := entry.Object.(*jsonDoc)
+		if !ok {
+			reply = errWrongType
+			return updateNone
+		}
+
+		matches := path.eval(doc.root, !xx)
+		var targets []jsonMatch
+		for _, m := range matches {
+			if (nx && m.node != nil) || (xx && m.node == nil) {
+				continue
+			}
+			targets = append(targets, m)
+		}
+		if len(targets) == 0 {
+			reply = respNil()
+			return updateNone
+		}
+
+		// Only the outermost targets change the size, targets within them
+		// end up detached from the document
+		valueSize := value.size()
+		for _, m := range outermost(targets) {
+			switch {
+			case m.node != nil:
+				doc.bytes += valueSize - m.node.size()
+			case m.parent.kind == jsonObject:
+				doc.bytes += valueSize + jsonFieldOverhead(m.key)
+			}
+		}
+		for i, m := range targets {
+			v := value
+			if i > 0 {
+				v = value.clone()
+			}
+			doc.root = m.replace(doc.root, v)
+		}
+		reply = respOK()
+		return updateStore
+	})
+
+	return reply
+}
+
+// jsonGetCommand implements JSON.GET key [INDENT s] [NEWLINE s] [SPACE s]
+// [path ...]
+func jsonGetCommand(c *Cache, args []string) string {
+	var indent, newline, space string
+	var paths []*jsonPath
+	var names []string
+
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if (opt == "INDENT" || opt == "NEWLINE" || opt == "SPACE") && i+1 < len(args) {
+			switch opt {
+			case "INDENT":
+				indent = args[i+1]
+			case "NEWLINE":
+				newline = args[i+1]
+			case "SPACE":
+				space = args[i+1]
+			}
+			i++
+			continue
+		}
+
+		path, ok := parseJSONPath(args[i])
+		if !ok {
+			return errJSONPath
+		}
+		paths = append(paths, path)
+		names = append(names, args[i])
+	}
+	if len(paths) == 0 {
+		paths, names = []*jsonPath{{legacy: true}}, []string{"."}
+	}
+
+	return viewJSON(c, args[1], func(doc *jsonDoc) string {
+		if doc == nil {
+			return respNil()
+		}
+
+		results := make([]*jsonValue, len(paths))
+		for i, path := range paths {
+			matches := path.eval(doc.root, false)
+			if path.legacy {
+				if len(matches) == 0 {
+					return respError("Path '" + names[i] + "' does not exist")
+				}
+				results[i] = matches[0].node
+				continue
+			}
+			arr := &jsonValue{kind: jsonArray}
+			for _, m := range matches {
+				arr.items = append(arr.items, m.node)
+			}
+			results[i] = arr
+		}
+
+		if len(results) == 1 {
+			return respBulk(results[0].encode(indent, newline, space))
+		}
+
+		obj := &jsonValue{kind: jsonObject, fields: make(map[string]*jsonValue)}
+		for i, name := range names {
+			obj.set(name, results[i])
+		}
+		return respBulk(obj.encode(indent, newline, space))
+	})
+}
+
+// jsonDelCommand implements JSON.DEL key [path]
+func jsonDelCommand(c *Cache, args []string) string {
+	if len(args) > 3 {
+		return respError(errSyntax)
+	}
+	path := &jsonPath{legacy: true}
+	if len(args) == 3 {
+		var ok bool
+		if path, ok = parseJSONPath(args[2]); !ok {
+			return errJSONPath
+		}
+	}
+
+	return updateJSON(c, args[1], func(doc *jsonDoc) (string, int) {
+		if doc == nil {
+			return respInt(0), updateNone
+		}
+		if len(path.segs) == 0 {
+			return respInt(1), updateDelete
+		}
+
+		matches := path.eval(doc.root, false)
+		if len(matches) == 0 {
+			return respInt(0), updateNone
+		}
+
+		for _, m := range outermost(matches) {
+			if m.parent.kind == jsonObject {
+				doc.bytes -= jsonFieldOverhead(m.key) + m.node.size()
+			} else {
+				doc.bytes -= jsonItemOverhead + m.node.size()
+			}
+		}
+
+		// Remove array items back to front so earlier indexes stay valid
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].index > matches[j].index
+		})
+		for _, m := range matches {
+			if m.parent.kind == jsonObject {
+				m.parent.remove(m.key)
+			} else {
+				m.parent.items = append(m.parent.items[:m.index], m.parent.items[m.index+1:]...)
+			}
+		}
+		return respInt(int64(len(matches))), updateStore
+	})
+}
+
+// addJSONNumbers adds two number literals, keeping integers exact
+func addJSONNumbers(a, b string) (string, bool) {
+	x, errX := strconv.ParseInt(a, 10, 64)
+	y, errY := strconv.ParseInt(b, 10, 64)
+	if errX == nil && errY == nil {
+		if sum := x + y; (sum > x) == (y > 0) {
+			return strconv.FormatInt(sum, 10), true
+		}
+	}
+
+	fx, errX := strconv.ParseFloat(a, 64)
+	fy, errY := strconv.ParseFloat(b, 64)
+	if errX != nil || errY != nil {
+		return "", false
+	}
+	sum := fx + fy
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", false
+	}
+	return strconv.FormatFloat(sum, 'g', -1, 64), true
+}
+
+// jsonNumIncrByCommand implements JSON.NUMINCRBY key path value
+func jsonNumIncrByCommand(c *Cache, args []string) string {
+	path, ok := parseJSONPath(args[2])
+	if !ok {
+		return errJSONPath
+	}
+	incr, err := parseJSON(args[3])
+	if err != nil || incr.kind != jsonNumber {
+		return respError("increment must be a number")
+	}
+
+	return updateJSON(c, args[1], func(doc *jsonDoc) (string, int) {
+		if doc == nil {
+			return errJSONNoKey, updateNone
+		}
+
+		// Every sum is computed before any is stored, so that a sum that
+		// overflows leaves all matches unchanged
+		matches := path.eval(doc.root, false)
+		sums := make([]string, len(matches))
+		for i, m := range matches {
+			if m.node.kind != jsonNumber {
+				continue
+			}
+			sum, ok := addJSONNumbers(m.node.str, incr.str)
+			if !ok {
+				return respError("result is not a finite number"), updateNone
+			}
+			sums[i] = sum
+		}
+
+		result := &jsonValue{kind: jsonArray}
+		changed := false
+		for i, m := range matches {
+			if m.node.kind != jsonNumber {
+				result.items = append(result.items, &jsonValue{kind: jsonNull})
+				continue
+			}
+			doc.bytes += int64(len(sums[i]) - len(m.node.str))
+			m.node.str = sums[i]
+			result.items = append(result.items, m.node)
+			changed = true
+		}
+
+		if path.legacy {
+			if !changed {
+				return respError("Path '" + args[2] + "' does not exist or does not hold a number"), updateNone
+			}
+			for _, item := range result.items {
+				if item.kind == jsonNumber {
+					return respBulk(item.str), updateStore
+				}
+			}
+		}
+		if !changed {
+			return respBulk(result.encode("", "", "")), updateNone
+		}
+		return respBulk(result.encode("", "", "")), updateStore
+	})
+}
+
+// jsonArrAppendCommand implements JSON.ARRAPPEND key path value [value ...]
+func jsonArrAppendCommand(c *Cache, args []string) string {
+	path, ok := parseJSONPath(args[2])
+	if !ok {
+		return errJSONPath
+	}
+	values := make([]*jsonValue, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		v, err := parseJSON(arg)
+		if err != nil {
+			return respError("invalid JSON: " + err.Error())
+		}
+		values = append(values, v)
+	}
+
+	return updateJSON(c, args[1], func(doc *jsonDoc) (string, int) {
+		if doc == nil {
+			return errJSONNoKey, updateNone
+		}
+
+		var items []string
+		changed := false
+		for _, m := range path.eval(doc.root, false) {
+			if m.node.kind != jsonArray {
+				items = append(items, respNil())
+				continue
+			}
+			for i, v := range values {
+				if changed || i > 0 {
+					v = v.clone()
+				}
+				m.node.items = append(m.node.items, v)
+				doc.bytes += jsonItemOverhead + v.size()
+			}
+			items = append(items, respInt(int64(len(m.node.items))))
+			changed = true
+		}
+
+		result := updateNone
+		if changed {
+			result = updateStore
+		}
+		if path.legacy {
+			for _, item := range items {
+				if item != respNil() {
+					return item, result
+				}
+			}
+			return respError("Path '" + args[2] + "' does not exist or is not an array"), result
+		}
+		return respArray(items), result
+	})
+}
+
+// jsonObjKeysCommand implements JSON.OBJKEYS key [path]
+func jsonObjKeysCommand(c *Cache, args []string) string {
+	if len(args) > 3 {
+		return respError(errSyntax)
+	}
+	path := &jsonPath{legacy: true}
+	if len(args) == 3 {
+		var ok bool
+		if path, ok = parseJSONPath(args[2]); !ok {
+			return errJSONPath
+		}
+	}
+
+	return viewJSON(c, args[1], func(doc *jsonDoc) string {
+		if doc == nil {
+			return respNil()
+		}
+
+		var items []string
+		for _, m := range path.eval(doc.root, false) {
+			if m.node.kind != jsonObject {
+				items = append(items, respNil())
+				continue
+			}
+			keys := make([]string, 0, len(m.node.keys))
+			for _, k := range m.node.keys {
+				keys = append(keys, respBulk(k))
+			}
+			items = append(items, respArray(keys))
+		}
+
+		if path.legacy {
+			if len(items) == 0 {
+				return respNil()
+			}
+			return items[0]
+		}
+		return respArray(items)
+	})
+}
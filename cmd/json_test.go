@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestJSONNumIncrByMultiPath(t *testing.T) {
+	const doc = `{"a":1,"b":{"a":2.5},"c":{"a":"x"}}`
+	const huge = `{"a":1,"b":{"a":1.7e308}}`
+	tests := []struct {
+		name    string
+		doc     string
+		path    string
+		incr    string
+		want    string
+		wantDoc string
+	}{
+		{"every match", doc, "$..a", "2", "$12\r\n[3,4.5,null]\r\n", `{"a":3,"b":{"a":4.5},"c":{"a":"x"}}`},
+		{"legacy path", doc, ".b.a", "2", "$3\r\n4.5\r\n", `{"a":1,"b":{"a":4.5},"c":{"a":"x"}}`},
+		{"no numbers", doc, "$.c.a", "1", "$6\r\n[null]\r\n", doc},
+		{"no match", doc, "$.z", "1", "$2\r\n[]\r\n", doc},
+		{"overflow leaves every match", huge, "$..a", "1.7e308", "-ERR result is not a finite number\r\n", huge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			executeCommand(c, []string{"JSON.SET", "k", "$", tt.doc})
+			got := executeCommand(c, []string{"JSON.NUMINCRBY", "k", tt.path, tt.incr})
+			if got != tt.want {
+				t.Fatalf("JSON.NUMINCRBY k %s %s = %q, want %q", tt.path, tt.incr, got, tt.want)
+			}
+			if got := executeCommand(c, []string{"JSON.GET", "k"}); got != respBulk(tt.wantDoc) {
+				t.Fatalf("document is %q, want %q", got, tt.wantDoc)
+			}
+		})
+	}
+}
+
+func TestJSONSizeTracking(t *testing.T) {
+	c := newTestCache(t)
+	commands := [][]string{
+		{"JSON.SET", "k", "$", `{"a":{"a":{"b":[1,2,{"a":3}]}},"b":[[1],[2,[3]]],"c":"x"}`},
+		{"JSON.SET", "k", "$..a", `{"a":[1,2]}`},
+		{"JSON.SET", "k", "$.new", `"value"`},
+		{"JSON.SET", "k", "$..a.b", `[1]`},
+		{"JSON.NUMINCRBY", "k", "$..*", "123456"},
+		{"JSON.ARRAPPEND", "k", "$..b", `{"z":1}`, "2"},
+		{"JSON.ARRAPPEND", "k", "$..a", `[1]`},
+		{"JSON.DEL", "k", "$..a"},
+		{"JSON.DEL", "k", "$.b[0]"},
+		{"JSON.SET", "k", "$", `[{"a":1},{"a":{"a":2}}]`},
+		{"JSON.DEL", "k", "$..*"},
+	}
+	for _, args := range commands {
+		executeCommand(c, args)
+		c.View("k", func(entry CacheEntry, exists bool) {
+			doc := entry.Object.(*jsonDoc)
+			if size := doc.root.size(); doc.bytes != size {
+				t.Fatalf("after %v the document size is %d, want %d", args, doc.bytes, size)
+			}
+		})
+	}
+}
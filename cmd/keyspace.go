@@ -0,0 +1,114 @@
+package main
+
+import "time"
+
+func init() {
+	registerCommand("TYPE", 2, flagReadOnly, typeCommand)
+	registerCommand("EXPIRE", 3, flagWrite, expireCommand)
+	registerCommand("PEXPIRE", 3, flagWrite, expireCommand)
+	registerCommand("TTL", 2, flagReadOnly, ttlCommand)
+	registerCommand("PTTL", 2, flagReadOnly, ttlCommand)
+	registerCommand("PERSIST", 2, flagWrite, persistCommand)
+}
+
+// parseSetTTL parses the EX seconds or PX milliseconds option of SET.
+// Seconds may be fractional. Invalid options give no TTL.
+func parseSetTTL(opts []string) time.Duration {
+	if len(opts) < 2 {
+		return 0
+	}
+	unit := map[string]string{"EX": "s", "PX": "ms"}[opts[0]]
+	if unit == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(opts[1] + unit)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// typeCommand implements TYPE key
+func typeCommand(c *Cache, args []string) string {
+	reply := respSimple("none")
+	c.View(args[1], func(entry CacheEntry, exists bool) {
+		if exists {
+			reply = respSimple(entry.Type())
+		}
+	})
+	return reply
+}
+
+// expireCommand implements EXPIRE key seconds and PEXPIRE key milliseconds.
+// A deadline in the past deletes the key, however far in the past it is.
+func expireCommand(c *Cache, args []string) string {
+	n, ok := parseInt(args[2])
+	if !ok {
+		return respError(errNotInteger)
+	}
+	unit := time.Second
+	if args[0] == "PEXPIRE" {
+		unit = time.Millisecond
+	}
+	if n > int64(time.Duration(1<<62)/unit) {
+		return respError("invalid expire time in '" + args[0] + "' command")
+	}
+	var ttl time.Duration
+	if n > 0 {
+		ttl = time.Duration(n) * unit
+	}
+
+	reply := respInt(0)
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			return updateNone
+		}
+		reply = respInt(1)
+		if ttl <= 0 {
+			return updateDelete
+		}
+		entry.ExpireAt = time.Now().Add(ttl).UnixNano()
+		return updateStore
+	})
+	if reply == respInt(1) && ttl > 0 {
+		c.notify(notifyGeneric, "expire", args[1])
+	}
+	return reply
+}
+
+// ttlCommand implements TTL key and PTTL key. Missing keys give -2 and keys
+// without a deadline -1.
+func ttlCommand(c *Cache, args []string) string {
+	reply := respInt(-2)
+	c.View(args[1], func(entry CacheEntry, exists bool) {
+		switch {
+		case !exists:
+		case entry.ExpireAt == 0:
+			reply = respInt(-1)
+		case args[0] == "PTTL":
+			left := time.Duration(entry.ExpireAt - time.Now().UnixNano())
+			reply = respInt(int64((left + time.Millisecond - 1) / time.Millisecond))
+		default:
+			left := time.Duration(entry.ExpireAt - time.Now().UnixNano())
+			reply = respInt(int64((left + time.Second/2) / time.Second))
+		}
+	})
+	return reply
+}
+
+// persistCommand implements PERSIST key
+func persistCommand(c *Cache, args []string) string {
+	reply := respInt(0)
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists || entry.ExpireAt == 0 {
+			return updateNone
+		}
+		entry.ExpireAt = 0
+		reply = respInt(1)
+		return updateStore
+	})
+	if reply == respInt(1) {
+		c.notify(notifyGeneric, "persist", args[1])
+	}
+	return reply
+}
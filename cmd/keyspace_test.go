@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestExpireCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		want   string
+		exists bool
+	}{
+		{"seconds", []string{"EXPIRE", "k", "100"}, ":1\r\n", true},
+		{"milliseconds", []string{"PEXPIRE", "k", "100000"}, ":1\r\n", true},
+		{"zero deletes", []string{"EXPIRE", "k", "0"}, ":1\r\n", false},
+		{"negative deletes", []string{"PEXPIRE", "k", "-1"}, ":1\r\n", false},
+		{"very negative deletes", []string{"EXPIRE", "k", "-9223372036854775808"}, ":1\r\n", false},
+		{"very negative milliseconds delete", []string{"PEXPIRE", "k", "-9223372036854775807"}, ":1\r\n", false},
+		{"too large", []string{"EXPIRE", "k", "9223372036854775807"}, "-ERR invalid expire time in 'EXPIRE' command\r\n", true},
+		{"not a number", []string{"EXPIRE", "k", "soon"}, "-ERR value is not an integer or out of range\r\n", true},
+		{"missing key", []string{"EXPIRE", "missing", "10"}, ":0\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			executeCommand(c, []string{"SET", "k", "v"})
+			if got := executeCommand(c, tt.args); got != tt.want {
+				t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+			}
+			if _, exists := c.Get("k"); exists != tt.exists {
+				t.Fatalf("after %v k exists = %v, want %v", tt.args, exists, tt.exists)
+			}
+		})
+	}
+}
+
+func TestTTLCommands(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "k", "v"})
+	executeCommand(c, []string{"SET", "t", "v", "EX", "100"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TTL", "missing"}, ":-2\r\n"},
+		{[]string{"TTL", "k"}, ":-1\r\n"},
+		{[]string{"TTL", "t"}, ":100\r\n"},
+		{[]string{"PERSIST", "t"}, ":1\r\n"},
+		{[]string{"PERSIST", "t"}, ":0\r\n"},
+		{[]string{"TTL", "t"}, ":-1\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
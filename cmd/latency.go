@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyHistoryLen is the number of samples kept per event
+const latencyHistoryLen = 160
+
+// Events tracked by the latency monitor. dustdb neither forks for
+// snapshots nor writes an AOF, so the Redis events for those never occur.
+const (
+	latencyCommand       = "command"        // A command run over TCP
+	latencyExpireCycle   = "expire-cycle"   // A pass of the expiry worker
+	latencyEvictionCycle = "eviction-cycle" // Evicting keys to get under maxmemory
+)
+
+// latencySample is the worst latency of an event within one second
+type latencySample struct {
+	time int64 // Unix seconds
+	ms   int64
+}
+
+// latencyEvent holds the recent samples of one event in a ring
+type latencyEvent struct {
+	samples [latencyHistoryLen]latencySample
+	next    int // Index the next sample is written to
+	count   int
+	max     int64 // Worst latency ever seen
+}
+
+// latest returns the newest sample
+func (e *latencyEvent) latest() latencySample {
+	return e.samples[(e.next-1+latencyHistoryLen)%latencyHistoryLen]
+}
+
+// history returns the samples, oldest first
+func (e *latencyEvent) history() []latencySample {
+	samples := make([]latencySample, 0, e.count)
+	for i := e.count; i > 0; i-- {
+		samples = append(samples, e.samples[(e.next-i+latencyHistoryLen)%latencyHistoryLen])
+	}
+	return samples
+}
+
+// latencyMonitor records events that take at least latency-monitor-threshold
+// milliseconds
+type latencyMonitor struct {
+	threshold atomic.Int64 // Milliseconds, 0 disables the monitor
+
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+func newLatencyMonitor() *latencyMonitor {
+	return &latencyMonitor{events: make(map[string]*latencyEvent)}
+}
+
+// add records that event took d. Nothing is locked unless d reaches the
+// threshold. Samples within the same second are merged, keeping the worst.
+func (m *latencyMonitor) add(event string, d time.Duration) {
+	threshold := m.threshold.Load()
+	ms := d.Milliseconds()
+	if threshold == 0 || ms < threshold {
+		return
+	}
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[event]
+	if !ok {
+		e = &latencyEvent{}
+		m.events[event] = e
+	}
+	e.max = max(e.max, ms)
+	if e.count > 0 && e.latest().time == now {
+		last := &e.samples[(e.next-1+latencyHistoryLen)%latencyHistoryLen]
+		last.ms = max(last.ms, ms)
+		return
+	}
+	e.samples[e.next] = latencySample{time: now, ms: ms}
+	e.next = (e.next + 1) % latencyHistoryLen
+	e.count = min(e.count+1, latencyHistoryLen)
+}
+
+// names returns the events with samples, sorted
+func (m *latencyMonitor) names() []string {
+	names := make([]string, 0, len(m.events))
+	for name := range m.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reset drops the samples of the given events, or of all events if none
+// are given, and returns how many events were dropped
+func (m *latencyMonitor) reset(events []string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(events) == 0 {
+		n := len(m.events)
+		m.events = make(map[string]*latencyEvent)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := m.events[event]; ok {
+			delete(m.events, event)
+			n++
+		}
+	}
+	return n
+}
+
+// latencyAdvice explains what can cause spikes of each event
+var latencyAdvice = map[string]string{
+	latencyCommand: "Slow commands. Check SLOWLOG GET for the commands involved and avoid " +
+		"commands that scan the whole keyspace, such as KEYS, on large datasets.",
+	latencyExpireCycle: "Many keys expiring at the same time. The expiry worker holds shard locks " +
+		"while it removes due keys, so spread TTLs out, for example by adding a random jitter.",
+	latencyEvictionCycle: "Writes waiting for keys to be evicted under maxmemory. Raise maxmemory " +
+		"or lower the write rate.",
+}
+
+// doctor writes a human readable report of the recorded events
+func (m *latencyMonitor) doctor() string {
+	threshold := m.threshold.Load()
+	if threshold == 0 {
+		return "Latency monitoring is disabled. Enable it with " +
+			"CONFIG SET latency-monitor-threshold <milliseconds>, for example 100.\n"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.events) == 0 {
+		return fmt.Sprintf("No event took %dms or more since monitoring started or was last reset. "+
+			"Latency looks fine.\n", threshold)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Events that took %dms or more:\n\n", threshold)
+	for i, name := range m.names() {
+		e := m.events[name]
+		samples := e.history()
+		var sum int64
+		for _, s := range samples {
+			sum += s.ms
+		}
+		avg := float64(sum) / float64(len(samples))
+		var deviation float64
+		for _, s := range samples {
+			deviation += abs(float64(s.ms) - avg)
+		}
+		deviation /= float64(len(samples))
+		period := samples[len(samples)-1].time - samples[0].time
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %.0fms, mean deviation %.0fms, over %ds). "+
+			"Worst all time event %dms.\n", i+1, name, len(samples), avg, deviation, period, e.max)
+	}
+	b.WriteString("\nAdvice:\n\n")
+	for _, name := range m.names() {
+		if advice, ok := latencyAdvice[name]; ok {
+			fmt.Fprintf(&b, "- %s: %s\n", name, advice)
+		}
+	}
+	return b.String()
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// latencyMonitorCommand implements LATENCY LATEST, HISTORY event,
+// RESET [event ...] and DOCTOR
+func latencyMonitorCommand(c *Cache, args []string) string {
+	m := c.latency
+	switch strings.ToUpper(args[1]) {
+	case "LATEST":
+		if len(args) != 2 {
+			return respError("wrong number of arguments for 'latency|latest' command")
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var items []string
+		for _, name := range m.names() {
+			e := m.events[name]
+			latest := e.latest()
+			items = append(items, respArray([]string{
+				respBulk(name), respInt(latest.time), respInt(latest.ms), respInt(e.max),
+			}))
+		}
+		return respArray(items)
+	case "HISTORY":
+		if len(args) != 3 {
+			return respError("wrong number of arguments for 'latency|history' command")
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var items []string
+		if e, ok := m.events[args[2]]; ok {
+			for _, s := range e.history() {
+				items = append(items, respArray([]string{respInt(s.time), respInt(s.ms)}))
+			}
+		}
+		return respArray(items)
+	case "RESET":
+		return respInt(int64(m.reset(args[2:])))
+	case "DOCTOR":
+		if len(args) != 2 {
+			return respError("wrong number of arguments for 'latency|doctor' command")
+		}
+		return respBulk(m.doctor())
+	}
+	return respError("unknown subcommand '" + args[1] + "'. Try LATENCY LATEST, HISTORY, RESET or DOCTOR.")
+}
+
+func init() {
+	registerCommand("LATENCY", -2, flagAdmin|flagNoScript, latencyMonitorCommand)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyMonitorAdd(t *testing.T) {
+	m := newLatencyMonitor()
+	m.add(latencyCommand, time.Hour)
+	if len(m.events) != 0 {
+		t.Fatal("disabled monitor recorded an event")
+	}
+
+	m.threshold.Store(10)
+	m.add(latencyCommand, 9*time.Millisecond)
+	if len(m.events) != 0 {
+		t.Fatal("event below the threshold was recorded")
+	}
+
+	// Events within the same second merge into one sample with the worst
+	// latency
+	for {
+		second := time.Now().Unix()
+		m.reset(nil)
+		m.add(latencyCommand, 20*time.Millisecond)
+		m.add(latencyCommand, 30*time.Millisecond)
+		m.add(latencyCommand, 10*time.Millisecond)
+		if time.Now().Unix() != second {
+			continue
+		}
+		e := m.events[latencyCommand]
+		if e.count != 1 || e.latest().ms != 30 || e.max != 30 {
+			t.Fatalf("event has %d samples, latest %dms and max %dms, want 1, 30 and 30", e.count, e.latest().ms, e.max)
+		}
+		break
+	}
+
+	// A full ring drops the oldest sample
+	e := &latencyEvent{max: 500}
+	for i := range e.samples {
+		e.samples[i] = latencySample{time: int64(i + 1), ms: 10}
+	}
+	e.count = latencyHistoryLen
+	m.events[latencyExpireCycle] = e
+	m.add(latencyExpireCycle, 40*time.Millisecond)
+	history := e.history()
+	if len(history) != latencyHistoryLen || history[0].time != 2 || history[len(history)-1].ms != 40 || e.max != 500 {
+		t.Fatalf("history has %d samples from %d to %dms, max %dms", len(history), history[0].time, history[len(history)-1].ms, e.max)
+	}
+}
+
+func TestLatencyDoctor(t *testing.T) {
+	m := newLatencyMonitor()
+	if got := m.doctor(); !strings.HasPrefix(got, "Latency monitoring is disabled.") {
+		t.Fatalf("doctor of a disabled monitor = %q", got)
+	}
+	m.threshold.Store(10)
+	if got := m.doctor(); !strings.HasPrefix(got, "No event took 10ms or more") {
+		t.Fatalf("doctor without events = %q", got)
+	}
+	m.add(latencyEvictionCycle, 25*time.Millisecond)
+	got := m.doctor()
+	for _, want := range []string{
+		"1. eviction-cycle: 1 latency spikes (average 25ms, mean deviation 0ms, over 0s). Worst all time event 25ms.\n",
+		"- eviction-cycle: " + latencyAdvice[latencyEvictionCycle] + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("doctor = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestLatencyCommand(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	executeCommand(c, []string{"CONFIG", "SET", "latency-monitor-threshold", "10"})
+	c.latency.add(latencyCommand, 15*time.Millisecond)
+	c.latency.add(latencyExpireCycle, 12*time.Millisecond)
+	now := c.latency.events[latencyCommand].latest().time
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"LATENCY", "LATEST"}, respArray([]string{
+			respArray([]string{respBulk("command"), respInt(now), respInt(15), respInt(15)}),
+			respArray([]string{respBulk("expire-cycle"), respInt(c.latency.events[latencyExpireCycle].latest().time), respInt(12), respInt(12)}),
+		})},
+		{[]string{"LATENCY", "HISTORY", "command"}, respArray([]string{respArray([]string{respInt(now), respInt(15)})})},
+		{[]string{"LATENCY", "HISTORY", "nope"}, respArray(nil)},
+		{[]string{"LATENCY", "HISTORY"}, "-ERR wrong number of arguments for 'latency|history' command\r\n"},
+		{[]string{"LATENCY", "LATEST", "x"}, "-ERR wrong number of arguments for 'latency|latest' command\r\n"},
+		{[]string{"LATENCY", "NOPE"}, "-ERR unknown subcommand 'NOPE'. Try LATENCY LATEST, HISTORY, RESET or DOCTOR.\r\n"},
+		{[]string{"LATENCY", "RESET", "command", "nope"}, respInt(1)},
+		{[]string{"LATENCY", "HISTORY", "command"}, respArray(nil)},
+		{[]string{"LATENCY", "RESET"}, respInt(1)},
+		{[]string{"LATENCY", "LATEST"}, respArray(nil)},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels, from the most to the least verbose
+const (
+	logDebug = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+var logLevelNames = []string{"debug", "verbose", "notice", "warning"}
+
+// logLevel is the least severe level that is logged
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(logNotice)
+}
+
+// parseLogLevel looks up a level by its configuration name
+func parseLogLevel(name string) (int, bool) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(n, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// logf logs a message if level is at least the configured log level
+func logf(level int, format string, args ...any) {
+	if int32(level) >= logLevel.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// setLogFile sends the log to path, or to stderr if path is empty
+func setLogFile(path string) error {
+	if path == "" {
+		log.SetOutput(os.Stderr)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	log.SetOutput(f)
+	return nil
+}
@@ -0,0 +1,1067 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file holds the lexer and parser of the Lua 5.1 subset understood by
+// the scripting engine. Scripts are compiled into a tree of statements and
+// expressions that luavm.go evaluates. Metatables, coroutines, goto and
+// the io, os and debug libraries are not supported.
+
+// Kinds of tokens
+const (
+	tokEOF = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	tokOp
+)
+
+// luaKeywords are the reserved words of Lua
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// luaOps are the operators and punctuation, longest first
+var luaOps = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// luaToken is a lexical token. text holds the name, keyword, operator or the
+// decoded contents of a string.
+type luaToken struct {
+	kind int
+	text string
+	num  float64
+	line int
+}
+
+// luaSyntaxError is a compile error of a script
+type luaSyntaxError struct {
+	line int
+	msg  string
+}
+
+func (e *luaSyntaxError) Error() string {
+	return fmt.Sprintf("user_script:%d: %s", e.line, e.msg)
+}
+
+// luaLex splits source into tokens
+func luaLex(src string) ([]luaToken, error) {
+	var tokens []luaToken
+	line := 1
+	i := 0
+
+	for i < len(src) {
+		ch := src[i]
+		switch {
+		case ch == '\n':
+			line++
+			i++
+			continue
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "--"):
+			i += 2
+			if level, ok := longBracket(src[i:]); ok {
+				body, n, ok := readLongString(src[i:], level)
+				if !ok {
+					return nil, &luaSyntaxError{line, "unfinished long comment"}
+				}
+				line += strings.Count(body, "\n")
+				i += n
+				continue
+			}
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
+		tok := luaToken{line: line}
+		switch {
+		case isNameStart(ch):
+			start := i
+			for i < len(src) && (isNameStart(src[i]) || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			tok.text = src[start:i]
+			tok.kind = tokName
+			if luaKeywords[tok.text] {
+				tok.kind = tokKeyword
+			}
+
+		case ch >= '0' && ch <= '9' || (ch == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9'):
+			start := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				i += 2
+				for i < len(src) && isHexDigit(src[i]) {
+					i++
+				}
+			} else {
+				for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+					i++
+				}
+				if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+					i++
+					if i < len(src) && (src[i] == '+' || src[i] == '-') {
+						i++
+					}
+					for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+						i++
+					}
+				}
+			}
+			n, ok := parseLuaNumber(src[start:i])
+			if !ok {
+				return nil, &luaSyntaxError{line, "malformed number near '" + src[start:i] + "'"}
+			}
+			tok.kind, tok.num = tokNumber, n
+
+		case ch == '"' || ch == '\'':
+			s, n, err := readQuotedString(src[i:], line)
+			if err != nil {
+				return nil, err
+			}
+			tok.kind, tok.text = tokString, s
+			i += n
+
+		case ch == '[':
+			if level, ok := longBracket(src[i:]); ok {
+				body, n, ok := readLongString(src[i:], level)
+				if !ok {
+					return nil, &luaSyntaxError{line, "unfinished long string"}
+				}
+				tok.kind, tok.text = tokString, strings.TrimPrefix(body, "\n")
+				line += strings.Count(body, "\n")
+				i += n
+				break
+			}
+			tok.kind, tok.text = tokOp, "["
+			i++
+
+		default:
+			for _, op := range luaOps {
+				if strings.HasPrefix(src[i:], op) {
+					tok.kind, tok.text = tokOp, op
+					i += len(op)
+					break
+				}
+			}
+			if tok.kind != tokOp {
+				return nil, &luaSyntaxError{line, fmt.Sprintf("unexpected symbol near '%c'", ch)}
+			}
+		}
+		tokens = append(tokens, tok)
+	}
+	return append(tokens, luaToken{kind: tokEOF, line: line}), nil
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// parseLuaNumber parses a decimal or hexadecimal number literal
+func parseLuaNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return float64(n), err == nil
+	}
+	if s == "" || strings.ContainsAny(s, "nN_") { // Rejects inf, nan and Go's digit separators
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return n, err == nil
+}
+
+// longBracket reports whether s starts with [[ or [=*[ and returns the
+// number of equal signs
+func longBracket(s string) (int, bool) {
+	if len(s) < 2 || s[0] != '[' {
+		return 0, false
+	}
+	level := 1
+	for level < len(s) && s[level] == '=' {
+		level++
+	}
+	if level < len(s) && s[level] == '[' {
+		return level - 1, true
+	}
+	return 0, false
+}
+
+// readLongString reads a long bracket string and returns its body and the
+// number of bytes consumed
+func readLongString(s string, level int) (string, int, bool) {
+	open := level + 2
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(s[open:], closing)
+	if end < 0 {
+		return "", 0, false
+	}
+	return s[open : open+end], open + end + len(closing), true
+}
+
+// readQuotedString decodes a single or double quoted string and returns it
+// with the number of bytes consumed
+func readQuotedString(s string, line int) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == quote:
+			return b.String(), i + 1, nil
+		case ch == '\n':
+			return "", 0, &luaSyntaxError{line, "unfinished string"}
+		case ch != '\\':
+			b.WriteByte(ch)
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			break
+		}
+		switch esc := s[i]; esc {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\n':
+			b.WriteByte('\n')
+			line++
+		default:
+			if esc >= '0' && esc <= '9' {
+				n := 0
+				for j := 0; j < 3 && i < len(s) && s[i] >= '0' && s[i] <= '9'; j++ {
+					n = n*10 + int(s[i]-'0')
+					i++
+				}
+				i--
+				if n > 255 {
+					return "", 0, &luaSyntaxError{line, "escape sequence too large"}
+				}
+				b.WriteByte(byte(n))
+			} else {
+				b.WriteByte(esc)
+			}
+		}
+	}
+	return "", 0, &luaSyntaxError{line, "unfinished string"}
+}
+
+// Expressions
+
+type luaExpr interface{}
+
+type (
+	luaConst    struct{ value any }
+	luaVararg   struct{}
+	luaNameExpr struct{ name string }
+	luaParen    struct{ expr luaExpr } // Truncates multiple results to one
+
+	luaIndexExpr struct {
+		obj, key luaExpr
+		line     int
+	}
+
+	luaCallExpr struct {
+		fn     luaExpr
+		method string // Set for obj:method(...) calls
+		args   []luaExpr
+		line   int
+	}
+
+	luaFuncExpr struct {
+		params []string
+		vararg bool
+		body   []luaStmt
+		name   string
+	}
+
+	luaBinExpr struct {
+		op          string
+		left, right luaExpr
+		line        int
+	}
+
+	luaUnExpr struct {
+		op   string
+		expr luaExpr
+		line int
+	}
+
+	luaField struct {
+		key   luaExpr // nil for positional items
+		value luaExpr
+	}
+
+	luaTableExpr struct{ fields []luaField }
+)
+
+// Statements
+
+type luaStmt interface{ stmtLine() int }
+
+type luaPos struct{ line int }
+
+func (p luaPos) stmtLine() int { return p.line }
+
+type (
+	luaLocalStmt struct {
+		luaPos
+		names []string
+		exprs []luaExpr
+	}
+
+	luaLocalFuncStmt struct {
+		luaPos
+		name string
+		fn   *luaFuncExpr
+	}
+
+	luaAssignStmt struct {
+		luaPos
+		targets []luaExpr
+		exprs   []luaExpr
+	}
+
+	luaCallStmt struct {
+		luaPos
+		call *luaCallExpr
+	}
+
+	luaDoStmt struct {
+		luaPos
+		body []luaStmt
+	}
+
+	luaWhileStmt struct {
+		luaPos
+		cond luaExpr
+		body []luaStmt
+	}
+
+	luaRepeatStmt struct {
+		luaPos
+		body []luaStmt
+		cond luaExpr
+	}
+
+	luaIfStmt struct {
+		luaPos
+		conds     []luaExpr
+		blocks    [][]luaStmt
+		elseBlock []luaStmt
+	}
+
+	luaNumForStmt struct {
+		luaPos
+		name               string
+		start, limit, step luaExpr
+		body               []luaStmt
+	}
+
+	luaGenForStmt struct {
+		luaPos
+		names []string
+		exprs []luaExpr
+		body  []luaStmt
+	}
+
+	luaReturnStmt struct {
+		luaPos
+		exprs []luaExpr
+	}
+
+	luaBreakStmt struct{ luaPos }
+)
+
+// luaMaxSyntaxLevels limits how deeply statements, expressions and table
+// constructors nest, so that a script cannot overflow the stack of the
+// parser or the interpreter
+const luaMaxSyntaxLevels = 200
+
+// luaParser builds the syntax tree from tokens
+type luaParser struct {
+	tokens []luaToken
+	pos    int
+	depth  int // Nesting of statements, expressions and table constructors
+}
+
+// luaCompile parses a script into the main function of a chunk. The chunk
+// is variadic like in Lua.
+func luaCompile(src string) (*luaFuncExpr, error) {
+	tokens, err := luaLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &luaParser{tokens: tokens}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("'<eof>' expected near '%s'", p.peek().text)
+	}
+	return &luaFuncExpr{vararg: true, body: body, name: "main chunk"}, nil
+}
+
+func (p *luaParser) peek() luaToken { return p.tokens[p.pos] }
+
+func (p *luaParser) next() luaToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// check reports whether the next token is the keyword or operator s
+func (p *luaParser) check(s string) bool {
+	tok := p.peek()
+	return (tok.kind == tokKeyword || tok.kind == tokOp) && tok.text == s
+}
+
+// accept consumes the keyword or operator s if it comes next
+func (p *luaParser) accept(s string) bool {
+	if p.check(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) errorf(format string, args ...any) error {
+	return &luaSyntaxError{p.peek().line, fmt.Sprintf(format, args...)}
+}
+
+// enter descends one syntax level, call leave when done
+func (p *luaParser) enter() error {
+	p.depth++
+	if p.depth > luaMaxSyntaxLevels {
+		return p.errorf("chunk has too many syntax levels")
+	}
+	return nil
+}
+
+func (p *luaParser) leave() { p.depth-- }
+
+func (p *luaParser) expect(s string) error {
+	if !p.accept(s) {
+		near := p.peek().text
+		if p.peek().kind == tokEOF {
+			near = "<eof>"
+		}
+		return p.errorf("'%s' expected near '%s'", s, near)
+	}
+	return nil
+}
+
+func (p *luaParser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != tokName {
+		return "", p.errorf("<name> expected near '%s'", tok.text)
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// blockEnd reports whether the next token closes a block
+func (p *luaParser) blockEnd() bool {
+	tok := p.peek()
+	if tok.kind == tokEOF {
+		return true
+	}
+	if tok.kind != tokKeyword {
+		return false
+	}
+	switch tok.text {
+	case "end", "else", "elseif", "until":
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) block() ([]luaStmt, error) {
+	var stmts []luaStmt
+	for !p.blockEnd() {
+		if p.accept(";") {
+			continue
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if _, ok := stmt.(*luaReturnStmt); ok {
+			p.accept(";")
+			if !p.blockEnd() {
+				return nil, p.errorf("'end' expected near '%s'", p.peek().text)
+			}
+			break
+		}
+		if _, ok := stmt.(*luaBreakStmt); ok {
+			p.accept(";")
+			if !p.blockEnd() {
+				return nil, p.errorf("'end' expected near '%s'", p.peek().text)
+			}
+			break
+		}
+	}
+	return stmts, nil
+}
+
+func (p *luaParser) statement() (luaStmt, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	pos := luaPos{p.peek().line}
+	tok := p.peek()
+	if tok.kind == tokKeyword {
+		switch tok.text {
+		case "local":
+			p.next()
+			if p.accept("function") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				fn, err := p.funcBody(name, false)
+				if err != nil {
+					return nil, err
+				}
+				return &luaLocalFuncStmt{pos, name, fn}, nil
+			}
+			var names []string
+			for {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				names = append(names, name)
+				if !p.accept(",") {
+					break
+				}
+			}
+			var exprs []luaExpr
+			if p.accept("=") {
+				var err error
+				if exprs, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			return &luaLocalStmt{pos, names, exprs}, nil
+
+		case "function":
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			var target luaExpr = &luaNameExpr{name}
+			method := false
+			for p.check(".") || p.check(":") {
+				method = p.next().text == ":"
+				key, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				name += "." + key
+				target = &luaIndexExpr{target, &luaConst{key}, pos.line}
+				if method {
+					break
+				}
+			}
+			fn, err := p.funcBody(name, method)
+			if err != nil {
+				return nil, err
+			}
+			return &luaAssignStmt{pos, []luaExpr{target}, []luaExpr{fn}}, nil
+
+		case "return":
+			p.next()
+			var exprs []luaExpr
+			if !p.blockEnd() && !p.check(";") {
+				var err error
+				if exprs, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			return &luaReturnStmt{pos, exprs}, nil
+
+		case "break":
+			p.next()
+			return &luaBreakStmt{pos}, nil
+
+		case "do":
+			p.next()
+			body, err := p.blockUntil("end")
+			if err != nil {
+				return nil, err
+			}
+			return &luaDoStmt{pos, body}, nil
+
+		case "while":
+			p.next()
+			cond, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("do"); err != nil {
+				return nil, err
+			}
+			body, err := p.blockUntil("end")
+			if err != nil {
+				return nil, err
+			}
+			return &luaWhileStmt{pos, cond, body}, nil
+
+		case "repeat":
+			p.next()
+			body, err := p.blockUntil("until")
+			if err != nil {
+				return nil, err
+			}
+			cond, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			return &luaRepeatStmt{pos, body, cond}, nil
+
+		case "if":
+			p.next()
+			stmt := &luaIfStmt{luaPos: pos}
+			for {
+				cond, err := p.expr(0)
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect("then"); err != nil {
+					return nil, err
+				}
+				body, err := p.block()
+				if err != nil {
+					return nil, err
+				}
+				stmt.conds = append(stmt.conds, cond)
+				stmt.blocks = append(stmt.blocks, body)
+				if !p.accept("elseif") {
+					break
+				}
+			}
+			if p.accept("else") {
+				body, err := p.block()
+				if err != nil {
+					return nil, err
+				}
+				stmt.elseBlock = body
+			}
+			return stmt, p.expect("end")
+
+		case "for":
+			p.next()
+			first, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if p.accept("=") {
+				stmt := &luaNumForStmt{luaPos: pos, name: first}
+				if stmt.start, err = p.expr(0); err != nil {
+					return nil, err
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if stmt.limit, err = p.expr(0); err != nil {
+					return nil, err
+				}
+				if p.accept(",") {
+					if stmt.step, err = p.expr(0); err != nil {
+						return nil, err
+					}
+				}
+				if err := p.expect("do"); err != nil {
+					return nil, err
+				}
+				if stmt.body, err = p.blockUntil("end"); err != nil {
+					return nil, err
+				}
+				return stmt, nil
+			}
+
+			stmt := &luaGenForStmt{luaPos: pos, names: []string{first}}
+			for p.accept(",") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				stmt.names = append(stmt.names, name)
+			}
+			if err := p.expect("in"); err != nil {
+				return nil, err
+			}
+			if stmt.exprs, err = p.exprList(); err != nil {
+				return nil, err
+			}
+			if err := p.expect("do"); err != nil {
+				return nil, err
+			}
+			if stmt.body, err = p.blockUntil("end"); err != nil {
+				return nil, err
+			}
+			return stmt, nil
+		}
+	}
+
+	// Function call or assignment
+	expr, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := expr.(*luaCallExpr); ok && !p.check("=") && !p.check(",") {
+		return &luaCallStmt{pos, call}, nil
+	}
+
+	targets := []luaExpr{expr}
+	for p.accept(",") {
+		target, err := p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	for _, target := range targets {
+		switch target.(type) {
+		case *luaNameExpr, *luaIndexExpr:
+		default:
+			return nil, p.errorf("syntax error near '%s'", p.peek().text)
+		}
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	exprs, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return &luaAssignStmt{pos, targets, exprs}, nil
+}
+
+// blockUntil parses a block closed by the keyword end
+func (p *luaParser) blockUntil(end string) ([]luaStmt, error) {
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	return body, p.expect(end)
+}
+
+// funcBody parses the parameters and body of a function. Methods get an
+// implicit self parameter.
+func (p *luaParser) funcBody(name string, method bool) (*luaFuncExpr, error) {
+	fn := &luaFuncExpr{name: name}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if !p.check(")") {
+		for {
+			if p.accept("...") {
+				fn.vararg = true
+				break
+			}
+			param, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			fn.params = append(fn.params, param)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	body, err := p.blockUntil("end")
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, nil
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		expr, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.accept(",") {
+			return exprs, nil
+		}
+	}
+}
+
+// luaBinaryPriority gives the left and right priority of binary operators.
+// A right priority lower than the left one makes an operator right
+// associative.
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+// luaUnaryPriority binds tighter than everything but ^
+const luaUnaryPriority = 8
+
+// expr parses an expression whose operators bind tighter than limit
+func (p *luaParser) expr(limit int) (luaExpr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	var left luaExpr
+	var err error
+	if tok := p.peek(); (tok.kind == tokKeyword && tok.text == "not") || (tok.kind == tokOp && (tok.text == "-" || tok.text == "#")) {
+		p.next()
+		operand, err := p.expr(luaUnaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &luaUnExpr{tok.text, operand, tok.line}
+	} else if left, err = p.simpleExpr(); err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp && tok.kind != tokKeyword {
+			return left, nil
+		}
+		prio, ok := luaBinaryPriority[tok.text]
+		if !ok || prio[0] <= limit {
+			return left, nil
+		}
+		p.next()
+		right, err := p.expr(prio[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &luaBinExpr{tok.text, left, right, tok.line}
+	}
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokNumber:
+		p.next()
+		return &luaConst{tok.num}, nil
+	case tokString:
+		p.next()
+		return &luaConst{tok.text}, nil
+	case tokKeyword:
+		switch tok.text {
+		case "nil":
+			p.next()
+			return &luaConst{nil}, nil
+		case "true":
+			p.next()
+			return &luaConst{true}, nil
+		case "false":
+			p.next()
+			return &luaConst{false}, nil
+		case "function":
+			p.next()
+			return p.funcBody("anonymous", false)
+		}
+	case tokOp:
+		switch tok.text {
+		case "...":
+			p.next()
+			return &luaVararg{}, nil
+		case "{":
+			return p.tableConstructor()
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() (luaExpr, error) {
+	tok := p.peek()
+	if tok.kind == tokName {
+		p.next()
+		return &luaNameExpr{tok.text}, nil
+	}
+	if p.accept("(") {
+		expr, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &luaParen{expr}, p.expect(")")
+	}
+	near := tok.text
+	if tok.kind == tokEOF {
+		near = "<eof>"
+	}
+	return nil, p.errorf("unexpected symbol near '%s'", near)
+}
+
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	expr, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		switch {
+		case p.accept("."):
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaIndexExpr{expr, &luaConst{key}, tok.line}
+
+		case p.accept("["):
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = &luaIndexExpr{expr, key, tok.line}
+
+		case p.accept(":"):
+			method, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCallExpr{expr, method, args, tok.line}
+
+		case p.check("(") || p.check("{") || tok.kind == tokString:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCallExpr{expr, "", args, tok.line}
+
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// callArgs parses (args), a table constructor or a string literal
+func (p *luaParser) callArgs() ([]luaExpr, error) {
+	tok := p.peek()
+	if tok.kind == tokString {
+		p.next()
+		return []luaExpr{&luaConst{tok.text}}, nil
+	}
+	if p.check("{") {
+		table, err := p.tableConstructor()
+		if err != nil {
+			return nil, err
+		}
+		return []luaExpr{table}, nil
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.accept(")") {
+		return nil, nil
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return args, p.expect(")")
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	table := &luaTableExpr{}
+	for !p.accept("}") {
+		var field luaField
+		switch {
+		case p.accept("["):
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			field.key = key
+
+		case p.peek().kind == tokName && p.tokens[p.pos+1].kind == tokOp && p.tokens[p.pos+1].text == "=":
+			field.key = &luaConst{p.next().text}
+			p.next()
+		}
+
+		value, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		field.value = value
+		table.fields = append(table.fields, field)
+
+		if !p.accept(",") && !p.accept(";") {
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// evalLua compiles and runs a chunk in a fresh state
+func evalLua(src string) ([]any, error) {
+	proto, err := luaCompile(src)
+	if err != nil {
+		return nil, err
+	}
+	return newLuaState().Call(&luaClosure{proto: proto}, nil)
+}
+
+func TestLuaCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"unfinished string", `return "abc`, "unfinished string"},
+		{"missing expression", `x = `, "unexpected symbol"},
+		{"missing end", `if true then return 1`, "'end' expected"},
+		{"missing then", `if true return 1 end`, "'then' expected"},
+		{"bad assignment", `1 = 2`, "unexpected symbol"},
+		{"nested parens", strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300), "too many syntax levels"},
+		{"nested tables", "return " + strings.Repeat("{", 300) + strings.Repeat("}", 300), "too many syntax levels"},
+		{"nested blocks", strings.Repeat("do ", 300) + strings.Repeat("end ", 300), "too many syntax levels"},
+		{"deep nesting", "return " + strings.Repeat("(", 1e6), "too many syntax levels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := luaCompile(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("luaCompile(%.40q) = %v, want an error containing %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLuaCompileWithinLimits(t *testing.T) {
+	src := "return " + strings.Repeat("(", 150) + "1" + strings.Repeat(")", 150)
+	if _, err := luaCompile(src); err != nil {
+		t.Fatalf("150 nested parens: %v", err)
+	}
+}
+
+func TestLuaEval(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want any
+	}{
+		{"arithmetic", `return 1 + 2 * 3 - 4 / 2`, 5.0},
+		{"power and modulo", `return 2 ^ 10 % 1000`, 24.0},
+		{"concat", `return "a" .. 1 .. "b"`, "a1b"},
+		{"length", `return #"abc" + #{1, 2, 3}`, 6.0},
+		{"comparison", `return 1 < 2 and "x" <= "y" and not (1 == "1")`, true},
+		{"closure", `local n = 0; local function inc() n = n + 1; return n end; inc(); return inc()`, 2.0},
+		{"varargs", `local function f(...) return select("#", ...) end; return f(1, nil, 3)`, 3.0},
+		{"numeric for", `local s = 0; for i = 10, 1, -2 do s = s + i end; return s`, 30.0},
+		{"generic for", `local s = ""; for _, v in ipairs({"a", "b", "c"}) do s = s .. v end; return s`, "abc"},
+		{"while", `local i = 0; while i < 5 do i = i + 1 end; return i`, 5.0},
+		{"repeat", `local i = 0; repeat local j = i; i = i + 1 until j >= 3; return i`, 4.0},
+		{"break", `local i = 0; while true do i = i + 1; if i == 3 then break end end; return i`, 3.0},
+		{"pairs order", `local t = {}; t.z = 1; t.a = 2; t.m = 3; local s = ""; for k in pairs(t) do s = s .. k end; return s`, "zam"},
+		{"string library", `return string.upper(string.sub("hello", 2, 4)) .. string.rep("x", 2)`, "ELLxx"},
+		{"string methods", `local s = "abc"; return s:len() + s:byte(1)`, 100.0},
+		{"table library", `local t = {3, 1, 2}; table.sort(t); table.insert(t, 4); return table.concat(t, ",")`, "1,2,3,4"},
+		{"tostring", `return tostring(10) .. tostring(1.5) .. tostring(nil)`, "101.5nil"},
+		{"tonumber", `return tonumber("0x10") + tonumber("  5  ")`, 21.0},
+		{"pcall success", `local ok, v = pcall(function() return 7 end); return ok and v`, 7.0},
+		{"pcall error", `local ok, err = pcall(function() error("boom") end); return tostring(ok) .. " " .. err`, "false user_script:1: boom"},
+		{"pcall runtime error", `local ok, err = pcall(function() return nil + 1 end); return err`, "user_script:1: attempt to perform arithmetic on a nil value"},
+		{"pcall error table", `local ok, err = pcall(error, {code = 5}); return err.code`, 5.0},
+		{"nested pcall", `return select(2, pcall(function() local ok, e = pcall(function() error("in", 0) end); error(e .. "out", 0) end))`, "inout"},
+		{"error level 0", `local ok, err = pcall(function() error("plain", 0) end); return err`, "plain"},
+		{"math", `return math.floor(3.7) + math.max(1, 5, 2) + math.abs(-2)`, 10.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rets, err := evalLua(tt.src)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.src, err)
+			}
+			if len(rets) == 0 || rets[0] != tt.want {
+				t.Fatalf("%s = %v, want %v", tt.src, rets, tt.want)
+			}
+		})
+	}
+}
+
+func TestLuaRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"call nil", `local f; f()`, "attempt to call a nil value"},
+		{"arithmetic on nil", `return {} + 1`, "attempt to perform arithmetic on a table value"},
+		{"index nil", `local t; return t.x`, "attempt to index a nil value"},
+		{"compare", `return 1 < "2"`, "attempt to compare"},
+		{"concat table", `return "a" .. {}`, "attempt to concatenate a table value"},
+		{"error", `error("failed")`, "user_script:1: failed"},
+		{"error line", "\n\nerror('line three')", "user_script:3: line three"},
+		{"stack overflow", `local function f() return 1 + f() end; return f()`, "stack overflow"},
+		{"stack overflow in pcall", `local function f() return 1 + f() end; error(select(2, pcall(f)), 0)`, "stack overflow"},
+		{"bad argument", `return string.rep()`, "bad argument #1 to 'rep'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := evalLua(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("%s: got %v, want an error containing %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLuaInterrupt(t *testing.T) {
+	errStop := errors.New("stopped")
+	for _, src := range []string{
+		`while true do end`,
+		`repeat until false`,
+		`for i = 1, 1e18 do end`,
+		`while true do pcall(function() end) end`,
+	} {
+		proto, err := luaCompile(src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		L := newLuaState()
+		calls := 0
+		L.interrupt = func() error {
+			calls++
+			if calls == 10 {
+				return errStop
+			}
+			return nil
+		}
+		if _, err := L.Call(&luaClosure{proto: proto}, nil); err != errStop {
+			t.Fatalf("%s: got %v, want the interrupt error", src, err)
+		}
+	}
+}
@@ -0,0 +1,1522 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Evaluation limits of the scripting engine
+const (
+	luaMaxCallDepth    = 200  // Nested calls before "stack overflow"
+	luaInterruptPeriod = 1000 // Steps between calls of the interrupt hook
+)
+
+// luaTable is a Lua table. Positive integer keys starting at 1 live in the
+// array part, everything else in the hash part. The hash part remembers
+// insertion order so that pairs visits keys in the same order every time,
+// which keeps scripts deterministic.
+type luaTable struct {
+	array   []any
+	index   map[any]int // Position of a key in entries
+	entries []luaEntry
+	live    int // Entries whose value is not nil
+}
+
+type luaEntry struct {
+	key, value any
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{index: make(map[any]int)}
+}
+
+// arrayIndex returns the array position of key if it is an integer
+func arrayIndex(key any) (int, bool) {
+	f, ok := key.(float64)
+	if !ok || f != math.Trunc(f) || f < 1 || f > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// Get returns t[key]
+func (t *luaTable) Get(key any) any {
+	if i, ok := arrayIndex(key); ok && i <= len(t.array) {
+		return t.array[i-1]
+	}
+	if pos, ok := t.index[key]; ok {
+		return t.entries[pos].value
+	}
+	return nil
+}
+
+// Set assigns t[key] = value
+func (t *luaTable) Set(key, value any) {
+	if i, ok := arrayIndex(key); ok {
+		if i <= len(t.array) {
+			t.array[i-1] = value
+			for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+				t.array = t.array[:len(t.array)-1]
+			}
+			return
+		}
+		if i == len(t.array)+1 && value != nil {
+			t.setHash(key, nil)
+			t.array = append(t.array, value)
+			// Move following keys over from the hash part
+			for {
+				next := float64(len(t.array) + 1)
+				v := t.Get(next)
+				if v == nil {
+					break
+				}
+				t.setHash(next, nil)
+				t.array = append(t.array, v)
+			}
+			return
+		}
+	}
+	t.setHash(key, value)
+}
+
+func (t *luaTable) setHash(key, value any) {
+	pos, ok := t.index[key]
+	if ok {
+		if t.entries[pos].value == nil && value != nil {
+			t.live++
+		} else if t.entries[pos].value != nil && value == nil {
+			t.live--
+		}
+		t.entries[pos].value = value
+		return
+	}
+	if value == nil {
+		return
+	}
+
+	// Drop deleted entries once they dominate. This only happens when a
+	// new key is added, which Lua forbids during traversal anyway.
+	if len(t.entries) > 2*t.live+8 {
+		kept := t.entries[:0]
+		for _, e := range t.entries {
+			if e.value != nil {
+				t.index[e.key] = len(kept)
+				kept = append(kept, e)
+			} else {
+				delete(t.index, e.key)
+			}
+		}
+		t.entries = kept
+	}
+	t.index[key] = len(t.entries)
+	t.entries = append(t.entries, luaEntry{key, value})
+	t.live++
+}
+
+// Len returns the length operator's result, a border of the array part
+func (t *luaTable) Len() int {
+	return len(t.array)
+}
+
+// Next returns the key and value after key in traversal order, or nil when
+// the traversal is over
+func (t *luaTable) Next(key any) (any, any, error) {
+	start := 0
+	if key != nil {
+		if i, ok := arrayIndex(key); ok && i <= len(t.array) {
+			start = i
+		} else if pos, ok := t.index[key]; ok {
+			start = len(t.array) + pos + 1
+		} else {
+			return nil, nil, errors.New("invalid key to 'next'")
+		}
+	}
+	for i := start; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i], nil
+		}
+	}
+	for i := max(start-len(t.array), 0); i < len(t.entries); i++ {
+		if t.entries[i].value != nil {
+			return t.entries[i].key, t.entries[i].value, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// luaGoFunc is a function implemented in Go
+type luaGoFunc struct {
+	name string
+	fn   func(L *luaState, args []any) ([]any, error)
+}
+
+// luaClosure is a Lua function with the scope it was created in
+type luaClosure struct {
+	proto *luaFuncExpr
+	scope *luaScope
+}
+
+// luaScope holds the local variables of a block
+type luaScope struct {
+	vars    map[string]*any
+	parent  *luaScope
+	varargs []any
+	fnScope bool // Outermost scope of a function, holds its varargs
+}
+
+func (s *luaScope) lookup(name string) *any {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *luaScope) define(name string, value any) {
+	if s.vars == nil {
+		s.vars = make(map[string]*any, 4)
+	}
+	s.vars[name] = &value
+}
+
+// luaError is a runtime error raised by a script. value is what was passed
+// to error(), usually a message string.
+type luaError struct {
+	value any
+}
+
+func (e *luaError) Error() string {
+	if t, ok := e.value.(*luaTable); ok {
+		if msg, ok := t.Get("err").(string); ok {
+			return msg
+		}
+	}
+	return luaToString(e.value)
+}
+
+// luaState runs scripts against a set of globals
+type luaState struct {
+	globals   *luaTable
+	depth     int
+	steps     int
+	line      int          // Line of the statement being executed
+	interrupt func() error // Called periodically to enforce time limits
+	seed      uint64       // State of math.random
+	readOnly  bool         // Globals cannot be assigned, for function libraries
+}
+
+// luaRandomSeed is the seed math.random starts from
+const luaRandomSeed = 0x2545f4914f6cdd1d
+
+// newLuaState creates a state with the standard library loaded
+func newLuaState() *luaState {
+	L := &luaState{globals: newLuaTable(), seed: luaRandomSeed}
+	L.openLibs()
+	return L
+}
+
+// Register adds a Go function to a table
+func (t *luaTable) Register(name string, fn func(L *luaState, args []any) ([]any, error)) {
+	t.Set(name, &luaGoFunc{name, fn})
+}
+
+// runtimeError builds an error that names the current line
+func (L *luaState) runtimeError(format string, args ...any) error {
+	return &luaError{fmt.Sprintf("user_script:%d: %s", L.line, fmt.Sprintf(format, args...))}
+}
+
+// step counts work and calls the interrupt hook now and then
+func (L *luaState) step() error {
+	L.steps++
+	if L.steps%luaInterruptPeriod == 0 && L.interrupt != nil {
+		return L.interrupt()
+	}
+	return nil
+}
+
+// Call calls a Lua or Go function
+func (L *luaState) Call(fn any, args []any) ([]any, error) {
+	if L.depth >= luaMaxCallDepth {
+		return nil, L.runtimeError("stack overflow")
+	}
+	L.depth++
+	defer func() { L.depth-- }()
+
+	switch f := fn.(type) {
+	case *luaGoFunc:
+		return f.fn(L, args)
+
+	case *luaClosure:
+		scope := &luaScope{parent: f.scope, fnScope: true}
+		for i, name := range f.proto.params {
+			var v any
+			if i < len(args) {
+				v = args[i]
+			}
+			scope.define(name, v)
+		}
+		if f.proto.vararg && len(args) > len(f.proto.params) {
+			scope.varargs = args[len(f.proto.params):]
+		}
+		line := L.line
+		flow, rets, err := L.execBlock(f.proto.body, scope)
+		L.line = line
+		if err != nil {
+			return nil, err
+		}
+		if flow == flowReturn {
+			return rets, nil
+		}
+		return nil, nil
+	}
+	return nil, L.runtimeError("attempt to call a %s value", luaTypeName(fn))
+}
+
+// Control flow of statements
+const (
+	flowNormal = iota
+	flowBreak
+	flowReturn
+)
+
+func (L *luaState) execBlock(stmts []luaStmt, scope *luaScope) (int, []any, error) {
+	for _, stmt := range stmts {
+		flow, rets, err := L.exec(stmt, scope)
+		if err != nil || flow != flowNormal {
+			return flow, rets, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (L *luaState) exec(stmt luaStmt, scope *luaScope) (int, []any, error) {
+	L.line = stmt.stmtLine()
+	if err := L.step(); err != nil {
+		return 0, nil, err
+	}
+
+	switch s := stmt.(type) {
+	case *luaLocalStmt:
+		values, err := L.evalList(s.exprs, scope)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, name := range s.names {
+			var v any
+			if i < len(values) {
+				v = values[i]
+			}
+			scope.define(name, v)
+		}
+
+	case *luaLocalFuncStmt:
+		scope.define(s.name, nil)
+		*scope.lookup(s.name) = &luaClosure{s.fn, scope}
+
+	case *luaAssignStmt:
+		values, err := L.evalList(s.exprs, scope)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, target := range s.targets {
+			var v any
+			if i < len(values) {
+				v = values[i]
+			}
+			if err := L.assign(target, v, scope); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaCallStmt:
+		if _, err := L.call(s.call, scope); err != nil {
+			return 0, nil, err
+		}
+
+	case *luaDoStmt:
+		return L.execBlock(s.body, &luaScope{parent: scope})
+
+	case *luaWhileStmt:
+		for {
+			cond, err := L.eval(s.cond, scope)
+			if err != nil {
+				return 0, nil, err
+			}
+			if !luaTruthy(cond) {
+				break
+			}
+			flow, rets, err := L.execBlock(s.body, &luaScope{parent: scope})
+			if err != nil || flow == flowReturn {
+				return flow, rets, err
+			}
+			if flow == flowBreak {
+				break
+			}
+			if err := L.step(); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaRepeatStmt:
+		for {
+			inner := &luaScope{parent: scope}
+			flow, rets, err := L.execBlock(s.body, inner)
+			if err != nil || flow == flowReturn {
+				return flow, rets, err
+			}
+			if flow == flowBreak {
+				break
+			}
+			// The condition sees the locals of the body
+			cond, err := L.eval(s.cond, inner)
+			if err != nil {
+				return 0, nil, err
+			}
+			if luaTruthy(cond) {
+				break
+			}
+			if err := L.step(); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaIfStmt:
+		for i, condExpr := range s.conds {
+			cond, err := L.eval(condExpr, scope)
+			if err != nil {
+				return 0, nil, err
+			}
+			if luaTruthy(cond) {
+				return L.execBlock(s.blocks[i], &luaScope{parent: scope})
+			}
+		}
+		if s.elseBlock != nil {
+			return L.execBlock(s.elseBlock, &luaScope{parent: scope})
+		}
+
+	case *luaNumForStmt:
+		var bounds [3]float64
+		bounds[2] = 1
+		for i, e := range []luaExpr{s.start, s.limit, s.step} {
+			if e == nil {
+				continue
+			}
+			v, err := L.eval(e, scope)
+			if err != nil {
+				return 0, nil, err
+			}
+			n, ok := luaToNumber(v)
+			if !ok {
+				return 0, nil, L.runtimeError("'for' %s must be a number", [3]string{"initial value", "limit", "step"}[i])
+			}
+			bounds[i] = n
+		}
+		start, limit, step := bounds[0], bounds[1], bounds[2]
+		for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+			inner := &luaScope{parent: scope}
+			inner.define(s.name, i)
+			flow, rets, err := L.execBlock(s.body, inner)
+			if err != nil || flow == flowReturn {
+				return flow, rets, err
+			}
+			if flow == flowBreak {
+				break
+			}
+			if err := L.step(); err != nil {
+				return 0, nil, err
+			}
+		}
+
+	case *luaGenForStmt:
+		values, err := L.evalList(s.exprs, scope)
+		if err != nil {
+			return 0, nil, err
+		}
+		values = append(values, nil, nil, nil)
+		fn, state, control := values[0], values[1], values[2]
+		for {
+			rets, err := L.Call(fn, []any{state, control})
+			if err != nil {
+				return 0, nil, err
+			}
+			if len(rets) == 0 || rets[0] == nil {
+				break
+			}
+			control = rets[0]
+			inner := &luaScope{parent: scope}
+			for i, name := range s.names {
+				var v any
+				if i < len(rets) {
+					v = rets[i]
+				}
+				inner.define(name, v)
+			}
+			flow, rets, err := L.execBlock(s.body, inner)
+			if err != nil || flow == flowReturn {
+				return flow, rets, err
+			}
+			if flow == flowBreak {
+				break
+			}
+		}
+
+	case *luaReturnStmt:
+		values, err := L.evalList(s.exprs, scope)
+		if err != nil {
+			return 0, nil, err
+		}
+		return flowReturn, values, nil
+
+	case *luaBreakStmt:
+		return flowBreak, nil, nil
+	}
+	return flowNormal, nil, nil
+}
+
+// assign stores value in a variable or table field
+func (L *luaState) assign(target luaExpr, value any, scope *luaScope) error {
+	switch t := target.(type) {
+	case *luaNameExpr:
+		if v := scope.lookup(t.name); v != nil {
+			*v = value
+		} else if L.readOnly {
+			return L.runtimeError("Attempt to modify a readonly table")
+		} else {
+			L.globals.Set(t.name, value)
+		}
+		return nil
+
+	case *luaIndexExpr:
+		obj, err := L.eval(t.obj, scope)
+		if err != nil {
+			return err
+		}
+		key, err := L.eval(t.key, scope)
+		if err != nil {
+			return err
+		}
+		table, ok := obj.(*luaTable)
+		if !ok {
+			return L.runtimeError("attempt to index a %s value", luaTypeName(obj))
+		}
+		if key == nil {
+			return L.runtimeError("table index is nil")
+		}
+		if f, ok := key.(float64); ok && math.IsNaN(f) {
+			return L.runtimeError("table index is NaN")
+		}
+		table.Set(key, value)
+		return nil
+	}
+	return L.runtimeError("cannot assign")
+}
+
+// evalList evaluates expressions, expanding the results of a trailing call
+// or vararg expression
+func (L *luaState) evalList(exprs []luaExpr, scope *luaScope) ([]any, error) {
+	values := make([]any, 0, len(exprs))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			rest, err := L.evalMulti(e, scope)
+			if err != nil {
+				return nil, err
+			}
+			return append(values, rest...), nil
+		}
+		v, err := L.eval(e, scope)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// evalMulti evaluates an expression keeping every result of calls and
+// varargs
+func (L *luaState) evalMulti(e luaExpr, scope *luaScope) ([]any, error) {
+	switch e := e.(type) {
+	case *luaCallExpr:
+		return L.call(e, scope)
+	case *luaVararg:
+		for s := scope; s != nil; s = s.parent {
+			if s.fnScope {
+				return s.varargs, nil
+			}
+		}
+		return nil, nil
+	}
+	v, err := L.eval(e, scope)
+	return []any{v}, err
+}
+
+func (L *luaState) call(e *luaCallExpr, scope *luaScope) ([]any, error) {
+	fn, err := L.eval(e.fn, scope)
+	if err != nil {
+		return nil, err
+	}
+	var args []any
+	if e.method != "" {
+		args = append(args, fn)
+		if fn, err = L.index(fn, e.method); err != nil {
+			return nil, err
+		}
+	}
+	rest, err := L.evalList(e.args, scope)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, rest...)
+
+	L.line = e.line
+	if fn == nil {
+		return nil, L.runtimeError("attempt to call a nil value (%s)", luaCallName(e))
+	}
+	return L.Call(fn, args)
+}
+
+// luaCallName describes the function of a call for error messages
+func luaCallName(e *luaCallExpr) string {
+	if e.method != "" {
+		return "method '" + e.method + "'"
+	}
+	switch f := e.fn.(type) {
+	case *luaNameExpr:
+		return "global '" + f.name + "'"
+	case *luaIndexExpr:
+		if k, ok := f.key.(*luaConst); ok {
+			if s, ok := k.value.(string); ok {
+				return "field '" + s + "'"
+			}
+		}
+	}
+	return "?"
+}
+
+// index returns obj[key]. Strings are indexed through the string library
+// so that s:upper() works.
+func (L *luaState) index(obj, key any) (any, error) {
+	switch o := obj.(type) {
+	case *luaTable:
+		return o.Get(key), nil
+	case string:
+		if lib, ok := L.globals.Get("string").(*luaTable); ok {
+			return lib.Get(key), nil
+		}
+	}
+	return nil, L.runtimeError("attempt to index a %s value", luaTypeName(obj))
+}
+
+func (L *luaState) eval(e luaExpr, scope *luaScope) (any, error) {
+	switch e := e.(type) {
+	case *luaConst:
+		return e.value, nil
+
+	case *luaNameExpr:
+		if v := scope.lookup(e.name); v != nil {
+			return *v, nil
+		}
+		return L.globals.Get(e.name), nil
+
+	case *luaParen:
+		return L.eval(e.expr, scope)
+
+	case *luaVararg, *luaCallExpr:
+		values, err := L.evalMulti(e, scope)
+		if err != nil || len(values) == 0 {
+			return nil, err
+		}
+		return values[0], nil
+
+	case *luaIndexExpr:
+		obj, err := L.eval(e.obj, scope)
+		if err != nil {
+			return nil, err
+		}
+		key, err := L.eval(e.key, scope)
+		if err != nil {
+			return nil, err
+		}
+		L.line = e.line
+		return L.index(obj, key)
+
+	case *luaFuncExpr:
+		return &luaClosure{e, scope}, nil
+
+	case *luaTableExpr:
+		t := newLuaTable()
+		n := 0
+		for i, field := range e.fields {
+			if field.key == nil {
+				// The last positional item expands calls and varargs
+				if i == len(e.fields)-1 {
+					values, err := L.evalMulti(field.value, scope)
+					if err != nil {
+						return nil, err
+					}
+					for _, v := range values {
+						n++
+						t.Set(float64(n), v)
+					}
+					continue
+				}
+				v, err := L.eval(field.value, scope)
+				if err != nil {
+					return nil, err
+				}
+				n++
+				t.Set(float64(n), v)
+				continue
+			}
+			key, err := L.eval(field.key, scope)
+			if err != nil {
+				return nil, err
+			}
+			if key == nil {
+				return nil, L.runtimeError("table index is nil")
+			}
+			v, err := L.eval(field.value, scope)
+			if err != nil {
+				return nil, err
+			}
+			t.Set(key, v)
+		}
+		return t, nil
+
+	case *luaUnExpr:
+		v, err := L.eval(e.expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		L.line = e.line
+		switch e.op {
+		case "not":
+			return !luaTruthy(v), nil
+		case "-":
+			n, ok := luaToNumber(v)
+			if !ok {
+				return nil, L.runtimeError("attempt to perform arithmetic on a %s value", luaTypeName(v))
+			}
+			return -n, nil
+		case "#":
+			switch o := v.(type) {
+			case string:
+				return float64(len(o)), nil
+			case *luaTable:
+				return float64(o.Len()), nil
+			}
+			return nil, L.runtimeError("attempt to get length of a %s value", luaTypeName(v))
+		}
+
+	case *luaBinExpr:
+		left, err := L.eval(e.left, scope)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "and":
+			if !luaTruthy(left) {
+				return left, nil
+			}
+			return L.eval(e.right, scope)
+		case "or":
+			if luaTruthy(left) {
+				return left, nil
+			}
+			return L.eval(e.right, scope)
+		}
+		right, err := L.eval(e.right, scope)
+		if err != nil {
+			return nil, err
+		}
+		L.line = e.line
+		return L.arith(e.op, left, right)
+	}
+	return nil, L.runtimeError("unsupported expression")
+}
+
+// arith applies a binary operator other than and/or
+func (L *luaState) arith(op string, left, right any) (any, error) {
+	switch op {
+	case "==":
+		return luaRawEqual(left, right), nil
+	case "~=":
+		return !luaRawEqual(left, right), nil
+
+	case "<", "<=", ">", ">=":
+		if op == ">" || op == ">=" {
+			left, right = right, left
+			op = map[string]string{">": "<", ">=": "<="}[op]
+		}
+		if a, ok := left.(float64); ok {
+			if b, ok := right.(float64); ok {
+				return a < b || (op == "<=" && a == b), nil
+			}
+		}
+		if a, ok := left.(string); ok {
+			if b, ok := right.(string); ok {
+				return a < b || (op == "<=" && a == b), nil
+			}
+		}
+		ta, tb := luaTypeName(left), luaTypeName(right)
+		if ta == tb {
+			return nil, L.runtimeError("attempt to compare two %s values", ta)
+		}
+		return nil, L.runtimeError("attempt to compare %s with %s", ta, tb)
+
+	case "..":
+		a, okA := luaConcatString(left)
+		b, okB := luaConcatString(right)
+		if !okA || !okB {
+			bad := left
+			if okA {
+				bad = right
+			}
+			return nil, L.runtimeError("attempt to concatenate a %s value", luaTypeName(bad))
+		}
+		return a + b, nil
+	}
+
+	a, okA := luaToNumber(left)
+	b, okB := luaToNumber(right)
+	if !okA || !okB {
+		bad := left
+		if okA {
+			bad = right
+		}
+		return nil, L.runtimeError("attempt to perform arithmetic on a %s value", luaTypeName(bad))
+	}
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, L.runtimeError("unknown operator %s", op)
+}
+
+func luaTruthy(v any) bool {
+	return v != nil && v != false
+}
+
+func luaRawEqual(a, b any) bool {
+	return a == b
+}
+
+func luaTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunc:
+		return "function"
+	}
+	return "userdata"
+}
+
+// luaToNumber converts numbers and numeric strings
+func luaToNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		return parseLuaNumber(n)
+	}
+	return 0, false
+}
+
+// luaNumberString formats a number like Lua's %.14g
+func luaNumberString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func luaConcatString(v any) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case float64:
+		return luaNumberString(s), true
+	}
+	return "", false
+}
+
+func luaToString(v any) string {
+	switch s := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(s)
+	case float64:
+		return luaNumberString(s)
+	case string:
+		return s
+	}
+	return fmt.Sprintf("%s: %p", luaTypeName(v), v)
+}
+
+// Standard library
+
+// luaArg returns argument i or nil
+func luaArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// checkNumber returns argument i as a number
+func (L *luaState) checkNumber(args []any, i int, fn string) (float64, error) {
+	n, ok := luaToNumber(luaArg(args, i))
+	if !ok {
+		return 0, L.runtimeError("bad argument #%d to '%s' (number expected, got %s)", i+1, fn, luaTypeName(luaArg(args, i)))
+	}
+	return n, nil
+}
+
+// checkString returns argument i as a string, numbers are converted
+func (L *luaState) checkString(args []any, i int, fn string) (string, error) {
+	s, ok := luaConcatString(luaArg(args, i))
+	if !ok {
+		return "", L.runtimeError("bad argument #%d to '%s' (string expected, got %s)", i+1, fn, luaTypeName(luaArg(args, i)))
+	}
+	return s, nil
+}
+
+// checkTable returns argument i as a table
+func (L *luaState) checkTable(args []any, i int, fn string) (*luaTable, error) {
+	t, ok := luaArg(args, i).(*luaTable)
+	if !ok {
+		return nil, L.runtimeError("bad argument #%d to '%s' (table expected, got %s)", i+1, fn, luaTypeName(luaArg(args, i)))
+	}
+	return t, nil
+}
+
+// optInt returns argument i as an integer, or def if it is missing
+func (L *luaState) optInt(args []any, i int, fn string, def int) (int, error) {
+	if luaArg(args, i) == nil {
+		return def, nil
+	}
+	n, err := L.checkNumber(args, i, fn)
+	return int(n), err
+}
+
+func (L *luaState) openLibs() {
+	g := L.globals
+
+	g.Register("type", func(L *luaState, args []any) ([]any, error) {
+		if len(args) == 0 {
+			return nil, L.runtimeError("bad argument #1 to 'type' (value expected)")
+		}
+		return []any{luaTypeName(args[0])}, nil
+	})
+	g.Register("tostring", func(L *luaState, args []any) ([]any, error) {
+		return []any{luaToString(luaArg(args, 0))}, nil
+	})
+	g.Register("tonumber", func(L *luaState, args []any) ([]any, error) {
+		v := luaArg(args, 0)
+		base, err := L.optInt(args, 1, "tonumber", 10)
+		if err != nil {
+			return nil, err
+		}
+		if base == 10 {
+			if n, ok := luaToNumber(v); ok {
+				return []any{n}, nil
+			}
+			return []any{nil}, nil
+		}
+		s, _ := luaConcatString(v)
+		n, err := strconv.ParseInt(strings.TrimSpace(s), base, 64)
+		if err != nil {
+			return []any{nil}, nil
+		}
+		return []any{float64(n)}, nil
+	})
+	g.Register("error", func(L *luaState, args []any) ([]any, error) {
+		v := luaArg(args, 0)
+		level, err := L.optInt(args, 1, "error", 1)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := v.(string); ok && level > 0 {
+			v = fmt.Sprintf("user_script:%d: %s", L.line, s)
+		}
+		return nil, &luaError{v}
+	})
+	g.Register("assert", func(L *luaState, args []any) ([]any, error) {
+		if !luaTruthy(luaArg(args, 0)) {
+			if msg := luaArg(args, 1); msg != nil {
+				return nil, &luaError{msg}
+			}
+			return nil, L.runtimeError("assertion failed!")
+		}
+		return args, nil
+	})
+	g.Register("pcall", func(L *luaState, args []any) ([]any, error) {
+		if len(args) == 0 {
+			return nil, L.runtimeError("bad argument #1 to 'pcall' (value expected)")
+		}
+		rets, err := L.Call(args[0], args[1:])
+		if err != nil {
+			var lerr *luaError
+			if !errors.As(err, &lerr) {
+				return nil, err // Interrupts cannot be caught
+			}
+			return []any{false, lerr.value}, nil
+		}
+		return append([]any{true}, rets...), nil
+	})
+	g.Register("select", func(L *luaState, args []any) ([]any, error) {
+		if s, ok := luaArg(args, 0).(string); ok && s == "#" {
+			return []any{float64(len(args) - 1)}, nil
+		}
+		n, err := L.checkNumber(args, 0, "select")
+		if err != nil {
+			return nil, err
+		}
+		i := int(n)
+		if i < 0 {
+			i = len(args) + i
+		}
+		if i < 1 {
+			return nil, L.runtimeError("bad argument #1 to 'select' (index out of range)")
+		}
+		if i >= len(args) {
+			return nil, nil
+		}
+		return args[i:], nil
+	})
+	g.Register("next", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "next")
+		if err != nil {
+			return nil, err
+		}
+		k, v, err := t.Next(luaArg(args, 1))
+		if err != nil {
+			return nil, L.runtimeError("%s", err)
+		}
+		if k == nil {
+			return []any{nil}, nil
+		}
+		return []any{k, v}, nil
+	})
+	next := g.Get("next")
+	g.Register("pairs", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "pairs")
+		if err != nil {
+			return nil, err
+		}
+		return []any{next, t, nil}, nil
+	})
+	ipairsIter := &luaGoFunc{"ipairs_iter", func(L *luaState, args []any) ([]any, error) {
+		t := args[0].(*luaTable)
+		i := args[1].(float64) + 1
+		v := t.Get(i)
+		if v == nil {
+			return []any{nil}, nil
+		}
+		return []any{i, v}, nil
+	}}
+	g.Register("ipairs", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "ipairs")
+		if err != nil {
+			return nil, err
+		}
+		return []any{ipairsIter, t, float64(0)}, nil
+	})
+	unpack := func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "unpack")
+		if err != nil {
+			return nil, err
+		}
+		i, err := L.optInt(args, 1, "unpack", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := L.optInt(args, 2, "unpack", t.Len())
+		if err != nil {
+			return nil, err
+		}
+		if j-i >= 8000 {
+			return nil, L.runtimeError("too many results to unpack")
+		}
+		var values []any
+		for k := i; k <= j; k++ {
+			values = append(values, t.Get(float64(k)))
+		}
+		return values, nil
+	}
+	g.Register("unpack", unpack)
+	g.Register("rawget", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "rawget")
+		if err != nil {
+			return nil, err
+		}
+		return []any{t.Get(luaArg(args, 1))}, nil
+	})
+	g.Register("rawset", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "rawset")
+		if err != nil {
+			return nil, err
+		}
+		t.Set(luaArg(args, 1), luaArg(args, 2))
+		return []any{t}, nil
+	})
+	g.Register("rawequal", func(L *luaState, args []any) ([]any, error) {
+		return []any{luaRawEqual(luaArg(args, 0), luaArg(args, 1))}, nil
+	})
+
+	L.openString()
+	L.openTable(unpack)
+	L.openMath()
+}
+
+func (L *luaState) openString() {
+	lib := newLuaTable()
+	L.globals.Set("string", lib)
+
+	lib.Register("len", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "len")
+		return []any{float64(len(s))}, err
+	})
+	lib.Register("sub", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "sub")
+		if err != nil {
+			return nil, err
+		}
+		i, err := L.optInt(args, 1, "sub", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := L.optInt(args, 2, "sub", -1)
+		if err != nil {
+			return nil, err
+		}
+		start, end := luaStringRange(len(s), i, j)
+		if start > end {
+			return []any{""}, nil
+		}
+		return []any{s[start-1 : end]}, nil
+	})
+	lib.Register("upper", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "upper")
+		return []any{strings.ToUpper(s)}, err
+	})
+	lib.Register("lower", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "lower")
+		return []any{strings.ToLower(s)}, err
+	})
+	lib.Register("reverse", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "reverse")
+		b := []byte(s)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return []any{string(b)}, err
+	})
+	lib.Register("rep", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "rep")
+		if err != nil {
+			return nil, err
+		}
+		n, err := L.checkNumber(args, 1, "rep")
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return []any{""}, nil
+		}
+		if float64(len(s))*n > 512<<20 {
+			return nil, L.runtimeError("resulting string too large")
+		}
+		return []any{strings.Repeat(s, int(n))}, nil
+	})
+	lib.Register("byte", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "byte")
+		if err != nil {
+			return nil, err
+		}
+		i, err := L.optInt(args, 1, "byte", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := L.optInt(args, 2, "byte", i)
+		if err != nil {
+			return nil, err
+		}
+		start, end := luaStringRange(len(s), i, j)
+		var values []any
+		for k := start; k <= end; k++ {
+			values = append(values, float64(s[k-1]))
+		}
+		return values, nil
+	})
+	lib.Register("char", func(L *luaState, args []any) ([]any, error) {
+		b := make([]byte, len(args))
+		for i := range args {
+			n, err := L.checkNumber(args, i, "char")
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > 255 {
+				return nil, L.runtimeError("bad argument #%d to 'char' (invalid value)", i+1)
+			}
+			b[i] = byte(n)
+		}
+		return []any{string(b)}, nil
+	})
+	lib.Register("find", func(L *luaState, args []any) ([]any, error) {
+		// Only plain searches are supported, Lua patterns are not
+		s, err := L.checkString(args, 0, "find")
+		if err != nil {
+			return nil, err
+		}
+		sub, err := L.checkString(args, 1, "find")
+		if err != nil {
+			return nil, err
+		}
+		init, err := L.optInt(args, 2, "find", 1)
+		if err != nil {
+			return nil, err
+		}
+		start, _ := luaStringRange(len(s), init, -1)
+		if start > len(s)+1 {
+			return []any{nil}, nil
+		}
+		pos := strings.Index(s[start-1:], sub)
+		if pos < 0 {
+			return []any{nil}, nil
+		}
+		pos += start
+		return []any{float64(pos), float64(pos + len(sub) - 1)}, nil
+	})
+	lib.Register("format", func(L *luaState, args []any) ([]any, error) {
+		format, err := L.checkString(args, 0, "format")
+		if err != nil {
+			return nil, err
+		}
+		s, err := L.format(format, args[1:])
+		return []any{s}, err
+	})
+}
+
+// luaStringRange turns Lua's 1-based and possibly negative string indices
+// into a clamped 1-based range
+func luaStringRange(n, i, j int) (int, int) {
+	if i < 0 {
+		i = max(n+i+1, 1)
+	} else if i == 0 {
+		i = 1
+	}
+	if j < 0 {
+		j = n + j + 1
+	} else if j > n {
+		j = n
+	}
+	return i, j
+}
+
+// format implements string.format for the %d, %i, %u, %c, %x, %X, %o, %e,
+// %E, %f, %g, %G, %q, %s and %% directives
+func (L *luaState) format(format string, args []any) (string, error) {
+	var b strings.Builder
+	arg := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			return "", L.runtimeError("invalid option '%%' to 'format'")
+		}
+		spec := format[start:i]
+		verb := format[i]
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if arg >= len(args) {
+			return "", L.runtimeError("bad argument #%d to 'format' (no value)", arg+2)
+		}
+		v := args[arg]
+		arg++
+
+		switch verb {
+		case 'd', 'i', 'u', 'c', 'x', 'X', 'o':
+			n, ok := luaToNumber(v)
+			if !ok {
+				return "", L.runtimeError("bad argument #%d to 'format' (number expected, got %s)", arg+1, luaTypeName(v))
+			}
+			goVerb := map[byte]string{'d': "d", 'i': "d", 'u': "d", 'c': "c", 'x': "x", 'X': "X", 'o': "o"}[verb]
+			fmt.Fprintf(&b, spec+goVerb, int64(n))
+		case 'e', 'E', 'f', 'g', 'G':
+			n, ok := luaToNumber(v)
+			if !ok {
+				return "", L.runtimeError("bad argument #%d to 'format' (number expected, got %s)", arg+1, luaTypeName(v))
+			}
+			fmt.Fprintf(&b, spec+string(verb), n)
+		case 's':
+			fmt.Fprintf(&b, spec+"s", luaToString(v))
+		case 'q':
+			s, _ := luaConcatString(v)
+			b.WriteString(strconv.Quote(s))
+		default:
+			return "", L.runtimeError("invalid option '%%%c' to 'format'", verb)
+		}
+	}
+	return b.String(), nil
+}
+
+func (L *luaState) openTable(unpack func(L *luaState, args []any) ([]any, error)) {
+	lib := newLuaTable()
+	L.globals.Set("table", lib)
+
+	lib.Register("unpack", unpack)
+	lib.Register("getn", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "getn")
+		if err != nil {
+			return nil, err
+		}
+		return []any{float64(t.Len())}, nil
+	})
+	lib.Register("insert", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "insert")
+		if err != nil {
+			return nil, err
+		}
+		switch len(args) {
+		case 2:
+			t.Set(float64(t.Len()+1), args[1])
+		case 3:
+			n, err := L.checkNumber(args, 1, "insert")
+			if err != nil {
+				return nil, err
+			}
+			pos := int(n)
+			if pos < 1 || pos > t.Len()+1 {
+				return nil, L.runtimeError("bad argument #2 to 'insert' (position out of bounds)")
+			}
+			for i := t.Len(); i >= pos; i-- {
+				t.Set(float64(i+1), t.Get(float64(i)))
+			}
+			t.Set(float64(pos), args[2])
+		default:
+			return nil, L.runtimeError("wrong number of arguments to 'insert'")
+		}
+		return nil, nil
+	})
+	lib.Register("remove", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "remove")
+		if err != nil {
+			return nil, err
+		}
+		n := t.Len()
+		pos, err := L.optInt(args, 1, "remove", n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return []any{nil}, nil
+		}
+		if pos < 1 || pos > n {
+			return nil, L.runtimeError("bad argument #2 to 'remove' (position out of bounds)")
+		}
+		v := t.Get(float64(pos))
+		for i := pos; i < n; i++ {
+			t.Set(float64(i), t.Get(float64(i+1)))
+		}
+		t.Set(float64(n), nil)
+		return []any{v}, nil
+	})
+	lib.Register("concat", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "concat")
+		if err != nil {
+			return nil, err
+		}
+		sep := ""
+		if luaArg(args, 1) != nil {
+			if sep, err = L.checkString(args, 1, "concat"); err != nil {
+				return nil, err
+			}
+		}
+		i, err := L.optInt(args, 2, "concat", 1)
+		if err != nil {
+			return nil, err
+		}
+		j, err := L.optInt(args, 3, "concat", t.Len())
+		if err != nil {
+			return nil, err
+		}
+		parts := make([]string, 0, max(j-i+1, 0))
+		for k := i; k <= j; k++ {
+			s, ok := luaConcatString(t.Get(float64(k)))
+			if !ok {
+				return nil, L.runtimeError("invalid value (at index %d) in table for 'concat'", k)
+			}
+			parts = append(parts, s)
+		}
+		return []any{strings.Join(parts, sep)}, nil
+	})
+	lib.Register("sort", func(L *luaState, args []any) ([]any, error) {
+		t, err := L.checkTable(args, 0, "sort")
+		if err != nil {
+			return nil, err
+		}
+		less := luaArg(args, 1)
+		items := make([]any, t.Len())
+		for i := range items {
+			items[i] = t.Get(float64(i + 1))
+		}
+		var sortErr error
+		sort.SliceStable(items, func(i, j int) bool {
+			if sortErr != nil {
+				return false
+			}
+			if less != nil {
+				rets, err := L.Call(less, []any{items[i], items[j]})
+				if err != nil {
+					sortErr = err
+					return false
+				}
+				return len(rets) > 0 && luaTruthy(rets[0])
+			}
+			r, err := L.arith("<", items[i], items[j])
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			return r.(bool)
+		})
+		if sortErr != nil {
+			return nil, sortErr
+		}
+		for i, v := range items {
+			t.Set(float64(i+1), v)
+		}
+		return nil, nil
+	})
+}
+
+func (L *luaState) openMath() {
+	lib := newLuaTable()
+	L.globals.Set("math", lib)
+	lib.Set("pi", math.Pi)
+	lib.Set("huge", math.Inf(1))
+
+	unary := map[string]func(float64) float64{
+		"floor": math.Floor, "ceil": math.Ceil, "abs": math.Abs, "sqrt": math.Sqrt,
+		"exp": math.Exp, "log10": math.Log10, "sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	}
+	for name, fn := range unary {
+		lib.Register(name, func(L *luaState, args []any) ([]any, error) {
+			n, err := L.checkNumber(args, 0, name)
+			return []any{fn(n)}, err
+		})
+	}
+	lib.Register("log", func(L *luaState, args []any) ([]any, error) {
+		n, err := L.checkNumber(args, 0, "log")
+		return []any{math.Log(n)}, err
+	})
+	lib.Register("fmod", func(L *luaState, args []any) ([]any, error) {
+		a, err := L.checkNumber(args, 0, "fmod")
+		if err != nil {
+			return nil, err
+		}
+		b, err := L.checkNumber(args, 1, "fmod")
+		return []any{math.Mod(a, b)}, err
+	})
+	lib.Register("pow", func(L *luaState, args []any) ([]any, error) {
+		a, err := L.checkNumber(args, 0, "pow")
+		if err != nil {
+			return nil, err
+		}
+		b, err := L.checkNumber(args, 1, "pow")
+		return []any{math.Pow(a, b)}, err
+	})
+	minMax := func(name string, better func(a, b float64) bool) {
+		lib.Register(name, func(L *luaState, args []any) ([]any, error) {
+			best, err := L.checkNumber(args, 0, name)
+			if err != nil {
+				return nil, err
+			}
+			for i := 1; i < len(args); i++ {
+				n, err := L.checkNumber(args, i, name)
+				if err != nil {
+					return nil, err
+				}
+				if better(n, best) {
+					best = n
+				}
+			}
+			return []any{best}, nil
+		})
+	}
+	minMax("min", func(a, b float64) bool { return a < b })
+	minMax("max", func(a, b float64) bool { return a > b })
+
+	// math.random is a xorshift generator. Script runs reset its seed, so the
+	// numbers and the writes that depend on them are the same every time.
+	lib.Register("randomseed", func(L *luaState, args []any) ([]any, error) {
+		n, err := L.checkNumber(args, 0, "randomseed")
+		L.seed = uint64(int64(n)) | 1
+		return nil, err
+	})
+	lib.Register("random", func(L *luaState, args []any) ([]any, error) {
+		L.seed ^= L.seed << 13
+		L.seed ^= L.seed >> 7
+		L.seed ^= L.seed << 17
+		r := float64(L.seed>>11) / (1 << 53)
+		switch len(args) {
+		case 0:
+			return []any{r}, nil
+		case 1:
+			m, err := L.checkNumber(args, 0, "random")
+			if err != nil || m < 1 {
+				return nil, L.runtimeError("bad argument #1 to 'random' (interval is empty)")
+			}
+			return []any{math.Floor(r*m) + 1}, nil
+		default:
+			lo, err := L.checkNumber(args, 0, "random")
+			if err != nil {
+				return nil, err
+			}
+			hi, err := L.checkNumber(args, 1, "random")
+			if err != nil || lo > hi {
+				return nil, L.runtimeError("bad argument #2 to 'random' (interval is empty)")
+			}
+			return []any{math.Floor(r*(hi-lo+1)) + lo}, nil
+		}
+	})
+}
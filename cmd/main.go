@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,24 +21,55 @@ import (
 
 // Constants for performance tuning
 const (
-	ShardCount          = 1024            // Power of 2 for optimal sharding
-	EvictionCheckPeriod = 5 * time.Second // How often to check for expired keys
-	ConnectionPoolSize  = 100000          // Pre-allocated connection pool size
-	MaxConcurrentConns  = 500000          // Maximum concurrent connections
-	TCPReadBufferSize   = 4 * 1024        // 4KB read buffer
-	TCPWriteBufferSize  = 4 * 1024        // 4KB write buffer
+	ConnectionPoolSize = 100000 // Pre-allocated connection pool size
+)
+
+// Version of dustdb, set at build time with -ldflags "-X main.Version=..."
+var Version = "0.1.0"
+
+// Performance tuning, set from the configuration at startup
+var (
+	ShardCount          = 1024             // Power of 2 for optimal sharding
+	EvictionCheckPeriod = 5 * time.Second  // Longest the expiry worker sleeps without a deadline
+	MaxConcurrentConns  = int64(500000)    // Maximum concurrent connections, accessed atomically
+	TCPReadBufferSize   = 4 * 1024         // 4KB read buffer
+	TCPWriteBufferSize  = 4 * 1024         // 4KB socket send buffer
+	ShutdownTimeout     = 10 * time.Second // Longest shutdown waits for clients to finish
 )
 
 // CacheEntry represents a value with its expiration time
 type CacheEntry struct {
 	Value    string
-	ExpireAt int64 // Unix timestamp in nanoseconds
+	Object   Object // Non-string value, nil for plain strings
+	ExpireAt int64  // Unix timestamp in nanoseconds
+	meta     *entryMeta
+}
+
+// Object is implemented by the non-string value types stored in a CacheEntry
+type Object interface {
+	Type() string   // Name reported by TYPE
+	String() string // Human readable rendering for the dashboard
+}
+
+// Type returns the type name of the entry's value
+func (e CacheEntry) Type() string {
+	if e.Object != nil {
+		return e.Object.Type()
+	}
+	return "string"
 }
 
 // CacheShard represents a single shard of the cache
 type CacheShard struct {
-	data map[string]CacheEntry
-	mu   sync.RWMutex
+	data       map[string]CacheEntry
+	mu         sync.RWMutex
+	admission  *tinyLFU               // Set while the admission filter is enabled
+	expires    expiryHeap             // Deadlines of keys with a TTL
+	nextExpiry int64                  // Earliest deadline in expires, read atomically
+	versions   map[string]*keyVersion // Modification counters of watched keys
+	keys       int64                  // Number of keys, read atomically
+	volatile   int64                  // Number of keys with a TTL, read atomically
+	gate       sync.RWMutex           // Transaction gate of the shard's keys, see gate.go
 }
 
 // Cache represents our in-memory key-value store with sharding
@@ -41,18 +77,44 @@ type Cache struct {
 	shards       []*CacheShard
 	shardMask    uint64
 	stats        CacheStats
+	maxMemory    int64          // Bytes, zero for no limit
+	policy       EvictionPolicy // Applied when maxMemory is reached
+	admission    atomic.Bool    // Whether the W-TinyLFU admission filter is enabled
+	nextExpiry   int64          // Next wake up of the expiry worker
+	expiryWake   chan struct{}
+	pubsub       *pubsubHub
+	scripts      *scriptEngine
+	functions    *functionRegistry
+	acl          *aclRegistry
+	commandStats *commandStats
+	slowlog      *slowlog
+	latency      *latencyMonitor
+	monitors     *monitorHub
+	startTime    time.Time
+	config       *Config     // Settings, changed by CONFIG SET
+	configMu     sync.Mutex  // Guards config
+	gateClient   *client     // Client holding every shard gate, whose user scripts run as
+	allGatesHeld atomic.Bool // Set while a script or EXEC holds every shard gate
+	notifyFlags  int32       // Keyspace event classes to publish
 	shutdownChan chan struct{}
+	shutdownOnce sync.Once
+	shutdownReq  chan shutdownRequest // SHUTDOWN asks main to stop
 }
 
 // CacheStats holds cache statistics for monitoring
 type CacheStats struct {
-	Gets        uint64
-	Sets        uint64
-	Deletes     uint64
-	Hits        uint64
-	Misses      uint64
-	Evictions   uint64
-	ActiveConns int64
+	Gets             uint64
+	Sets             uint64
+	Deletes          uint64
+	Hits             uint64
+	Misses           uint64
+	Evictions        uint64 // Keys removed because they expired
+	MemoryEvictions  uint64 // Keys removed to stay under maxmemory
+	AdmissionRejects uint64 // New keys the admission filter refused to keep
+	UsedMemory       int64
+	ActiveConns      int64
+	RejectedConns    uint64 // Connections refused because of maxclients
+	TotalConns       uint64 // Connections accepted since startup
 }
 
 // NewCache initializes a new Cache with sharding
@@ -63,35 +125,58 @@ func NewCache() *Cache {
 	cache := &Cache{
 		shards:       make([]*CacheShard, ShardCount),
 		shardMask:    shardMask,
+		nextExpiry:   math.MaxInt64,
+		expiryWake:   make(chan struct{}, 1),
+		pubsub:       newPubSubHub(),
+		scripts:      newScriptEngine(),
+		functions:    newFunctionRegistry(),
+		acl:          newACLRegistry(),
+		commandStats: newCommandStats(),
+		slowlog:      newSlowlog(),
+		latency:      newLatencyMonitor(),
+		monitors:     newMonitorHub(),
+		startTime:    time.Now(),
 		shutdownChan: make(chan struct{}),
+		shutdownReq:  make(chan shutdownRequest),
 	}
 
 	// Initialize each shard
 	for i := 0; i < ShardCount; i++ {
 		cache.shards[i] = &CacheShard{
-			data: make(map[string]CacheEntry),
+			data:       make(map[string]CacheEntry),
+			nextExpiry: math.MaxInt64,
 		}
 	}
 
-	// Start background eviction worker
-	go cache.evictionWorker()
+	// Start background expiry worker
+	go cache.expiryWorker()
 
 	return cache
 }
 
 // getShard returns the appropriate shard for a given key
 func (c *Cache) getShard(key string) *CacheShard {
+	return c.shards[c.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard that holds key
+func (c *Cache) shardIndex(key string) int {
 	// FNV-1a hash for even distribution
 	var h uint64
 	for i := 0; i < len(key); i++ {
 		h ^= uint64(key[i])
 		h *= 0x100000001b3
 	}
-	return c.shards[h&c.shardMask]
+	return int(h & c.shardMask)
 }
 
-// Set adds a key-value pair to the cache
-func (c *Cache) Set(key, value string, ttl time.Duration) {
+// Set adds a key-value pair to the cache. It fails with ErrOutOfMemory when
+// maxmemory is reached and the policy cannot make room.
+func (c *Cache) Set(key, value string, ttl time.Duration) error {
+	if !c.ReserveMemory() {
+		return ErrOutOfMemory
+	}
+
 	shard := c.getShard(key)
 	shard.mu.Lock()
 
@@ -100,17 +185,25 @@ func (c *Cache) Set(key, value string, ttl time.Duration) {
 		expireAt = time.Now().Add(ttl).UnixNano()
 	}
 
-	shard.data[key] = CacheEntry{
+	c.storeEntry(shard, key, CacheEntry{
 		Value:    value,
 		ExpireAt: expireAt,
-	}
+	})
 
 	shard.mu.Unlock()
 	atomic.AddUint64(&c.stats.Sets, 1)
+	c.notify(notifyString, "set", key)
+	return nil
 }
 
 // Get retrieves a value from the cache
 func (c *Cache) Get(key string) (string, bool) {
+	entry, exists := c.Lookup(key)
+	return entry.Value, exists
+}
+
+// Lookup retrieves the full entry stored at key, including non-string values
+func (c *Cache) Lookup(key string) (CacheEntry, bool) {
 	shard := c.getShard(key)
 	shard.mu.RLock()
 
@@ -121,7 +214,7 @@ func (c *Cache) Get(key string) (string, bool) {
 		shard.mu.RUnlock()
 		atomic.AddUint64(&c.stats.Gets, 1)
 		atomic.AddUint64(&c.stats.Misses, 1)
-		return "", false
+		return CacheEntry{}, false
 	}
 
 	// Check expiration
@@ -130,21 +223,50 @@ func (c *Cache) Get(key string) (string, bool) {
 
 		// Delete expired key with write lock
 		shard.mu.Lock()
-		delete(shard.data, key)
+		if entry, exists := shard.data[key]; exists && entry.ExpireAt > 0 && time.Now().UnixNano() > entry.ExpireAt {
+			c.removeEntry(shard, key)
+			c.notify(notifyExpired, "expired", key)
+		}
 		shard.mu.Unlock()
 
 		atomic.AddUint64(&c.stats.Gets, 1)
 		atomic.AddUint64(&c.stats.Misses, 1)
 		atomic.AddUint64(&c.stats.Evictions, 1)
-		return "", false
+		return CacheEntry{}, false
 	}
 
-	value := entry.Value
+	c.recordAccess(shard, key, entry)
 	shard.mu.RUnlock()
 
 	atomic.AddUint64(&c.stats.Gets, 1)
 	atomic.AddUint64(&c.stats.Hits, 1)
-	return value, true
+	return entry, true
+}
+
+// View runs fn with the entry stored at key while holding the shard's read
+// lock, so that non-string values can be read safely. fn must not modify the
+// entry.
+func (c *Cache) View(key string, fn func(entry CacheEntry, exists bool)) {
+	shard := c.getShard(key)
+	shard.mu.RLock()
+
+	entry, exists := shard.data[key]
+	if exists && entry.ExpireAt > 0 && time.Now().UnixNano() > entry.ExpireAt {
+		entry, exists = CacheEntry{}, false
+	}
+	if exists {
+		c.recordAccess(shard, key, entry)
+	}
+	fn(entry, exists)
+
+	shard.mu.RUnlock()
+
+	atomic.AddUint64(&c.stats.Gets, 1)
+	if exists {
+		atomic.AddUint64(&c.stats.Hits, 1)
+	} else {
+		atomic.AddUint64(&c.stats.Misses, 1)
+	}
 }
 
 // Delete removes a key-value pair from the cache
@@ -154,9 +276,10 @@ func (c *Cache) Delete(key string) bool {
 
 	_, exists := shard.data[key]
 	if exists {
-		delete(shard.data, key)
+		c.removeEntry(shard, key)
 		shard.mu.Unlock()
 		atomic.AddUint64(&c.stats.Deletes, 1)
+		c.notify(notifyGeneric, "del", key)
 		return true
 	}
 
@@ -164,6 +287,69 @@ func (c *Cache) Delete(key string) bool {
 	return false
 }
 
+// Results returned by Update callbacks
+const (
+	updateNone   = iota // Leave the key untouched
+	updateStore         // Store the modified entry
+	updateDelete        // Remove the key
+)
+
+// Update atomically reads and rewrites the entry stored at key while holding
+// the shard's write lock. Missing or expired keys are passed to fn as a zero
+// entry with exists set to false. What happens to the key afterwards depends
+// on the update result fn returns.
+func (c *Cache) Update(key string, fn func(entry *CacheEntry, exists bool) int) {
+	shard := c.getShard(key)
+	shard.mu.Lock()
+
+	entry, exists := shard.data[key]
+	if exists && entry.ExpireAt > 0 && time.Now().UnixNano() > entry.ExpireAt {
+		c.removeEntry(shard, key)
+		atomic.AddUint64(&c.stats.Evictions, 1)
+		c.notify(notifyExpired, "expired", key)
+		entry, exists = CacheEntry{}, false
+	}
+	if exists {
+		c.recordAccess(shard, key, entry)
+	}
+
+	switch fn(&entry, exists) {
+	case updateStore:
+		c.storeEntry(shard, key, entry)
+		shard.mu.Unlock()
+		atomic.AddUint64(&c.stats.Sets, 1)
+		return
+
+	case updateDelete:
+		if exists {
+			c.removeEntry(shard, key)
+			shard.mu.Unlock()
+			atomic.AddUint64(&c.stats.Deletes, 1)
+			c.notify(notifyGeneric, "del", key)
+			return
+		}
+	}
+
+	shard.mu.Unlock()
+}
+
+// ForEach calls fn for every non-expired entry, holding each shard's read
+// lock in turn. fn must not modify the entry or call back into the cache.
+// Like GetAll this visits every key and is meant for multi-key queries only.
+func (c *Cache) ForEach(fn func(key string, entry CacheEntry)) {
+	now := time.Now().UnixNano()
+
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		for k, entry := range shard.data {
+			if entry.ExpireAt == 0 || now < entry.ExpireAt {
+				fn(k, entry)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+}
+
 // GetAll returns all non-expired keys and values in the cache
 // Note: This is expensive and should be used for UI/admin only
 func (c *Cache) GetAll() map[string]string {
@@ -174,7 +360,11 @@ func (c *Cache) GetAll() map[string]string {
 		shard.mu.RLock()
 		for k, entry := range shard.data {
 			if entry.ExpireAt == 0 || now < entry.ExpireAt {
-				result[k] = entry.Value
+				if entry.Object != nil {
+					result[k] = entry.Object.String()
+				} else {
+					result[k] = entry.Value
+				}
 			}
 		}
 		shard.mu.RUnlock()
@@ -183,79 +373,85 @@ func (c *Cache) GetAll() map[string]string {
 	return result
 }
 
-// evictionWorker periodically checks for and removes expired keys
-func (c *Cache) evictionWorker() {
-	ticker := time.NewTicker(EvictionCheckPeriod)
-	defer ticker.Stop()
+// GetStats returns current cache statistics
+func (c *Cache) GetStats() CacheStats {
+	return CacheStats{
+		Gets:             atomic.LoadUint64(&c.stats.Gets),
+		Sets:             atomic.LoadUint64(&c.stats.Sets),
+		Deletes:          atomic.LoadUint64(&c.stats.Deletes),
+		Hits:             atomic.LoadUint64(&c.stats.Hits),
+		Misses:           atomic.LoadUint64(&c.stats.Misses),
+		Evictions:        atomic.LoadUint64(&c.stats.Evictions),
+		MemoryEvictions:  atomic.LoadUint64(&c.stats.MemoryEvictions),
+		AdmissionRejects: atomic.LoadUint64(&c.stats.AdmissionRejects),
+		UsedMemory:       atomic.LoadInt64(&c.stats.UsedMemory),
+		ActiveConns:      atomic.LoadInt64(&c.stats.ActiveConns),
+		RejectedConns:    atomic.LoadUint64(&c.stats.RejectedConns),
+		TotalConns:       atomic.LoadUint64(&c.stats.TotalConns),
+	}
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			c.evictExpired()
-		case <-c.shutdownChan:
-			return
-		}
+// KeyCounts returns the number of keys and the number of keys with a TTL,
+// from counters kept up to date as keys are stored and removed
+func (c *Cache) KeyCounts() (keys, expires int64) {
+	for _, shard := range c.shards {
+		keys += atomic.LoadInt64(&shard.keys)
+		expires += atomic.LoadInt64(&shard.volatile)
 	}
+	return keys, expires
 }
 
-// evictExpired checks all shards and removes expired keys
-func (c *Cache) evictExpired() {
+// AverageTTL returns the average time the keys with a TTL have left. It
+// visits every key.
+func (c *Cache) AverageTTL() time.Duration {
 	now := time.Now().UnixNano()
-	var evictionCount uint64
-
+	var ttlSum, expires int64
 	for _, shard := range c.shards {
-		var keysToDelete []string
-
-		// First, identify expired keys with read lock
 		shard.mu.RLock()
-		for k, entry := range shard.data {
-			if entry.ExpireAt > 0 && now > entry.ExpireAt {
-				keysToDelete = append(keysToDelete, k)
+		for _, entry := range shard.data {
+			if entry.ExpireAt > 0 {
+				expires++
+				ttlSum += max(entry.ExpireAt-now, 0)
 			}
 		}
 		shard.mu.RUnlock()
-
-		// Then delete them with write lock if any were found
-		if len(keysToDelete) > 0 {
-			shard.mu.Lock()
-			for _, k := range keysToDelete {
-				// Double-check expiration before deleting (it might have been updated)
-				if entry, exists := shard.data[k]; exists {
-					if entry.ExpireAt > 0 && now > entry.ExpireAt {
-						delete(shard.data, k)
-						evictionCount++
-					}
-				}
-			}
-			shard.mu.Unlock()
-		}
 	}
-
-	if evictionCount > 0 {
-		atomic.AddUint64(&c.stats.Evictions, evictionCount)
+	if expires == 0 {
+		return 0
 	}
+	return time.Duration(ttlSum / expires)
 }
 
-// GetStats returns current cache statistics
-func (c *Cache) GetStats() CacheStats {
-	return CacheStats{
-		Gets:        atomic.LoadUint64(&c.stats.Gets),
-		Sets:        atomic.LoadUint64(&c.stats.Sets),
-		Deletes:     atomic.LoadUint64(&c.stats.Deletes),
-		Hits:        atomic.LoadUint64(&c.stats.Hits),
-		Misses:      atomic.LoadUint64(&c.stats.Misses),
-		Evictions:   atomic.LoadUint64(&c.stats.Evictions),
-		ActiveConns: atomic.LoadInt64(&c.stats.ActiveConns),
+// HitRatio returns the share of reads that found their key, between 0 and 1
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
 	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
-// Shutdown gracefully shuts down the cache
+// Shutdown gracefully shuts down the cache. The servers stop accepting
+// connections and wind down the open ones.
 func (c *Cache) Shutdown() {
-	close(c.shutdownChan)
+	c.shutdownOnce.Do(func() { close(c.shutdownChan) })
 }
 
-// StartTCPServer starts a TCP server on the specified port
-func StartTCPServer(cache *Cache, port string) {
+// shuttingDown reports whether Shutdown has been called
+func (c *Cache) shuttingDown() bool {
+	select {
+	case <-c.shutdownChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// StartTCPServer starts a TCP server on the specified port. Connections
+// use TLS if tlsConfig is not nil. Once the cache is shut down it stops
+// accepting connections, lets every connection finish the command it is
+// running and returns. It reports false if connections had to be cut off
+// after ShutdownTimeout.
+func StartTCPServer(cache *Cache, port string, tlsConfig *tls.Config) bool {
 	// Set system limits
 	// In production, also set ulimit -n to a high value (1M+)
 
@@ -266,24 +462,48 @@ func StartTCPServer(cache *Cache, port string) {
 	}
 	defer listener.Close()
 
-	log.Printf("TCP server listening on %s", port)
+	if tlsConfig != nil {
+		logf(logNotice, "TCP server listening on %s with TLS", port)
+	} else {
+		logf(logNotice, "TCP server listening on %s", port)
+	}
 
 	//TODO: crate lg file for database records
 
-	// Connection limiter using a semaphore
-	connLimiter := make(chan struct{}, MaxConcurrentConns)
-
 	// Pre-allocate worker goroutines
 	wg := &sync.WaitGroup{}
 
-	for {
-		// Block if too many concurrent connections
-		connLimiter <- struct{}{}
+	// Open connections, so that shutdown can interrupt their reads
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	go func() {
+		<-cache.shutdownChan
+		listener.Close()
+		connsMu.Lock()
+		for conn := range conns {
+			conn.SetReadDeadline(time.Now())
+		}
+		connsMu.Unlock()
+	}()
 
+	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			<-connLimiter // Release the token
+			if cache.shuttingDown() {
+				break
+			}
+			logf(logWarning, "Failed to accept connection: %v", err)
+			continue
+		}
+
+		// Refuse connections over the limit, which CONFIG SET maxclients
+		// may change at any time
+		if atomic.LoadInt64(&cache.stats.ActiveConns) >= atomic.LoadInt64(&MaxConcurrentConns) {
+			if tlsConfig == nil {
+				conn.Write([]byte("-ERR max number of clients reached\r\n"))
+			}
+			conn.Close()
+			atomic.AddUint64(&cache.stats.RejectedConns, 1)
 			continue
 		}
 
@@ -292,15 +512,29 @@ func StartTCPServer(cache *Cache, port string) {
 			tcpConn.SetNoDelay(true)   // Disable Nagle's algorithm
 			tcpConn.SetKeepAlive(true) // Enable keep-alive
 			tcpConn.SetKeepAlivePeriod(30 * time.Second)
+			tcpConn.SetWriteBuffer(TCPWriteBufferSize)
 		}
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+
+		connsMu.Lock()
+		conns[conn] = true
+		if cache.shuttingDown() {
+			conn.SetReadDeadline(time.Now())
+		}
+		connsMu.Unlock()
 
 		wg.Add(1)
 		atomic.AddInt64(&cache.stats.ActiveConns, 1)
+		atomic.AddUint64(&cache.stats.TotalConns, 1)
 
 		go func() {
 			defer func() {
 				conn.Close()
-				<-connLimiter // Release the token
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
 				atomic.AddInt64(&cache.stats.ActiveConns, -1)
 				wg.Done()
 			}()
@@ -308,11 +542,37 @@ func StartTCPServer(cache *Cache, port string) {
 			handleConnection(conn, cache)
 		}()
 	}
+
+	// Wait for the commands in flight, then cut off whoever is left
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return true
+	case <-time.After(ShutdownTimeout):
+	}
+	connsMu.Lock()
+	logf(logWarning, "Closing %d connections still busy after %s", len(conns), ShutdownTimeout)
+	for conn := range conns {
+		conn.Close()
+	}
+	connsMu.Unlock()
+	wg.Wait()
+	return false
 }
 
 // handleConnection processes incoming TCP connections
 func handleConnection(conn net.Conn, cache *Cache) {
 	reader := bufio.NewReaderSize(conn, TCPReadBufferSize)
+	cl := newClient(conn)
+	cl.user = cache.acl.defaultUser()
+	defer cl.close()
+	defer cache.pubsub.unsubscribeAll(cl)
+	defer cache.unwatchAll(cl)
+	defer cache.monitors.remove(cl)
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -320,125 +580,208 @@ func handleConnection(conn net.Conn, cache *Cache) {
 			break
 		}
 
-		line = strings.TrimSpace(line)
-		parts := strings.Fields(line)
+		parts, ok := splitArgs(line)
+		if !ok {
+			cl.reply("-ERR Protocol error: unbalanced quotes in request\r\n")
+			continue
+		}
 
 		if len(parts) == 0 {
 			continue
 		}
 
 		cmd := strings.ToUpper(parts[0])
-		switch cmd {
-		case "SET":
-			if len(parts) < 3 {
-				conn.Write([]byte("-ERR wrong number of arguments for 'set' command\r\n"))
-				continue
-			}
-			key := parts[1]
-			value := parts[2]
-			var ttl time.Duration
-			if len(parts) > 3 && parts[3] == "EX" && len(parts) > 4 {
-				seconds, err := time.ParseDuration(parts[4] + "s")
-				if err == nil {
-					ttl = seconds
-				}
-			}
-			cache.Set(key, value, ttl)
-			conn.Write([]byte("OK\r\n"))
-
-		case "GET":
-			if len(parts) != 2 {
-				conn.Write([]byte("-ERR wrong number of arguments for 'get' command\r\n"))
-				continue
+		parts[0] = cmd
+		if cache.acl.revoked(cl.user) {
+			return
+		}
+		if cl.user == nil && cmd != "AUTH" && cmd != "QUIT" {
+			if cl.multi {
+				cl.dirty = true
 			}
-			key := parts[1]
-			value, exists := cache.Get(key)
-			if exists {
-				conn.Write([]byte("" + value + "\r\n"))
-			} else {
-				conn.Write([]byte("key not availible\r\n"))
+			cache.commandStats.reject(cmd, errNoAuth)
+			cl.reply(errNoAuth)
+			continue
+		}
+		if cl.user != nil {
+			context := "toplevel"
+			if cl.multi {
+				context = "multi"
 			}
-
-		case "DEL":
-			if len(parts) != 2 {
-				conn.Write([]byte("-ERR wrong number of arguments for 'del' command\r\n"))
+			if reply := cache.acl.check(cl.user, parts, context, cl.info()); reply != "" {
+				if cl.multi {
+					cl.dirty = true
+				}
+				cache.commandStats.reject(cmd, reply)
+				cl.reply(reply)
 				continue
 			}
-			key := parts[1]
-			if cache.Delete(key) {
-				conn.Write([]byte(":1\r\n"))
-			} else {
-				conn.Write([]byte(":0\r\n"))
-			}
+		}
+		if cache.pubsub.subscribed(cl) && !subscribedCommands[cmd] {
+			cl.reply(respError("Can't execute '" + strings.ToLower(cmd) + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+			continue
+		}
+		if cl.monitor && cmd != "QUIT" {
+			cl.reply(respError("only QUIT is allowed in MONITOR mode"))
+			continue
+		}
 
-		case "PING":
-			conn.Write([]byte("+PONG\r\n"))
+		// Commands of an open transaction are queued until EXEC
+		if cl.multi && cmd != "QUIT" && !transactionControl[cmd] {
+			cl.reply(cl.queueCommand(parts))
+			continue
+		}
 
+		start := time.Now()
+		var reply string
+		switch cmd {
 		case "QUIT":
-			conn.Write([]byte("+OK\r\n"))
+			reply = "+OK\r\n"
+		case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE":
+			reply = subscribeCommand(cache, cl, parts)
+		case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+			reply = transactionCommand(cache, cl, parts)
+		case "AUTH":
+			reply = authCommand(cache, cl, parts)
+		case "ACL":
+			reply = aclCommand(cache, cl, parts)
+		case "MONITOR":
+			reply = monitorCommand(cache, cl, parts)
+		default:
+			reply = cache.execute(cl, parts)
+		}
+		elapsed := time.Since(start)
+		cache.commandStats.record(cmd, elapsed, reply)
+		cache.slowlog.record(parts, start, elapsed, cl)
+		cache.latency.add(latencyCommand, elapsed)
+		cache.monitors.feed(start, parts, cl.conn.RemoteAddr().String())
+
+		if reply != "" {
+			cl.reply(reply)
+		}
+		if cmd == "QUIT" {
+			// Subscribers and monitors get the reply queued, send it
+			// before the connection is closed
+			cl.flush()
 			return
+		}
+	}
+}
 
-		case "INFO":
-			stats := cache.GetStats()
-			info := fmt.Sprintf("+# Stats\r\n"+
-				"gets:%d\r\n"+
-				"sets:%d\r\n"+
-				"deletes:%d\r\n"+
-				"hits:%d\r\n"+
-				"misses:%d\r\n"+
-				"evictions:%d\r\n"+
-				"active_connections:%d\r\n",
-				stats.Gets, stats.Sets, stats.Deletes,
-				stats.Hits, stats.Misses, stats.Evictions,
-				stats.ActiveConns)
-			conn.Write([]byte(info))
+// executeCommand runs a command that does not depend on the connection and
+// returns its reply. args[0] must be upper-cased. Callers hold the gates of
+// its shards, see gate.go.
+func executeCommand(cache *Cache, parts []string) string {
+	switch parts[0] {
+	case "SET":
+		if len(parts) < 3 {
+			return "-ERR wrong number of arguments for 'set' command\r\n"
+		}
+		key := parts[1]
+		value := parts[2]
+		ttl := parseSetTTL(parts[3:])
+		if err := cache.Set(key, value, ttl); err != nil {
+			return errOOM
+		}
+		return "OK\r\n"
 
-		default:
-			conn.Write([]byte("-ERR unknown command '" + cmd + "'\r\n"))
+	case "GET":
+		if len(parts) != 2 {
+			return "-ERR wrong number of arguments for 'get' command\r\n"
+		}
+		key := parts[1]
+		entry, exists := cache.Lookup(key)
+		if exists && entry.Object != nil {
+			return errWrongType
+		} else if exists {
+			return "" + entry.Value + "\r\n"
 		}
+		return "key not availible\r\n"
+
+	case "DEL":
+		if len(parts) != 2 {
+			return "-ERR wrong number of arguments for 'del' command\r\n"
+		}
+		key := parts[1]
+		if cache.Delete(key) {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+
+	case "PING":
+		return "+PONG\r\n"
+
+	case "INFO":
+		return infoCommand(cache, parts)
+
+	default:
+		return dispatchCommand(cache, parts)
 	}
 }
 
-// StartWebServer starts a web server for the GUI
-func StartWebServer(cache *Cache, port string) {
+// StartWebServer starts a web server for the GUI. It serves HTTPS if
+// tlsConfig is not nil. Like StartTCPServer it returns once the cache is
+// shut down, reporting false if requests were still running after
+// ShutdownTimeout.
+func StartWebServer(cache *Cache, port string, tlsConfig *tls.Config) bool {
 	// Use a more efficient HTTP server setup
 	server := &http.Server{
 		Addr:         port,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		TLSConfig:    tlsConfig,
 	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := cache.acl.authenticateRequest(w, r)
+		if !ok {
+			return
+		}
+		if !cache.acl.canReadAllKeys(user) {
+			http.Error(w, "NOPERM No permissions to access a key", http.StatusForbidden)
+			return
+		}
+
 		data := cache.GetAll()
 		stats := cache.GetStats()
 
-		// Calculate hit rate
-		hitRate := 0.0
-		totalOps := stats.Hits + stats.Misses
-		if totalOps > 0 {
-			hitRate = float64(stats.Hits) / float64(totalOps) * 100
+		hitRate := stats.HitRatio() * 100
+		_, evictionPolicy := cache.MaxMemory()
+		policy := evictionPolicy.String()
+		if cache.admission.Load() {
+			policy += " + tinylfu"
 		}
 
 		templateData := struct {
 			Data    map[string]string
 			Stats   CacheStats
 			HitRate float64
+			Policy  string
+			Slowlog []slowlogEntry
 		}{
 			Data:    data,
 			Stats:   stats,
 			HitRate: hitRate,
+			Policy:  policy,
+			Slowlog: cache.slowlog.get(20),
 		}
 
 		tmpl := template.Must(template.New("index").Parse(dashboardTemplate))
 		tmpl.Execute(w, templateData)
 	})
 
+	http.HandleFunc("/metrics", metricsHandler(cache))
+
 	http.HandleFunc("/api/command", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		user, ok := cache.acl.authenticateRequest(w, r)
+		if !ok {
+			return
+		}
 
 		cmd := r.FormValue("cmd")
 		if cmd == "" {
@@ -446,13 +789,22 @@ func StartWebServer(cache *Cache, port string) {
 			return
 		}
 
-		parts := strings.Fields(cmd)
-		if len(parts) == 0 {
+		parts, ok := splitArgs(cmd)
+		if !ok || len(parts) == 0 {
 			http.Error(w, `{"status":"error","message":"Invalid command"}`, http.StatusBadRequest)
 			return
 		}
 
 		command := strings.ToUpper(parts[0])
+		parts[0] = command
+		if reply := cache.acl.check(user, parts, "toplevel", "addr="+r.RemoteAddr+" web user="+user.name); reply != "" {
+			http.Error(w, `{"status":"error","message":"`+strings.TrimSuffix(reply[1:], "\r\n")+`"}`, http.StatusForbidden)
+			return
+		}
+
+		// The gate of the key's shard is held while the command runs, but not
+		// while the reply is written to a client that may be slow to read it.
+		// As over TCP, waiting for the gate fails once a script runs too long.
 		switch command {
 		case "SET":
 			if len(parts) < 3 {
@@ -461,14 +813,22 @@ func StartWebServer(cache *Cache, port string) {
 			}
 			key := parts[1]
 			value := parts[2]
-			var ttl time.Duration
-			if len(parts) > 3 && parts[3] == "EX" && len(parts) > 4 {
-				seconds, err := time.ParseDuration(parts[4] + "s")
-				if err == nil {
-					ttl = seconds
-				}
+			ttl := parseSetTTL(parts[3:])
+			gates, reply := cache.holdGates([][]string{parts}, nil, false)
+			if reply != "" {
+				http.Error(w, `{"status":"error","message":"`+strings.TrimSuffix(reply[1:], "\r\n")+`"}`, http.StatusServiceUnavailable)
+				return
 			}
-			cache.Set(key, value, ttl)
+			start := time.Now()
+			err := cache.Set(key, value, ttl)
+			cache.unlockGates(gates, false)
+			if err != nil {
+				cache.commandStats.record(command, time.Since(start), errOOM)
+				http.Error(w, `{"status":"error","message":"OOM `+err.Error()+`"}`, http.StatusInsufficientStorage)
+				return
+			}
+			cache.commandStats.record(command, time.Since(start), respOK())
+			cache.monitors.feed(start, parts, r.RemoteAddr)
 			fmt.Fprintf(w, `{"status":"success"}`)
 
 		case "DEL":
@@ -477,7 +837,17 @@ func StartWebServer(cache *Cache, port string) {
 				return
 			}
 			key := parts[1]
-			if cache.Delete(key) {
+			gates, reply := cache.holdGates([][]string{parts}, nil, false)
+			if reply != "" {
+				http.Error(w, `{"status":"error","message":"`+strings.TrimSuffix(reply[1:], "\r\n")+`"}`, http.StatusServiceUnavailable)
+				return
+			}
+			start := time.Now()
+			deleted := cache.Delete(key)
+			cache.unlockGates(gates, false)
+			cache.commandStats.record(command, time.Since(start), respOK())
+			cache.monitors.feed(start, parts, r.RemoteAddr)
+			if deleted {
 				fmt.Fprintf(w, `{"status":"success"}`)
 			} else {
 				fmt.Fprintf(w, `{"status":"success","message":"Key not found"}`)
@@ -488,8 +858,27 @@ func StartWebServer(cache *Cache, port string) {
 		}
 	})
 
-	log.Printf("Web server listening on %s", port)
-	log.Fatal(server.ListenAndServe())
+	// Once the cache is shut down, finish the requests in flight
+	stopped := make(chan bool, 1)
+	go func() {
+		<-cache.shutdownChan
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		stopped <- server.Shutdown(ctx) == nil
+	}()
+
+	var err error
+	if tlsConfig != nil {
+		logf(logNotice, "Web server listening on %s with TLS", port)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logf(logNotice, "Web server listening on %s", port)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	return <-stopped
 }
 
 const dashboardTemplate = `
@@ -545,6 +934,7 @@ const dashboardTemplate = `
             font-size: 14px;
         }
         th, td {
+            white-space: pre-wrap;
             padding: 12px 15px;
             text-align: left;
             border-bottom: 1px solid #e9ecef;
@@ -641,11 +1031,19 @@ const dashboardTemplate = `
             </div>
             <div class="stat-card">
                 <div class="stat-value">{{printf "%.1f" .HitRate}}%</div>
-                <div class="stat-label">Hit Rate</div>
+                <div class="stat-label">Hit Rate ({{.Policy}})</div>
             </div>
             <div class="stat-card">
                 <div class="stat-value">{{.Stats.Evictions}}</div>
-                <div class="stat-label">Evictions</div>
+                <div class="stat-label">Expired Keys</div>
+            </div>
+            <div class="stat-card">
+                <div class="stat-value">{{.Stats.MemoryEvictions}}</div>
+                <div class="stat-label">Evicted Keys</div>
+            </div>
+            <div class="stat-card">
+                <div class="stat-value">{{.Stats.UsedMemory}}</div>
+                <div class="stat-label">Used Memory (bytes)</div>
             </div>
             <div class="stat-card">
                 <div class="stat-value">{{.Stats.ActiveConns}}</div>
@@ -700,6 +1098,38 @@ const dashboardTemplate = `
             </tbody>
         </table>
         
+        <h2>Slow Commands</h2>
+        <table>
+            <thead>
+                <tr>
+                    <th>ID</th>
+                    <th>Time</th>
+                    <th>Duration (&micro;s)</th>
+                    <th>Command</th>
+                    <th>Client</th>
+                    <th>Name</th>
+                </tr>
+            </thead>
+            <tbody>
+                {{if eq (len .Slowlog) 0}}
+                <tr>
+                    <td colspan="6" class="empty-message">No slow commands</td>
+                </tr>
+                {{else}}
+                {{range .Slowlog}}
+                <tr>
+                    <td>{{.ID}}</td>
+                    <td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+                    <td>{{.Micros}}</td>
+                    <td>{{.Command}}</td>
+                    <td>{{.ClientAddr}}</td>
+                    <td>{{.ClientName}}</td>
+                </tr>
+                {{end}}
+                {{end}}
+            </tbody>
+        </table>
+        
         <div class="actions">
             <button class="refresh-btn" onclick="location.reload()">Refresh</button>
         </div>
@@ -768,11 +1198,43 @@ const dashboardTemplate = `
 `
 
 func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := setLogFile(cfg.LogFile); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	ShardCount = cfg.ShardCount
+	EvictionCheckPeriod = cfg.EvictionCheckPeriod
+	ShutdownTimeout = cfg.ShutdownTimeout
+	TCPReadBufferSize = cfg.ReadBufferSize
+	TCPWriteBufferSize = cfg.WriteBufferSize
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err = NewTLSConfig(cfg.TLS)
+		if err != nil {
+			log.Fatalf("Failed setting up TLS: %v", err)
+		}
+	}
+
 	// Set max CPU cores for parallelism
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// Create cache with optimized shard count
 	cache := NewCache()
+	cache.ApplyConfig(cfg)
+	if cfg.ACLFile != "" {
+		if err := cache.LoadACL(cfg.ACLFile); err != nil {
+			log.Fatalf("Failed loading ACL users from %s: %v", cfg.ACLFile, err)
+		}
+	}
+	if cfg.FunctionsFile != "" {
+		if err := cache.LoadFunctions(cfg.FunctionsFile); err != nil {
+			log.Fatalf("Failed loading function libraries from %s: %v", cfg.FunctionsFile, err)
+		}
+	}
 	/*
 	   	// Log startup info
 	   	fmt.Printf(`
@@ -823,12 +1285,24 @@ func main() {
 	fmt.Printf("%s", "🌟 keep feet clean because dust is inevitable\n")
 	fmt.Printf("  \n")
 
-	log.Printf("Starting high-performance cache with %d shards", ShardCount)
-	log.Printf("System has %d CPU cores", runtime.NumCPU())
-
-	// Start the TCP server in a goroutine
-	go StartTCPServer(cache, ":8989")
+	if cfg.File != "" {
+		logf(logNotice, "Configuration loaded from %s", cfg.File)
+	}
+	logf(logNotice, "Starting high-performance cache with %d shards", ShardCount)
+	logf(logVerbose, "System has %d CPU cores", runtime.NumCPU())
+	if cfg.MaxMemory > 0 {
+		logf(logNotice, "Memory limited to %d bytes with policy %s and admission %s", cfg.MaxMemory, cfg.MaxMemoryPolicy, admissionName(cfg.MaxMemoryAdmission))
+	}
 
-	// Start the web server (this will block)
-	StartWebServer(cache, ":9090")
+	// Start the TCP server and the web server, they return once shut down
+	tcpDrained := make(chan bool, 1)
+	go func() {
+		tcpDrained <- StartTCPServer(cache, net.JoinHostPort(cfg.Bind, strconv.Itoa(cfg.Port)), tlsConfig)
+	}()
+	webDrained := make(chan bool, 1)
+	go func() {
+		webDrained <- StartWebServer(cache, net.JoinHostPort(cfg.WebBind, strconv.Itoa(cfg.WebPort)), tlsConfig)
+	}()
+
+	os.Exit(waitForShutdown(cache, tcpDrained, webDrained))
 }
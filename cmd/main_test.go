@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCache returns an empty cache whose expiry worker stops when the
+// test ends
+func newTestCache(t *testing.T) *Cache {
+	c := NewCache()
+	t.Cleanup(c.Shutdown)
+	return c
+}
+
+// testClient returns a client on one end of a pipe, logged in as the
+// default user as if connected over TCP
+func testClient(t *testing.T, c *Cache) *client {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	cl := newClient(conn)
+	cl.user = c.acl.defaultUser()
+	return cl
+}
+
+// testSubscriber returns a client like testClient together with a function
+// that checks the next bytes written to its connection, where pushed
+// messages arrive
+func testSubscriber(t *testing.T, c *Cache) (*client, func(want string)) {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	cl := newClient(conn)
+	cl.user = c.acl.defaultUser()
+	return cl, expectFunc(t, peer)
+}
+
+// testConn serves a connection as the TCP server does and returns functions
+// that send an inline command and check the next bytes received
+func testConn(t *testing.T, c *Cache) (send func(line string), expect func(want string)) {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	go handleConnection(conn, c)
+
+	send = func(line string) {
+		t.Helper()
+		peer.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatalf("sending %q: %v", line, err)
+		}
+	}
+	return send, expectFunc(t, peer)
+}
+
+// expectFunc returns a function that fails the test unless the next bytes
+// read from conn within a second are want
+func expectFunc(t *testing.T, conn net.Conn) func(want string) {
+	return func(want string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, len(want))
+		if n, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("read %q, want %q: %v", buf[:n], want, err)
+		}
+		if string(buf) != want {
+			t.Fatalf("read %q, want %q", buf, want)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Tuning of the approximated eviction
+const (
+	MaxMemorySamples = 5 // Keys sampled per shard for every eviction
+
+	entryOverhead = int64(unsafe.Sizeof(CacheEntry{}) + unsafe.Sizeof(entryMeta{}) + 48) // Map slot and allocation headers
+
+	lfuInitValue  = 5           // Counter of new keys so they are not evicted at once
+	lfuLogFactor  = 10          // Higher values make the counter saturate more slowly
+	lfuDecayTime  = time.Minute // The counter drops by one per idle period
+	lfuMaxCounter = 255
+)
+
+func init() {
+	registerCommand("MEMORY", -2, flagReadOnly, memoryCommand)
+}
+
+// EvictionPolicy selects the keys removed when maxmemory is reached
+type EvictionPolicy int32
+
+// Supported eviction policies
+const (
+	PolicyNoEviction EvictionPolicy = iota
+	PolicyAllKeysLRU
+	PolicyVolatileLRU
+	PolicyAllKeysLFU
+	PolicyVolatileLFU
+	PolicyAllKeysRandom
+	PolicyVolatileRandom
+	PolicyVolatileTTL
+)
+
+// evictionPolicyNames maps policies to their configuration names
+var evictionPolicyNames = []string{
+	PolicyNoEviction:     "noeviction",
+	PolicyAllKeysLRU:     "allkeys-lru",
+	PolicyVolatileLRU:    "volatile-lru",
+	PolicyAllKeysLFU:     "allkeys-lfu",
+	PolicyVolatileLFU:    "volatile-lfu",
+	PolicyAllKeysRandom:  "allkeys-random",
+	PolicyVolatileRandom: "volatile-random",
+	PolicyVolatileTTL:    "volatile-ttl",
+}
+
+// String returns the configuration name of the policy
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// ParseEvictionPolicy looks up a policy by its configuration name
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	for p, n := range evictionPolicyNames {
+		if strings.EqualFold(n, name) {
+			return EvictionPolicy(p), true
+		}
+	}
+	return 0, false
+}
+
+// volatile reports whether the policy only evicts keys with a TTL
+func (p EvictionPolicy) volatile() bool {
+	return p == PolicyVolatileLRU || p == PolicyVolatileLFU || p == PolicyVolatileRandom || p == PolicyVolatileTTL
+}
+
+// errOOM is the reply to commands refused because memory is full
+const errOOM = "-OOM command not allowed when used memory > 'maxmemory'.\r\n"
+
+// ErrOutOfMemory is returned by Set when maxmemory is reached and no key
+// can be evicted
+var ErrOutOfMemory = errors.New("command not allowed when used memory > 'maxmemory'")
+
+// entryMeta holds the bookkeeping of a stored entry. It is shared by every
+// copy of the entry so that readers holding only the read lock can record
+// accesses atomically.
+type entryMeta struct {
+	size       int64  // Accounted bytes, guarded by the shard's write lock
+	lastAccess int64  // Unix nanoseconds, atomic
+	frequency  uint32 // Logarithmic LFU counter, atomic
+}
+
+// newEntryMeta returns the bookkeeping for a freshly written key
+func newEntryMeta() *entryMeta {
+	return &entryMeta{lastAccess: time.Now().UnixNano(), frequency: lfuInitValue}
+}
+
+// touch records an access: the LRU clock is refreshed and the LFU counter is
+// first decayed by the idle periods and then incremented with a probability
+// that falls as the counter grows
+func (m *entryMeta) touch() {
+	now := time.Now().UnixNano()
+	last := atomic.SwapInt64(&m.lastAccess, now)
+
+	counter := int64(atomic.LoadUint32(&m.frequency))
+	counter = max(counter-(now-last)/int64(lfuDecayTime), 0)
+	if counter < lfuMaxCounter {
+		base := float64(max(counter-lfuInitValue, 0))
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	atomic.StoreUint32(&m.frequency, uint32(counter))
+}
+
+// idle returns how long ago the entry was last accessed
+func (m *entryMeta) idle(now int64) int64 {
+	return now - atomic.LoadInt64(&m.lastAccess)
+}
+
+// lfu returns the decayed LFU counter
+func (m *entryMeta) lfu(now int64) int64 {
+	counter := int64(atomic.LoadUint32(&m.frequency))
+	return max(counter-m.idle(now)/int64(lfuDecayTime), 0)
+}
+
+// memoryUser is implemented by Objects that can estimate their own size
+type memoryUser interface {
+	MemoryUsage() int64
+}
+
+// entrySize estimates the bytes used by key and entry
+func entrySize(key string, entry CacheEntry) int64 {
+	size := entryOverhead + int64(len(key)) + int64(len(entry.Value))
+	if m, ok := entry.Object.(memoryUser); ok {
+		size += m.MemoryUsage()
+	}
+	return size
+}
+
+// storeEntry writes entry to the shard and updates the memory accounting.
+// The shard's write lock must be held.
+func (c *Cache) storeEntry(shard *CacheShard, key string, entry CacheEntry) {
+	var delta int64
+	old, exists := shard.data[key]
+	if exists {
+		delta -= old.meta.size
+		if old.ExpireAt > 0 {
+			atomic.AddInt64(&shard.volatile, -1)
+		}
+	} else {
+		atomic.AddInt64(&shard.keys, 1)
+	}
+	if entry.ExpireAt > 0 {
+		atomic.AddInt64(&shard.volatile, 1)
+	}
+	if entry.meta == nil {
+		entry.meta = newEntryMeta()
+	}
+	entry.meta.size = entrySize(key, entry)
+	delta += entry.meta.size
+
+	shard.data[key] = entry
+	atomic.AddInt64(&c.stats.UsedMemory, delta)
+	bumpVersion(shard, key)
+
+	if entry.ExpireAt > 0 && (!exists || old.ExpireAt != entry.ExpireAt) {
+		c.scheduleExpiry(shard, key, entry.ExpireAt)
+	}
+
+	if shard.admission != nil {
+		limit, policy := c.MaxMemory()
+		full := limit > 0 && atomic.LoadInt64(&c.stats.UsedMemory) > limit
+		shard.admission.store(key, entry.meta.size, full)
+		if full {
+			c.admitCandidates(shard, limit, policy)
+		}
+	}
+}
+
+// removeEntry deletes key from the shard and updates the memory accounting.
+// The shard's write lock must be held.
+func (c *Cache) removeEntry(shard *CacheShard, key string) {
+	if old, exists := shard.data[key]; exists {
+		delete(shard.data, key)
+		atomic.AddInt64(&c.stats.UsedMemory, -old.meta.size)
+		atomic.AddInt64(&shard.keys, -1)
+		if old.ExpireAt > 0 {
+			atomic.AddInt64(&shard.volatile, -1)
+		}
+		bumpVersion(shard, key)
+
+		if a := shard.admission; a != nil {
+			a.mu.Lock()
+			a.remove(key)
+			a.mu.Unlock()
+		}
+	}
+}
+
+// recordAccess updates the access bookkeeping of a key that is read or
+// modified. The shard's read or write lock must be held.
+func (c *Cache) recordAccess(shard *CacheShard, key string, entry CacheEntry) {
+	entry.meta.touch()
+	if shard.admission != nil {
+		shard.admission.access(key)
+	}
+}
+
+// parseMemorySize parses sizes such as 1048576, 100kb, 512mb or 2gb
+func parseMemorySize(s string) (int64, bool) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1}}
+
+	s = strings.ToLower(s)
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+	n, ok := parseInt(s)
+	if !ok || n < 0 || n > math.MaxInt64/factor {
+		return 0, false
+	}
+	return n * factor, true
+}
+
+// SetMaxMemory changes the memory limit in bytes and the eviction policy.
+// A limit of zero disables it. The admission filter, if enabled, splits the
+// limit evenly between shards and keeps what it learned.
+func (c *Cache) SetMaxMemory(limit int64, policy EvictionPolicy) {
+	atomic.StoreInt64(&c.maxMemory, limit)
+	atomic.StoreInt32((*int32)(&c.policy), int32(policy))
+	c.resizeAdmission(limit)
+}
+
+// MaxMemory returns the memory limit and the eviction policy
+func (c *Cache) MaxMemory() (int64, EvictionPolicy) {
+	return atomic.LoadInt64(&c.maxMemory), EvictionPolicy(atomic.LoadInt32((*int32)(&c.policy)))
+}
+
+// ReserveMemory is called before commands that may use more memory. It
+// evicts keys according to the policy until memory use is under the limit
+// again and reports whether the command may go ahead.
+func (c *Cache) ReserveMemory() bool {
+	limit, policy := c.MaxMemory()
+	if limit <= 0 || atomic.LoadInt64(&c.stats.UsedMemory) <= limit {
+		return true
+	}
+	start := time.Now()
+	defer func() { c.latency.add(latencyEvictionCycle, time.Since(start)) }()
+	for atomic.LoadInt64(&c.stats.UsedMemory) > limit {
+		if policy == PolicyNoEviction || !c.evictOne(policy) {
+			return false
+		}
+	}
+	return true
+}
+
+// evictOne samples keys of a random shard and removes the best candidate.
+// Shards without candidates are skipped, and so are shards in use by a
+// transaction unless the caller is the one that holds every gate. With the
+// admission filter a first round only looks at keys it has not admitted
+// yet and keys on probation, so keys that were read again are kept while
+// there are others. It returns false if no shard has a key that the policy
+// allows to evict.
+func (c *Cache) evictOne(policy EvictionPolicy) bool {
+	ownsGates := c.allGatesHeld.Load()
+	rounds := 1
+	if c.admission.Load() {
+		rounds = 2
+	}
+	for round := 0; round < rounds; round++ {
+		start := rand.Uint64()
+		for try := uint64(0); try < uint64(len(c.shards)); try++ {
+			shard := c.shards[(start+try)&c.shardMask]
+			if !ownsGates && !shard.gate.TryRLock() {
+				continue
+			}
+			shard.mu.Lock()
+			key, rejected, ok := chooseVictim(shard, policy, round == 0)
+			if ok {
+				c.removeEntry(shard, key)
+				c.notify(notifyEvicted, "evicted", key)
+			}
+			shard.mu.Unlock()
+			if !ownsGates {
+				shard.gate.RUnlock()
+			}
+
+			if ok {
+				atomic.AddUint64(&c.stats.MemoryEvictions, 1)
+				if rejected {
+					atomic.AddUint64(&c.stats.AdmissionRejects, 1)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chooseVictim picks the key of the shard to evict, through the admission
+// filter if it is enabled and filtered is set. rejected reports whether it
+// is a new key the filter refused. The shard's write lock must be held.
+func chooseVictim(shard *CacheShard, policy EvictionPolicy, filtered bool) (key string, rejected, ok bool) {
+	if a := shard.admission; a != nil && filtered {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.victim(shard, policy)
+	}
+	key, ok = sampleVictim(shard, policy, nil)
+	return key, false, ok
+}
+
+// sampleVictim picks the best key to evict among MaxMemorySamples keys of
+// the shard, only considering keys allowed reports true for if it is not
+// nil. Map iteration starts at a random position, which makes the sample
+// approximately random.
+func sampleVictim(shard *CacheShard, policy EvictionPolicy, allowed func(key string) bool) (string, bool) {
+	now := time.Now().UnixNano()
+
+	var victim string
+	var best int64
+	found, sampled, visited := false, 0, 0
+	for key, entry := range shard.data {
+		// Volatile policies skip keys without a TTL, but only so many
+		if sampled == MaxMemorySamples || visited == 4*MaxMemorySamples {
+			break
+		}
+		visited++
+		if (policy.volatile() && entry.ExpireAt == 0) || (allowed != nil && !allowed(key)) {
+			continue
+		}
+		sampled++
+
+		// Higher scores are better candidates
+		var score int64
+		switch policy {
+		case PolicyAllKeysLRU, PolicyVolatileLRU:
+			score = entry.meta.idle(now)
+		case PolicyAllKeysLFU, PolicyVolatileLFU:
+			score = lfuMaxCounter - entry.meta.lfu(now)
+		case PolicyVolatileTTL:
+			score = -entry.ExpireAt
+		}
+		if !found || score > best {
+			victim, best, found = key, score, true
+		}
+		if policy == PolicyAllKeysRandom || policy == PolicyVolatileRandom {
+			break
+		}
+	}
+	return victim, found
+}
+
+// memoryCommand implements MEMORY USAGE key and MEMORY STATS
+func memoryCommand(c *Cache, args []string) string {
+	switch strings.ToUpper(args[1]) {
+	case "USAGE":
+		if len(args) != 3 && !(len(args) == 5 && strings.EqualFold(args[3], "SAMPLES")) {
+			return respError(errSyntax)
+		}
+		reply := respNil()
+		c.View(args[2], func(entry CacheEntry, exists bool) {
+			if exists {
+				reply = respInt(entry.meta.size)
+			}
+		})
+		return reply
+
+	case "STATS":
+		limit, policy := c.MaxMemory()
+		stats := c.GetStats()
+		return respArray([]string{
+			respSimple("used.memory"), respInt(stats.UsedMemory),
+			respSimple("maxmemory"), respInt(limit),
+			respSimple("maxmemory.policy"), respBulk(policy.String()),
+			respSimple("keys.evicted"), respInt(int64(stats.MemoryEvictions)),
+			respSimple("keys.expired"), respInt(int64(stats.Evictions)),
+		})
+	}
+	return respError("unknown subcommand '" + args[1] + "'. Try MEMORY USAGE or MEMORY STATS.")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stored reports whether key is in its shard without counting an access
+func stored(c *Cache, key string) bool {
+	shard := c.getShard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	_, exists := shard.data[key]
+	return exists
+}
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"1048576", 1048576, true},
+		{"100kb", 100 << 10, true},
+		{"512MB", 512 << 20, true},
+		{"2gb", 2 << 30, true},
+		{"1k", 1000, true},
+		{"3m", 3000000, true},
+		{"10b", 10, true},
+		{"0", 0, true},
+		{"-1mb", 0, false},
+		{"mb", 0, false},
+		{"10tb", 0, false},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"9007199254740992kb", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseMemorySize(tt.in); got != tt.want || ok != tt.ok {
+			t.Errorf("parseMemorySize(%q) = %d, %v, want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	c := fillCache(t, 100, "noeviction", "none")
+	oom := -1
+	for i := 0; i < 200; i++ {
+		if executeCommand(c, []string{"SET", "key:" + strconv.Itoa(i), "v"}) == errOOM {
+			oom = i
+			break
+		}
+	}
+	if oom < 90 || oom > 110 {
+		t.Fatalf("first refused write was number %d, want about 100", oom)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "key:0"}, "v\r\n"},
+		{[]string{"ZADD", "z", "1", "a"}, errOOM},
+		{[]string{"PFADD", "h", "a"}, errOOM},
+		{[]string{"DEL", "key:0"}, ":1\r\n"},
+		{[]string{"DEL", "key:1"}, ":1\r\n"},
+		{[]string{"SET", "key:0", "v"}, "OK\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if n := c.GetStats().MemoryEvictions; n != 0 {
+		t.Fatalf("noeviction evicted %d keys", n)
+	}
+}
+
+func TestAllKeysPolicies(t *testing.T) {
+	for _, policy := range []string{"allkeys-lru", "allkeys-lfu", "allkeys-random"} {
+		c := fillCache(t, 1000, policy, "none")
+		limit, _ := c.MaxMemory()
+		for i := 0; i < 5000; i++ {
+			if got := executeCommand(c, []string{"SET", "key:" + strconv.Itoa(i), "v"}); got != "OK\r\n" {
+				t.Fatalf("%s: SET = %q", policy, got)
+			}
+		}
+		stats := c.GetStats()
+		keys, _ := c.KeyCounts()
+		if stats.UsedMemory > limit+entrySize("key:0000", CacheEntry{Value: "v"}) || keys < 900 {
+			t.Fatalf("%s: %d keys use %d bytes of %d", policy, keys, stats.UsedMemory, limit)
+		}
+		if stats.MemoryEvictions != uint64(5000-keys) {
+			t.Fatalf("%s: %d evictions for %d keys left", policy, stats.MemoryEvictions, keys)
+		}
+	}
+}
+
+// The policies below pick the best of a few keys of one shard, so the caches
+// hold enough keys for every shard to have a choice
+
+func TestLRUKeepsRecentKeys(t *testing.T) {
+	c := fillCache(t, 20000, "allkeys-lru", "none")
+	for i := 0; i < 20000; i++ {
+		executeCommand(c, []string{"SET", "key:" + strconv.Itoa(i), "v"})
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 100; i++ {
+		executeCommand(c, []string{"GET", "key:" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 5000; i++ {
+		executeCommand(c, []string{"SET", "new:" + strconv.Itoa(i), "v"})
+	}
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		if stored(c, "key:"+strconv.Itoa(i)) {
+			kept++
+		}
+	}
+	if kept < 95 {
+		t.Fatalf("kept %d of 100 recently read keys", kept)
+	}
+}
+
+func TestLFUKeepsFrequentKeys(t *testing.T) {
+	c := fillCache(t, 20000, "allkeys-lfu", "none")
+	for i := 0; i < 20000; i++ {
+		executeCommand(c, []string{"SET", "key:" + strconv.Itoa(i), "v"})
+	}
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			executeCommand(c, []string{"GET", "key:" + strconv.Itoa(i)})
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		executeCommand(c, []string{"SET", "new:" + strconv.Itoa(i), "v"})
+	}
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		if stored(c, "key:"+strconv.Itoa(i)) {
+			kept++
+		}
+	}
+	if kept < 95 {
+		t.Fatalf("kept %d of 100 frequently read keys", kept)
+	}
+}
+
+func TestVolatilePolicies(t *testing.T) {
+	for _, policy := range []string{"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl"} {
+		c := fillCache(t, 1000, policy, "none")
+		for i := 0; i < 500; i++ {
+			c.Set("persistent:"+strconv.Itoa(i), "v", 0)
+			c.Set("ttl:"+strconv.Itoa(i), "v", time.Hour)
+		}
+
+		oom := false
+		for i := 0; i < 1000 && !oom; i++ {
+			oom = executeCommand(c, []string{"SET", "new:" + strconv.Itoa(i), "v"}) == errOOM
+		}
+		if !oom {
+			t.Fatalf("%s: writes never failed after every key with a TTL was evicted", policy)
+		}
+		for i := 0; i < 500; i++ {
+			if !stored(c, "persistent:"+strconv.Itoa(i)) {
+				t.Fatalf("%s evicted a key without a TTL", policy)
+			}
+		}
+		if _, expires := c.KeyCounts(); expires != 0 {
+			t.Fatalf("%s: %d keys with a TTL are left", policy, expires)
+		}
+	}
+}
+
+func TestVolatileTTLEvictsSoonestFirst(t *testing.T) {
+	c := fillCache(t, 20000, "volatile-ttl", "none")
+	for i := 0; i < 10000; i++ {
+		c.Set("soon:"+strconv.Itoa(i), "v", time.Hour)
+		c.Set("later:"+strconv.Itoa(i), "v", 24*time.Hour)
+	}
+	for i := 0; i < 5000; i++ {
+		executeCommand(c, []string{"SET", "new:" + strconv.Itoa(i), "v"})
+	}
+
+	later := 0
+	for i := 0; i < 10000; i++ {
+		if stored(c, "later:"+strconv.Itoa(i)) {
+			later++
+		}
+	}
+	if later < 9500 {
+		t.Fatalf("evicting 5000 keys removed %d keys with the later deadline", 10000-later)
+	}
+}
+
+func TestMemoryCommand(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	executeCommand(c, []string{"CONFIG", "SET", "maxmemory", "1mb", "maxmemory-policy", "allkeys-lru"})
+	executeCommand(c, []string{"SET", "k", "value"})
+	usage := respInt(entrySize("k", CacheEntry{Value: "value"}))
+	used := c.GetStats().UsedMemory
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"MEMORY", "USAGE", "k"}, usage},
+		{[]string{"MEMORY", "USAGE", "k", "SAMPLES", "5"}, usage},
+		{[]string{"MEMORY", "USAGE", "missing"}, "$-1\r\n"},
+		{[]string{"MEMORY", "USAGE", "k", "5"}, "-ERR syntax error\r\n"},
+		{[]string{"MEMORY", "STATS"}, respArray([]string{
+			"+used.memory\r\n", respInt(used),
+			"+maxmemory\r\n", ":1048576\r\n",
+			"+maxmemory.policy\r\n", "$11\r\nallkeys-lru\r\n",
+			"+keys.evicted\r\n", ":0\r\n",
+			"+keys.expired\r\n", ":0\r\n",
+		})},
+		{[]string{"MEMORY", "DOCTOR"}, "-ERR unknown subcommand 'DOCTOR'. Try MEMORY USAGE or MEMORY STATS.\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w io.Writer
+}
+
+// family writes the HELP and TYPE lines of a metric
+func (m metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value of a metric, labels are name/value pairs
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.Write([]byte(name))
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+		}
+		fmt.Fprintf(m.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(m.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// metric writes a metric with a single unlabeled value
+func (m metricsWriter) metric(name, kind, help string, value float64) {
+	m.family(name, kind, help)
+	m.sample(name, value)
+}
+
+// writeMetrics writes every metric of the cache
+func (c *Cache) writeMetrics(w io.Writer) {
+	m := metricsWriter{w}
+	stats := c.GetStats()
+	maxMemory, policy := c.MaxMemory()
+	keys, expires := c.KeyCounts()
+
+	m.metric("dustdb_uptime_seconds", "gauge", "Seconds since the server started.", time.Since(c.startTime).Seconds())
+	m.metric("dustdb_commands_gets_total", "counter", "Key reads.", float64(stats.Gets))
+	m.metric("dustdb_commands_sets_total", "counter", "Key writes.", float64(stats.Sets))
+	m.metric("dustdb_commands_deletes_total", "counter", "Key deletions.", float64(stats.Deletes))
+	m.metric("dustdb_keyspace_hits_total", "counter", "Reads that found their key.", float64(stats.Hits))
+	m.metric("dustdb_keyspace_misses_total", "counter", "Reads that did not find their key.", float64(stats.Misses))
+	m.metric("dustdb_expired_keys_total", "counter", "Keys removed because their TTL passed.", float64(stats.Evictions))
+	m.metric("dustdb_evicted_keys_total", "counter", "Keys evicted to stay under maxmemory.", float64(stats.MemoryEvictions))
+	m.metric("dustdb_admission_rejects_total", "counter", "New keys the tinylfu admission filter refused to keep.", float64(stats.AdmissionRejects))
+
+	m.metric("dustdb_keys", "gauge", "Keys in the keyspace.", float64(keys))
+	m.metric("dustdb_keys_with_expiry", "gauge", "Keys that have a TTL.", float64(expires))
+	m.metric("dustdb_memory_used_bytes", "gauge", "Memory used by keys and values.", float64(stats.UsedMemory))
+	m.metric("dustdb_memory_max_bytes", "gauge", "The maxmemory limit, 0 if there is none.", float64(maxMemory))
+	m.family("dustdb_memory_max_policy", "gauge", "The maxmemory-policy in effect.")
+	m.sample("dustdb_memory_max_policy", 1, "policy", policy.String())
+	m.family("dustdb_memory_admission", "gauge", "The maxmemory-admission filter in effect.")
+	m.sample("dustdb_memory_admission", 1, "admission", admissionName(c.admission.Load()))
+
+	m.metric("dustdb_connected_clients", "gauge", "Open TCP connections.", float64(stats.ActiveConns))
+	m.metric("dustdb_rejected_connections_total", "counter", "Connections refused because of maxclients.", float64(stats.RejectedConns))
+	m.metric("dustdb_pubsub_channels", "gauge", "Channels with at least one subscriber.", float64(len(c.pubsub.names(subChannel, ""))))
+	m.metric("dustdb_pubsub_patterns", "gauge", "Subscribed patterns.", float64(c.pubsub.numPat()))
+
+	// dustdb has no keyspace snapshots, so the functions file is all there
+	// is to persist
+	c.functions.mu.Lock()
+	file, saveErr, lastSave := c.functions.file, c.functions.saveErr, c.functions.lastSave
+	c.functions.mu.Unlock()
+	enabled, ok, saved := 0.0, 1.0, 0.0
+	if file != "" {
+		enabled = 1
+	}
+	if saveErr != nil {
+		ok = 0
+	}
+	if !lastSave.IsZero() {
+		saved = float64(lastSave.UnixNano()) / 1e9
+	}
+	m.metric("dustdb_persistence_functions_enabled", "gauge", "Whether function libraries are kept in a file.", enabled)
+	m.metric("dustdb_persistence_functions_last_save_ok", "gauge", "Whether the last save of the functions file succeeded.", ok)
+	m.metric("dustdb_persistence_functions_last_save_timestamp_seconds", "gauge", "Time of the last successful save of the functions file.", saved)
+	m.family("dustdb_replication_role", "gauge", "Replication role of the server, always master as dustdb does not replicate yet.")
+	m.sample("dustdb_replication_role", 1, "role", "master")
+	m.metric("dustdb_connected_replicas", "gauge", "Connected replicas.", 0)
+
+	names := c.commandStats.called()
+	m.family("dustdb_command_calls_total", "counter", "Calls of each command.")
+	for _, name := range names {
+		m.sample("dustdb_command_calls_total", float64(c.commandStats.commands[name].calls.Load()), "cmd", strings.ToLower(name))
+	}
+	m.family("dustdb_command_failed_calls_total", "counter", "Calls of each command that replied with an error.")
+	for _, name := range names {
+		m.sample("dustdb_command_failed_calls_total", float64(c.commandStats.commands[name].failed.Load()), "cmd", strings.ToLower(name))
+	}
+	m.family("dustdb_command_rejected_calls_total", "counter", "Calls of each command refused before running, such as by ACLs.")
+	for _, name := range names {
+		m.sample("dustdb_command_rejected_calls_total", float64(c.commandStats.commands[name].rejected.Load()), "cmd", strings.ToLower(name))
+	}
+	codes, counts := c.commandStats.errorCounts()
+	m.family("dustdb_errors_total", "counter", "Error replies by error code.")
+	for _, code := range codes {
+		m.sample("dustdb_errors_total", float64(counts[code]), "code", code)
+	}
+	m.family("dustdb_command_duration_seconds", "histogram", "Time taken by each command.")
+	for _, name := range names {
+		stat, cmd := c.commandStats.commands[name], strings.ToLower(name)
+		calls := stat.calls.Load()
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += stat.buckets[i].Load()
+			m.sample("dustdb_command_duration_seconds_bucket", float64(cumulative), "cmd", cmd, "le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))
+		}
+		m.sample("dustdb_command_duration_seconds_bucket", float64(calls), "cmd", cmd, "le", "+Inf")
+		m.sample("dustdb_command_duration_seconds_sum", float64(stat.nanos.Load())/1e9, "cmd", cmd)
+		m.sample("dustdb_command_duration_seconds_count", float64(calls), "cmd", cmd)
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m.metric("go_goroutines", "gauge", "Goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	m.metric("go_memstats_heap_alloc_bytes", "gauge", "Heap bytes allocated and still in use.", float64(mem.HeapAlloc))
+	m.metric("go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.", float64(mem.Sys))
+	m.metric("go_gc_cycles_total", "counter", "Completed GC cycles.", float64(mem.NumGC))
+}
+
+// metricsHandler serves /metrics. Scrapers authenticate like other web
+// clients and need permission to run INFO.
+func metricsHandler(cache *Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := cache.acl.authenticateRequest(w, r)
+		if !ok {
+			return
+		}
+		if reply := cache.acl.check(user, []string{"INFO"}, "toplevel", "addr="+r.RemoteAddr+" web user="+user.name); reply != "" {
+			http.Error(w, strings.TrimSuffix(reply[1:], "\r\n"), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		cache.writeMetrics(w)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns the sample lines of the metrics page keyed by metric
+// name and labels
+func scrape(c *Cache) map[string]string {
+	var b strings.Builder
+	c.writeMetrics(&b)
+	samples := make(map[string]string)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if i := strings.LastIndexByte(line, ' '); i > 0 && !strings.HasPrefix(line, "#") {
+			samples[line[:i]] = line[i+1:]
+		}
+	}
+	return samples
+}
+
+func TestMetricsKeyCounts(t *testing.T) {
+	c := newTestCache(t)
+	steps := []struct {
+		args     []string
+		keys     string
+		volatile string
+	}{
+		{[]string{"SET", "a", "1"}, "1", "0"},
+		{[]string{"SET", "b", "1", "EX", "100"}, "2", "1"},
+		{[]string{"SET", "b", "2"}, "2", "0"},
+		{[]string{"EXPIRE", "a", "100"}, "2", "1"},
+		{[]string{"EXPIRE", "a", "200"}, "2", "1"},
+		{[]string{"PERSIST", "a"}, "2", "0"},
+		{[]string{"ZADD", "z", "1", "m"}, "3", "0"},
+		{[]string{"PEXPIRE", "z", "100000"}, "3", "1"},
+		{[]string{"DEL", "z"}, "2", "0"},
+		{[]string{"EXPIRE", "a", "-1"}, "1", "0"},
+		{[]string{"DEL", "missing"}, "1", "0"},
+	}
+	for _, step := range steps {
+		executeCommand(c, step.args)
+		samples := scrape(c)
+		if samples["dustdb_keys"] != step.keys || samples["dustdb_keys_with_expiry"] != step.volatile {
+			t.Fatalf("after %v keys = %s and keys with expiry = %s, want %s and %s",
+				step.args, samples["dustdb_keys"], samples["dustdb_keys_with_expiry"], step.keys, step.volatile)
+		}
+	}
+
+	// Keys removed by the expiry worker and by eviction are counted too
+	executeCommand(c, []string{"SET", "t", "1", "PX", "1"})
+	if !waitExpired(c, "t") {
+		t.Fatal("t did not expire")
+	}
+	if got := scrape(c)["dustdb_keys"]; got != "1" {
+		t.Fatalf("after expiry keys = %s, want 1", got)
+	}
+	c.SetMaxMemory(1, PolicyAllKeysRandom)
+	c.ReserveMemory()
+	if samples := scrape(c); samples["dustdb_keys"] != "0" || samples["dustdb_evicted_keys_total"] != "1" {
+		t.Fatalf("after eviction keys = %s and evicted = %s, want 0 and 1", samples["dustdb_keys"], samples["dustdb_evicted_keys_total"])
+	}
+}
+
+func TestMetricsPage(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "k", "v"})
+	c.commandStats.record("GET", 0, "$1\r\nv\r\n")
+	c.commandStats.record("GET", 0, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+
+	rec := httptest.NewRecorder()
+	metricsHandler(c)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("GET /metrics = %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE dustdb_keys gauge\ndustdb_keys 1\n",
+		`dustdb_memory_max_policy{policy="noeviction"} 1`,
+		`dustdb_command_calls_total{cmd="get"} 2`,
+		`dustdb_command_failed_calls_total{cmd="get"} 1`,
+		`dustdb_errors_total{code="WRONGTYPE"} 1`,
+		`dustdb_command_duration_seconds_bucket{cmd="get",le="+Inf"} 2`,
+		`dustdb_command_duration_seconds_count{cmd="get"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
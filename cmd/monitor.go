@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// monitorHub holds the clients that ran MONITOR
+type monitorHub struct {
+	// Checked before anything else, so that commands cost one atomic load
+	// while nobody monitors
+	count atomic.Int32
+
+	mu      sync.RWMutex
+	clients map[*client]bool
+}
+
+func newMonitorHub() *monitorHub {
+	return &monitorHub{clients: make(map[*client]bool)}
+}
+
+// add starts sending commands to cl
+func (h *monitorHub) add(cl *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.clients[cl] {
+		h.clients[cl] = true
+		h.count.Add(1)
+	}
+}
+
+// remove stops sending commands to cl
+func (h *monitorHub) remove(cl *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[cl] {
+		delete(h.clients, cl)
+		h.count.Add(-1)
+	}
+}
+
+// feed sends a command that started at start to every monitor. source is
+// the address of the client that sent it, or lua for commands called by
+// scripts. As in Redis, administrative commands and QUIT are left out and
+// passwords are redacted. Monitors that fall behind are disconnected by
+// the output limit of push.
+func (h *monitorHub) feed(start time.Time, args []string, source string) {
+	if h.count.Load() == 0 {
+		return
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok || cmd.flags&flagAdmin != 0 || args[0] == "QUIT" {
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "+%d.%06d [0 %s]", start.Unix(), start.Nanosecond()/1000, source)
+	for _, arg := range redactArgs(args) {
+		b.WriteByte(' ')
+		quoteMonitorArg(&b, arg)
+	}
+	b.WriteString("\r\n")
+	line := b.String()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for cl := range h.clients {
+		cl.push(line)
+	}
+}
+
+// quoteMonitorArg writes arg in double quotes, escaping quotes, backslashes
+// and unprintable bytes so that the line cannot be broken up
+func quoteMonitorArg(b *strings.Builder, arg string) {
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch ch := arg[i]; ch {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if ch < 0x20 || ch > 0x7e {
+				fmt.Fprintf(b, `\x%02x`, ch)
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// monitorCommand implements MONITOR. From then on the connection receives
+// every command run by any client and only accepts QUIT.
+func monitorCommand(c *Cache, cl *client, args []string) string {
+	if len(args) != 1 {
+		return respError("wrong number of arguments for 'monitor' command")
+	}
+	cl.monitor = true
+	cl.pushMode.Store(true)
+	c.monitors.add(cl)
+	return respOK()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuoteMonitorArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"plain", `"plain"`},
+		{"", `""`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`a\b`, `"a\\b"`},
+		{"line\r\nbreak\ttab", `"line\r\nbreak\ttab"`},
+		{"\x00\x7f\xff", `"\x00\x7f\xff"`},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		quoteMonitorArg(&b, tt.arg)
+		if got := b.String(); got != tt.want {
+			t.Fatalf("quoteMonitorArg(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestMonitorFeed(t *testing.T) {
+	c := newTestCache(t)
+	cl, expect := testSubscriber(t, c)
+	if got := monitorCommand(c, cl, []string{"MONITOR", "x"}); got != respError("wrong number of arguments for 'monitor' command") {
+		t.Fatalf("MONITOR x = %q", got)
+	}
+	if got := monitorCommand(c, cl, []string{"MONITOR"}); got != respOK() {
+		t.Fatalf("MONITOR = %q", got)
+	}
+
+	start := time.Unix(1700000000, 123456789)
+	c.monitors.feed(start, []string{"SET", "k", "a b\n"}, "127.0.0.1:5000")
+	expect("+1700000000.123456 [0 127.0.0.1:5000] \"SET\" \"k\" \"a b\\n\"\r\n")
+	c.monitors.feed(start, []string{"AUTH", "alice", "secret"}, "lua")
+	expect("+1700000000.123456 [0 lua] \"AUTH\" \"(redacted)\" \"(redacted)\"\r\n")
+
+	// Administrative commands, QUIT and unknown commands are left out
+	c.monitors.feed(start, []string{"CONFIG", "GET", "maxmemory"}, "lua")
+	c.monitors.feed(start, []string{"QUIT"}, "lua")
+	c.monitors.feed(start, []string{"NOPE"}, "lua")
+	c.monitors.feed(start, []string{"GET", "k"}, "lua")
+	expect("+1700000000.123456 [0 lua] \"GET\" \"k\"\r\n")
+
+	c.monitors.remove(cl)
+	c.monitors.remove(cl)
+	if n := c.monitors.count.Load(); n != 0 {
+		t.Fatalf("%d monitors after removing the only one", n)
+	}
+}
+
+func TestMonitorConn(t *testing.T) {
+	c := newTestCache(t)
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	go handleConnection(conn, c)
+	peer.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(peer)
+	roundTrip := func(line string) string {
+		t.Helper()
+		if _, err := peer.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatalf("sending %q: %v", line, err)
+		}
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the reply to %q: %v", line, err)
+		}
+		return reply
+	}
+	if got := roundTrip("MONITOR"); got != respOK() {
+		t.Fatalf("MONITOR = %q", got)
+	}
+	if got, want := roundTrip("GET a"), respError("only QUIT is allowed in MONITOR mode"); got != want {
+		t.Fatalf("GET a while monitoring = %q, want %q", got, want)
+	}
+
+	send, expect := testConn(t, c)
+	send("SET a 1")
+	expect("OK\r\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "+") || !strings.HasSuffix(line, " [0 pipe] \"SET\" \"a\" \"1\"\r\n") {
+		t.Fatalf("monitor received %q, %v", line, err)
+	}
+
+	if got := roundTrip("QUIT"); got != respOK() {
+		t.Fatalf("QUIT = %q", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.monitors.count.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("monitor was not removed after QUIT")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// Keyspace event classes, set with the notify-keyspace-events flags
+const (
+	notifyKeyspace = 1 << iota // K: publish on __keyspace@0__:<key>
+	notifyKeyevent             // E: publish on __keyevent@0__:<event>
+	notifyGeneric              // g: del, expire, persist
+	notifyString               // $: set
+	notifyExpired              // x: expired
+	notifyEvicted              // e: evicted
+
+	notifyAll = notifyGeneric | notifyString | notifyExpired | notifyEvicted // A
+)
+
+// notifyFlagClasses maps notify-keyspace-events characters to classes.
+// Characters for types dustdb does not have are accepted and ignored.
+var notifyFlagClasses = map[rune]int{
+	'K': notifyKeyspace, 'E': notifyKeyevent, 'A': notifyAll,
+	'g': notifyGeneric, '$': notifyString, 'x': notifyExpired, 'e': notifyEvicted,
+	'l': 0, 's': 0, 'h': 0, 'z': 0, 't': 0, 'm': 0, 'd': 0, 'n': 0,
+}
+
+// parseNotifyFlags parses a notify-keyspace-events value such as "Ex" or
+// "KEA"
+func parseNotifyFlags(s string) (int, bool) {
+	flags := 0
+	for _, ch := range s {
+		class, ok := notifyFlagClasses[ch]
+		if !ok {
+			return 0, false
+		}
+		flags |= class
+	}
+	return flags, true
+}
+
+// formatNotifyFlags turns classes back into notify-keyspace-events
+// characters
+func formatNotifyFlags(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		for _, ch := range "g$xe" {
+			if flags&notifyFlagClasses[ch] != 0 {
+				b.WriteRune(ch)
+			}
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		b.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		b.WriteByte('E')
+	}
+	return b.String()
+}
+
+// SetNotifyFlags changes which keyspace events are published. Events are
+// only published if a class and at least one of K and E are enabled.
+func (c *Cache) SetNotifyFlags(flags int) {
+	atomic.StoreInt32(&c.notifyFlags, int32(flags))
+}
+
+// NotifyFlags returns the enabled keyspace event classes
+func (c *Cache) NotifyFlags() int {
+	return int(atomic.LoadInt32(&c.notifyFlags))
+}
+
+// notify publishes a keyspace event for key if its class is enabled. It does
+// not block and may be called while holding shard locks.
+func (c *Cache) notify(class int, event, key string) {
+	flags := c.NotifyFlags()
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		c.pubsub.publish("__keyspace@0__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		c.pubsub.publish("__keyevent@0__:"+event, key)
+	}
+}
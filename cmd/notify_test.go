@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// keyspaceMessage is the message received by a subscriber of pattern for
+// an event published on channel
+func keyspaceMessage(pattern, channel, message string) string {
+	return respArray([]string{respBulk("pmessage"), respBulk(pattern), respBulk(channel), respBulk(message)})
+}
+
+func TestNotifyFlags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"KEA", "AKE", true},
+		{"Ex", "xE", true},
+		{"K$g", "g$K", true},
+		{"Eg$xe", "AE", true},
+		{"Klz", "K", true},
+		{"KQ", "", false},
+	}
+	for _, tt := range tests {
+		flags, ok := parseNotifyFlags(tt.in)
+		if ok != tt.ok || (ok && formatNotifyFlags(flags) != tt.want) {
+			t.Errorf("parseNotifyFlags(%q) = %q, %v, want %q, %v", tt.in, formatNotifyFlags(flags), ok, tt.want, tt.ok)
+		}
+	}
+
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	if got, want := executeCommand(c, []string{"CONFIG", "SET", "notify-keyspace-events", "KQ"}),
+		"-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - must be keyspace event classes such as KEA or Ex\r\n"; got != want {
+		t.Fatalf("CONFIG SET = %q, want %q", got, want)
+	}
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	executeCommand(c, []string{"CONFIG", "SET", "notify-keyspace-events", "KEA"})
+	cl, expect := testSubscriber(t, c)
+	subscribeCommand(c, cl, []string{"PSUBSCRIBE", "__key*__:*"})
+	expect(respArray([]string{respBulk("psubscribe"), respBulk("__key*__:*"), respInt(1)}))
+
+	events := []struct {
+		args  []string
+		event string
+	}{
+		{[]string{"SET", "k", "v"}, "set"},
+		{[]string{"EXPIRE", "k", "100"}, "expire"},
+		{[]string{"PERSIST", "k"}, "persist"},
+		{[]string{"DEL", "k"}, "del"},
+		{[]string{"SET", "k", "v"}, "set"},
+		{[]string{"PEXPIRE", "k", "0"}, "del"},
+	}
+	for _, e := range events {
+		executeCommand(c, e.args)
+		expect(keyspaceMessage("__key*__:*", "__keyspace@0__:k", e.event))
+		expect(keyspaceMessage("__key*__:*", "__keyevent@0__:"+e.event, "k"))
+	}
+}
+
+func TestKeyspaceEventClasses(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	cl, expect := testSubscriber(t, c)
+	subscribeCommand(c, cl, []string{"PSUBSCRIBE", "*"})
+	expect(respArray([]string{respBulk("psubscribe"), respBulk("*"), respInt(1)}))
+
+	// Nothing is published for disabled classes, so the marker arrives first
+	executeCommand(c, []string{"CONFIG", "SET", "notify-keyspace-events", "E$"})
+	executeCommand(c, []string{"SET", "k", "v"})
+	executeCommand(c, []string{"EXPIRE", "k", "100"})
+	executeCommand(c, []string{"DEL", "k"})
+	executeCommand(c, []string{"PUBLISH", "marker", "1"})
+	expect(keyspaceMessage("*", "__keyevent@0__:set", "k"))
+	expect(keyspaceMessage("*", "marker", "1"))
+
+	// Classes without K or E publish nothing
+	executeCommand(c, []string{"CONFIG", "SET", "notify-keyspace-events", "A"})
+	executeCommand(c, []string{"SET", "k", "v"})
+	executeCommand(c, []string{"PUBLISH", "marker", "2"})
+	expect(keyspaceMessage("*", "marker", "2"))
+}
+
+func TestExpiredAndEvictedEvents(t *testing.T) {
+	c := fillCache(t, 1000, "volatile-ttl", "none")
+	executeCommand(c, []string{"CONFIG", "SET", "notify-keyspace-events", "Exe"})
+	cl, expect := testSubscriber(t, c)
+	subscribeCommand(c, cl, []string{"SUBSCRIBE", "__keyevent@0__:expired", "__keyevent@0__:evicted"})
+	expect(respArray([]string{respBulk("subscribe"), respBulk("__keyevent@0__:expired"), respInt(1)}))
+	expect(respArray([]string{respBulk("subscribe"), respBulk("__keyevent@0__:evicted"), respInt(2)}))
+
+	// The expiry worker removes the key without it being read
+	c.Set("k", "v", time.Millisecond)
+	expect(respArray([]string{respBulk("message"), respBulk("__keyevent@0__:expired"), respBulk("k")}))
+
+	// Only the key with a TTL can be evicted
+	c.Set("victim", "v", time.Hour)
+	for i := 0; i < 2000 && c.GetStats().MemoryEvictions == 0; i++ {
+		executeCommand(c, []string{"SET", "key:" + strconv.Itoa(i), "v"})
+	}
+	expect(respArray([]string{respBulk("message"), respBulk("__keyevent@0__:evicted"), respBulk("victim")}))
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registerCommand("PUBLISH", 3, flagPubSub, publishCommand)
+	registerCommand("SPUBLISH", 3, flagPubSub, publishCommand)
+	registerCommand("PUBSUB", -2, flagPubSub, pubsubCommand)
+}
+
+// Confirmation replies by kind of subscription
+var (
+	subscribeReplies   = [3]string{"subscribe", "psubscribe", "ssubscribe"}
+	unsubscribeReplies = [3]string{"unsubscribe", "punsubscribe", "sunsubscribe"}
+)
+
+// pubsubHub routes published messages to subscribed clients. Shard
+// channels are a namespace of their own, as in a cluster they are served by
+// the node owning the channel's slot.
+type pubsubHub struct {
+	mu   sync.RWMutex
+	subs [3]map[string]map[*client]bool // Subscribers by kind and name
+}
+
+// newPubSubHub creates a hub without subscriptions
+func newPubSubHub() *pubsubHub {
+	h := &pubsubHub{}
+	for i := range h.subs {
+		h.subs[i] = make(map[string]map[*client]bool)
+	}
+	return h
+}
+
+// subscribe adds cl to the subscribers of a channel, pattern or shard
+// channel. The confirmation is queued before the lock is released so that it
+// reaches the client ahead of any message.
+func (h *pubsubHub) subscribe(cl *client, kind int, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[kind][name] == nil {
+		h.subs[kind][name] = make(map[*client]bool)
+	}
+	h.subs[kind][name][cl] = true
+	if !cl.subs[kind][name] {
+		cl.subs[kind][name] = true
+		cl.numSubs.Add(1)
+	}
+
+	cl.pushMode.Store(true)
+	cl.push(respArray([]string{respBulk(subscribeReplies[kind]), respBulk(name), respInt(int64(cl.subscriptions(kind)))}))
+}
+
+// unsubscribe removes cl from the subscribers of the given names, or of all
+// its subscriptions of the kind if names is empty, and queues a confirmation
+// for each
+func (h *pubsubHub) unsubscribe(cl *client, kind int, names []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cl.pushMode.Store(true)
+	if len(names) == 0 {
+		for name := range cl.subs[kind] {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			cl.push(respArray([]string{respBulk(unsubscribeReplies[kind]), respNil(), respInt(int64(cl.subscriptions(kind)))}))
+			return
+		}
+	}
+
+	for _, name := range names {
+		h.remove(cl, kind, name)
+		cl.push(respArray([]string{respBulk(unsubscribeReplies[kind]), respBulk(name), respInt(int64(cl.subscriptions(kind)))}))
+	}
+}
+
+// remove drops a single subscription. h.mu must be held.
+func (h *pubsubHub) remove(cl *client, kind int, name string) {
+	if cl.subs[kind][name] {
+		delete(cl.subs[kind], name)
+		cl.numSubs.Add(-1)
+	}
+	delete(h.subs[kind][name], cl)
+	if len(h.subs[kind][name]) == 0 {
+		delete(h.subs[kind], name)
+	}
+}
+
+// unsubscribeAll drops every subscription of cl
+func (h *pubsubHub) unsubscribeAll(cl *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for kind := range cl.subs {
+		for name := range cl.subs[kind] {
+			h.remove(cl, kind, name)
+		}
+	}
+}
+
+// subscribed reports whether cl has any subscription. It is checked before
+// every command, so it reads the client's count instead of taking the lock.
+func (h *pubsubHub) subscribed(cl *client) bool {
+	return cl.numSubs.Load() > 0
+}
+
+// publish delivers message to the subscribers of channel and of every
+// matching pattern and returns the number of receivers. It never blocks, so
+// it may be called while holding shard locks.
+func (h *pubsubHub) publish(channel, message string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	receivers := 0
+	if subs := h.subs[subChannel][channel]; len(subs) > 0 {
+		msg := respArray([]string{respBulk("message"), respBulk(channel), respBulk(message)})
+		for cl := range subs {
+			cl.push(msg)
+			receivers++
+		}
+	}
+	for pattern, subs := range h.subs[subPattern] {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		msg := respArray([]string{respBulk("pmessage"), respBulk(pattern), respBulk(channel), respBulk(message)})
+		for cl := range subs {
+			cl.push(msg)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// spublish delivers message to the subscribers of a shard channel. Patterns
+// do not apply to shard channels.
+func (h *pubsubHub) spublish(channel, message string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	subs := h.subs[subShard][channel]
+	if len(subs) > 0 {
+		msg := respArray([]string{respBulk("smessage"), respBulk(channel), respBulk(message)})
+		for cl := range subs {
+			cl.push(msg)
+		}
+	}
+	return len(subs)
+}
+
+// names returns the subscribed names of a kind matching pattern, or all of
+// them if pattern is empty
+func (h *pubsubHub) names(kind int, pattern string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var names []string
+	for name := range h.subs[kind] {
+		if pattern == "" || globMatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// numSub returns the number of subscribers of a name
+func (h *pubsubHub) numSub(kind int, name string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs[kind][name])
+}
+
+// numPat returns the number of distinct subscribed patterns
+func (h *pubsubHub) numPat() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs[subPattern])
+}
+
+// globMatch reports whether s matches a glob style pattern: * matches any
+// run of characters, ? a single character, [abc], [^abc] and [a-z] sets of
+// characters and a backslash escapes the next character. Every other element
+// matches exactly one character, so on a mismatch only the last * needs to
+// take one more character, which keeps the match linear in len(s) for each
+// star instead of exponential.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, starEnd := -1, 0 // Element after the last *, and where its run ends in s
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, starEnd = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if next, ok := globMatchChar(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starEnd++
+		p, i = star, starEnd
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchChar matches ch against the pattern element at p, which is not a
+// *, and returns the position of the next element
+func globMatchChar(pattern string, p int, ch byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+
+	case '[':
+		end := strings.IndexByte(pattern[p+1:], ']')
+		if end < 0 {
+			// An unterminated set matches a literal '['
+			return p + 1, ch == '['
+		}
+		set := pattern[p+1 : p+1+end]
+		negate := len(set) > 0 && set[0] == '^'
+		if negate {
+			set = set[1:]
+		}
+		matched := false
+		for i := 0; i < len(set); i++ {
+			if i+2 < len(set) && set[i+1] == '-' {
+				lo, hi := min(set[i], set[i+2]), max(set[i], set[i+2])
+				matched = matched || (ch >= lo && ch <= hi)
+				i += 2
+			} else {
+				matched = matched || ch == set[i]
+			}
+		}
+		return p + end + 2, matched != negate
+
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return p + 1, ch == pattern[p]
+}
+
+// subscribeKinds maps the subscription commands to the kind they manage
+var subscribeKinds = map[string]int{
+	"SUBSCRIBE": subChannel, "PSUBSCRIBE": subPattern, "SSUBSCRIBE": subShard,
+	"UNSUBSCRIBE": subChannel, "PUNSUBSCRIBE": subPattern, "SUNSUBSCRIBE": subShard,
+}
+
+// subscribeCommand implements SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE with one
+// or more names, and UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE with zero or
+// more. They need the connection's client, and the replies are pushed
+// rather than returned.
+func subscribeCommand(c *Cache, cl *client, args []string) string {
+	kind := subscribeKinds[args[0]]
+	if strings.Contains(args[0], "UNSUBSCRIBE") {
+		c.pubsub.unsubscribe(cl, kind, args[1:])
+		return ""
+	}
+
+	if len(args) < 2 {
+		return respError("wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+	}
+	for _, name := range args[1:] {
+		c.pubsub.subscribe(cl, kind, name)
+	}
+	return ""
+}
+
+// subscribedCommands are the only commands accepted from a client with
+// subscriptions
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"PING": true, "QUIT": true,
+}
+
+// publishCommand implements PUBLISH channel message and SPUBLISH
+// shardchannel message
+func publishCommand(c *Cache, args []string) string {
+	if args[0] == "SPUBLISH" {
+		return respInt(int64(c.pubsub.spublish(args[1], args[2])))
+	}
+	return respInt(int64(c.pubsub.publish(args[1], args[2])))
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern], NUMSUB [channel ...],
+// NUMPAT, SHARDCHANNELS [pattern] and SHARDNUMSUB [shardchannel ...]
+func pubsubCommand(c *Cache, args []string) string {
+	sub := strings.ToUpper(args[1])
+	switch sub {
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 3 {
+			return respError("wrong number of arguments for 'pubsub|" + strings.ToLower(sub) + "' command")
+		}
+		kind, pattern := subChannel, ""
+		if sub == "SHARDCHANNELS" {
+			kind = subShard
+		}
+		if len(args) == 3 {
+			pattern = args[2]
+		}
+		var items []string
+		for _, name := range c.pubsub.names(kind, pattern) {
+			items = append(items, respBulk(name))
+		}
+		return respArray(items)
+
+	case "NUMSUB", "SHARDNUMSUB":
+		kind := subChannel
+		if sub == "SHARDNUMSUB" {
+			kind = subShard
+		}
+		var items []string
+		for _, name := range args[2:] {
+			items = append(items, respBulk(name), respInt(int64(c.pubsub.numSub(kind, name))))
+		}
+		return respArray(items)
+
+	case "NUMPAT":
+		if len(args) != 2 {
+			return respError("wrong number of arguments for 'pubsub|numpat' command")
+		}
+		return respInt(int64(c.pubsub.numPat()))
+	}
+	return respError("unknown subcommand '" + args[1] + "' for 'pubsub' command")
+}
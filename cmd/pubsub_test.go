@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"news", "news", true},
+		{"news", "newsx", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "news", false},
+		{"*.sport", "news.sport", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYYcZ", false},
+		{"a*b*c", "abcbc", true},
+		{"h?llo", "hallo", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[ello", "h[ello", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`a\`, `a\`, true},
+		{"**a", "ba", true},
+		{"*[0-9]", "key9", true},
+		{"*?", "", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchManyStars(t *testing.T) {
+	// With backtracking into every * this would not finish
+	pattern := strings.Repeat("*a", 30) + "*b"
+	if globMatch(pattern, strings.Repeat("a", 10000)) {
+		t.Fatal("matched a string without b")
+	}
+}
+
+// pushed encodes a message pushed to a subscriber
+func pushed(fields ...string) string {
+	items := make([]string, len(fields))
+	for i, f := range fields {
+		if n, err := strconv.ParseInt(f, 10, 64); err == nil {
+			items[i] = respInt(n)
+		} else {
+			items[i] = respBulk(f)
+		}
+	}
+	return respArray(items)
+}
+
+func TestSubscribeAndPublish(t *testing.T) {
+	c := newTestCache(t)
+	sub, received := testConn(t, c)
+	pub, replied := testConn(t, c)
+
+	sub("SUBSCRIBE news sport")
+	received(pushed("subscribe", "news", "1") + pushed("subscribe", "sport", "2"))
+	sub("PSUBSCRIBE n*")
+	received(pushed("psubscribe", "n*", "3"))
+
+	pub("PUBLISH news hello")
+	replied(":2\r\n")
+	received(pushed("message", "news", "hello") + pushed("pmessage", "n*", "news", "hello"))
+	pub("PUBLISH weather rain")
+	replied(":0\r\n")
+
+	// Only subscription commands, PING and QUIT are served while subscribed
+	sub("GET k")
+	received("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")
+	sub("PING")
+	received("+PONG\r\n")
+
+	pub("PUBSUB CHANNELS")
+	replied(respArray([]string{respBulk("news"), respBulk("sport")}))
+	pub("PUBSUB CHANNELS s*")
+	replied(respArray([]string{respBulk("sport")}))
+	pub("PUBSUB NUMSUB news other")
+	replied(respArray([]string{respBulk("news"), respInt(1), respBulk("other"), respInt(0)}))
+	pub("PUBSUB NUMPAT")
+	replied(":1\r\n")
+	pub("PUBSUB HELP")
+	replied("-ERR unknown subcommand 'HELP' for 'pubsub' command\r\n")
+
+	sub("UNSUBSCRIBE news")
+	received(pushed("unsubscribe", "news", "2"))
+	sub("UNSUBSCRIBE")
+	received(pushed("unsubscribe", "sport", "1"))
+	sub("UNSUBSCRIBE")
+	received(respArray([]string{respBulk("unsubscribe"), respNil(), respInt(1)}))
+	sub("PUNSUBSCRIBE")
+	received(pushed("punsubscribe", "n*", "0"))
+
+	// Without subscriptions every command is accepted again
+	sub("SET k v")
+	received("OK\r\n")
+}
+
+func TestShardChannels(t *testing.T) {
+	c := newTestCache(t)
+	sub, received := testConn(t, c)
+	pub, replied := testConn(t, c)
+
+	sub("SUBSCRIBE news")
+	received(pushed("subscribe", "news", "1"))
+	sub("SSUBSCRIBE news orders")
+	received(pushed("ssubscribe", "news", "1") + pushed("ssubscribe", "orders", "2"))
+	sub("PSUBSCRIBE *")
+	received(pushed("psubscribe", "*", "2"))
+
+	// Shard channels are a namespace of their own that patterns do not see
+	pub("SPUBLISH orders new")
+	replied(":1\r\n")
+	received(pushed("smessage", "orders", "new"))
+	pub("PUBLISH orders new")
+	replied(":1\r\n")
+	received(pushed("pmessage", "*", "orders", "new"))
+
+	pub("PUBSUB SHARDCHANNELS")
+	replied(respArray([]string{respBulk("news"), respBulk("orders")}))
+	pub("PUBSUB SHARDNUMSUB orders")
+	replied(respArray([]string{respBulk("orders"), respInt(1)}))
+	pub("PUBSUB CHANNELS")
+	replied(respArray([]string{respBulk("news")}))
+
+	sub("SUNSUBSCRIBE orders")
+	received(pushed("sunsubscribe", "orders", "1"))
+	sub("SUNSUBSCRIBE")
+	received(pushed("sunsubscribe", "news", "0"))
+}
+
+// waitNumSub waits until channel has n subscribers
+func waitNumSub(c *Cache, channel string, n int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if c.pubsub.numSub(subChannel, channel) == n {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSubscriberDisconnect(t *testing.T) {
+	c := newTestCache(t)
+	sub, received := testConn(t, c)
+	sub("SUBSCRIBE news")
+	received(pushed("subscribe", "news", "1"))
+
+	sub("QUIT")
+	received(respOK())
+	if !waitNumSub(c, "news", 0) {
+		t.Fatal("subscription outlived the connection")
+	}
+	if got := executeCommand(c, []string{"PUBLISH", "news", "hello"}); got != ":0\r\n" {
+		t.Fatalf("PUBLISH after the subscriber left = %q", got)
+	}
+}
+
+func TestSlowSubscriberDisconnected(t *testing.T) {
+	c := newTestCache(t)
+	SetPubSubOutputLimit(1 << 10)
+	t.Cleanup(func() { SetPubSubOutputLimit(32 << 20) })
+
+	sub, received := testConn(t, c)
+	sub("SUBSCRIBE news")
+	received(pushed("subscribe", "news", "1"))
+
+	// The subscriber reads nothing, publishing must not block
+	message := strings.Repeat("x", 100)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			executeCommand(c, []string{"PUBLISH", "news", message})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PUBLISH blocked on a subscriber that does not read")
+	}
+	if !waitNumSub(c, "news", 0) {
+		t.Fatal("subscriber over the output limit was not disconnected")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerCommand("EVAL", -3, flagExclusive|flagNoScript, evalCommand)
+	registerCommand("EVALSHA", -3, flagExclusive|flagNoScript, evalCommand)
+	registerCommand("SCRIPT", -2, flagNoGate|flagNoScript, scriptCommand)
+}
+
+// ScriptTimeLimit is how long a script may run before other clients are
+// told that the server is busy
+var ScriptTimeLimit = 5 * time.Second
+
+// Script errors
+const (
+	errNoScript   = "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	errNotBusy    = "-NOTBUSY No scripts in execution right now.\r\n"
+	errBusy       = "-BUSY dustdb is busy running a script. You can only call SCRIPT KILL.\r\n"
+	errUnkillable = "-UNKILLABLE Sorry the script already executed write commands against the dataset. You can wait for the script to finish.\r\n"
+)
+
+// errScriptKilled stops a script. It is not a luaError, so pcall cannot
+// catch it.
+var errScriptKilled = errors.New("ERR Script killed by user with SCRIPT KILL...")
+
+// States of a running script. A script leaves scriptRunning either when it
+// calls its first write command or when SCRIPT KILL stops it, whichever
+// happens first, so a script that wrote cannot be killed.
+const (
+	scriptRunning int32 = iota
+	scriptWriting
+	scriptKilled
+)
+
+// scriptRun is the state of the script being executed
+type scriptRun struct {
+	started time.Time
+	state   atomic.Int32 // scriptRunning, scriptWriting or scriptKilled
+	noWrite bool         // Write commands are refused, for FCALL_RO
+	client  *client      // Client that runs the script, whose user commands are checked against
+}
+
+// scriptEngine caches compiled scripts by their SHA1 digest and tracks the
+// running script. Scripts hold every shard gate exclusively, so at most one
+// runs at a time.
+type scriptEngine struct {
+	mu      sync.Mutex
+	scripts map[string]*luaFuncExpr
+	running atomic.Pointer[scriptRun]
+}
+
+// newScriptEngine creates an engine with an empty script cache
+func newScriptEngine() *scriptEngine {
+	return &scriptEngine{scripts: make(map[string]*luaFuncExpr)}
+}
+
+// scriptSHA returns the hex SHA1 digest that identifies a script
+func scriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// load compiles a script and caches it. It returns the digest or an error
+// reply.
+func (e *scriptEngine) load(body string) (string, *luaFuncExpr, string) {
+	sha := scriptSHA(body)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if proto, ok := e.scripts[sha]; ok {
+		return sha, proto, ""
+	}
+	proto, err := luaCompile(body)
+	if err != nil {
+		return "", nil, respError("Error compiling script (new function): " + err.Error())
+	}
+	e.scripts[sha] = proto
+	return sha, proto, ""
+}
+
+// lookup returns a cached script
+func (e *scriptEngine) lookup(sha string) *luaFuncExpr {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.scripts[strings.ToLower(sha)]
+}
+
+// busy returns the BUSY error once the running script exceeded the time
+// limit
+func (e *scriptEngine) busy() string {
+	if run := e.running.Load(); run != nil && time.Since(run.started) > ScriptTimeLimit {
+		return errBusy
+	}
+	return ""
+}
+
+// evalCommand implements EVAL script numkeys [key ...] [arg ...] and
+// EVALSHA sha1 numkeys [key ...] [arg ...]
+func evalCommand(c *Cache, args []string) string {
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil {
+		return respError(errNotInteger)
+	}
+	if numKeys < 0 {
+		return respError("Number of keys can't be negative")
+	}
+	if numKeys > len(args)-3 {
+		return respError("Number of keys can't be greater than number of args")
+	}
+
+	var proto *luaFuncExpr
+	if args[0] == "EVALSHA" {
+		if proto = c.scripts.lookup(args[1]); proto == nil {
+			return errNoScript
+		}
+	} else {
+		var reply string
+		if _, proto, reply = c.scripts.load(args[1]); reply != "" {
+			return reply
+		}
+	}
+	return c.runScript(proto, args[3:3+numKeys], args[3+numKeys:])
+}
+
+// runScript executes a compiled script with the KEYS and ARGV tables and
+// converts its result into a reply. Every run starts from fresh globals and
+// the same random seed, and tables iterate in insertion order, so a script
+// applied to the same data always makes the same writes.
+func (c *Cache) runScript(proto *luaFuncExpr, keys, argv []string) string {
+	L := newLuaState()
+	L.globals.Set("KEYS", luaStringArray(keys))
+	L.globals.Set("ARGV", luaStringArray(argv))
+	return c.runLua(L, &luaClosure{proto: proto}, nil, false)
+}
+
+// runLua calls fn in L as the running script, with a redis table that can
+// call commands, and converts its result into a reply
+func (c *Cache) runLua(L *luaState, fn any, args []any, noWrite bool) string {
+	run := &scriptRun{started: time.Now(), noWrite: noWrite, client: c.gateClient}
+	c.scripts.running.Store(run)
+	defer c.scripts.running.Store(nil)
+
+	L.seed = luaRandomSeed
+	L.interrupt = func() error {
+		if run.state.Load() == scriptKilled {
+			return errScriptKilled
+		}
+		return nil
+	}
+	L.globals.Set("redis", c.redisLib(run))
+
+	rets, err := L.Call(fn, args)
+	if err != nil {
+		if err == errScriptKilled {
+			return "-" + err.Error() + "\r\n"
+		}
+		return scriptErrorReply(err.Error())
+	}
+	if len(rets) == 0 {
+		return respNil()
+	}
+	return luaToResp(rets[0])
+}
+
+// scriptErrorReply turns an error message of a script into an error reply.
+// Messages that already carry an error code such as ERR or WRONGTYPE keep
+// it.
+func scriptErrorReply(msg string) string {
+	msg = strings.ReplaceAll(msg, "\r\n", " ")
+	code, _, _ := strings.Cut(msg, " ")
+	if code == "" || strings.ToUpper(code) != code || strings.ContainsAny(code, ":.") {
+		return respError(msg)
+	}
+	return "-" + msg + "\r\n"
+}
+
+// luaStringArray builds a table of strings
+func luaStringArray(items []string) *luaTable {
+	t := newLuaTable()
+	for i, s := range items {
+		t.Set(float64(i+1), s)
+	}
+	return t
+}
+
+// redisLib builds the redis table through which a script calls commands
+func (c *Cache) redisLib(run *scriptRun) *luaTable {
+	lib := newLuaTable()
+	lib.Register("call", func(L *luaState, args []any) ([]any, error) {
+		return c.scriptCall(L, run, args, false)
+	})
+	lib.Register("pcall", func(L *luaState, args []any) ([]any, error) {
+		return c.scriptCall(L, run, args, true)
+	})
+	lib.Register("error_reply", func(L *luaState, args []any) ([]any, error) {
+		msg, err := L.checkString(args, 0, "error_reply")
+		t := newLuaTable()
+		t.Set("err", msg)
+		return []any{t}, err
+	})
+	lib.Register("status_reply", func(L *luaState, args []any) ([]any, error) {
+		msg, err := L.checkString(args, 0, "status_reply")
+		t := newLuaTable()
+		t.Set("ok", msg)
+		return []any{t}, err
+	})
+	lib.Register("sha1hex", func(L *luaState, args []any) ([]any, error) {
+		s, err := L.checkString(args, 0, "sha1hex")
+		return []any{scriptSHA(s)}, err
+	})
+	lib.Register("log", func(L *luaState, args []any) ([]any, error) {
+		level, err := L.checkNumber(args, 0, "log")
+		if err != nil {
+			return nil, err
+		}
+		if level < logDebug || level > logWarning {
+			return nil, L.runtimeError("Invalid debug level.")
+		}
+		parts := make([]string, 0, len(args))
+		for i := 1; i < len(args); i++ {
+			parts = append(parts, luaToString(args[i]))
+		}
+		logf(int(level), "script: %s", strings.Join(parts, " "))
+		return nil, nil
+	})
+	lib.Register("replicate_commands", func(L *luaState, args []any) ([]any, error) {
+		return []any{true}, nil
+	})
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		lib.Set(level, float64(i))
+	}
+	return lib
+}
+
+// scriptCall implements redis.call and redis.pcall. Errors of the command
+// are raised by call and returned as an error table by pcall.
+func (c *Cache) scriptCall(L *luaState, run *scriptRun, args []any, protected bool) ([]any, error) {
+	if len(args) == 0 {
+		return nil, L.runtimeError("Please specify at least one argument for this redis lib call")
+	}
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := luaConcatString(arg)
+		if !ok {
+			return nil, L.runtimeError("Lua redis lib command arguments must be strings or integers")
+		}
+		parts[i] = s
+	}
+	parts[0] = strings.ToUpper(parts[0])
+
+	var reply string
+	cmd, ok := inlineCommands[parts[0]]
+	if !ok {
+		cmd, ok = commandTable[parts[0]]
+	}
+	denied := ""
+	if ok && run.client != nil {
+		denied = c.acl.check(run.client.user, parts, "lua", run.client.info())
+	}
+	switch {
+	case !ok:
+		reply = respError("Unknown command called from script")
+	case cmd.flags&flagNoScript != 0:
+		reply = respError("This command is not allowed from script")
+	case cmd.flags&flagWrite != 0 && run.noWrite:
+		reply = respError("Write commands are not allowed from read-only scripts")
+	case denied != "":
+		reply = denied
+	default:
+		if cmd.flags&flagWrite != 0 && !run.state.CompareAndSwap(scriptRunning, scriptWriting) && run.state.Load() == scriptKilled {
+			return nil, errScriptKilled
+		}
+		start := time.Now()
+		reply = scriptExecute(c, parts)
+		c.commandStats.record(parts[0], time.Since(start), reply)
+		c.monitors.feed(start, parts, "lua")
+	}
+
+	value, _ := respToLua(reply)
+	if t, ok := value.(*luaTable); ok && t.Get("err") != nil && !protected {
+		return nil, &luaError{t}
+	}
+	return []any{value}, nil
+}
+
+// scriptExecute runs a command for a script. GET is answered here because
+// the inline reply of handleConnection does not tell a missing key apart
+// from a value.
+func scriptExecute(c *Cache, args []string) string {
+	if args[0] == "GET" && len(args) == 2 {
+		entry, exists := c.Lookup(args[1])
+		switch {
+		case !exists:
+			return respNil()
+		case entry.Object != nil:
+			return errWrongType
+		}
+		return respBulk(entry.Value)
+	}
+	return executeCommand(c, args)
+}
+
+// respToLua converts an encoded reply into a Lua value the way Redis does:
+// integers become numbers, bulk strings strings, arrays tables, status and
+// error replies tables with an ok or err field, and nil replies false. It
+// returns the value and the rest of the input.
+func respToLua(reply string) (any, string) {
+	line, rest, _ := strings.Cut(reply, "\r\n")
+	if line == "" {
+		return false, rest
+	}
+
+	switch line[0] {
+	case '+':
+		t := newLuaTable()
+		t.Set("ok", line[1:])
+		return t, rest
+	case '-':
+		t := newLuaTable()
+		t.Set("err", line[1:])
+		return t, rest
+	case ':':
+		n, _ := strconv.ParseFloat(line[1:], 64)
+		return n, rest
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 || n+2 > len(rest) {
+			return false, rest
+		}
+		return rest[:n], rest[n+2:]
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return false, rest
+		}
+		t := newLuaTable()
+		for i := 1; i <= n; i++ {
+			var item any
+			item, rest = respToLua(rest)
+			t.Set(float64(i), item)
+		}
+		return t, rest
+	}
+
+	// Inline replies such as the OK of SET are plain lines
+	t := newLuaTable()
+	t.Set("ok", line)
+	return t, rest
+}
+
+// luaToResp converts the value returned by a script into a reply: numbers
+// become integers, tables with an err or ok field error or status replies,
+// other tables arrays up to their first nil, true 1 and nil or false a nil
+// reply
+func luaToResp(v any) string {
+	switch v := v.(type) {
+	case string:
+		return respBulk(v)
+	case float64:
+		return respInt(int64(v))
+	case bool:
+		if v {
+			return respInt(1)
+		}
+	case *luaTable:
+		if msg, ok := v.Get("err").(string); ok {
+			return scriptErrorReply(msg)
+		}
+		if msg, ok := v.Get("ok").(string); ok {
+			return respSimple(msg)
+		}
+		items := make([]string, 0, v.Len())
+		for i := 1; i <= v.Len(); i++ {
+			item := v.Get(float64(i))
+			if item == nil {
+				break
+			}
+			items = append(items, luaToResp(item))
+		}
+		return respArray(items)
+	}
+	return respNil()
+}
+
+// scriptCommand implements SCRIPT LOAD script, SCRIPT EXISTS sha1
+// [sha1 ...], SCRIPT FLUSH [ASYNC|SYNC] and SCRIPT KILL. It runs without
+// the shard gates so that SCRIPT KILL reaches a script that holds them.
+func scriptCommand(c *Cache, args []string) string {
+	sub := strings.ToUpper(args[1])
+	switch sub {
+	case "LOAD":
+		if len(args) != 3 {
+			return respError("wrong number of arguments for 'script|load' command")
+		}
+		sha, _, reply := c.scripts.load(args[2])
+		if reply != "" {
+			return reply
+		}
+		return respBulk(sha)
+
+	case "EXISTS":
+		if len(args) < 3 {
+			return respError("wrong number of arguments for 'script|exists' command")
+		}
+		items := make([]string, 0, len(args)-2)
+		for _, sha := range args[2:] {
+			exists := int64(0)
+			if c.scripts.lookup(sha) != nil {
+				exists = 1
+			}
+			items = append(items, respInt(exists))
+		}
+		return respArray(items)
+
+	case "FLUSH":
+		if len(args) > 3 || (len(args) == 3 && strings.ToUpper(args[2]) != "ASYNC" && strings.ToUpper(args[2]) != "SYNC") {
+			return respError(errSyntax)
+		}
+		c.scripts.mu.Lock()
+		clear(c.scripts.scripts)
+		c.scripts.mu.Unlock()
+		return respOK()
+
+	case "KILL":
+		run := c.scripts.running.Load()
+		if run == nil {
+			return errNotBusy
+		}
+		if !run.state.CompareAndSwap(scriptRunning, scriptKilled) && run.state.Load() != scriptKilled {
+			return errUnkillable
+		}
+		return respOK()
+	}
+	return respError("unknown subcommand '" + args[1] + "' for 'script' command")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEvalConversions(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "str", "hello"})
+	executeCommand(c, []string{"ZADD", "zset", "1", "a", "2", "b"})
+
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"integer", `return 42`, ":42\r\n"},
+		{"float truncated", `return 3.99`, ":3\r\n"},
+		{"string", `return "x"`, "$1\r\nx\r\n"},
+		{"true", `return true`, ":1\r\n"},
+		{"false", `return false`, "$-1\r\n"},
+		{"nil", `return nil`, "$-1\r\n"},
+		{"array stops at nil", `return {1, "a", nil, 3}`, "*2\r\n:1\r\n$1\r\na\r\n"},
+		{"status table", `return {ok = "FINE"}`, "+FINE\r\n"},
+		{"error table", `return {err = "WRONG thing"}`, "-WRONG thing\r\n"},
+		{"error_reply", `return redis.error_reply("MY error")`, "-MY error\r\n"},
+		{"status_reply", `return redis.status_reply("DONE")`, "+DONE\r\n"},
+		{"keys and argv", `return {KEYS[1], ARGV[1]}`, "*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{"call bulk", `return redis.call("GET", "str")`, "$5\r\nhello\r\n"},
+		{"call missing key is false", `return redis.call("GET", "missing") == false`, ":1\r\n"},
+		{"call integer", `return redis.call("ZCARD", "zset") + 1`, ":3\r\n"},
+		{"call array", `return redis.call("ZRANGE", "zset", 0, -1)`, "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{"call status", `return redis.call("PING").ok`, "$4\r\nPONG\r\n"},
+		{"call number argument", `redis.call("SET", "n", 12); return redis.call("GET", "n")`, "$2\r\n12\r\n"},
+		{"call error raises", `redis.call("ZCARD", "str")`, "-WRONGTYPE"},
+		{"pcall error table", `return redis.pcall("ZCARD", "str").err:sub(1, 9)`, "$9\r\nWRONGTYPE\r\n"},
+		{"pcall catches", `local ok = pcall(redis.call, "ZCARD", "str"); return ok`, "$-1\r\n"},
+		{"unknown command", `return redis.pcall("NOPE")`, "-ERR Unknown command called from script"},
+		{"script only command", `return redis.call("EVAL", "return 1", 0)`, "-ERR This command is not allowed from script"},
+		{"bad argument", `return redis.call("GET", {})`, "-ERR user_script:1: Lua redis lib command arguments must be strings or integers"},
+		{"no arguments", `return redis.call()`, "-ERR user_script:1: Please specify at least one argument"},
+		{"syntax error", `return (`, "-ERR Error compiling script (new function): user_script:1: unexpected symbol"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := executeCommand(c, []string{"EVAL", tt.script, "1", "k", "v"})
+			if !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("EVAL %s = %q, want %q", tt.script, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionNoWrites(t *testing.T) {
+	c := newTestCache(t)
+	lib := "#!lua name=lib\n" +
+		"redis.register_function{function_name = 'setter', callback = function(keys) return redis.call('SET', keys[1], 'v') end, flags = {'no-writes'}}"
+	if got := executeCommand(c, []string{"FUNCTION", "LOAD", lib}); got != respBulk("lib") {
+		t.Fatalf("FUNCTION LOAD = %q", got)
+	}
+	got := executeCommand(c, []string{"FCALL_RO", "setter", "1", "k"})
+	if !strings.Contains(got, "Write commands are not allowed from read-only scripts") {
+		t.Fatalf("FCALL_RO with SET = %q", got)
+	}
+	if _, exists := c.Get("k"); exists {
+		t.Fatal("a no-writes function wrote a key")
+	}
+}
+
+func TestScriptKill(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		state    int32
+		wantKill string
+		want     string
+	}{
+		{"read-only script", `while true do end`, scriptRunning, respOK(), "-ERR Script killed by user with SCRIPT KILL...\r\n"},
+		{"script that wrote", `redis.call("SET", "k", "v"); for i = 1, 1e6 do end; return 1`, scriptWriting, errUnkillable, ":1\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			done := make(chan string)
+			go func() { done <- executeCommand(c, []string{"EVAL", tt.script, "0"}) }()
+			for {
+				if run := c.scripts.running.Load(); run != nil && run.state.Load() == tt.state {
+					break
+				}
+				runtime.Gosched()
+			}
+			if got := executeCommand(c, []string{"SCRIPT", "KILL"}); got != tt.wantKill {
+				t.Fatalf("SCRIPT KILL = %q, want %q", got, tt.wantKill)
+			}
+			if got := <-done; got != tt.want {
+				t.Fatalf("EVAL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Exit codes of a shutdown
+const (
+	exitClean      = 0 // Every client finished and everything was saved
+	exitSaveFailed = 1 // Persistence could not be flushed
+	exitCutOff     = 2 // Clients were still busy after ShutdownTimeout
+)
+
+// SavePersistence writes everything dustdb keeps on disk. There is no
+// snapshot of the keyspace, so that is the function libraries.
+func (c *Cache) SavePersistence() error {
+	c.functions.mu.Lock()
+	defer c.functions.mu.Unlock()
+	return c.functions.save()
+}
+
+// shutdownRequest is a SHUTDOWN waiting for the shutdown sequence to save
+type shutdownRequest struct {
+	save   bool
+	result chan error // Receives the outcome of the save, nil without one
+}
+
+// requestShutdown asks main to shut the server down, see waitForShutdown,
+// and returns the error of the save if it failed. The server keeps running
+// in that case.
+func (c *Cache) requestShutdown(save bool) error {
+	req := shutdownRequest{save: save, result: make(chan error, 1)}
+	select {
+	case c.shutdownReq <- req:
+		return <-req.result
+	case <-c.shutdownChan:
+		return nil // Already shutting down
+	}
+}
+
+// waitForShutdown blocks until SIGTERM, SIGINT or SHUTDOWN, then shuts the
+// cache down, waits for both servers to drain and flushes persistence. A
+// SHUTDOWN saves before anything stops and is refused if that fails, so the
+// client learns about it; a signal saves once the clients are gone. It
+// returns the exit code of the process.
+func waitForShutdown(c *Cache, tcpDrained, webDrained <-chan bool) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	save := true
+	for waiting := true; waiting; {
+		select {
+		case sig := <-signals:
+			logf(logWarning, "Received %s, scheduling shutdown...", sig)
+			waiting = false
+		case req := <-c.shutdownReq:
+			logf(logWarning, "User requested shutdown...")
+			var err error
+			if req.save {
+				if err = c.SavePersistence(); err != nil {
+					logf(logWarning, "Error saving before SHUTDOWN: %v", err)
+				}
+			}
+			req.result <- err
+			// Saved already or not wanted
+			save, waiting = false, err != nil
+		}
+	}
+	// A second signal skips the wait for clients
+	signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+
+	c.Shutdown()
+	code := exitClean
+	if !<-tcpDrained || !<-webDrained {
+		code = exitCutOff
+	}
+	if save {
+		if err := c.SavePersistence(); err != nil {
+			logf(logWarning, "Error saving on shutdown: %v", err)
+			code = exitSaveFailed
+		}
+	}
+	logf(logWarning, "dustdb is now ready to exit, bye bye...")
+	return code
+}
+
+// shutdownCommand implements SHUTDOWN [NOSAVE|SAVE]. The shutdown sequence
+// saves first, and if that fails the error is reported to the client and
+// the server keeps running. On success the connection is closed without a
+// reply.
+func shutdownCommand(c *Cache, args []string) string {
+	save := true
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "NOSAVE":
+			save = false
+		case "SAVE":
+		default:
+			return respError(errSyntax)
+		}
+	} else if len(args) > 2 {
+		return respError(errSyntax)
+	}
+
+	if err := c.requestShutdown(save); err != nil {
+		return respError("Errors trying to SHUTDOWN. Check logs.")
+	}
+	return ""
+}
+
+func init() {
+	registerCommand("SHUTDOWN", -1, flagAdmin|flagNoScript|flagNoMulti|flagNoGate, shutdownCommand)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// startShutdownSequence runs waitForShutdown as main does, with servers
+// that drain at once, and returns the channel its exit code is sent on
+func startShutdownSequence(c *Cache) <-chan int {
+	drained := make(chan bool, 2)
+	drained <- true
+	drained <- true
+	code := make(chan int, 1)
+	go func() { code <- waitForShutdown(c, drained, drained) }()
+	return code
+}
+
+func TestShutdownSavesOnce(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	file := filepath.Join(dir, "functions.json")
+	c := newTestCache(t)
+	if err := c.LoadFunctions(file); err != nil {
+		t.Fatal(err)
+	}
+	code := startShutdownSequence(c)
+
+	// The directory is missing, so the save fails and the server stays up
+	if got := executeCommand(c, []string{"SHUTDOWN"}); got != respError("Errors trying to SHUTDOWN. Check logs.") {
+		t.Fatalf("SHUTDOWN with a failing save = %q", got)
+	}
+	if c.shuttingDown() {
+		t.Fatal("the server shut down although saving failed")
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if got := executeCommand(c, []string{"SHUTDOWN", "SAVE"}); got != "" {
+		t.Fatalf("SHUTDOWN SAVE = %q, want no reply", got)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatalf("SHUTDOWN did not save: %v", err)
+	}
+	if got := <-code; got != exitClean {
+		t.Fatalf("exit code %d, want %d", got, exitClean)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("the shutdown sequence saved a second time")
+	}
+}
+
+func TestShutdownNoSave(t *testing.T) {
+	c := newTestCache(t)
+	if err := c.LoadFunctions(filepath.Join(t.TempDir(), "missing", "functions.json")); err != nil {
+		t.Fatal(err)
+	}
+	code := startShutdownSequence(c)
+	if got := executeCommand(c, []string{"SHUTDOWN", "NOSAVE"}); got != "" {
+		t.Fatalf("SHUTDOWN NOSAVE = %q, want no reply", got)
+	}
+	if got := <-code; got != exitClean {
+		t.Fatalf("exit code %d, want %d", got, exitClean)
+	}
+	if !c.shuttingDown() {
+		t.Fatal("the cache was not shut down")
+	}
+	if got := executeCommand(c, []string{"SHUTDOWN", "NOW"}); got != respError(errSyntax) {
+		t.Fatalf("SHUTDOWN NOW = %q", got)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on the arguments kept in a slowlog entry
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is a command that took longer than the slowlog threshold
+type slowlogEntry struct {
+	ID         int64
+	Time       time.Time
+	Duration   time.Duration
+	Args       []string // Truncated and with secrets redacted
+	ClientAddr string
+	ClientName string // Empty until clients can be named
+}
+
+// Command renders the arguments for the dashboard
+func (e slowlogEntry) Command() string {
+	return strings.Join(e.Args, " ")
+}
+
+// Micros returns the duration in microseconds, the unit SLOWLOG replies in
+func (e slowlogEntry) Micros() int64 {
+	return e.Duration.Microseconds()
+}
+
+// slowlog keeps the latest slow commands in a ring buffer
+type slowlog struct {
+	threshold atomic.Int64 // Microseconds, negative disables the log
+
+	mu      sync.Mutex
+	entries []slowlogEntry // Ring of at most maxLen entries
+	next    int            // Index the next entry is written to
+	maxLen  int
+	nextID  int64
+}
+
+func newSlowlog() *slowlog {
+	s := &slowlog{maxLen: 128}
+	s.threshold.Store(10000)
+	return s
+}
+
+// configure changes the threshold in microseconds and the number of entries
+// kept. Shrinking the log drops the oldest entries.
+func (s *slowlog) configure(threshold int64, maxLen int) {
+	s.threshold.Store(threshold)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if maxLen != s.maxLen {
+		entries := s.newest(maxLen)
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		s.entries, s.next, s.maxLen = entries, len(entries)%max(maxLen, 1), maxLen
+	}
+}
+
+// record adds the command args to the log if it took at least the
+// threshold. The check is a single atomic load so that fast commands cost
+// next to nothing.
+func (s *slowlog) record(args []string, start time.Time, d time.Duration, cl *client) {
+	threshold := s.threshold.Load()
+	if threshold < 0 || d.Microseconds() < threshold {
+		return
+	}
+	entry := slowlogEntry{
+		Time:       start,
+		Duration:   d,
+		Args:       truncateArgs(redactArgs(args)),
+		ClientAddr: cl.conn.RemoteAddr().String(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxLen == 0 {
+		return
+	}
+	entry.ID = s.nextID
+	s.nextID++
+	if len(s.entries) < s.maxLen {
+		s.entries = append(s.entries, entry)
+	} else {
+		s.entries[s.next] = entry
+	}
+	s.next = (s.next + 1) % s.maxLen
+}
+
+// newest returns up to count entries, newest first. A negative count
+// returns all of them. The caller holds s.mu.
+func (s *slowlog) newest(count int) []slowlogEntry {
+	if count < 0 || count > len(s.entries) {
+		count = len(s.entries)
+	}
+	entries := make([]slowlogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entries = append(entries, s.entries[(s.next-i+len(s.entries))%len(s.entries)])
+	}
+	return entries
+}
+
+// get returns up to count entries, newest first
+func (s *slowlog) get(count int) []slowlogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newest(count)
+}
+
+// len returns the number of entries in the log
+func (s *slowlog) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// reset empties the log. IDs keep counting up.
+func (s *slowlog) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries, s.next = nil, 0
+}
+
+// redactArgs returns args with passwords replaced, so that they never show
+// up in the slowlog or MONITOR
+func redactArgs(args []string) []string {
+	redactFrom := len(args)
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		redactFrom = 1
+	case "ACL":
+		if len(args) > 1 && strings.EqualFold(args[1], "SETUSER") {
+			redactFrom = 3
+		}
+	case "CONFIG":
+		if len(args) > 1 && strings.EqualFold(args[1], "SET") {
+			redacted := append([]string(nil), args...)
+			for i := 2; i+1 < len(redacted); i += 2 {
+				if strings.EqualFold(redacted[i], "requirepass") {
+					redacted[i+1] = "(redacted)"
+				}
+			}
+			return redacted
+		}
+	}
+	if redactFrom >= len(args) {
+		return args
+	}
+	redacted := append([]string(nil), args[:redactFrom]...)
+	for range args[redactFrom:] {
+		redacted = append(redacted, "(redacted)")
+	}
+	return redacted
+}
+
+// truncateArgs limits the number and length of args the way Redis does in
+// its slowlog
+func truncateArgs(args []string) []string {
+	n := min(len(args), slowlogMaxArgs)
+	truncated := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if i == slowlogMaxArgs-1 && len(args) > slowlogMaxArgs {
+			truncated = append(truncated, "... ("+strconv.Itoa(len(args)-slowlogMaxArgs+1)+" more arguments)")
+			break
+		}
+		arg := args[i]
+		if len(arg) > slowlogMaxArgLen {
+			arg = arg[:slowlogMaxArgLen] + "... (" + strconv.Itoa(len(arg)-slowlogMaxArgLen) + " more bytes)"
+		}
+		truncated = append(truncated, arg)
+	}
+	return truncated
+}
+
+// slowlogCommand implements SLOWLOG GET [count], SLOWLOG LEN and SLOWLOG
+// RESET
+func slowlogCommand(c *Cache, args []string) string {
+	switch strings.ToUpper(args[1]) {
+	case "GET":
+		if len(args) > 3 {
+			return respError("wrong number of arguments for 'slowlog|get' command")
+		}
+		count := 10
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < -1 {
+				return respError("count should be greater than or equal to -1")
+			}
+			count = n
+		}
+		var items []string
+		for _, entry := range c.slowlog.get(count) {
+			argItems := make([]string, len(entry.Args))
+			for i, arg := range entry.Args {
+				argItems[i] = respBulk(arg)
+			}
+			items = append(items, respArray([]string{
+				respInt(entry.ID),
+				respInt(entry.Time.Unix()),
+				respInt(entry.Micros()),
+				respArray(argItems),
+				respBulk(entry.ClientAddr),
+				respBulk(entry.ClientName),
+			}))
+		}
+		return respArray(items)
+	case "LEN":
+		if len(args) != 2 {
+			return respError("wrong number of arguments for 'slowlog|len' command")
+		}
+		return respInt(int64(c.slowlog.len()))
+	case "RESET":
+		if len(args) != 2 {
+			return respError("wrong number of arguments for 'slowlog|reset' command")
+		}
+		c.slowlog.reset()
+		return respOK()
+	}
+	return respError("unknown subcommand '" + args[1] + "'. Try SLOWLOG GET, LEN or RESET.")
+}
+
+func init() {
+	registerCommand("SLOWLOG", -2, flagAdmin, slowlogCommand)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowlogIDs returns the IDs of the entries in the log, newest first
+func slowlogIDs(s *slowlog) []int64 {
+	var ids []int64
+	for _, entry := range s.get(-1) {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSlowlogRecord(t *testing.T) {
+	c := newTestCache(t)
+	cl := testClient(t, c)
+	s := newSlowlog()
+	s.configure(1000, 3)
+
+	s.record([]string{"GET", "fast"}, time.Now(), 999*time.Microsecond, cl)
+	for i := 0; i < 5; i++ {
+		s.record([]string{"GET", "slow"}, time.Now(), time.Millisecond, cl)
+	}
+	if got, want := slowlogIDs(s), []int64{4, 3, 2}; !equalIDs(got, want) {
+		t.Fatalf("slowlog IDs = %v, want %v", got, want)
+	}
+	if got := s.get(1); len(got) != 1 || got[0].ID != 4 || got[0].Command() != "GET slow" || got[0].Micros() != 1000 {
+		t.Fatalf("newest entry = %+v", got)
+	}
+
+	// Shrinking keeps the newest entries and growing keeps them all
+	s.configure(1000, 2)
+	if got, want := slowlogIDs(s), []int64{4, 3}; !equalIDs(got, want) {
+		t.Fatalf("slowlog IDs after shrinking = %v, want %v", got, want)
+	}
+	s.configure(1000, 4)
+	s.record([]string{"GET", "slow"}, time.Now(), time.Millisecond, cl)
+	if got, want := slowlogIDs(s), []int64{5, 4, 3}; !equalIDs(got, want) {
+		t.Fatalf("slowlog IDs after growing = %v, want %v", got, want)
+	}
+
+	s.reset()
+	s.record([]string{"GET", "slow"}, time.Now(), time.Millisecond, cl)
+	if got, want := slowlogIDs(s), []int64{6}; !equalIDs(got, want) {
+		t.Fatalf("slowlog IDs after a reset = %v, want %v", got, want)
+	}
+
+	s.configure(-1, 4)
+	s.record([]string{"GET", "slow"}, time.Now(), time.Hour, cl)
+	s.configure(0, 0)
+	s.record([]string{"GET", "slow"}, time.Now(), time.Hour, cl)
+	if s.len() != 0 {
+		t.Fatalf("disabled slowlog has %d entries", s.len())
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"AUTH", "secret"}, "AUTH (redacted)"},
+		{[]string{"auth", "alice", "secret"}, "auth (redacted) (redacted)"},
+		{[]string{"ACL", "SETUSER", "alice", "on", ">secret"}, "ACL SETUSER alice (redacted) (redacted)"},
+		{[]string{"ACL", "WHOAMI"}, "ACL WHOAMI"},
+		{[]string{"CONFIG", "SET", "maxmemory", "1mb", "REQUIREPASS", "secret"}, "CONFIG SET maxmemory 1mb REQUIREPASS (redacted)"},
+		{[]string{"CONFIG", "GET", "requirepass"}, "CONFIG GET requirepass"},
+		{[]string{"SET", "requirepass", "secret"}, "SET requirepass secret"},
+	}
+	for _, tt := range tests {
+		original := strings.Join(tt.args, " ")
+		if got := strings.Join(redactArgs(tt.args), " "); got != tt.want {
+			t.Fatalf("redactArgs(%v) = %q, want %q", tt.args, got, tt.want)
+		}
+		if strings.Join(tt.args, " ") != original {
+			t.Fatalf("redactArgs changed its arguments to %v", tt.args)
+		}
+	}
+}
+
+func TestTruncateArgs(t *testing.T) {
+	args := []string{"RPUSH", "list", strings.Repeat("x", slowlogMaxArgLen+10)}
+	got := truncateArgs(args)
+	if want := strings.Repeat("x", slowlogMaxArgLen) + "... (10 more bytes)"; got[2] != want {
+		t.Fatalf("long argument truncated to %q, want %q", got[2], want)
+	}
+
+	for i := 0; i < 40; i++ {
+		args = append(args, "v")
+	}
+	got = truncateArgs(args)
+	if len(got) != slowlogMaxArgs || got[slowlogMaxArgs-1] != "... (12 more arguments)" {
+		t.Fatalf("%d arguments truncated to %d ending in %q", len(args), len(got), got[len(got)-1])
+	}
+}
+
+func TestSlowlogCommand(t *testing.T) {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	send, expect := testConn(t, c)
+	send("CONFIG SET slowlog-log-slower-than 0")
+	expect(respOK())
+	send("AUTH nobody secret")
+	expect(errWrongPass)
+	send("SLOWLOG LEN")
+	expect(respInt(2))
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SLOWLOG", "GET", "-2"}, "-ERR count should be greater than or equal to -1\r\n"},
+		{[]string{"SLOWLOG", "GET", "1", "2"}, "-ERR wrong number of arguments for 'slowlog|get' command\r\n"},
+		{[]string{"SLOWLOG", "LEN", "x"}, "-ERR wrong number of arguments for 'slowlog|len' command\r\n"},
+		{[]string{"SLOWLOG", "NOPE"}, "-ERR unknown subcommand 'NOPE'. Try SLOWLOG GET, LEN or RESET.\r\n"},
+		{[]string{"SLOWLOG", "GET", "0"}, respArray(nil)},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// SLOWLOG LEN itself is entry 2
+	got := executeCommand(c, []string{"SLOWLOG", "GET", "2"})
+	wantArgs := respArray([]string{respBulk("AUTH"), respBulk("(redacted)"), respBulk("(redacted)")})
+	if !strings.HasPrefix(got, "*2\r\n*6\r\n:2\r\n") || !strings.Contains(got, "*6\r\n:1\r\n") ||
+		!strings.Contains(got, wantArgs+respBulk("pipe")+respBulk("")) {
+		t.Fatalf("SLOWLOG GET 2 = %q, want entries 2 and 1 for a redacted AUTH", got)
+	}
+
+	if got := executeCommand(c, []string{"SLOWLOG", "RESET"}); got != respOK() {
+		t.Fatalf("SLOWLOG RESET = %q", got)
+	}
+	if got := executeCommand(c, []string{"SLOWLOG", "LEN"}); got != respInt(0) {
+		t.Fatalf("SLOWLOG LEN after a reset = %q", got)
+	}
+}
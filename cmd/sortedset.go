@@ -0,0 +1,322 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// sortedSetPreview is the number of members shown on the dashboard
+const sortedSetPreview = 10
+
+func init() {
+	registerCommand("ZADD", -4, flagWrite|flagDenyOOM, zaddCommand)
+	registerCommand("ZREM", -3, flagWrite, zremCommand)
+	registerCommand("ZSCORE", 3, flagReadOnly, zscoreCommand)
+	registerCommand("ZCARD", 2, flagReadOnly, zcardCommand)
+	registerCommand("ZRANGE", -4, flagReadOnly, zrangeCommand)
+}
+
+// zsetEntry is a member of a sorted set together with its score
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+// less orders entries by score, then lexicographically by member
+func (e zsetEntry) less(o zsetEntry) bool {
+	if e.score != o.score {
+		return e.score < o.score
+	}
+	return e.member < o.member
+}
+
+// sortedSet keeps members ordered by score. Lookups by member go through the
+// dict, ordered access uses binary search on the sorted slice.
+type sortedSet struct {
+	dict        map[string]float64
+	sorted      []zsetEntry
+	memberBytes int64 // Combined length of all members
+}
+
+// newSortedSet creates an empty sorted set
+func newSortedSet() *sortedSet {
+	return &sortedSet{dict: make(map[string]float64)}
+}
+
+// Type implements Object
+func (z *sortedSet) Type() string {
+	return "zset"
+}
+
+// String implements Object
+func (z *sortedSet) String() string {
+	var b strings.Builder
+	for i, e := range z.sorted {
+		if i == sortedSetPreview {
+			b.WriteString(", ...")
+			break
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(e.member + ": " + formatFloat(e.score))
+	}
+	return b.String()
+}
+
+// MemoryUsage implements memoryUser. Members are shared by the dict and the
+// sorted slice.
+func (z *sortedSet) MemoryUsage() int64 {
+	return z.memberBytes + int64(len(z.sorted))*72
+}
+
+// Len returns the number of members
+func (z *sortedSet) Len() int {
+	return len(z.sorted)
+}
+
+// Score returns the score of member
+func (z *sortedSet) Score(member string) (float64, bool) {
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// search returns the position of e in the sorted slice, or where it would
+// be inserted
+func (z *sortedSet) search(e zsetEntry) int {
+	return sort.Search(len(z.sorted), func(i int) bool {
+		return !z.sorted[i].less(e)
+	})
+}
+
+// Add inserts member or updates its score. It returns true if the member
+// was added rather than updated.
+func (z *sortedSet) Add(member string, score float64) bool {
+	old, exists := z.dict[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.Remove(member)
+	}
+
+	e := zsetEntry{member: member, score: score}
+	i := z.search(e)
+	z.sorted = append(z.sorted, zsetEntry{})
+	copy(z.sorted[i+1:], z.sorted[i:])
+	z.sorted[i] = e
+	z.dict[member] = score
+	z.memberBytes += int64(len(member))
+	return !exists
+}
+
+// Remove deletes member, returning false if it was not present
+func (z *sortedSet) Remove(member string) bool {
+	score, exists := z.dict[member]
+	if !exists {
+		return false
+	}
+
+	i := z.search(zsetEntry{member: member, score: score})
+	z.sorted = append(z.sorted[:i], z.sorted[i+1:]...)
+	delete(z.dict, member)
+	z.memberBytes -= int64(len(member))
+	return true
+}
+
+// RangeByScore returns the members with min <= score < max in order
+func (z *sortedSet) RangeByScore(min, max float64) []zsetEntry {
+	lo := sort.Search(len(z.sorted), func(i int) bool {
+		return z.sorted[i].score >= min
+	})
+	hi := sort.Search(len(z.sorted), func(i int) bool {
+		return z.sorted[i].score >= max
+	})
+	return z.sorted[lo:hi]
+}
+
+// updateSortedSet runs fn against the sorted set stored at key, creating it
+// if create is set and the key is missing. Empty sets are removed from the
+// cache. fn is not called for missing keys when create is false, and the
+// returned reply is then empty.
+func updateSortedSet(c *Cache, key string, create bool, fn func(z *sortedSet) string) string {
+	var reply string
+	c.Update(key, func(entry *CacheEntry, exists bool) int {
+		var z *sortedSet
+		switch {
+		case exists:
+			var ok bool
+			if z, ok = entry.Object.(*sortedSet); !ok {
+				reply = errWrongType
+				return updateNone
+			}
+		case create:
+			z = newSortedSet()
+			entry.Object = z
+		default:
+			return updateNone
+		}
+
+		reply = fn(z)
+		if z.Len() == 0 {
+			return updateDelete
+		}
+		return updateStore
+	})
+	return reply
+}
+
+// viewSortedSet runs fn against the sorted set stored at key while holding
+// the shard's read lock. z is nil when the key does not exist.
+func viewSortedSet(c *Cache, key string, fn func(z *sortedSet) string) string {
+	var reply string
+	c.View(key, func(entry CacheEntry, exists bool) {
+		if !exists {
+			reply = fn(nil)
+			return
+		}
+		z, ok := entry.Object.(*sortedSet)
+		if !ok {
+			reply = errWrongType
+			return
+		}
+		reply = fn(z)
+	})
+	return reply
+}
+
+// zaddCommand implements ZADD key [NX|XX] [CH] score member [score member ...]
+func zaddCommand(c *Cache, args []string) string {
+	var nx, xx, ch bool
+	i := 2
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break loop
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return respError(errSyntax)
+	}
+	if nx && xx {
+		return respError("XX and NX options at the same time are not compatible")
+	}
+
+	scores := make([]float64, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, ok := parseFloat(pairs[j])
+		if !ok {
+			return respError(errNotFloat)
+		}
+		scores = append(scores, score)
+	}
+
+	reply := updateSortedSet(c, args[1], !xx, func(z *sortedSet) string {
+		var added, changed int64
+		for j, score := range scores {
+			member := pairs[j*2+1]
+			old, exists := z.Score(member)
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			if z.Add(member, score) {
+				added++
+			} else if old != score {
+				changed++
+			}
+		}
+		if ch {
+			return respInt(added + changed)
+		}
+		return respInt(added)
+	})
+	if reply == "" {
+		return respInt(0)
+	}
+	return reply
+}
+
+// zremCommand implements ZREM key member [member ...]
+func zremCommand(c *Cache, args []string) string {
+	reply := updateSortedSet(c, args[1], false, func(z *sortedSet) string {
+		var removed int64
+		for _, member := range args[2:] {
+			if z.Remove(member) {
+				removed++
+			}
+		}
+		return respInt(removed)
+	})
+	if reply == "" {
+		return respInt(0)
+	}
+	return reply
+}
+
+// zscoreCommand implements ZSCORE key member
+func zscoreCommand(c *Cache, args []string) string {
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		if z == nil {
+			return respNil()
+		}
+		score, ok := z.Score(args[2])
+		if !ok {
+			return respNil()
+		}
+		return respBulk(formatFloat(score))
+	})
+}
+
+// zcardCommand implements ZCARD key
+func zcardCommand(c *Cache, args []string) string {
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		if z == nil {
+			return respInt(0)
+		}
+		return respInt(int64(z.Len()))
+	})
+}
+
+// zrangeCommand implements ZRANGE key start stop [WITHSCORES]
+func zrangeCommand(c *Cache, args []string) string {
+	start, ok1 := parseInt(args[2])
+	stop, ok2 := parseInt(args[3])
+	if !ok1 || !ok2 {
+		return respError(errNotInteger)
+	}
+
+	withScores := false
+	if len(args) == 5 && strings.EqualFold(args[4], "WITHSCORES") {
+		withScores = true
+	} else if len(args) > 4 {
+		return respError(errSyntax)
+	}
+
+	return viewSortedSet(c, args[1], func(z *sortedSet) string {
+		if z == nil {
+			return respArray(nil)
+		}
+		start, stop, ok := normalizeRange(start, stop, int64(z.Len()))
+		if !ok {
+			return respArray(nil)
+		}
+
+		var items []string
+		for _, e := range z.sorted[start : stop+1] {
+			items = append(items, respBulk(e.member))
+			if withScores {
+				items = append(items, respBulk(formatFloat(e.score)))
+			}
+		}
+		return respArray(items)
+	})
+}
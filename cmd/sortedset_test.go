@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestSortedSetCommands(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "str", "hello"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ZADD", "z", "2", "b", "1", "a", "3", "c"}, ":3\r\n"},
+		{[]string{"ZADD", "z", "1", "b"}, ":0\r\n"},
+		{[]string{"ZRANGE", "z", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"ZRANGE", "z", "0", "0", "WITHSCORES"}, "*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"ZRANGE", "z", "-1", "-1", "withscores"}, "*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{[]string{"ZRANGE", "z", "5", "10"}, "*0\r\n"},
+		{[]string{"ZRANGE", "z", "0", "1", "BOGUS"}, "-ERR syntax error\r\n"},
+		{[]string{"ZADD", "z", "CH", "5", "a", "4", "d"}, ":2\r\n"},
+		{[]string{"ZADD", "z", "NX", "9", "a", "6", "e"}, ":1\r\n"},
+		{[]string{"ZADD", "z", "XX", "CH", "7", "e", "0", "f"}, ":1\r\n"},
+		{[]string{"ZADD", "z", "NX", "XX", "1", "a"}, "-ERR XX and NX options at the same time are not compatible\r\n"},
+		{[]string{"ZADD", "z", "one", "a"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"ZADD", "z", "CH", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"ZSCORE", "z", "a"}, "$1\r\n5\r\n"},
+		{[]string{"ZSCORE", "z", "f"}, "$-1\r\n"},
+		{[]string{"ZCARD", "z"}, ":5\r\n"},
+		{[]string{"ZRANGE", "z", "0", "-1"}, "*5\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\na\r\n$1\r\ne\r\n"},
+		{[]string{"ZREM", "z", "a", "x", "b"}, ":2\r\n"},
+		{[]string{"ZADD", "missing", "XX", "1", "a"}, ":0\r\n"},
+		{[]string{"TYPE", "missing"}, "+none\r\n"},
+		{[]string{"ZCARD", "str"}, errWrongType},
+		{[]string{"ZADD", "str", "1", "a"}, errWrongType},
+		{[]string{"ZREM", "z", "c", "d", "e"}, ":3\r\n"},
+		{[]string{"TYPE", "z"}, "+none\r\n"},
+		{[]string{"ZCARD", "z"}, ":0\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSortedSetOrder(t *testing.T) {
+	z := newSortedSet()
+	z.Add("b", 1)
+	z.Add("a", 1)
+	z.Add("c", -1)
+	z.Add("b", 0)
+	want := []string{"c", "b", "a"}
+	for i, e := range z.sorted {
+		if e.member != want[i] {
+			t.Fatalf("order = %v, want %v", z.sorted, want)
+		}
+	}
+	if got := z.RangeByScore(0, 1); len(got) != 1 || got[0].member != "b" {
+		t.Fatalf("RangeByScore(0, 1) = %v", got)
+	}
+	z.Remove("b")
+	z.Remove("c")
+	if z.Len() != 1 || z.memberBytes != 1 {
+		t.Fatalf("after removal Len = %d, memberBytes = %d", z.Len(), z.memberBytes)
+	}
+}
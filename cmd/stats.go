@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the command latency histograms
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond, 50 * time.Microsecond, 100 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second,
+}
+
+// Error replies are counted for at most maxErrorCodes codes, as in Redis.
+// Once that many were seen, further codes share the errorCodeOther count so
+// that clients sending made up errors through scripts cannot grow the map.
+const (
+	maxErrorCodes  = 128
+	errorCodeOther = "OTHER"
+)
+
+// commandStat counts the calls of one command
+type commandStat struct {
+	calls    atomic.Uint64
+	failed   atomic.Uint64 // Calls that replied with an error
+	rejected atomic.Uint64 // Calls refused before running, such as by ACLs
+	nanos    atomic.Uint64 // Total time spent in the command
+	buckets  [len(latencyBuckets)]atomic.Uint64
+}
+
+// commandStats holds a commandStat for every known command and counts
+// error replies by their error code
+type commandStats struct {
+	// Filled once and only read afterwards, so recording takes no lock
+	commands map[string]*commandStat
+
+	errorsMu sync.Mutex
+	errors   map[string]uint64
+}
+
+// newCommandStats creates the statistics of every command
+func newCommandStats() *commandStats {
+	s := &commandStats{commands: make(map[string]*commandStat), errors: make(map[string]uint64)}
+	for _, name := range allCommandNames() {
+		s.commands[name] = &commandStat{}
+	}
+	return s
+}
+
+// record counts a call of the command name that took d and replied reply.
+// Calls of unknown commands only count towards the error codes.
+func (s *commandStats) record(name string, d time.Duration, reply string) {
+	failed := strings.HasPrefix(reply, "-")
+	if failed {
+		s.recordError(reply)
+	}
+	stat, ok := s.commands[name]
+	if !ok {
+		return
+	}
+	stat.calls.Add(1)
+	stat.nanos.Add(uint64(d))
+	if failed {
+		stat.failed.Add(1)
+	}
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			stat.buckets[i].Add(1)
+			break
+		}
+	}
+}
+
+// reject counts a call of the command name that was refused with reply
+// before it ran
+func (s *commandStats) reject(name, reply string) {
+	if stat, ok := s.commands[name]; ok {
+		stat.rejected.Add(1)
+	}
+	s.recordError(reply)
+}
+
+// recordError counts an error reply by its code, the first word after the
+// dash
+func (s *commandStats) recordError(reply string) {
+	code, _, _ := strings.Cut(strings.TrimPrefix(reply, "-"), " ")
+	code = strings.TrimSuffix(code, "\r\n")
+	s.errorsMu.Lock()
+	if _, ok := s.errors[code]; !ok && len(s.errors) >= maxErrorCodes-1 {
+		code = errorCodeOther
+	}
+	s.errors[code]++
+	s.errorsMu.Unlock()
+}
+
+// errorCounts returns the error codes seen so far, sorted, and their counts
+func (s *commandStats) errorCounts() ([]string, map[string]uint64) {
+	s.errorsMu.Lock()
+	defer s.errorsMu.Unlock()
+	counts := make(map[string]uint64, len(s.errors))
+	codes := make([]string, 0, len(s.errors))
+	for code, n := range s.errors {
+		counts[code] = n
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes, counts
+}
+
+// called returns the names of the commands that were called or rejected at
+// least once, sorted
+func (s *commandStats) called() []string {
+	var names []string
+	for name, stat := range s.commands {
+		if stat.calls.Load() > 0 || stat.rejected.Load() > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,983 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TSChunkSize is the compressed size in bytes after which a new chunk is
+// started
+const TSChunkSize = 4096
+
+func init() {
+	registerCommand("TS.CREATE", -2, flagWrite|flagDenyOOM, tsCreateCommand)
+	registerCommand("TS.ADD", -4, flagWrite|flagDenyOOM, tsAddCommand)
+	registerCommand("TS.GET", 2, flagReadOnly, tsGetCommand)
+	registerCommand("TS.RANGE", -4, flagReadOnly, tsRangeCommand)
+	registerCommand("TS.MRANGE", -4, flagReadOnly, tsMRangeCommand)
+	registerCommand("TS.INFO", 2, flagReadOnly, tsInfoCommand)
+	registerCommand("TS.CREATERULE", 6, flagWrite|flagDenyOOM, tsCreateRuleCommand)
+	registerCommand("TS.DELETERULE", 3, flagWrite, tsDeleteRuleCommand)
+}
+
+// bitWriter appends values of arbitrary bit width to a byte slice
+type bitWriter struct {
+	buf   []byte
+	nbits uint64
+}
+
+// write appends the low n bits of v, most significant bit first
+func (w *bitWriter) write(v uint64, n int) {
+	for n > 0 {
+		if w.nbits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		free := 8 - int(w.nbits%8)
+		take := min(free, n)
+		part := byte(v>>(n-take)) & byte(1<<take-1)
+		w.buf[len(w.buf)-1] |= part << (free - take)
+		n -= take
+		w.nbits += uint64(take)
+	}
+}
+
+// bitReader reads back what a bitWriter wrote
+type bitReader struct {
+	buf []byte
+	pos uint64
+}
+
+// read returns the next n bits
+func (r *bitReader) read(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		avail := 8 - int(r.pos%8)
+		take := min(avail, n)
+		part := r.buf[r.pos/8] >> (avail - take) & byte(1<<take-1)
+		v = v<<take | uint64(part)
+		n -= take
+		r.pos += uint64(take)
+	}
+	return v
+}
+
+// signExtend interprets the low n bits of v as a two's complement number
+func signExtend(v uint64, n int) int64 {
+	if n < 64 && v > 1<<(n-1) {
+		return int64(v) - 1<<n
+	}
+	return int64(v)
+}
+
+// tsChunk holds samples compressed the Gorilla way: timestamps as delta of
+// deltas, values XORed with the previous value
+type tsChunk struct {
+	w         bitWriter
+	count     int
+	firstTS   int64
+	lastTS    int64
+	lastDelta int64
+	lastValue float64
+	leading   int // Leading zeros of the previous XOR window, -1 before the first one
+	trailing  int
+}
+
+// newTSChunk creates an empty chunk
+func newTSChunk() *tsChunk {
+	return &tsChunk{leading: -1}
+}
+
+// append adds a sample. Timestamps must not decrease.
+func (c *tsChunk) append(ts int64, value float64) {
+	if c.count == 0 {
+		c.w.write(uint64(ts), 64)
+		c.w.write(math.Float64bits(value), 64)
+		c.firstTS, c.lastTS, c.lastValue = ts, ts, value
+		c.count++
+		return
+	}
+
+	// Delta of deltas use '0', '10' + 7 bits, '110' + 9 bits,
+	// '1110' + 12 bits or '1111' + 64 bits
+	delta := ts - c.lastTS
+	dod := delta - c.lastDelta
+	switch {
+	case dod == 0:
+		c.w.write(0, 1)
+	case dod >= -63 && dod <= 64:
+		c.w.write(0b10, 2)
+		c.w.write(uint64(dod), 7)
+	case dod >= -255 && dod <= 256:
+		c.w.write(0b110, 3)
+		c.w.write(uint64(dod), 9)
+	case dod >= -2047 && dod <= 2048:
+		c.w.write(0b1110, 4)
+		c.w.write(uint64(dod), 12)
+	default:
+		c.w.write(0b1111, 4)
+		c.w.write(uint64(dod), 64)
+	}
+
+	xor := math.Float64bits(value) ^ math.Float64bits(c.lastValue)
+	if xor == 0 {
+		c.w.write(0, 1)
+	} else {
+		leading := min(bits.LeadingZeros64(xor), 31)
+		trailing := bits.TrailingZeros64(xor)
+		if c.leading >= 0 && leading >= c.leading && trailing >= c.trailing {
+			c.w.write(0b10, 2)
+			c.w.write(xor>>c.trailing, 64-c.leading-c.trailing)
+		} else {
+			c.leading, c.trailing = leading, trailing
+			significant := 64 - leading - trailing
+			c.w.write(0b11, 2)
+			c.w.write(uint64(leading), 5)
+			c.w.write(uint64(significant-1), 6)
+			c.w.write(xor>>trailing, significant)
+		}
+	}
+
+	c.lastTS, c.lastDelta, c.lastValue = ts, delta, value
+	c.count++
+}
+
+// each decodes the chunk and calls fn for every sample until fn returns
+// false
+func (c *tsChunk) each(fn func(ts int64, value float64) bool) bool {
+	if c.count == 0 {
+		return true
+	}
+
+	r := bitReader{buf: c.w.buf}
+	ts := int64(r.read(64))
+	bitsValue := r.read(64)
+	if !fn(ts, math.Float64frombits(bitsValue)) {
+		return false
+	}
+
+	var delta int64
+	leading, trailing := 0, 0
+	for i := 1; i < c.count; i++ {
+		var dod int64
+		switch {
+		case r.read(1) == 0:
+		case r.read(1) == 0:
+			dod = signExtend(r.read(7), 7)
+		case r.read(1) == 0:
+			dod = signExtend(r.read(9), 9)
+		case r.read(1) == 0:
+			dod = signExtend(r.read(12), 12)
+		default:
+			dod = int64(r.read(64))
+		}
+		delta += dod
+		ts += delta
+
+		if r.read(1) == 1 {
+			if r.read(1) == 1 {
+				leading = int(r.read(5))
+				significant := int(r.read(6)) + 1
+				trailing = 64 - leading - significant
+			}
+			bitsValue ^= r.read(64-leading-trailing) << trailing
+		}
+
+		if !fn(ts, math.Float64frombits(bitsValue)) {
+			return false
+		}
+	}
+	return true
+}
+
+// tsAggregator accumulates the samples of one bucket
+type tsAggregator struct {
+	count              int
+	sum, min, max      float64
+	first, last        float64
+	bucketStart        int64
+	bucketInitialized  bool
+	aggregationType    string
+	bucketDurationMsec int64
+}
+
+// Supported aggregation types
+var tsAggregationTypes = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true,
+	"count": true, "first": true, "last": true, "range": true,
+}
+
+// add accumulates a sample
+func (a *tsAggregator) add(value float64) {
+	if a.count == 0 {
+		a.min, a.max, a.first = value, value, value
+	}
+	a.count++
+	a.sum += value
+	a.min = math.Min(a.min, value)
+	a.max = math.Max(a.max, value)
+	a.last = value
+}
+
+// result returns the aggregated value of the bucket
+func (a *tsAggregator) result() float64 {
+	switch a.aggregationType {
+	case "avg":
+		return a.sum / float64(a.count)
+	case "sum":
+		return a.sum
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "count":
+		return float64(a.count)
+	case "first":
+		return a.first
+	case "last":
+		return a.last
+	case "range":
+		return a.max - a.min
+	}
+	return 0
+}
+
+// reset starts a new bucket
+func (a *tsAggregator) reset(bucketStart int64) {
+	*a = tsAggregator{
+		bucketStart:        bucketStart,
+		bucketInitialized:  true,
+		aggregationType:    a.aggregationType,
+		bucketDurationMsec: a.bucketDurationMsec,
+	}
+}
+
+// bucketOf returns the start of the bucket holding ts
+func (a *tsAggregator) bucketOf(ts int64) int64 {
+	start := ts - ts%a.bucketDurationMsec
+	if ts < 0 && ts%a.bucketDurationMsec != 0 {
+		start -= a.bucketDurationMsec
+	}
+	return start
+}
+
+// tsRule is a compaction rule that rolls samples of a series into a
+// coarser destination series
+type tsRule struct {
+	dest string
+	agg  tsAggregator
+}
+
+// tsSample is a single timestamped value
+type tsSample struct {
+	ts    int64
+	value float64
+}
+
+// timeSeries is the Object stored for TS keys
+type timeSeries struct {
+	chunks    []*tsChunk
+	retention int64 // Milliseconds, zero keeps samples forever
+	labels    [][2]string
+	rules     []*tsRule
+	sourceKey string // Set when the series is the destination of a rule
+	total     int
+}
+
+// newTimeSeries creates an empty series
+func newTimeSeries(retention int64, labels [][2]string) *timeSeries {
+	return &timeSeries{
+		chunks:    []*tsChunk{newTSChunk()},
+		retention: retention,
+		labels:    labels,
+	}
+}
+
+// Type implements Object
+func (s *timeSeries) Type() string {
+	return "timeseries"
+}
+
+// String implements Object
+func (s *timeSeries) String() string {
+	last := s.chunks[len(s.chunks)-1]
+	desc := fmt.Sprintf("time series: %d samples in %d chunks", s.total, len(s.chunks))
+	if s.total > 0 {
+		desc += fmt.Sprintf(", last %d = %s", last.lastTS, formatFloat(last.lastValue))
+	}
+	for _, l := range s.labels {
+		desc += fmt.Sprintf(", %s=%s", l[0], l[1])
+	}
+	return desc
+}
+
+// MemoryUsage implements memoryUser
+func (s *timeSeries) MemoryUsage() int64 {
+	var size int64
+	for _, c := range s.chunks {
+		size += int64(cap(c.w.buf)) + 96
+	}
+	for _, l := range s.labels {
+		size += int64(len(l[0])+len(l[1])) + 32
+	}
+	for _, r := range s.rules {
+		size += int64(len(r.dest)) + 128
+	}
+	return size
+}
+
+// lastSample returns the newest sample
+func (s *timeSeries) lastSample() (tsSample, bool) {
+	last := s.chunks[len(s.chunks)-1]
+	if last.count == 0 {
+		return tsSample{}, false
+	}
+	return tsSample{ts: last.lastTS, value: last.lastValue}, true
+}
+
+// Add appends a sample and trims chunks that fell out of the retention
+// window
+func (s *timeSeries) Add(ts int64, value float64) error {
+	last := s.chunks[len(s.chunks)-1]
+	if last.count > 0 && ts <= last.lastTS {
+		return fmt.Errorf("TSDB: timestamp must be higher than the maximum existing timestamp")
+	}
+
+	if len(last.w.buf) >= TSChunkSize {
+		last = newTSChunk()
+		s.chunks = append(s.chunks, last)
+	}
+	last.append(ts, value)
+	s.total++
+
+	if s.retention > 0 {
+		for len(s.chunks) > 1 && s.chunks[0].lastTS < ts-s.retention {
+			s.total -= s.chunks[0].count
+			s.chunks = s.chunks[1:]
+		}
+	}
+	return nil
+}
+
+// Range returns the samples with from <= ts <= to that are inside the
+// retention window
+func (s *timeSeries) Range(from, to int64) []tsSample {
+	if newest, ok := s.lastSample(); ok && s.retention > 0 {
+		from = max(from, newest.ts-s.retention)
+	}
+
+	var samples []tsSample
+	for _, c := range s.chunks {
+		if c.count == 0 || c.lastTS < from || c.firstTS > to {
+			continue
+		}
+		c.each(func(ts int64, value float64) bool {
+			if ts > to {
+				return false
+			}
+			if ts >= from {
+				samples = append(samples, tsSample{ts: ts, value: value})
+			}
+			return true
+		})
+	}
+	return samples
+}
+
+// Matches reports whether the series satisfies every label filter
+func (s *timeSeries) Matches(filters []tsFilter) bool {
+	for _, f := range filters {
+		value := ""
+		for _, l := range s.labels {
+			if l[0] == f.label {
+				value = l[1]
+			}
+		}
+
+		found := false
+		for _, v := range f.values {
+			if v == value {
+				found = true
+			}
+		}
+		if found == f.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// tsFilter is a parsed label=value or label!=value filter. An empty value
+// stands for a missing label.
+type tsFilter struct {
+	label  string
+	values []string
+	negate bool
+}
+
+// parseTSFilter parses label=value, label!=value, label= and label!= as well
+// as the list forms label=(a,b) and label!=(a,b)
+func parseTSFilter(s string) (tsFilter, bool) {
+	var f tsFilter
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return f, false
+	}
+	f.label = s[:i]
+	if strings.HasSuffix(f.label, "!") {
+		f.label, f.negate = f.label[:len(f.label)-1], true
+	}
+	if f.label == "" {
+		return f, false
+	}
+
+	value := s[i+1:]
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		f.values = strings.Split(value[1:len(value)-1], ",")
+	} else {
+		f.values = []string{value}
+	}
+	return f, true
+}
+
+// parseTSTimestamp parses a timestamp, "-" and "+" stand for the oldest and
+// newest possible ones and "*" for the current time
+func parseTSTimestamp(s string) (int64, bool) {
+	switch s {
+	case "-":
+		return math.MinInt64, true
+	case "+":
+		return math.MaxInt64, true
+	case "*":
+		return time.Now().UnixMilli(), true
+	}
+	return parseInt(s)
+}
+
+// tsOptions holds the RETENTION and LABELS options of TS.CREATE and TS.ADD
+type tsOptions struct {
+	retention int64
+	labels    [][2]string
+}
+
+// parseTSOptions parses [RETENTION ms] [LABELS label value ...]
+func parseTSOptions(args []string) (tsOptions, string) {
+	var opts tsOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "RETENTION":
+			if i+1 >= len(args) {
+				return opts, errSyntax
+			}
+			n, ok := parseInt(args[i+1])
+			if !ok || n < 0 {
+				return opts, "TSDB: invalid retention"
+			}
+			opts.retention = n
+			i++
+		case "LABELS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return opts, "TSDB: invalid labels"
+			}
+			for j := 0; j < len(rest); j += 2 {
+				opts.labels = append(opts.labels, [2]string{rest[j], rest[j+1]})
+			}
+			return opts, ""
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, ""
+}
+
+// tsRangeOptions holds the options shared by TS.RANGE and TS.MRANGE
+type tsRangeOptions struct {
+	count      int
+	agg        *tsAggregator
+	withLabels bool
+	filters    []tsFilter
+}
+
+// parseTSRangeOptions parses [COUNT n] [AGGREGATION type bucket] and, for
+// TS.MRANGE, [WITHLABELS] FILTER filter...
+func parseTSRangeOptions(args []string, multi bool) (tsRangeOptions, string) {
+	var opts tsRangeOptions
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COUNT" && i+1 < len(args):
+			n, ok := parseInt(args[i+1])
+			if !ok || n <= 0 {
+				return opts, "TSDB: invalid COUNT"
+			}
+			opts.count = int(n)
+			i++
+		case opt == "AGGREGATION" && i+2 < len(args):
+			agg, errMsg := parseTSAggregation(args[i+1], args[i+2])
+			if errMsg != "" {
+				return opts, errMsg
+			}
+			opts.agg = agg
+			i += 2
+		case multi && opt == "WITHLABELS":
+			opts.withLabels = true
+		case multi && opt == "FILTER":
+			for _, arg := range args[i+1:] {
+				f, ok := parseTSFilter(arg)
+				if !ok {
+					return opts, "TSDB: failed parsing labels"
+				}
+				opts.filters = append(opts.filters, f)
+			}
+			i = len(args)
+		default:
+			return opts, errSyntax
+		}
+	}
+
+	if multi && len(opts.filters) == 0 {
+		return opts, "TSDB: missing FILTER argument"
+	}
+	return opts, ""
+}
+
+// parseTSAggregation parses an aggregation type and bucket duration
+func parseTSAggregation(typ, bucket string) (*tsAggregator, string) {
+	typ = strings.ToLower(typ)
+	if !tsAggregationTypes[typ] {
+		return nil, "TSDB: Unknown aggregation type"
+	}
+	n, ok := parseInt(bucket)
+	if !ok || n <= 0 {
+		return nil, "TSDB: bucketDuration must be greater than zero"
+	}
+	return &tsAggregator{aggregationType: typ, bucketDurationMsec: n}, ""
+}
+
+// apply aggregates and limits samples as requested by the options
+func (opts tsRangeOptions) apply(samples []tsSample) []tsSample {
+	if opts.agg != nil && len(samples) > 0 {
+		agg := *opts.agg
+		var out []tsSample
+		for _, s := range samples {
+			bucket := agg.bucketOf(s.ts)
+			if agg.bucketInitialized && bucket != agg.bucketStart {
+				out = append(out, tsSample{ts: agg.bucketStart, value: agg.result()})
+			}
+			if !agg.bucketInitialized || bucket != agg.bucketStart {
+				agg.reset(bucket)
+			}
+			agg.add(s.value)
+		}
+		samples = append(out, tsSample{ts: agg.bucketStart, value: agg.result()})
+	}
+
+	if opts.count > 0 && len(samples) > opts.count {
+		samples = samples[:opts.count]
+	}
+	return samples
+}
+
+// encodeSamples encodes samples as an array of [timestamp, value] pairs
+func encodeSamples(samples []tsSample) string {
+	items := make([]string, 0, len(samples))
+	for _, s := range samples {
+		items = append(items, respArray([]string{respInt(s.ts), respBulk(formatFloat(s.value))}))
+	}
+	return respArray(items)
+}
+
+// encodeLabels encodes labels as an array of [label, value] pairs
+func encodeLabels(labels [][2]string) string {
+	items := make([]string, 0, len(labels))
+	for _, l := range labels {
+		items = append(items, respArray([]string{respBulk(l[0]), respBulk(l[1])}))
+	}
+	return respArray(items)
+}
+
+// viewTimeSeries runs fn against the series stored at key under the shard's
+// read lock
+func viewTimeSeries(c *Cache, key string, fn func(s *timeSeries) string) string {
+	var reply string
+	c.View(key, func(entry CacheEntry, exists bool) {
+		if !exists {
+			reply = respError("TSDB: the key does not exist")
+			return
+		}
+		s, ok := entry.Object.(*timeSeries)
+		if !ok {
+			reply = errWrongType
+			return
+		}
+		reply = fn(s)
+	})
+	return reply
+}
+
+// tsCreateCommand implements TS.CREATE key [RETENTION ms] [LABELS ...]
+func tsCreateCommand(c *Cache, args []string) string {
+	opts, errMsg := parseTSOptions(args[2:])
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists {
+			reply = respError("TSDB: key already exists")
+			return updateNone
+		}
+		entry.Object = newTimeSeries(opts.retention, opts.labels)
+		reply = respOK()
+		return updateStore
+	})
+	return reply
+}
+
+// addSample appends a sample to the series at key, creating it with opts if
+// needed, and then feeds finished buckets into compaction destinations
+func addSample(c *Cache, key string, ts int64, value float64, opts *tsOptions) string {
+	type emission struct {
+		dest   string
+		sample tsSample
+	}
+	var emissions []emission
+
+	var reply string
+	c.Update(key, func(entry *CacheEntry, exists bool) int {
+		var s *timeSeries
+		switch {
+		case exists:
+			var ok bool
+			if s, ok = entry.Object.(*timeSeries); !ok {
+				reply = errWrongType
+				return updateNone
+			}
+		case opts != nil:
+			s = newTimeSeries(opts.retention, opts.labels)
+			entry.Object = s
+		default:
+			reply = respError("TSDB: the key does not exist")
+			return updateNone
+		}
+
+		if err := s.Add(ts, value); err != nil {
+			reply = respError(err.Error())
+			return updateNone
+		}
+
+		for _, r := range s.rules {
+			bucket := r.agg.bucketOf(ts)
+			if r.agg.bucketInitialized && bucket != r.agg.bucketStart {
+				emissions = append(emissions, emission{r.dest, tsSample{r.agg.bucketStart, r.agg.result()}})
+			}
+			if !r.agg.bucketInitialized || bucket != r.agg.bucketStart {
+				r.agg.reset(bucket)
+			}
+			r.agg.add(value)
+		}
+
+		reply = respInt(ts)
+		return updateStore
+	})
+
+	// Destinations are updated after the source's shard lock is released.
+	// Rules whose destination was deleted or replaced are dropped.
+	var gone []string
+	for _, e := range emissions {
+		if !addCompacted(c, key, e.dest, e.sample) {
+			gone = append(gone, e.dest)
+		}
+	}
+	if len(gone) > 0 {
+		c.Update(key, func(entry *CacheEntry, exists bool) int {
+			s, ok := entry.Object.(*timeSeries)
+			if !ok {
+				return updateNone
+			}
+			s.rules = slices.DeleteFunc(s.rules, func(r *tsRule) bool {
+				return slices.Contains(gone, r.dest)
+			})
+			return updateStore
+		})
+	}
+	return reply
+}
+
+// addCompacted adds a sample that a rule of src emitted to dest. It returns
+// false if dest is no longer the destination of src. Samples the
+// destination rejects are logged, as no client is waiting for the error.
+func addCompacted(c *Cache, src, dest string, sample tsSample) bool {
+	found := true
+	c.Update(dest, func(entry *CacheEntry, exists bool) int {
+		s, ok := entry.Object.(*timeSeries)
+		if !exists || !ok || s.sourceKey != src {
+			found = false
+			return updateNone
+		}
+		if err := s.Add(sample.ts, sample.value); err != nil {
+			logf(logWarning, "Compaction of %s into %s failed: %v", src, dest, err)
+			return updateNone
+		}
+		return updateStore
+	})
+	if !found {
+		logf(logNotice, "Dropped the compaction rule of %s into %s, the destination no longer exists", src, dest)
+	}
+	return found
+}
+
+// tsAddKeys returns the key of TS.ADD and the destinations of its
+// compaction rules, which TS.ADD writes as well
+func tsAddKeys(c *Cache, args []string) []string {
+	keys := []string{args[1]}
+	c.View(args[1], func(entry CacheEntry, exists bool) {
+		if s, ok := entry.Object.(*timeSeries); ok {
+			for _, r := range s.rules {
+				keys = append(keys, r.dest)
+			}
+		}
+	})
+	return keys
+}
+
+// tsAddCommand implements TS.ADD key timestamp value [RETENTION ms]
+// [LABELS ...]
+func tsAddCommand(c *Cache, args []string) string {
+	ts, ok := parseTSTimestamp(args[2])
+	if !ok || args[2] == "-" || args[2] == "+" {
+		return respError("TSDB: invalid timestamp")
+	}
+	value, ok := parseFloat(args[3])
+	if !ok {
+		return respError("TSDB: invalid value")
+	}
+	opts, errMsg := parseTSOptions(args[4:])
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+
+	return addSample(c, args[1], ts, value, &opts)
+}
+
+// tsGetCommand implements TS.GET key
+func tsGetCommand(c *Cache, args []string) string {
+	return viewTimeSeries(c, args[1], func(s *timeSeries) string {
+		last, ok := s.lastSample()
+		if !ok {
+			return respArray(nil)
+		}
+		return respArray([]string{respInt(last.ts), respBulk(formatFloat(last.value))})
+	})
+}
+
+// tsRangeCommand implements TS.RANGE key from to [COUNT n]
+// [AGGREGATION type bucket]
+func tsRangeCommand(c *Cache, args []string) string {
+	from, ok1 := parseTSTimestamp(args[2])
+	to, ok2 := parseTSTimestamp(args[3])
+	if !ok1 || !ok2 {
+		return respError("TSDB: invalid timestamp")
+	}
+	opts, errMsg := parseTSRangeOptions(args[4:], false)
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+
+	return viewTimeSeries(c, args[1], func(s *timeSeries) string {
+		return encodeSamples(opts.apply(s.Range(from, to)))
+	})
+}
+
+// tsMRangeCommand implements TS.MRANGE from to [WITHLABELS] [COUNT n]
+// [AGGREGATION type bucket] FILTER filter...
+func tsMRangeCommand(c *Cache, args []string) string {
+	from, ok1 := parseTSTimestamp(args[1])
+	to, ok2 := parseTSTimestamp(args[2])
+	if !ok1 || !ok2 {
+		return respError("TSDB: invalid timestamp")
+	}
+	opts, errMsg := parseTSRangeOptions(args[3:], true)
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+
+	type result struct {
+		key    string
+		labels [][2]string
+		reply  string
+	}
+	var results []result
+
+	c.ForEach(func(key string, entry CacheEntry) {
+		s, ok := entry.Object.(*timeSeries)
+		if !ok || !s.Matches(opts.filters) {
+			return
+		}
+		r := result{key: key, reply: encodeSamples(opts.apply(s.Range(from, to)))}
+		if opts.withLabels {
+			r.labels = s.labels
+		}
+		results = append(results, r)
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].key < results[j].key })
+
+	items := make([]string, 0, len(results))
+	for _, r := range results {
+		items = append(items, respArray([]string{respBulk(r.key), encodeLabels(r.labels), r.reply}))
+	}
+	return respArray(items)
+}
+
+// tsInfoCommand implements TS.INFO key
+func tsInfoCommand(c *Cache, args []string) string {
+	return viewTimeSeries(c, args[1], func(s *timeSeries) string {
+		var memory, first int64
+		for _, chunk := range s.chunks {
+			memory += int64(len(chunk.w.buf))
+		}
+		if s.total > 0 {
+			for _, chunk := range s.chunks {
+				if chunk.count > 0 {
+					first = chunk.firstTS
+					break
+				}
+			}
+		}
+		last, _ := s.lastSample()
+
+		rules := make([]string, 0, len(s.rules))
+		for _, r := range s.rules {
+			rules = append(rules, respArray([]string{
+				respBulk(r.dest),
+				respInt(r.agg.bucketDurationMsec),
+				respSimple(strings.ToUpper(r.agg.aggregationType)),
+			}))
+		}
+		source := respNil()
+		if s.sourceKey != "" {
+			source = respBulk(s.sourceKey)
+		}
+
+		return respArray([]string{
+			respSimple("totalSamples"), respInt(int64(s.total)),
+			respSimple("memoryUsage"), respInt(memory),
+			respSimple("firstTimestamp"), respInt(first),
+			respSimple("lastTimestamp"), respInt(last.ts),
+			respSimple("retentionTime"), respInt(s.retention),
+			respSimple("chunkCount"), respInt(int64(len(s.chunks))),
+			respSimple("labels"), encodeLabels(s.labels),
+			respSimple("sourceKey"), source,
+			respSimple("rules"), respArray(rules),
+		})
+	})
+}
+
+// tsCreateRuleCommand implements TS.CREATERULE source dest AGGREGATION type
+// bucket
+func tsCreateRuleCommand(c *Cache, args []string) string {
+	if !strings.EqualFold(args[3], "AGGREGATION") {
+		return respError(errSyntax)
+	}
+	agg, errMsg := parseTSAggregation(args[4], args[5])
+	if errMsg != "" {
+		return respError(errMsg)
+	}
+	src, dest := args[1], args[2]
+	if src == dest {
+		return respError("TSDB: the source key and destination key should be different")
+	}
+
+	// Claim the destination first so that it can only have one source
+	var reply string
+	c.Update(dest, func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			reply = respError("TSDB: the key does not exist")
+			return updateNone
+		}
+		s, ok := entry.Object.(*timeSeries)
+		switch {
+		case !ok:
+			reply = errWrongType
+		case s.sourceKey != "":
+			reply = respError("TSDB: the destination key already has a src rule")
+		case len(s.rules) > 0:
+			reply = respError("TSDB: the destination key already has a dst rule")
+		default:
+			s.sourceKey = src
+			return updateStore
+		}
+		return updateNone
+	})
+	if reply != "" {
+		return reply
+	}
+
+	c.Update(src, func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			reply = respError("TSDB: the key does not exist")
+			return updateNone
+		}
+		s, ok := entry.Object.(*timeSeries)
+		switch {
+		case !ok:
+			reply = errWrongType
+		case s.sourceKey != "":
+			reply = respError("TSDB: the source key already has a source rule")
+		default:
+			s.rules = append(s.rules, &tsRule{dest: dest, agg: *agg})
+			reply = respOK()
+			return updateStore
+		}
+		return updateNone
+	})
+
+	// Release the destination again if the source rejected the rule
+	if reply != respOK() {
+		c.Update(dest, func(entry *CacheEntry, exists bool) int {
+			if s, ok := entry.Object.(*timeSeries); ok && s.sourceKey == src {
+				s.sourceKey = ""
+				return updateStore
+			}
+			return updateNone
+		})
+	}
+	return reply
+}
+
+// tsDeleteRuleCommand implements TS.DELETERULE source dest
+func tsDeleteRuleCommand(c *Cache, args []string) string {
+	src, dest := args[1], args[2]
+
+	reply := respError("TSDB: compaction rule does not exist")
+	c.Update(src, func(entry *CacheEntry, exists bool) int {
+		s, ok := entry.Object.(*timeSeries)
+		if !exists || !ok {
+			return updateNone
+		}
+		for i, r := range s.rules {
+			if r.dest == dest {
+				s.rules = append(s.rules[:i], s.rules[i+1:]...)
+				reply = respOK()
+				return updateStore
+			}
+		}
+		return updateNone
+	})
+
+	if reply == respOK() {
+		c.Update(dest, func(entry *CacheEntry, exists bool) int {
+			if s, ok := entry.Object.(*timeSeries); ok && s.sourceKey == src {
+				s.sourceKey = ""
+				return updateStore
+			}
+			return updateNone
+		})
+	}
+	return reply
+}
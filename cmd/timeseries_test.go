@@ -0,0 +1,209 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestTSChunkRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var samples []tsSample
+	ts := int64(-1000000)
+	value := 0.0
+	for i := 0; i < 5000; i++ {
+		// Mix steady intervals with jitter and jumps of every encoded width
+		switch rng.Intn(6) {
+		case 0:
+			ts += 1000
+		case 1:
+			ts += 1000 + rng.Int63n(128) - 63
+		case 2:
+			ts += 1 + rng.Int63n(512)
+		case 3:
+			ts += 1 + rng.Int63n(4096)
+		case 4:
+			ts += 1 + rng.Int63n(1<<40)
+		default:
+			ts++
+		}
+		switch rng.Intn(4) {
+		case 0:
+		case 1:
+			value += float64(rng.Intn(10))
+		case 2:
+			value = rng.NormFloat64() * 1e6
+		default:
+			value = -value
+		}
+		samples = append(samples, tsSample{ts, value})
+	}
+
+	s := newTimeSeries(0, nil)
+	for _, sample := range samples {
+		if err := s.Add(sample.ts, sample.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.chunks) < 2 {
+		t.Fatalf("5000 samples fit in %d chunk", len(s.chunks))
+	}
+	got := s.Range(math.MinInt64, math.MaxInt64)
+	if len(got) != len(samples) {
+		t.Fatalf("Range returned %d samples, want %d", len(got), len(samples))
+	}
+	for i := range samples {
+		if got[i] != samples[i] {
+			t.Fatalf("sample %d = %v, want %v", i, got[i], samples[i])
+		}
+	}
+}
+
+func TestTSCommands(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"SET", "str", "hello"})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TS.CREATE", "temp", "LABELS", "room", "kitchen"}, "+OK\r\n"},
+		{[]string{"TS.CREATE", "temp"}, "-ERR TSDB: key already exists\r\n"},
+		{[]string{"TS.CREATE", "x", "RETENTION", "-1"}, "-ERR TSDB: invalid retention\r\n"},
+		{[]string{"TS.CREATE", "x", "LABELS", "room"}, "-ERR TSDB: invalid labels\r\n"},
+		{[]string{"TS.GET", "temp"}, "*0\r\n"},
+		{[]string{"TS.ADD", "temp", "1000", "20"}, ":1000\r\n"},
+		{[]string{"TS.ADD", "temp", "2000", "22.5"}, ":2000\r\n"},
+		{[]string{"TS.ADD", "temp", "2500", "24"}, ":2500\r\n"},
+		{[]string{"TS.ADD", "temp", "4000", "18"}, ":4000\r\n"},
+		{[]string{"TS.ADD", "temp", "4000", "19"}, "-ERR TSDB: timestamp must be higher than the maximum existing timestamp\r\n"},
+		{[]string{"TS.ADD", "temp", "-", "19"}, "-ERR TSDB: invalid timestamp\r\n"},
+		{[]string{"TS.ADD", "temp", "5000", "hot"}, "-ERR TSDB: invalid value\r\n"},
+		{[]string{"TS.GET", "temp"}, "*2\r\n:4000\r\n$2\r\n18\r\n"},
+		{[]string{"TS.RANGE", "temp", "1500", "3000"}, "*2\r\n*2\r\n:2000\r\n$4\r\n22.5\r\n*2\r\n:2500\r\n$2\r\n24\r\n"},
+		{[]string{"TS.RANGE", "temp", "-", "+", "COUNT", "1"}, "*1\r\n*2\r\n:1000\r\n$2\r\n20\r\n"},
+		{[]string{"TS.RANGE", "temp", "-", "+", "AGGREGATION", "max", "2000"}, "*3\r\n*2\r\n:0\r\n$2\r\n20\r\n*2\r\n:2000\r\n$2\r\n24\r\n*2\r\n:4000\r\n$2\r\n18\r\n"},
+		{[]string{"TS.RANGE", "temp", "-", "+", "AGGREGATION", "avg", "5000"}, "*1\r\n*2\r\n:0\r\n$6\r\n21.125\r\n"},
+		{[]string{"TS.RANGE", "temp", "-", "+", "AGGREGATION", "median", "5000"}, "-ERR TSDB: Unknown aggregation type\r\n"},
+		{[]string{"TS.RANGE", "temp", "-", "+", "AGGREGATION", "avg", "0"}, "-ERR TSDB: bucketDuration must be greater than zero\r\n"},
+		{[]string{"TS.RANGE", "temp", "-", "+", "COUNT", "0"}, "-ERR TSDB: invalid COUNT\r\n"},
+		{[]string{"TS.RANGE", "missing", "-", "+"}, "-ERR TSDB: the key does not exist\r\n"},
+		{[]string{"TS.RANGE", "str", "-", "+"}, errWrongType},
+		{[]string{"TS.ADD", "str", "1", "1"}, errWrongType},
+		{[]string{"TS.ADD", "new", "1", "1", "RETENTION", "100"}, ":1\r\n"},
+		{[]string{"TYPE", "new"}, "+timeseries\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestTSAggregationNegativeBuckets(t *testing.T) {
+	agg := tsAggregator{bucketDurationMsec: 10}
+	tests := []struct{ ts, want int64 }{{0, 0}, {9, 0}, {10, 10}, {-1, -10}, {-10, -10}, {-11, -20}}
+	for _, tt := range tests {
+		if got := agg.bucketOf(tt.ts); got != tt.want {
+			t.Errorf("bucketOf(%d) = %d, want %d", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestTSRetention(t *testing.T) {
+	s := newTimeSeries(1000, nil)
+	for ts := int64(0); ts < 100000; ts += 10 {
+		s.Add(ts, float64(ts))
+	}
+	got := s.Range(math.MinInt64, math.MaxInt64)
+	if len(got) != 101 || got[0].ts != 98990 {
+		t.Fatalf("Range returned %d samples starting at %d, want 101 starting at 98990", len(got), got[0].ts)
+	}
+	// Whole chunks older than the window are dropped
+	if s.chunks[0].lastTS < 99990-1000 {
+		t.Fatalf("chunk ending at %d was kept", s.chunks[0].lastTS)
+	}
+}
+
+func TestTSCompaction(t *testing.T) {
+	c := newTestCache(t)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TS.CREATE", "raw"}, "+OK\r\n"},
+		{[]string{"TS.CREATE", "sum"}, "+OK\r\n"},
+		{[]string{"TS.CREATERULE", "raw", "missing", "AGGREGATION", "sum", "10"}, "-ERR TSDB: the key does not exist\r\n"},
+		{[]string{"TS.CREATERULE", "raw", "raw", "AGGREGATION", "sum", "10"}, "-ERR TSDB: the source key and destination key should be different\r\n"},
+		{[]string{"TS.CREATERULE", "raw", "sum", "AGGREGATION", "sum", "10"}, "+OK\r\n"},
+		{[]string{"TS.CREATERULE", "other", "sum", "AGGREGATION", "sum", "10"}, "-ERR TSDB: the destination key already has a src rule\r\n"},
+		{[]string{"TS.CREATERULE", "sum", "raw", "AGGREGATION", "sum", "10"}, "-ERR TSDB: the destination key already has a dst rule\r\n"},
+		{[]string{"TS.ADD", "raw", "1", "1"}, ":1\r\n"},
+		{[]string{"TS.ADD", "raw", "5", "2"}, ":5\r\n"},
+		{[]string{"TS.RANGE", "sum", "-", "+"}, "*0\r\n"},
+		{[]string{"TS.ADD", "raw", "12", "4"}, ":12\r\n"},
+		{[]string{"TS.ADD", "raw", "25", "8"}, ":25\r\n"},
+		{[]string{"TS.RANGE", "sum", "-", "+"}, "*2\r\n*2\r\n:0\r\n$1\r\n3\r\n*2\r\n:10\r\n$1\r\n4\r\n"},
+		{[]string{"TS.DELETERULE", "raw", "sum"}, "+OK\r\n"},
+		{[]string{"TS.DELETERULE", "raw", "sum"}, "-ERR TSDB: compaction rule does not exist\r\n"},
+		{[]string{"TS.ADD", "raw", "40", "1"}, ":40\r\n"},
+		{[]string{"TS.RANGE", "sum", "-", "+"}, "*2\r\n*2\r\n:0\r\n$1\r\n3\r\n*2\r\n:10\r\n$1\r\n4\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestTSCompactionDestinationDeleted(t *testing.T) {
+	c := newTestCache(t)
+	executeCommand(c, []string{"TS.CREATE", "raw"})
+	executeCommand(c, []string{"TS.CREATE", "avg"})
+	executeCommand(c, []string{"TS.CREATERULE", "raw", "avg", "AGGREGATION", "avg", "10"})
+	executeCommand(c, []string{"TS.ADD", "raw", "1", "1"})
+	c.Delete("avg")
+	executeCommand(c, []string{"TS.CREATE", "avg"})
+	executeCommand(c, []string{"TS.ADD", "raw", "11", "1"})
+
+	if got := executeCommand(c, []string{"TS.RANGE", "avg", "-", "+"}); got != "*0\r\n" {
+		t.Fatalf("recreated destination received %q", got)
+	}
+	var rules int
+	c.View("raw", func(entry CacheEntry, exists bool) {
+		rules = len(entry.Object.(*timeSeries).rules)
+	})
+	if rules != 0 {
+		t.Fatalf("rule into the deleted destination was kept")
+	}
+}
+
+func TestTSMRange(t *testing.T) {
+	c := newTestCache(t)
+	for i, room := range []string{"kitchen", "hall", "attic"} {
+		key := "temp:" + room
+		executeCommand(c, []string{"TS.ADD", key, "1000", strconv.Itoa(20 + i), "LABELS", "room", room, "type", "temp"})
+	}
+	executeCommand(c, []string{"TS.ADD", "humidity", "1000", "60", "LABELS", "type", "humidity"})
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TS.MRANGE", "-", "+", "FILTER", "room=hall"}, "*1\r\n*3\r\n$9\r\ntemp:hall\r\n*0\r\n*1\r\n*2\r\n:1000\r\n$2\r\n21\r\n"},
+		{[]string{"TS.MRANGE", "-", "+", "WITHLABELS", "FILTER", "room=(attic,hall)", "type=temp"}, "*2\r\n" +
+			"*3\r\n$10\r\ntemp:attic\r\n*2\r\n*2\r\n$4\r\nroom\r\n$5\r\nattic\r\n*2\r\n$4\r\ntype\r\n$4\r\ntemp\r\n*1\r\n*2\r\n:1000\r\n$2\r\n22\r\n" +
+			"*3\r\n$9\r\ntemp:hall\r\n*2\r\n*2\r\n$4\r\nroom\r\n$4\r\nhall\r\n*2\r\n$4\r\ntype\r\n$4\r\ntemp\r\n*1\r\n*2\r\n:1000\r\n$2\r\n21\r\n"},
+		{[]string{"TS.MRANGE", "-", "+", "FILTER", "room="}, "*1\r\n*3\r\n$8\r\nhumidity\r\n*0\r\n*1\r\n*2\r\n:1000\r\n$2\r\n60\r\n"},
+		{[]string{"TS.MRANGE", "-", "+", "FILTER", "room!=", "room!=kitchen", "type=temp"}, "*2\r\n" +
+			"*3\r\n$10\r\ntemp:attic\r\n*0\r\n*1\r\n*2\r\n:1000\r\n$2\r\n22\r\n" +
+			"*3\r\n$9\r\ntemp:hall\r\n*0\r\n*1\r\n*2\r\n:1000\r\n$2\r\n21\r\n"},
+		{[]string{"TS.MRANGE", "-", "+", "FILTER", "=x"}, "-ERR TSDB: failed parsing labels\r\n"},
+		{[]string{"TS.MRANGE", "-", "+", "COUNT", "1"}, "-ERR TSDB: missing FILTER argument\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
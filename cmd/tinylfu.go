@@ -0,0 +1,350 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// W-TinyLFU tuning
+const (
+	tinyLFUCounters       = 1024 // Frequency counters per shard, a power of two
+	tinyLFUWindowPercent  = 1    // Share of a shard's budget kept for the window
+	tinyLFUProtectPercent = 80   // Share of the main region kept for the protected segment
+)
+
+// Segments of a W-TinyLFU shard
+const (
+	segmentWindow = iota
+	segmentCandidate
+	segmentProbation
+	segmentProtected
+)
+
+// frequencySketch is a count-min sketch of 4-bit counters used to estimate
+// how often keys were accessed recently. A doorkeeper bloom filter absorbs
+// the first access of every key so that one-hit wonders do not pollute the
+// counters, and everything is halved once sampleSize accesses were counted
+// so that old popularity fades.
+type frequencySketch struct {
+	table      []uint64 // 16 counters per word
+	doorkeeper []uint64
+	additions  int
+	sampleSize int
+}
+
+// newFrequencySketch allocates a sketch with the given number of counters
+// per row
+func newFrequencySketch(counters int) *frequencySketch {
+	return &frequencySketch{
+		table:      make([]uint64, counters/16),
+		doorkeeper: make([]uint64, counters/64),
+		sampleSize: 10 * counters,
+	}
+}
+
+// counterIndex returns the counter of row i for the hash
+func (f *frequencySketch) counterIndex(hash uint64, i int) uint64 {
+	h := (hash + uint64(i)*0x9e3779b97f4a7c15) * 0xbf58476d1ce4e5b9
+	h ^= h >> 31
+	return h & uint64(len(f.table)*16-1)
+}
+
+// doorkeeperBits returns the two doorkeeper bits of the hash
+func (f *frequencySketch) doorkeeperBits(hash uint64) (uint64, uint64) {
+	n := uint64(len(f.doorkeeper) * 64)
+	return hash % n, (hash >> 32) % n
+}
+
+// Increment counts an access of the hashed key
+func (f *frequencySketch) Increment(hash uint64) {
+	b1, b2 := f.doorkeeperBits(hash)
+	if f.doorkeeper[b1/64]&(1<<(b1%64)) == 0 || f.doorkeeper[b2/64]&(1<<(b2%64)) == 0 {
+		f.doorkeeper[b1/64] |= 1 << (b1 % 64)
+		f.doorkeeper[b2/64] |= 1 << (b2 % 64)
+	} else {
+		for i := 0; i < 4; i++ {
+			idx := f.counterIndex(hash, i)
+			shift := (idx % 16) * 4
+			if (f.table[idx/16]>>shift)&0xf < 15 {
+				f.table[idx/16] += 1 << shift
+			}
+		}
+	}
+
+	f.additions++
+	if f.additions >= f.sampleSize {
+		f.reset()
+	}
+}
+
+// Frequency returns the estimated recent access count of the hashed key
+func (f *frequencySketch) Frequency(hash uint64) int {
+	freq := 15
+	for i := 0; i < 4; i++ {
+		idx := f.counterIndex(hash, i)
+		freq = min(freq, int((f.table[idx/16]>>((idx%16)*4))&0xf))
+	}
+	b1, b2 := f.doorkeeperBits(hash)
+	if f.doorkeeper[b1/64]&(1<<(b1%64)) != 0 && f.doorkeeper[b2/64]&(1<<(b2%64)) != 0 {
+		freq++
+	}
+	return freq
+}
+
+// reset halves every counter and clears the doorkeeper
+func (f *frequencySketch) reset() {
+	for i := range f.table {
+		f.table[i] = (f.table[i] >> 1) & 0x7777777777777777
+	}
+	clear(f.doorkeeper)
+	f.additions /= 2
+}
+
+// tinyLFUNode is a key tracked by the admission policy
+type tinyLFUNode struct {
+	key     string
+	hash    uint64
+	size    int64
+	segment int
+}
+
+// tinyLFU is the W-TinyLFU admission state of one shard. New keys enter a
+// small LRU window. Keys falling out of the window while memory is full
+// become candidates, and a candidate only enters the main region once the
+// sketch says it is more popular than the key the eviction policy would
+// evict in its place. The main region is a segmented LRU whose probation
+// segment holds keys seen once and whose protected segment holds keys
+// accessed again; the policy looks for victims in probation first.
+type tinyLFU struct {
+	mu        sync.Mutex
+	segments  [4]*list.List // Front is most recently used
+	bytes     [4]int64
+	nodes     map[string]*list.Element
+	sketch    *frequencySketch
+	windowCap int64
+	protected int64 // Capacity of the protected segment
+}
+
+// newTinyLFU creates the admission state of a shard with a budget in bytes
+func newTinyLFU(capacity int64) *tinyLFU {
+	t := &tinyLFU{
+		nodes:  make(map[string]*list.Element),
+		sketch: newFrequencySketch(tinyLFUCounters),
+	}
+	for i := range t.segments {
+		t.segments[i] = list.New()
+	}
+	t.resize(capacity)
+	return t
+}
+
+// resize changes the budget of the shard. Keys that no longer fit in the
+// window or the protected segment move to probation, and the sketch keeps
+// what it learned. t.mu must be held.
+func (t *tinyLFU) resize(capacity int64) {
+	t.windowCap = capacity * tinyLFUWindowPercent / 100
+	t.protected = (capacity - t.windowCap) * tinyLFUProtectPercent / 100
+	t.shrink(segmentWindow, t.windowCap, segmentProbation)
+	t.shrink(segmentProtected, t.protected, segmentProbation)
+}
+
+// shrink moves the least recently used keys of a segment to the front of
+// another one until it fits in capacity. The newest key always stays.
+func (t *tinyLFU) shrink(segment int, capacity int64, to int) {
+	l := t.segments[segment]
+	for t.bytes[segment] > capacity && l.Len() > 1 {
+		t.moveTo(l.Back(), to)
+	}
+}
+
+// tinyLFUHash hashes a key for the sketch
+func tinyLFUHash(key string) uint64 {
+	return murmurHash64A([]byte(key), 0x2f0d3c5b)
+}
+
+// moveTo moves a tracked key to the front of a segment
+func (t *tinyLFU) moveTo(e *list.Element, segment int) *list.Element {
+	n := e.Value.(*tinyLFUNode)
+	if n.segment == segment {
+		t.segments[segment].MoveToFront(e)
+		return e
+	}
+	t.segments[n.segment].Remove(e)
+	t.bytes[n.segment] -= n.size
+	n.segment = segment
+	t.bytes[segment] += n.size
+	e = t.segments[segment].PushFront(n)
+	t.nodes[n.key] = e
+	return e
+}
+
+// access records a read of key. Reads only hold the shard's read lock, so
+// like a lossy read buffer the access is dropped when another reader is
+// updating the policy at the same time.
+func (t *tinyLFU) access(key string) {
+	if !t.mu.TryLock() {
+		return
+	}
+	t.touch(key)
+	t.mu.Unlock()
+}
+
+// touch counts an access and promotes the key. t.mu must be held.
+func (t *tinyLFU) touch(key string) {
+	e, ok := t.nodes[key]
+	if !ok {
+		return
+	}
+	n := e.Value.(*tinyLFUNode)
+	t.sketch.Increment(n.hash)
+
+	if n.segment == segmentProbation {
+		t.moveTo(e, segmentProtected)
+		t.shrink(segmentProtected, t.protected, segmentProbation)
+	} else {
+		t.moveTo(e, n.segment)
+	}
+}
+
+// store records that key was written with the given size. Keys falling out
+// of the window become candidates if memory is full and enter probation
+// otherwise.
+func (t *tinyLFU) store(key string, size int64, full bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.nodes[key]; ok {
+		n := e.Value.(*tinyLFUNode)
+		t.bytes[n.segment] += size - n.size
+		n.size = size
+	} else {
+		t.add(key, size, segmentWindow)
+	}
+
+	to := segmentProbation
+	if full {
+		to = segmentCandidate
+	}
+	t.shrink(segmentWindow, t.windowCap, to)
+}
+
+// add starts tracking key in a segment and counts it in the sketch. t.mu
+// must be held.
+func (t *tinyLFU) add(key string, size int64, segment int) {
+	n := &tinyLFUNode{key: key, hash: tinyLFUHash(key), size: size, segment: segment}
+	t.nodes[key] = t.segments[segment].PushFront(n)
+	t.bytes[segment] += size
+	t.sketch.Increment(n.hash)
+}
+
+// remove stops tracking key. t.mu must be held.
+func (t *tinyLFU) remove(key string) {
+	if e, ok := t.nodes[key]; ok {
+		n := e.Value.(*tinyLFUNode)
+		t.segments[n.segment].Remove(e)
+		t.bytes[n.segment] -= n.size
+		delete(t.nodes, key)
+	}
+}
+
+// inProbation reports whether key is in the probation segment. t.mu must
+// be held.
+func (t *tinyLFU) inProbation(key string) bool {
+	e, ok := t.nodes[key]
+	return ok && e.Value.(*tinyLFUNode).segment == segmentProbation
+}
+
+// victim picks the key of the shard to evict. The policy chooses among the
+// probation segment and the newest candidate duels with its choice: the
+// one the sketch finds less popular is evicted, ties going against the
+// candidate, and a winning candidate enters probation. rejected reports
+// whether a candidate lost. t.mu and the shard's write lock must be held.
+func (t *tinyLFU) victim(shard *CacheShard, policy EvictionPolicy) (key string, rejected, ok bool) {
+	key, ok = sampleVictim(shard, policy, t.inProbation)
+	e := t.segments[segmentCandidate].Front()
+	if e == nil {
+		return key, false, ok
+	}
+	candidate := e.Value.(*tinyLFUNode)
+	switch {
+	case policy.volatile() && shard.data[candidate.key].ExpireAt == 0:
+		// The policy may not evict the candidate, so it is let in
+		t.moveTo(e, segmentProbation)
+		return key, false, ok
+	case !ok || t.sketch.Frequency(candidate.hash) <= t.sketch.Frequency(tinyLFUHash(key)):
+		return candidate.key, true, true
+	}
+	t.moveTo(e, segmentProbation)
+	return key, false, true
+}
+
+// admitCandidates settles the keys that left the shard's window while
+// memory is full: each one duels with the victim of the eviction policy
+// and the loser is evicted, until memory is under limit again or no
+// candidate is left. The shard's write lock must be held.
+func (c *Cache) admitCandidates(shard *CacheShard, limit int64, policy EvictionPolicy) {
+	a := shard.admission
+	for policy != PolicyNoEviction && atomic.LoadInt64(&c.stats.UsedMemory) > limit {
+		a.mu.Lock()
+		key, rejected, ok := "", false, false
+		if a.segments[segmentCandidate].Len() > 0 {
+			key, rejected, ok = a.victim(shard, policy)
+		}
+		a.mu.Unlock()
+		if !ok {
+			return
+		}
+
+		c.removeEntry(shard, key)
+		c.notify(notifyEvicted, "evicted", key)
+		atomic.AddUint64(&c.stats.MemoryEvictions, 1)
+		if rejected {
+			atomic.AddUint64(&c.stats.AdmissionRejects, 1)
+		}
+	}
+}
+
+// admissionName returns the configuration name of the admission filter
+func admissionName(enabled bool) string {
+	if enabled {
+		return "tinylfu"
+	}
+	return "none"
+}
+
+// SetAdmission turns the W-TinyLFU admission filter in front of the
+// eviction policy on or off. Keys already stored start out in the
+// probation segment; turning it on while it is on keeps its state.
+func (c *Cache) SetAdmission(enabled bool) {
+	c.admission.Store(enabled)
+	limit, _ := c.MaxMemory()
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		switch {
+		case !enabled:
+			shard.admission = nil
+		case shard.admission == nil:
+			a := newTinyLFU(limit / int64(len(c.shards)))
+			for k, entry := range shard.data {
+				a.add(k, entry.meta.size, segmentProbation)
+			}
+			shard.admission = a
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// resizeAdmission gives the admission state of every shard its share of a
+// new memory limit
+func (c *Cache) resizeAdmission(limit int64) {
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		if a := shard.admission; a != nil {
+			a.mu.Lock()
+			a.resize(limit / int64(len(c.shards)))
+			a.mu.Unlock()
+		}
+		shard.mu.Unlock()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	f := newFrequencySketch(tinyLFUCounters)
+	hot, cold := tinyLFUHash("hot"), tinyLFUHash("cold")
+	if got := f.Frequency(hot); got != 0 {
+		t.Fatalf("unseen key has frequency %d", got)
+	}
+	f.Increment(cold)
+	if got := f.Frequency(cold); got != 1 {
+		t.Fatalf("after one access the doorkeeper gives %d, want 1", got)
+	}
+	for i := 0; i < 8; i++ {
+		f.Increment(hot)
+	}
+	if got := f.Frequency(hot); got != 8 {
+		t.Fatalf("after 8 accesses frequency is %d, want 8", got)
+	}
+	f.reset()
+	if got := f.Frequency(hot); got != 3 {
+		t.Fatalf("after aging frequency is %d, want 3", got)
+	}
+	if got := f.Frequency(cold); got != 0 {
+		t.Fatalf("aging kept the doorkeeper, frequency is %d", got)
+	}
+}
+
+// fillCache configures a cache that holds about n small keys
+func fillCache(t *testing.T, n int, policy, admission string) *Cache {
+	c := newTestCache(t)
+	c.ApplyConfig(DefaultConfig())
+	limit := strconv.FormatInt(int64(n)*entrySize("key:00000", CacheEntry{Value: "v"}), 10)
+	if got := executeCommand(c, []string{"CONFIG", "SET", "maxmemory", limit, "maxmemory-policy", policy, "maxmemory-admission", admission}); got != respOK() {
+		t.Fatalf("CONFIG SET = %q", got)
+	}
+	return c
+}
+
+func TestAdmissionKeepsHotKeys(t *testing.T) {
+	for _, admission := range []string{"none", "tinylfu"} {
+		c := fillCache(t, 20000, "allkeys-lru", admission)
+		for i := 0; i < 200; i++ {
+			executeCommand(c, []string{"SET", "hot:" + strconv.Itoa(i), "v"})
+		}
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 200; i++ {
+				executeCommand(c, []string{"GET", "hot:" + strconv.Itoa(i)})
+			}
+		}
+		for i := 0; i < 100000; i++ {
+			executeCommand(c, []string{"SET", "scan:" + strconv.Itoa(i), "v"})
+		}
+
+		kept := 0
+		for i := 0; i < 200; i++ {
+			if _, exists := c.Get("hot:" + strconv.Itoa(i)); exists {
+				kept++
+			}
+		}
+		stats := c.GetStats()
+		switch admission {
+		case "none":
+			if kept > 20 || stats.AdmissionRejects != 0 {
+				t.Fatalf("without admission a scan kept %d of 200 hot keys and rejected %d keys", kept, stats.AdmissionRejects)
+			}
+		case "tinylfu":
+			if kept < 190 || stats.AdmissionRejects == 0 {
+				t.Fatalf("with admission a scan kept %d of 200 hot keys and rejected %d keys", kept, stats.AdmissionRejects)
+			}
+		}
+	}
+}
+
+func TestAdmissionFollowsVolatilePolicy(t *testing.T) {
+	c := fillCache(t, 500, "volatile-lru", "tinylfu")
+	for i := 0; i < 300; i++ {
+		executeCommand(c, []string{"SET", "ttl:" + strconv.Itoa(i), "v", "EX", "1000"})
+	}
+	oom := false
+	for i := 0; i < 2000 && !oom; i++ {
+		oom = executeCommand(c, []string{"SET", "key:" + strconv.Itoa(i), "v"}) == errOOM
+	}
+	if !oom {
+		t.Fatal("writes never failed although only keys with a TTL may be evicted")
+	}
+	for i := 0; i < 2000; i++ {
+		if entry, exists := c.Lookup("key:" + strconv.Itoa(i)); !exists {
+			break
+		} else if entry.ExpireAt != 0 {
+			t.Fatal("key without a TTL got one")
+		}
+	}
+	keys, expires := c.KeyCounts()
+	if expires != 0 || c.GetStats().MemoryEvictions != 300 {
+		t.Fatalf("%d keys with a TTL are left and %d keys were evicted, want 0 and 300 (%d keys)", expires, c.GetStats().MemoryEvictions, keys)
+	}
+}
+
+func TestAdmissionResize(t *testing.T) {
+	c := fillCache(t, 10000, "allkeys-lfu", "tinylfu")
+	executeCommand(c, []string{"SET", "hot", "v"})
+	for i := 0; i < 10; i++ {
+		executeCommand(c, []string{"GET", "hot"})
+	}
+	shard := c.getShard("hot")
+	a := shard.admission
+	freq := a.sketch.Frequency(tinyLFUHash("hot"))
+	windowCap := a.windowCap
+
+	executeCommand(c, []string{"CONFIG", "SET", "maxmemory", "100mb"})
+	if shard.admission != a {
+		t.Fatal("changing maxmemory rebuilt the admission state")
+	}
+	if got := a.sketch.Frequency(tinyLFUHash("hot")); got != freq {
+		t.Fatalf("changing maxmemory reset the sketch, frequency %d, want %d", got, freq)
+	}
+	if want := int64(100<<20) / int64(len(c.shards)) * tinyLFUWindowPercent / 100; a.windowCap != want || a.windowCap == windowCap {
+		t.Fatalf("window capacity is %d, want %d", a.windowCap, want)
+	}
+
+	// Switching the policy keeps the filter as well
+	executeCommand(c, []string{"CONFIG", "SET", "maxmemory-policy", "volatile-ttl"})
+	if shard.admission != a {
+		t.Fatal("changing the policy rebuilt the admission state")
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CONFIG", "GET", "maxmemory-admission"}, "*2\r\n$19\r\nmaxmemory-admission\r\n$7\r\ntinylfu\r\n"},
+		{[]string{"CONFIG", "SET", "maxmemory-admission", "lru"}, "-ERR CONFIG SET failed (possibly related to argument 'maxmemory-admission') - must be none or tinylfu\r\n"},
+		{[]string{"CONFIG", "SET", "maxmemory-admission", "none"}, "+OK\r\n"},
+		{[]string{"CONFIG", "GET", "maxmemory-admission"}, "*2\r\n$19\r\nmaxmemory-admission\r\n$4\r\nnone\r\n"},
+	}
+	for _, tt := range tests {
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if shard.admission != nil {
+		t.Fatal("the admission state was kept after turning the filter off")
+	}
+}
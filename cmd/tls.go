@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// TLSReloadPeriod is how often the certificate files are checked for changes
+const TLSReloadPeriod = 5 * time.Second
+
+// TLSOptions configures TLS for the TCP and web servers
+type TLSOptions struct {
+	CertFile    string // Server certificate chain in PEM
+	KeyFile     string // Private key of the certificate in PEM
+	CACertFile  string // CAs that client certificates are verified against
+	AuthClients string // no, optional or yes: whether clients must present a certificate
+}
+
+// tlsMaterial is one loaded version of the certificate files
+type tlsMaterial struct {
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes [3]time.Time
+}
+
+// tlsReloader serves the certificates of TLSOptions and reloads them when
+// the files change, so certificates can be rotated without a restart
+type tlsReloader struct {
+	opts    TLSOptions
+	current atomic.Pointer[tlsMaterial]
+}
+
+// NewTLSConfig loads the certificate files and returns a configuration that
+// picks up changes to them. Connections that are already open keep the
+// certificate they were made with.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	clientAuth := tls.NoClientCert
+	switch opts.AuthClients {
+	case "", "no":
+	case "optional":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "yes":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls-auth-clients must be no, optional or yes, not %q", opts.AuthClients)
+	}
+	if clientAuth != tls.NoClientCert && opts.CACertFile == "" {
+		return nil, fmt.Errorf("tls-auth-clients %s needs tls-ca-cert-file", opts.AuthClients)
+	}
+
+	r := &tlsReloader{opts: opts}
+	material, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(material)
+	go r.watch()
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuth,
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		m := r.current.Load()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*m.cert}
+		cfg.ClientCAs = m.clientCA
+		return cfg, nil
+	}
+	return base, nil
+}
+
+// modTimes returns the modification times of the certificate files
+func (r *tlsReloader) modTimes() ([3]time.Time, error) {
+	var times [3]time.Time
+	for i, path := range []string{r.opts.CertFile, r.opts.KeyFile, r.opts.CACertFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return times, err
+		}
+		times[i] = info.ModTime()
+	}
+	return times, nil
+}
+
+// load reads the certificate, its key and the client CAs
+func (r *tlsReloader) load() (*tlsMaterial, error) {
+	times, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	material := &tlsMaterial{cert: &cert, modTimes: times}
+
+	if r.opts.CACertFile != "" {
+		pem, err := os.ReadFile(r.opts.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		material.clientCA = x509.NewCertPool()
+		if !material.clientCA.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.opts.CACertFile)
+		}
+	}
+	return material, nil
+}
+
+// watch reloads the files whenever one of them changes
+func (r *tlsReloader) watch() {
+	ticker := time.NewTicker(TLSReloadPeriod)
+	defer ticker.Stop()
+
+	seen := r.current.Load().modTimes
+	for range ticker.C {
+		seen = r.reload(seen)
+	}
+}
+
+// reload loads the files again if their modification times differ from
+// seen and returns the times it found. A change that does not load, such as
+// a certificate written before its key, keeps the old files in use until
+// the next change.
+func (r *tlsReloader) reload(seen [3]time.Time) [3]time.Time {
+	times, err := r.modTimes()
+	if err != nil || times == seen {
+		return seen
+	}
+	material, err := r.load()
+	if err != nil {
+		logf(logWarning, "Failed reloading TLS certificates: %v", err)
+		return times
+	}
+	r.current.Store(material)
+	logf(logNotice, "Reloaded TLS certificates from %s", r.opts.CertFile)
+	return times
+}
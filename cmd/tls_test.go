@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate with its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, _ := x509.MarshalECPrivateKey(c.key)
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsKey returns the certificate as used by a TLS client
+func (c *testCert) tlsKey() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// handshake connects a client to a server over a pipe and returns the
+// error seen by the server
+func handshake(server, client *tls.Config) error {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		tlsConn := tls.Client(clientConn, client)
+		err := tlsConn.Handshake()
+		if err == nil {
+			// TLS 1.3 servers verify the client after the client is done
+			tlsConn.Read(make([]byte, 1))
+		}
+		done <- err
+	}()
+	err := tls.Server(serverConn, server).Handshake()
+	serverConn.Close()
+	<-done
+	return err
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("no certificates here"), 0o600)
+
+	tests := []struct {
+		name string
+		opts TLSOptions
+		want string
+	}{
+		{"bad auth clients", TLSOptions{CertFile: certFile, KeyFile: keyFile, AuthClients: "maybe"}, `tls-auth-clients must be no, optional or yes, not "maybe"`},
+		{"client auth without CA", TLSOptions{CertFile: certFile, KeyFile: keyFile, AuthClients: "yes"}, "tls-auth-clients yes needs tls-ca-cert-file"},
+		{"missing key", TLSOptions{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.key")}, "stat " + filepath.Join(dir, "missing.key") + ": no such file or directory"},
+		{"key of the certificate", TLSOptions{CertFile: certFile, KeyFile: certFile}, "tls: found a certificate rather than a key in the PEM for the private key"},
+		{"empty CA file", TLSOptions{CertFile: certFile, KeyFile: keyFile, CACertFile: empty, AuthClients: "yes"}, "no certificates found in " + empty},
+	}
+	for _, tt := range tests {
+		if _, err := NewTLSConfig(tt.opts); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: NewTLSConfig = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	trusted := newTestCert(t, "client", ca).tlsKey()
+	untrusted := newTestCert(t, "client", newTestCert(t, "other ca", nil)).tlsKey()
+
+	tests := []struct {
+		authClients string
+		clientCert  *tls.Certificate
+		ok          bool
+	}{
+		{"no", nil, true},
+		{"no", &untrusted, true},
+		{"optional", nil, true},
+		{"optional", &trusted, true},
+		{"optional", &untrusted, false},
+		{"yes", nil, false},
+		{"yes", &trusted, true},
+		{"yes", &untrusted, false},
+	}
+	for _, tt := range tests {
+		server, err := NewTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, CACertFile: caFile, AuthClients: tt.authClients})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if tt.clientCert != nil {
+			// Send the certificate even if the server does not list its CA
+			clientCert := tt.clientCert
+			client.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return clientCert, nil
+			}
+		}
+		if err := handshake(server, client); (err == nil) != tt.ok {
+			t.Errorf("tls-auth-clients %s with client certificate %v: handshake error %v", tt.authClients, tt.clientCert != nil, err)
+		}
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "first", ca)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	r := &tlsReloader{opts: TLSOptions{CertFile: certFile, KeyFile: keyFile}}
+	material, err := r.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.current.Store(material)
+	seen := r.reload(material.modTimes)
+	if r.current.Load() != material {
+		t.Fatal("unchanged files were loaded again")
+	}
+
+	// A certificate written before its key does not load and is skipped
+	second := newTestCert(t, "second", ca)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.der}), 0o600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	seen = r.reload(seen)
+	if r.current.Load() != material {
+		t.Fatal("a certificate that does not match its key was loaded")
+	}
+
+	second.write(t, dir, "server")
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	r.reload(seen)
+	if got := r.current.Load().cert.Leaf; got == nil || got.Subject.CommonName != "second" {
+		t.Fatalf("after rotation the certificate is %v, want second", got)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+)
+
+// Defaults for TOPK.RESERVE when only k is given
+const (
+	TopKDefaultWidth = 8
+	TopKDefaultDepth = 7
+	TopKDefaultDecay = 0.9
+)
+
+func init() {
+	registerCommand("TOPK.RESERVE", -3, flagWrite|flagDenyOOM, topkReserveCommand)
+	registerCommand("TOPK.ADD", -3, flagWrite|flagDenyOOM, topkAddCommand)
+	registerCommand("TOPK.INCRBY", -4, flagWrite|flagDenyOOM, topkAddCommand)
+	registerCommand("TOPK.QUERY", -3, flagReadOnly, topkQueryCommand)
+	registerCommand("TOPK.COUNT", -3, flagReadOnly, topkQueryCommand)
+	registerCommand("TOPK.LIST", -2, flagReadOnly, topkListCommand)
+	registerCommand("TOPK.INFO", 2, flagReadOnly, topkInfoCommand)
+}
+
+// heavyKeeperBucket is a counter owned by the item with the fingerprint
+type heavyKeeperBucket struct {
+	fp    uint32
+	count uint64
+}
+
+// topKItem is an entry of the list of heavy hitters
+type topKItem struct {
+	item  string
+	count uint64
+}
+
+// topK tracks the k most frequent items of a stream with the HeavyKeeper
+// algorithm: every row has one bucket per item hash, and a colliding item
+// decays the bucket's count with a probability that falls exponentially as
+// the count grows, so that large counts belong to genuinely frequent items
+type topK struct {
+	buckets []heavyKeeperBucket // depth rows of width buckets
+	width   uint64
+	depth   uint64
+	decay   float64
+	k       int
+	heap    []topKItem // The current top items, unordered
+}
+
+// newTopK creates an empty structure
+func newTopK(k int, width, depth uint64, decay float64) *topK {
+	return &topK{
+		buckets: make([]heavyKeeperBucket, width*depth),
+		width:   width,
+		depth:   depth,
+		decay:   decay,
+		k:       k,
+	}
+}
+
+// Type implements Object
+func (t *topK) Type() string {
+	return "topk"
+}
+
+// String implements Object
+func (t *topK) String() string {
+	var top []string
+	for _, it := range t.List() {
+		top = append(top, fmt.Sprintf("%s (%d)", it.item, it.count))
+	}
+	return fmt.Sprintf("top-%d: %s", t.k, strings.Join(top, ", "))
+}
+
+// MemoryUsage implements memoryUser
+func (t *topK) MemoryUsage() int64 {
+	size := int64(len(t.buckets)) * 16
+	for _, it := range t.heap {
+		size += int64(len(it.item)) + 24
+	}
+	return size
+}
+
+// topKFingerprint returns the fingerprint stored in buckets for item
+func topKFingerprint(item string) uint32 {
+	return uint32(murmurHash64A([]byte(item), 0x5bd1e995))
+}
+
+// find returns the position of item in the heap or -1
+func (t *topK) find(item string) int {
+	for i := range t.heap {
+		if t.heap[i].item == item {
+			return i
+		}
+	}
+	return -1
+}
+
+// IncrBy counts n occurrences of item. If item enters the list and pushes
+// another item out the expelled item is returned.
+func (t *topK) IncrBy(item string, n uint64) (string, bool) {
+	fp := topKFingerprint(item)
+
+	var maxCount uint64
+	for row := uint64(0); row < t.depth; row++ {
+		b := &t.buckets[row*t.width+murmurHash64A([]byte(item), row)%t.width]
+		switch {
+		case b.count == 0:
+			b.fp, b.count = fp, n
+		case b.fp == fp:
+			b.count = satAdd(b.count, n)
+		default:
+			for remaining := n; remaining > 0; remaining-- {
+				if rand.Float64() < math.Pow(t.decay, float64(b.count)) {
+					b.count--
+					if b.count == 0 {
+						b.fp, b.count = fp, remaining
+						break
+					}
+				}
+			}
+		}
+		if b.fp == fp {
+			maxCount = max(maxCount, b.count)
+		}
+	}
+
+	if i := t.find(item); i >= 0 {
+		t.heap[i].count = max(t.heap[i].count, maxCount)
+		return "", false
+	}
+	if len(t.heap) < t.k {
+		if maxCount > 0 {
+			t.heap = append(t.heap, topKItem{item: item, count: maxCount})
+		}
+		return "", false
+	}
+
+	lowest := 0
+	for i := range t.heap {
+		if t.heap[i].count < t.heap[lowest].count {
+			lowest = i
+		}
+	}
+	if maxCount <= t.heap[lowest].count {
+		return "", false
+	}
+	expelled := t.heap[lowest].item
+	t.heap[lowest] = topKItem{item: item, count: maxCount}
+	return expelled, true
+}
+
+// Count returns the estimated count of item
+func (t *topK) Count(item string) uint64 {
+	fp := topKFingerprint(item)
+	var count uint64
+	for row := uint64(0); row < t.depth; row++ {
+		b := t.buckets[row*t.width+murmurHash64A([]byte(item), row)%t.width]
+		if b.fp == fp {
+			count = max(count, b.count)
+		}
+	}
+	return count
+}
+
+// List returns the top items, most frequent first
+func (t *topK) List() []topKItem {
+	list := append([]topKItem(nil), t.heap...)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].count != list[j].count {
+			return list[i].count > list[j].count
+		}
+		return list[i].item < list[j].item
+	})
+	return list
+}
+
+// topkReserveCommand implements TOPK.RESERVE key topk [width depth decay]
+func topkReserveCommand(c *Cache, args []string) string {
+	k, ok := parseInt(args[2])
+	if !ok || k <= 0 || k > 1<<20 {
+		return respError("TopK: invalid k")
+	}
+
+	width, depth, decay := int64(TopKDefaultWidth), int64(TopKDefaultDepth), TopKDefaultDecay
+	switch len(args) {
+	case 3:
+	case 6:
+		var ok1, ok2, ok3 bool
+		width, ok1 = parseInt(args[3])
+		depth, ok2 = parseInt(args[4])
+		decay, ok3 = parseFloat(args[5])
+		if !ok1 || !ok2 || width <= 0 || depth <= 0 || width > 1<<26/depth {
+			return respError("TopK: invalid width/depth")
+		}
+		if !ok3 || decay <= 0 || decay > 1 {
+			return respError("TopK: decay must be between 0 and 1")
+		}
+	default:
+		return respError(errSyntax)
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if exists {
+			reply = respError("TopK: key already exists")
+			return updateNone
+		}
+		entry.Object = newTopK(int(k), uint64(width), uint64(depth), decay)
+		reply = respOK()
+		return updateStore
+	})
+	return reply
+}
+
+// topkAddCommand implements TOPK.ADD key item [item ...] and TOPK.INCRBY
+// key item increment [item increment ...]. The reply lists the items that
+// were pushed out of the top list.
+func topkAddCommand(c *Cache, args []string) string {
+	var items []string
+	var increments []uint64
+	if args[0] == "TOPK.INCRBY" {
+		if len(args)%2 != 0 {
+			return respError(errSyntax)
+		}
+		for i := 2; i < len(args); i += 2 {
+			n, ok := parseInt(args[i+1])
+			if !ok || n < 1 || n > 100000 {
+				return respError("TopK: increment must be an integer between 1 and 100000")
+			}
+			items = append(items, args[i])
+			increments = append(increments, uint64(n))
+		}
+	} else {
+		items = args[2:]
+		for range items {
+			increments = append(increments, 1)
+		}
+	}
+
+	var reply string
+	c.Update(args[1], func(entry *CacheEntry, exists bool) int {
+		if !exists {
+			reply = respError("TopK: key does not exist")
+			return updateNone
+		}
+		t, ok := entry.Object.(*topK)
+		if !ok {
+			reply = errWrongType
+			return updateNone
+		}
+
+		expelled := make([]string, 0, len(items))
+		for i, item := range items {
+			if out, ok := t.IncrBy(item, increments[i]); ok {
+				expelled = append(expelled, respBulk(out))
+			} else {
+				expelled = append(expelled, respNil())
+			}
+		}
+		reply = respArray(expelled)
+		return updateStore
+	})
+	return reply
+}
+
+// viewTopK runs fn against the structure stored at key under the shard's
+// read lock
+func viewTopK(c *Cache, key string, fn func(t *topK) string) string {
+	var reply string
+	c.View(key, func(entry CacheEntry, exists bool) {
+		if !exists {
+			reply = respError("TopK: key does not exist")
+			return
+		}
+		t, ok := entry.Object.(*topK)
+		if !ok {
+			reply = errWrongType
+			return
+		}
+		reply = fn(t)
+	})
+	return reply
+}
+
+// topkQueryCommand implements TOPK.QUERY key item [item ...] and
+// TOPK.COUNT key item [item ...]
+func topkQueryCommand(c *Cache, args []string) string {
+	return viewTopK(c, args[1], func(t *topK) string {
+		items := make([]string, 0, len(args)-2)
+		for _, item := range args[2:] {
+			switch {
+			case args[0] == "TOPK.COUNT":
+				items = append(items, respInt(int64(min(t.Count(item), math.MaxInt64))))
+			case t.find(item) >= 0:
+				items = append(items, respInt(1))
+			default:
+				items = append(items, respInt(0))
+			}
+		}
+		return respArray(items)
+	})
+}
+
+// topkListCommand implements TOPK.LIST key [WITHCOUNT]
+func topkListCommand(c *Cache, args []string) string {
+	withCount := false
+	switch {
+	case len(args) == 3 && strings.EqualFold(args[2], "WITHCOUNT"):
+		withCount = true
+	case len(args) != 2:
+		return respError(errSyntax)
+	}
+
+	return viewTopK(c, args[1], func(t *topK) string {
+		var items []string
+		for _, it := range t.List() {
+			items = append(items, respBulk(it.item))
+			if withCount {
+				items = append(items, respInt(int64(min(it.count, math.MaxInt64))))
+			}
+		}
+		return respArray(items)
+	})
+}
+
+// topkInfoCommand implements TOPK.INFO key
+func topkInfoCommand(c *Cache, args []string) string {
+	return viewTopK(c, args[1], func(t *topK) string {
+		return respArray([]string{
+			respSimple("k"), respInt(int64(t.k)),
+			respSimple("width"), respInt(int64(t.width)),
+			respSimple("depth"), respInt(int64(t.depth)),
+			respSimple("decay"), respBulk(formatFloat(t.decay)),
+		})
+	})
+}
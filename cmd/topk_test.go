@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestTopKDimensions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TOPK.RESERVE", "k", "10"}, "+OK\r\n"},
+		{[]string{"TOPK.RESERVE", "k", "10", "1000", "5", "0.9"}, "+OK\r\n"},
+		{[]string{"TOPK.RESERVE", "k", "0"}, "-ERR TopK: invalid k\r\n"},
+		{[]string{"TOPK.RESERVE", "k", "10", "0", "5", "0.9"}, "-ERR TopK: invalid width/depth\r\n"},
+		{[]string{"TOPK.RESERVE", "k", "10", "67108865", "1", "0.9"}, "-ERR TopK: invalid width/depth\r\n"},
+		// The product wraps around to 0 in 64 bits
+		{[]string{"TOPK.RESERVE", "k", "10", "4294967296", "4294967296", "0.9"}, "-ERR TopK: invalid width/depth\r\n"},
+		{[]string{"TOPK.RESERVE", "k", "10", "1000", "5", "1.5"}, "-ERR TopK: decay must be between 0 and 1\r\n"},
+	}
+	for _, tt := range tests {
+		c := newTestCache(t)
+		if got := executeCommand(c, tt.args); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
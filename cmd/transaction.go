@@ -0,0 +1,233 @@
+package main
+
+import "time"
+
+// inlineCommands describes the commands handled by executeCommand itself
+// rather than the command table
+var inlineCommands = map[string]*command{
+	"SET":  {name: "SET", arity: -3, flags: flagWrite | flagDenyOOM},
+	"GET":  {name: "GET", arity: 2, flags: flagReadOnly},
+	"DEL":  {name: "DEL", arity: 2, flags: flagWrite},
+	"PING": {name: "PING", arity: -1},
+	"INFO": {name: "INFO", arity: -1},
+}
+
+// transactionControl holds the commands that run right away inside MULTI
+// instead of being queued
+var transactionControl = map[string]bool{"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true, "UNWATCH": true}
+
+// errExecAbort is returned by EXEC when a command could not be queued
+const errExecAbort = "-EXECABORT Transaction discarded because of previous errors.\r\n"
+
+// keyVersion counts modifications of a watched key
+type keyVersion struct {
+	version  uint64
+	watchers int
+}
+
+// watchedKey is a key watched by a client and the version it had
+type watchedKey struct {
+	key     string
+	version uint64
+}
+
+// bumpVersion records a modification of key if it is watched. The shard's
+// write lock must be held.
+func bumpVersion(shard *CacheShard, key string) {
+	if v := shard.versions[key]; v != nil {
+		v.version++
+	}
+}
+
+// watch starts tracking modifications of key on behalf of cl
+func (c *Cache) watch(cl *client, key string) {
+	shard := c.getShard(key)
+	shard.mu.Lock()
+	if shard.versions == nil {
+		shard.versions = make(map[string]*keyVersion)
+	}
+	v := shard.versions[key]
+	if v == nil {
+		v = &keyVersion{}
+		shard.versions[key] = v
+	}
+	v.watchers++
+	version := v.version
+	shard.mu.Unlock()
+
+	cl.watched = append(cl.watched, watchedKey{key: key, version: version})
+}
+
+// unwatchAll forgets every key watched by cl
+func (c *Cache) unwatchAll(cl *client) {
+	for _, w := range cl.watched {
+		shard := c.getShard(w.key)
+		shard.mu.Lock()
+		if v := shard.versions[w.key]; v != nil {
+			v.watchers--
+			if v.watchers == 0 {
+				delete(shard.versions, w.key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	cl.watched = nil
+}
+
+// watchesIntact reports whether none of the keys watched by cl was modified
+// since it was watched. Keys that expired in the meantime count as modified.
+func (c *Cache) watchesIntact(cl *client) bool {
+	now := time.Now().UnixNano()
+	for _, w := range cl.watched {
+		shard := c.getShard(w.key)
+		shard.mu.RLock()
+		changed := shard.versions[w.key].version != w.version
+		if entry, exists := shard.data[w.key]; exists && entry.ExpireAt > 0 && now > entry.ExpireAt {
+			changed = true
+		}
+		shard.mu.RUnlock()
+		if changed {
+			return false
+		}
+	}
+	return true
+}
+
+// execute runs a command behind the gates of its shards. Most commands
+// share them, scripts hold every gate exclusively and a few run without
+// them so that they get through while a script runs. Once a script exceeds
+// its time limit other commands fail with BUSY, including those already
+// waiting for a gate.
+func (c *Cache) execute(cl *client, args []string) string {
+	flags := 0
+	if cmd, ok := commandTable[args[0]]; ok {
+		flags = cmd.flags
+	}
+	if flags&flagNoGate != 0 {
+		return executeCommand(c, args)
+	}
+	if reply := c.scripts.busy(); reply != "" {
+		return reply
+	}
+
+	exclusive := flags&flagExclusive != 0
+	gates, reply := c.holdGates([][]string{args}, nil, exclusive)
+	if reply != "" {
+		return reply
+	}
+	defer c.unlockGates(gates, exclusive)
+	if exclusive {
+		c.holdAll(cl)
+		defer c.releaseAll()
+	}
+	return executeCommand(c, args)
+}
+
+// queueCommand adds a command to the open transaction of cl. Commands that
+// are unknown, change the connection or have the wrong number of arguments
+// are refused and make EXEC fail.
+func (cl *client) queueCommand(args []string) string {
+	if _, ok := connectionCommands[args[0]]; ok {
+		cl.dirty = true
+		return respError("Command not allowed inside a transaction")
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		cl.dirty = true
+		return respError("unknown command '" + args[0] + "'")
+	}
+	if cmd.flags&flagNoMulti != 0 {
+		cl.dirty = true
+		return respError("Command not allowed inside a transaction")
+	}
+	if reply := checkArity(cmd, args); reply != "" {
+		cl.dirty = true
+		return reply
+	}
+	cl.commands = append(cl.commands, args)
+	return respSimple("QUEUED")
+}
+
+// discard closes the open transaction of cl and forgets its watched keys
+func (c *Cache) discard(cl *client) {
+	cl.multi, cl.dirty, cl.commands = false, false, nil
+	c.unwatchAll(cl)
+}
+
+// transactionCommand implements MULTI, EXEC, DISCARD, WATCH key [key ...]
+// and UNWATCH. EXEC holds the gates of the shards of its keys and watched
+// keys exclusively, so no other command uses those shards until the whole
+// transaction has been applied.
+func transactionCommand(c *Cache, cl *client, args []string) string {
+	switch args[0] {
+	case "MULTI":
+		if cl.multi {
+			return respError("MULTI calls can not be nested")
+		}
+		cl.multi = true
+		return respOK()
+
+	case "DISCARD":
+		if !cl.multi {
+			return respError("DISCARD without MULTI")
+		}
+		c.discard(cl)
+		return respOK()
+
+	case "WATCH":
+		if cl.multi {
+			return respError("WATCH inside MULTI is not allowed")
+		}
+		if len(args) < 2 {
+			return respError("wrong number of arguments for 'watch' command")
+		}
+		for _, key := range args[1:] {
+			c.watch(cl, key)
+		}
+		return respOK()
+
+	case "UNWATCH":
+		c.unwatchAll(cl)
+		return respOK()
+	}
+
+	// EXEC
+	if !cl.multi {
+		return respError("EXEC without MULTI")
+	}
+	defer c.discard(cl)
+	if cl.dirty {
+		return errExecAbort
+	}
+
+	if reply := c.scripts.busy(); reply != "" {
+		return reply
+	}
+	watched := make([]string, len(cl.watched))
+	for i, w := range cl.watched {
+		watched[i] = w.key
+	}
+	gates, reply := c.holdGates(cl.commands, watched, true)
+	if reply != "" {
+		return reply
+	}
+	defer c.unlockGates(gates, true)
+	// Scripts in the transaction run as its client, which is only safe to
+	// record while every gate is held
+	if len(gates) == len(c.shards) {
+		c.holdAll(cl)
+		defer c.releaseAll()
+	}
+
+	if !c.watchesIntact(cl) {
+		return respNilArray()
+	}
+	replies := make([]string, len(cl.commands))
+	for i, args := range cl.commands {
+		start := time.Now()
+		replies[i] = executeCommand(c, args)
+		c.commandStats.record(args[0], time.Since(start), replies[i])
+		c.monitors.feed(start, args, cl.conn.RemoteAddr().String())
+	}
+	return respArray(replies)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// transact runs MULTI, queues commands and returns the reply of EXEC
+func transact(t *testing.T, c *Cache, cl *client, commands ...[]string) string {
+	t.Helper()
+	if got := transactionCommand(c, cl, []string{"MULTI"}); got != respOK() {
+		t.Fatalf("MULTI = %q", got)
+	}
+	for _, args := range commands {
+		if got := cl.queueCommand(args); got != respSimple("QUEUED") {
+			return got
+		}
+	}
+	return transactionCommand(c, cl, []string{"EXEC"})
+}
+
+func TestExecWithWatch(t *testing.T) {
+	c := newTestCache(t)
+	cl, other := testClient(t, c), testClient(t, c)
+	executeCommand(c, []string{"SET", "k", "1"})
+
+	// Untouched watched keys let the transaction through
+	transactionCommand(c, cl, []string{"WATCH", "k"})
+	got := transact(t, c, cl, []string{"SET", "k", "2"}, []string{"SET", "j", "3"}, []string{"GET", "k"})
+	if want := respArray([]string{"OK\r\n", "OK\r\n", "2\r\n"}); got != want {
+		t.Fatalf("EXEC = %q, want %q", got, want)
+	}
+
+	// A write by another client aborts it
+	transactionCommand(c, cl, []string{"WATCH", "k"})
+	c.execute(other, []string{"SET", "k", "other"})
+	if got := transact(t, c, cl, []string{"SET", "k", "3"}); got != respNilArray() {
+		t.Fatalf("EXEC after a watched key changed = %q, want a nil array", got)
+	}
+	if v, _ := c.Get("k"); v != "other" {
+		t.Fatalf("k = %q, want other", v)
+	}
+
+	// EXEC forgets the watched keys, so the next transaction goes through
+	c.execute(other, []string{"SET", "k", "again"})
+	if got := transact(t, c, cl, []string{"SET", "k", "4"}); got != respArray([]string{"OK\r\n"}) {
+		t.Fatalf("EXEC without watches = %q", got)
+	}
+
+	// Deleting and expiring a watched key count as changes
+	transactionCommand(c, cl, []string{"WATCH", "k"})
+	c.execute(other, []string{"DEL", "k"})
+	if got := transact(t, c, cl, []string{"SET", "k", "5"}); got != respNilArray() {
+		t.Fatalf("EXEC after a watched key was deleted = %q, want a nil array", got)
+	}
+	executeCommand(c, []string{"SET", "t", "1", "PX", "1"})
+	transactionCommand(c, cl, []string{"WATCH", "t"})
+	time.Sleep(10 * time.Millisecond)
+	if got := transact(t, c, cl, []string{"SET", "k", "6"}); got != respNilArray() {
+		t.Fatalf("EXEC after a watched key expired = %q, want a nil array", got)
+	}
+
+	// UNWATCH drops the watches
+	transactionCommand(c, cl, []string{"WATCH", "k"})
+	c.execute(other, []string{"SET", "k", "7"})
+	transactionCommand(c, cl, []string{"UNWATCH"})
+	if got := transact(t, c, cl, []string{"SET", "k", "8"}); got != respArray([]string{"OK\r\n"}) {
+		t.Fatalf("EXEC after UNWATCH = %q", got)
+	}
+}
+
+func TestExecAbort(t *testing.T) {
+	c := newTestCache(t)
+	cl := testClient(t, c)
+	transactionCommand(c, cl, []string{"MULTI"})
+	cl.queueCommand([]string{"SET", "k", "1"})
+	if got := cl.queueCommand([]string{"NOPE"}); got != respError("unknown command 'NOPE'") {
+		t.Fatalf("queueing an unknown command = %q", got)
+	}
+	if got := transactionCommand(c, cl, []string{"EXEC"}); got != errExecAbort {
+		t.Fatalf("EXEC = %q, want EXECABORT", got)
+	}
+	if _, exists := c.Get("k"); exists {
+		t.Fatal("an aborted transaction wrote a key")
+	}
+}
+
+func TestExecWithScriptAndWatch(t *testing.T) {
+	c := newTestCache(t)
+	cl, other := testClient(t, c), testClient(t, c)
+	transactionCommand(c, cl, []string{"WATCH", "k"})
+	c.execute(other, []string{"EVAL", `return redis.call("SET", KEYS[1], "x")`, "1", "k"})
+	got := transact(t, c, cl, []string{"EVAL", `return redis.call("GET", KEYS[1])`, "1", "k"})
+	if got != respNilArray() {
+		t.Fatalf("EXEC after a script changed a watched key = %q, want a nil array", got)
+	}
+	got = transact(t, c, cl, []string{"EVAL", `return redis.call("GET", KEYS[1])`, "1", "k"})
+	if want := respArray([]string{respBulk("x")}); got != want {
+		t.Fatalf("EXEC with a script = %q, want %q", got, want)
+	}
+}